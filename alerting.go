@@ -0,0 +1,137 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// alerting fires incidents when a run fails, or when several real runs in a
+// row delete nothing even though they had candidates, which usually means the
+// credentials or RBAC broke silently.
+type alerting struct {
+	alerter   gcrcleaner.Alerter
+	store     gcrcleaner.StateStore
+	threshold int
+	key       string
+
+	// state is used instead of the store when none is configured, so the
+	// count only survives within a server process.
+	state gcrcleaner.State
+}
+
+// newAlerting configures alerting from the environment. It returns nil if no
+// alerter is configured.
+func newAlerting(jsonKey []byte, baseRepo string) (*alerting, error) {
+	source := "gcr-cleaner " + baseRepo
+
+	var alerter gcrcleaner.Alerter
+	switch {
+	case os.Getenv("CLEANER_PAGERDUTY_ROUTING_KEY") != "":
+		alerter = &gcrcleaner.PagerDutyAlerter{
+			RoutingKey: os.Getenv("CLEANER_PAGERDUTY_ROUTING_KEY"),
+			Source:     source,
+		}
+	case os.Getenv("CLEANER_OPSGENIE_API_KEY") != "":
+		alerter = &gcrcleaner.OpsgenieAlerter{
+			APIKey:  os.Getenv("CLEANER_OPSGENIE_API_KEY"),
+			BaseURL: os.Getenv("CLEANER_OPSGENIE_URL"),
+			Source:  source,
+		}
+	default:
+		return nil, nil
+	}
+
+	threshold, err := strconv.Atoi(getenv("CLEANER_ALERT_ZERO_DELETION_RUNS", "3"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_ALERT_ZERO_DELETION_RUNS: %w", err)
+	}
+	store, err := newStateStore(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &alerting{
+		alerter:   alerter,
+		store:     store,
+		threshold: threshold,
+		key:       "gcr-cleaner/" + baseRepo,
+	}, nil
+}
+
+// afterRun triggers or resolves incidents based on the outcome of a run.
+func (a *alerting) afterRun(res *runResult, dry bool, runErr error) {
+	if a == nil || res.Skipped {
+		return
+	}
+	ctx := context.Background()
+
+	failedKey := a.key + "/failed"
+	if runErr != nil {
+		summary := fmt.Sprintf("gcr-cleaner run failed for %s", strings.TrimPrefix(a.key, "gcr-cleaner/"))
+		if err := a.alerter.Trigger(ctx, failedKey, summary, runErr.Error()); err != nil {
+			log.Printf("failed to trigger alert: %s", err)
+		}
+	} else if err := a.alerter.Resolve(ctx, failedKey); err != nil {
+		log.Printf("failed to resolve alert: %s", err)
+	}
+
+	// Only real runs say anything about whether deletion still works.
+	if dry {
+		return
+	}
+
+	state := &a.state
+	if a.store != nil {
+		var err error
+		if state, err = a.store.Load(ctx); err != nil {
+			log.Printf("failed to load state: %s", err)
+			return
+		}
+	}
+
+	stalledKey := a.key + "/stalled"
+	if res.Candidates > 0 && res.Deleted == 0 {
+		state.ZeroDeletionRuns++
+		if a.threshold > 0 && state.ZeroDeletionRuns >= a.threshold {
+			summary := fmt.Sprintf("gcr-cleaner deleted nothing for %d runs in a row for %s",
+				state.ZeroDeletionRuns, strings.TrimPrefix(a.key, "gcr-cleaner/"))
+			details := fmt.Sprintf("The last run had %d candidates but deleted none.", res.Candidates)
+			if err := a.alerter.Trigger(ctx, stalledKey, summary, details); err != nil {
+				log.Printf("failed to trigger alert: %s", err)
+			}
+		}
+	} else {
+		if state.ZeroDeletionRuns >= a.threshold && a.threshold > 0 {
+			if err := a.alerter.Resolve(ctx, stalledKey); err != nil {
+				log.Printf("failed to resolve alert: %s", err)
+			}
+		}
+		state.ZeroDeletionRuns = 0
+	}
+
+	if a.store != nil {
+		if err := a.store.Save(ctx, state); err != nil {
+			log.Printf("failed to save state: %s", err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// apiError is the JSON body of a failed API request.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// candidatesResponse is the JSON body of GET /v1/repos/{repo}/candidates.
+type candidatesResponse struct {
+	Repo       string                 `json:"repo"`
+	Policy     gcrcleaner.Policy      `json:"policy"`
+	Candidates []*gcrcleaner.Decision `json:"candidates"`
+	Kept       int                    `json:"kept"`
+}
+
+// cleanResponse is the JSON body of POST /v1/repos/{repo}/clean.
+type cleanResponse struct {
+	RunID string `json:"runId"`
+}
+
+// runResponse is the JSON body of GET /v1/runs/{id}.
+type runResponse struct {
+	Run    *Run            `json:"run"`
+	Events []ProgressEvent `json:"events"`
+}
+
+// registerAPI adds the REST API to the mux. Policies always come from the
+// server's own configuration; callers can only choose which repo to clean,
+// whether it is a dry run and how many tags to keep.
+func (s *server) registerAPI(mux *http.ServeMux) {
+	if os.Getenv("CLEANER_API_TOKEN") == "" {
+		log.Printf("CLEANER_API_TOKEN is not set, not serving the REST API")
+		return
+	}
+	mux.HandleFunc("/v1/repos/", s.authorize(s.handleRepo))
+	mux.HandleFunc("/v1/runs/", s.authorize(s.handleRun))
+	mux.HandleFunc("/v1/kept", s.authorize(s.handleKept))
+}
+
+// authorize requires the bearer token in CLEANER_API_TOKEN.
+func (s *server) authorize(next http.HandlerFunc) http.HandlerFunc {
+	token := os.Getenv("CLEANER_API_TOKEN")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			writeJSON(w, http.StatusUnauthorized, &apiError{Error: "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorized returns true if the request sends the token as a bearer token.
+// An empty token authorizes nothing.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got := r.Header.Get("Authorization")
+	if !strings.HasPrefix(got, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(got, "Bearer ")), []byte(token)) == 1
+}
+
+// handleRepo serves GET /v1/repos/{repo}/candidates and
+// POST /v1/repos/{repo}/clean. Repo names are relative to the base repo and
+// may contain slashes.
+func (s *server) handleRepo(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/repos/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: "not found"})
+		return
+	}
+	name, action := path[:i], path[i+1:]
+	if strings.Contains(name, "..") {
+		writeJSON(w, http.StatusBadRequest, &apiError{Error: "invalid repo name"})
+		return
+	}
+
+	switch {
+	case action == "candidates" && r.Method == http.MethodGet:
+		s.handleCandidates(w, name)
+	case action == "clean" && r.Method == http.MethodPost:
+		s.handleClean(w, r, name)
+	case action == "candidates" || action == "clean":
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+	default:
+		writeJSON(w, http.StatusNotFound, &apiError{Error: "not found"})
+	}
+}
+
+// handleCandidates returns the manifests a clean of the repo would delete.
+func (s *server) handleCandidates(w http.ResponseWriter, name string) {
+	plans, err := s.cleaner.Plan([]string{name})
+	if err != nil || len(plans) == 0 {
+		msg := "repo not found"
+		if err != nil {
+			msg = err.Error()
+		}
+		writeJSON(w, http.StatusBadGateway, &apiError{Error: msg})
+		return
+	}
+
+	plan := plans[0]
+	candidates := plan.Candidates()
+	writeJSON(w, http.StatusOK, &candidatesResponse{
+		Repo:       plan.Repo,
+		Policy:     plan.Policy,
+		Candidates: candidates,
+		Kept:       len(plan.Decisions) - len(candidates),
+	})
+}
+
+// handleClean starts a clean of the repo in the background. Pass ?dry=true
+// for a dry run and ?keep=n to override the keep of the repo's policy, which
+// real runs only do if it keeps more.
+func (s *server) handleClean(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.isLeader() {
+		writeJSON(w, http.StatusServiceUnavailable, &apiError{Error: "this replica is not the leader"})
+		return
+	}
+
+	dry, _ := strconv.ParseBool(r.URL.Query().Get("dry"))
+	var keep *int
+	if v := r.URL.Query().Get("keep"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: "invalid keep"})
+			return
+		}
+		keep = &n
+	}
+	run := s.history.start([]string{name}, dry, keep)
+	go s.execute(run, 0)
+
+	writeJSON(w, http.StatusAccepted, &cleanResponse{RunID: run.ID})
+}
+
+// handleRun serves GET /v1/runs/{id}, returning the run and all of its
+// progress events, and GET /v1/runs/{id}/events, see handleRunEvents.
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/runs/")
+	if strings.HasSuffix(id, "/events") {
+		s.handleRunEvents(w, r, strings.TrimSuffix(id, "/events"))
+		return
+	}
+	run, events, _, ok := s.history.get(id, 0)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: "run not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, &runResponse{Run: run, Events: events})
+}
+
+// handleKept serves GET /v1/kept, the index of every manifest that still
+// exists after the last full run, with its tags. Pass ?repo=name for the
+// manifests of a single child repo and &digest=sha256:... to look up a single
+// manifest, which is not found if it no longer exists.
+func (s *server) handleKept(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed"})
+		return
+	}
+	if !s.kept.Ready() {
+		writeJSON(w, http.StatusServiceUnavailable, &apiError{Error: "no full run has finished yet"})
+		return
+	}
+
+	repo, digest := s.keptRepo(r.URL.Query().Get("repo")), r.URL.Query().Get("digest")
+	if digest == "" {
+		writeJSON(w, http.StatusOK, s.kept.Snapshot(repo))
+		return
+	}
+	if repo == "" {
+		writeJSON(w, http.StatusBadRequest, &apiError{Error: "digest requires repo"})
+		return
+	}
+	tags, ok := s.kept.Lookup(repo, digest)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: "manifest not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, &gcrcleaner.KeptDigest{Repo: repo, Digest: digest, Tags: tags})
+}
+
+// keptRepo returns the full name of a child repo of the kept index, which is
+// empty for every repo.
+func (s *server) keptRepo(name string) string {
+	if name == "" {
+		return ""
+	}
+	return s.cleaner.BaseRepo() + "/" + name
+}
+
+// runEventsPoll is how often streams of run progress check for new events.
+const runEventsPoll = time.Second
+
+// handleRunEvents streams the progress events of a run as newline-delimited
+// JSON, from ?since=n onwards, as they happen, and then the finished run.
+func (s *server) handleRunEvents(w http.ResponseWriter, r *http.Request, id string) {
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	if since < 0 {
+		since = 0
+	}
+	run, events, since, ok := s.history.get(id, since)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, &apiError{Error: "run not found"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for {
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		}
+		if run.Done {
+			enc.Encode(run)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(runEventsPoll):
+		}
+		if run, events, since, ok = s.history.get(id, since); !ok {
+			// The run dropped out of the history.
+			return
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// backendOption picks the registry backend from CLEANER_BACKEND, or from the
+// host of the base repo if it isn't set. It returns nil for Google
+// registries, which the cleaner uses by default.
+func backendOption(base string) (gcrcleaner.Option, error) {
+	kind := os.Getenv("CLEANER_BACKEND")
+	if kind == "" {
+		switch {
+		case strings.HasPrefix(base, "ghcr.io/"):
+			kind = "ghcr"
+		case strings.HasPrefix(base, "registry.gitlab.com/"):
+			kind = "gitlab"
+		case strings.HasPrefix(base, "quay.io/"):
+			kind = "quay"
+		default:
+			kind = "gcr"
+		}
+	}
+
+	switch kind {
+	case "gcr":
+		return nil, nil
+	case "ghcr":
+		b, err := ghcrBackend()
+		if err != nil {
+			return nil, err
+		}
+		return gcrcleaner.WithBackend(b), nil
+	case "gitlab":
+		if os.Getenv("GITLAB_TOKEN") == "" {
+			return nil, fmt.Errorf("GitLab requires GITLAB_TOKEN")
+		}
+		return gcrcleaner.WithBackend(gcrcleaner.NewGitLabBackend(os.Getenv("GITLAB_URL"), os.Getenv("GITLAB_TOKEN"))), nil
+	case "quay":
+		if os.Getenv("QUAY_TOKEN") == "" {
+			return nil, fmt.Errorf("Quay requires QUAY_TOKEN")
+		}
+		b := gcrcleaner.NewQuayBackend(os.Getenv("QUAY_URL"), os.Getenv("QUAY_TOKEN"))
+		if expire := os.Getenv("QUAY_EXPIRE_AFTER"); expire != "" {
+			d, err := time.ParseDuration(expire)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse QUAY_EXPIRE_AFTER: %w", err)
+			}
+			b.Expire = d
+		}
+		return gcrcleaner.WithBackend(b), nil
+	default:
+		return nil, fmt.Errorf("unknown CLEANER_BACKEND %q", kind)
+	}
+}
+
+// ghcrBackend creates the GHCR backend, authenticated either with a GitHub
+// App installation or a personal access token.
+func ghcrBackend() (*gcrcleaner.GHCRBackend, error) {
+	var b *gcrcleaner.GHCRBackend
+	switch {
+	case os.Getenv("GITHUB_APP_ID") != "":
+		key := []byte(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+		if len(key) == 0 {
+			keyPath := os.Getenv("GITHUB_APP_PRIVATE_KEY_FILE")
+			var err error
+			if key, err = ioutil.ReadFile(keyPath); err != nil {
+				return nil, fmt.Errorf("failed to read GitHub App private key %s: %w", keyPath, err)
+			}
+		}
+		var err error
+		b, err = gcrcleaner.NewGHCRBackendWithApp(os.Getenv("GITHUB_APP_ID"), os.Getenv("GITHUB_APP_INSTALLATION_ID"), key)
+		if err != nil {
+			return nil, err
+		}
+	case os.Getenv("GITHUB_TOKEN") != "":
+		b = gcrcleaner.NewGHCRBackendWithToken(os.Getenv("GITHUB_TOKEN"))
+	default:
+		return nil, fmt.Errorf("GHCR requires GITHUB_TOKEN or GITHUB_APP_ID")
+	}
+
+	b.User = getenv("GITHUB_OWNER_TYPE", "org") == "user"
+	return b, nil
+}
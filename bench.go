@@ -0,0 +1,106 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+)
+
+// runBench benchmarks planning, which selects the candidates and computes
+// what every policy keeps, and dry executing plans, against a synthetic
+// in-memory registry with the configured policies and exceptions. With
+// -max-plan, it fails if planning got slower than that, to catch changes to
+// the policy engine that blow up run times.
+//
+//	gcrcleaner bench [-repos N] [-manifests N] [-tagged-every N] [-max-plan DURATION]
+func runBench(args []string, base string, auther gcrauthn.Authenticator, opts []gcrcleaner.Option) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	repos := fs.Int("repos", 10, "how many synthetic child repos to plan")
+	manifests := fs.Int("manifests", 10000, "how many manifests every synthetic repo has")
+	taggedEvery := fs.Int("tagged-every", 4, "tag one manifest in this many")
+	maxPlan := fs.Duration("max-plan", 0, "fail if planning takes longer than this")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if base == "" {
+		base = "gcr.io/bench"
+	}
+	load := gcrcleaner.SyntheticLoad{Repos: *repos, Manifests: *manifests, TaggedEvery: *taggedEvery}
+	inv := gcrcleaner.SyntheticInventory(base, load, time.Now())
+	cleaner, err := gcrcleaner.NewCleaner(auther, 1, append(opts, gcrcleaner.WithBaseRepo(base),
+		gcrcleaner.WithoutClusterScan(), gcrcleaner.WithBackend(gcrcleaner.NewSnapshotBackend(inv)))...)
+	if err != nil {
+		return err
+	}
+
+	var plans []*gcrcleaner.RepoPlan
+	var benchErr error
+	plan := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if plans, benchErr = cleaner.Plan(nil); benchErr != nil {
+				b.FailNow()
+			}
+		}
+	})
+	if benchErr != nil {
+		return benchErr
+	}
+
+	// Dry runs log every candidate, which would only time the logger.
+	log.SetOutput(ioutil.Discard)
+	execute := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, benchErr = cleaner.ExecuteResults(plans, true, nil); benchErr != nil {
+				b.FailNow()
+			}
+		}
+	})
+	log.SetOutput(os.Stderr)
+	if benchErr != nil {
+		return benchErr
+	}
+
+	candidates := 0
+	for _, p := range plans {
+		candidates += len(p.Candidates())
+	}
+	total := *repos * *manifests
+	fmt.Printf("%d repos of %d manifests, %d candidates\n", *repos, *manifests, candidates)
+	for _, r := range []struct {
+		name string
+		res  testing.BenchmarkResult
+	}{{"plan", plan}, {"execute (dry)", execute}} {
+		perOp := time.Duration(r.res.NsPerOp())
+		fmt.Printf("%-14s %12s/op %10.0f manifests/s %12d B/op %10d allocs/op\n", r.name, perOp,
+			float64(total)/perOp.Seconds(), r.res.AllocedBytesPerOp(), r.res.AllocsPerOp())
+	}
+
+	if *maxPlan > 0 && time.Duration(plan.NsPerOp()) > *maxPlan {
+		return fmt.Errorf("planning took %s, more than -max-plan %s", time.Duration(plan.NsPerOp()), *maxPlan)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// checkpointBatchSize is the batch size of checkpointed runs without
+// CLEANER_REPO_BATCH_SIZE, as progress is saved after every batch.
+const checkpointBatchSize = 10
+
+// checkpoints saves the progress of a job run of every child repo, if
+// CLEANER_CHECKPOINT is set. Server runs and runs of single repos aren't
+// checkpointed.
+var checkpoints *checkpointer
+
+// checkpointer saves the progress of a run after every batch of repos, so
+// the next run resumes an interrupted one.
+type checkpointer struct {
+	store gcrcleaner.StateStore
+	cp    *gcrcleaner.Checkpoint
+
+	// deadline is when the run stops starting batches, leaving the rest to
+	// the next run, or zero for no deadline.
+	deadline time.Time
+
+	// unfinished is true once the run stopped at its deadline, or failed
+	// to list the repos of a base repo.
+	unfinished bool
+}
+
+// newCheckpointer loads the checkpoint at CLEANER_CHECKPOINT, a local path or
+// a gs://bucket/object URI, or returns nil if it isn't set. A checkpoint of
+// the same label and kind of run updated within CLEANER_CHECKPOINT_MAX_AGE is
+// resumed, keeping its run ID; otherwise a new run with the given ID starts.
+func newCheckpointer(jsonKey []byte, runID, label string, dry bool) (*checkpointer, error) {
+	location := os.Getenv("CLEANER_CHECKPOINT")
+	if location == "" {
+		return nil, nil
+	}
+	maxAge, err := time.ParseDuration(getenv("CLEANER_CHECKPOINT_MAX_AGE", "24h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_CHECKPOINT_MAX_AGE: %w", err)
+	}
+	budget, err := time.ParseDuration(getenv("CLEANER_RUN_BUDGET", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_RUN_BUDGET: %w", err)
+	}
+	client, err := storageClient(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	store, err := gcrcleaner.NewStateStore(location, client)
+	if err != nil {
+		return nil, err
+	}
+	state, err := store.Load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checkpointer{store: store}
+	if budget > 0 {
+		c.deadline = time.Now().Add(budget)
+	}
+	if cp := state.Checkpoint; cp != nil && cp.Label == label && cp.Dry == dry && time.Since(cp.Updated) < maxAge {
+		log.Printf("resuming run %s from its checkpoint of %s: %d repos already cleaned, %d manifests deleted",
+			cp.RunID, cp.Updated.Format(time.RFC3339), cp.Repos(), len(cp.Deleted))
+		c.cp = cp
+		return c, nil
+	}
+	c.cp = gcrcleaner.NewCheckpoint(runID, label, dry, time.Now())
+	return c, nil
+}
+
+// remaining returns the child repos of the base repo the run hasn't cleaned
+// yet.
+func (c *checkpointer) remaining(base string, repos []string) []string {
+	var out []string
+	for _, r := range repos {
+		if !c.cp.IsDone(base, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// expired returns true if the run is past its budget.
+func (c *checkpointer) expired() bool {
+	return !c.deadline.IsZero() && time.Now().After(c.deadline)
+}
+
+// record saves a cleaned batch of child repos of the base repo. Failures are
+// only logged, as the batch is then just cleaned again.
+func (c *checkpointer) record(base string, repos, deleted []string) {
+	c.cp.Record(base, repos, deleted, time.Now())
+	if err := c.store.Save(context.Background(), &gcrcleaner.State{Checkpoint: c.cp}); err != nil {
+		log.Printf("failed to save checkpoint: %s", err)
+	}
+}
+
+// finish removes the checkpoint once the run has cleaned every repo, or
+// leaves it for the next run if it didn't.
+func (c *checkpointer) finish() {
+	if c.unfinished {
+		log.Printf("leaving the remaining repos to the next run, %d repos cleaned so far", c.cp.Repos())
+		return
+	}
+	if err := c.store.Save(context.Background(), &gcrcleaner.State{}); err != nil {
+		log.Printf("failed to clear checkpoint: %s", err)
+	}
+}
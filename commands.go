@@ -0,0 +1,821 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+)
+
+// runCommand runs a subcommand against the cleaners' base repos. Only clean
+// deletes anything.
+func runCommand(cmd string, args []string, cleaners []*gcrcleaner.Cleaner, locks []*gcrcleaner.RunLock, jsonKey []byte, dry bool) error {
+	switch cmd {
+	case "clean":
+		return runClean(args, cleaners, locks, dry)
+	case "plan", "list":
+		return runPlan(cmd, args, cleaners)
+	case "stats":
+		return runStats(cmd, args, cleaners)
+	case "simulate":
+		return runSimulate(args, cleaners, jsonKey)
+	case "snapshot":
+		return runSnapshot(args, cleaners)
+	case "advise":
+		return runAdvise(args, cleaners)
+	case "delete-flagged":
+		return runDeleteFlagged(args, cleaners, locks, dry)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// runPlan prints every manifest of the given child repos, or of every child
+// repo, with whether a clean would keep or delete it and why.
+//
+//	gcrcleaner plan [-json] [-delete-only] [REPO...]
+func runPlan(cmd string, args []string, cleaners []*gcrcleaner.Cleaner) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the plans as JSON")
+	deleteOnly := fs.Bool("delete-only", false, "only print the manifests that would be deleted")
+	repos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+
+	plans, planErr := planAll(cleaners, repos)
+	if *asJSON {
+		if err := printJSON(plans); err != nil {
+			return err
+		}
+	} else {
+		printPlans(plans, *deleteOnly)
+	}
+	return planErr
+}
+
+// runClean cleans the given child repos, given by their full names, right
+// away with their policies, without listing the base repo's other child
+// repos. It holds the base repo's run lock, so it is skipped while a
+// scheduled run cleans the base repo.
+//
+//	gcrcleaner [-dry] clean [-keep N] REPO...
+func runClean(args []string, cleaners []*gcrcleaner.Cleaner, locks []*gcrcleaner.RunLock, dry bool) error {
+	fs := flag.NewFlagSet("clean", flag.ContinueOnError)
+	fs.BoolVar(&dry, "dry", dry, "only log what would be deleted")
+	keep := fs.Int("keep", -1, "override the number of tags the repos' policies keep")
+	repos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(repos) == 0 {
+		return fmt.Errorf("usage: clean [-dry] [-keep N] REPO...")
+	}
+	var opts gcrcleaner.CleanOptions
+	opts.Dry = dry
+	if *keep >= 0 {
+		opts.Keep = keep
+	}
+
+	// Clean every repo with the cleaner of the base repo it is under.
+	children := make([][]string, len(cleaners))
+	for _, r := range repos {
+		found := false
+		for i, cleaner := range cleaners {
+			if base := cleaner.BaseRepo(); base != "" && strings.HasPrefix(r, base+"/") {
+				children[i] = append(children[i], strings.TrimPrefix(r, base+"/"))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s isn't a child repo of the base repo, set GCR_BASE_REPO to a repo it is under", r)
+		}
+	}
+
+	var errStrings []string
+	for i, cleaner := range cleaners {
+		if len(children[i]) == 0 {
+			continue
+		}
+		res, err := clean(cleaner, locks[i], children[i], opts)
+		logStatus(res, dry)
+		if err != nil {
+			errStrings = append(errStrings, err.Error())
+		}
+	}
+	if len(errStrings) > 0 {
+		return fmt.Errorf("%s", strings.Join(errStrings, ", "))
+	}
+	return nil
+}
+
+// runDeleteFlagged deletes exactly the images that Trivy or Grype JSON
+// reports flag, in the repos they are in, or in every child repo for images
+// the reports only name by digest. Flagged images that are excepted, like
+// those in use, are kept.
+//
+//	gcrcleaner [-dry] delete-flagged [-min-severity S] REPORT...
+func runDeleteFlagged(args []string, cleaners []*gcrcleaner.Cleaner, locks []*gcrcleaner.RunLock, dry bool) error {
+	fs := flag.NewFlagSet("delete-flagged", flag.ContinueOnError)
+	fs.BoolVar(&dry, "dry", dry, "only log what would be deleted")
+	minSeverity := fs.String("min-severity", "", "only delete images with findings of this severity, like HIGH, or worse")
+	files, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("usage: delete-flagged [-dry] [-min-severity S] REPORT...")
+	}
+	var reports [][]byte
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, b)
+	}
+	flagged, err := gcrcleaner.ParseScanReports(reports, *minSeverity)
+	if err != nil {
+		return err
+	}
+	if flagged.Len() == 0 {
+		log.Printf("the reports flag no images")
+		return nil
+	}
+	var opts gcrcleaner.CleanOptions
+	opts.Dry = dry
+	opts.Flagged = flagged
+
+	// Clean every flagged repo with the cleaner of the base repo it is under.
+	repos := flagged.Repos()
+	children := make([][]string, len(cleaners))
+	for _, r := range repos {
+		found := false
+		for i, cleaner := range cleaners {
+			if base := cleaner.BaseRepo(); base != "" && strings.HasPrefix(r, base+"/") {
+				children[i] = append(children[i], strings.TrimPrefix(r, base+"/"))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s isn't a child repo of the base repo, set GCR_BASE_REPO to a repo it is under", r)
+		}
+	}
+
+	var errStrings []string
+	for i, cleaner := range cleaners {
+		if repos == nil {
+			if len(cleaners) > 1 {
+				if exists, err := cleaner.Exists(); err != nil || !exists {
+					continue
+				}
+			}
+			if children[i], err = cleaner.Repos(); err != nil {
+				errStrings = append(errStrings, err.Error())
+				continue
+			}
+		}
+		if len(children[i]) == 0 {
+			continue
+		}
+		res, err := clean(cleaner, locks[i], children[i], opts)
+		logStatus(res, dry)
+		if err != nil {
+			errStrings = append(errStrings, err.Error())
+		}
+	}
+	if len(errStrings) > 0 {
+		return fmt.Errorf("%s", strings.Join(errStrings, ", "))
+	}
+	return nil
+}
+
+// runValidate checks the policy file and the exceptions, and with -registry
+// also that everything they name exists in the registry. It fails if there
+// are any errors, for use in CI.
+//
+//	gcrcleaner validate [-registry]
+func runValidate(args []string, bases []string, store *gcrcleaner.ExceptionStore, allowFullPrune bool, auther gcrauthn.Authenticator, opts []gcrcleaner.Option) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	registry := fs.Bool("registry", false, "also check that excepted repos and tags and repos with policies exist")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var problems []gcrcleaner.Problem
+	for _, base := range bases {
+		problems = append(problems, gcrcleaner.Validate(context.Background(), base, store, allowFullPrune)...)
+		if !*registry || hasErrors(problems) {
+			continue
+		}
+
+		backend, err := backendOption(base)
+		if err != nil {
+			return err
+		}
+		baseOpts := append([]gcrcleaner.Option{gcrcleaner.WithBaseRepo(base), gcrcleaner.WithoutClusterScan()}, opts...)
+		if backend != nil {
+			baseOpts = append(baseOpts, backend)
+		}
+		cleaner, err := gcrcleaner.NewCleaner(auther, 1, baseOpts...)
+		if err != nil {
+			return err
+		}
+		if len(bases) > 1 {
+			if exists, err := cleaner.Exists(); err != nil || !exists {
+				continue
+			}
+		}
+		problems = append(problems, cleaner.VerifyRegistry()...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if hasErrors(problems) {
+		return fmt.Errorf("configuration is invalid")
+	}
+	fmt.Println("configuration is valid")
+	return nil
+}
+
+// runPolicy runs a policy subcommand. The only one is test, which checks
+// that the policy file produces exactly the decisions the fixtures, JSON
+// files, expect, for use in CI.
+//
+//	gcrcleaner policy test [-policy FILE] [-json] FIXTURES...
+func runPolicy(args []string, allowFullPrune bool) error {
+	if len(args) == 0 || args[0] != "test" {
+		return fmt.Errorf("usage: policy test [-policy FILE] [-json] FIXTURES...")
+	}
+	fs := flag.NewFlagSet("policy test", flag.ContinueOnError)
+	policyFile := fs.String("policy", os.Getenv("CLEANER_POLICY_FILE"), "the policy file to test, CLEANER_POLICY_FILE by default")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	paths, err := parseInterspersed(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("usage: policy test [-policy FILE] [-json] FIXTURES...")
+	}
+
+	var fixtures []gcrcleaner.PolicyFixture
+	for _, p := range paths {
+		f, err := gcrcleaner.LoadPolicyFixtures(p)
+		if err != nil {
+			return err
+		}
+		fixtures = append(fixtures, f...)
+	}
+	results, err := gcrcleaner.TestPolicies(*policyFile, fixtures, allowFullPrune)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if len(r.Failures) > 0 {
+			failed++
+		}
+	}
+	if *asJSON {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			if len(r.Failures) == 0 {
+				fmt.Printf("ok    %s\n", r.Fixture)
+				continue
+			}
+			fmt.Printf("FAIL  %s\n", r.Fixture)
+			for _, f := range r.Failures {
+				fmt.Printf("      %s\n", f)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d fixtures failed", failed, len(results))
+	}
+	return nil
+}
+
+// runCompare prints the digests and tags that only one of two base repos
+// has, child repo by child repo, e.g. to check a mirror or backup is
+// complete before relying on it. Either base repo may be a snapshot file
+// instead, to compare against the registry as it was. It fails if they
+// differ.
+//
+//	gcrcleaner compare [-json] BASE_A BASE_B [REPO...]
+func runCompare(args []string, auther gcrauthn.Authenticator, opts []gcrcleaner.Option) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the differences as JSON")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("usage: compare [-json] BASE_A BASE_B [REPO...]")
+	}
+
+	var cleaners []*gcrcleaner.Cleaner
+	for _, base := range args[:2] {
+		var cleaner *gcrcleaner.Cleaner
+		var err error
+		if strings.HasSuffix(base, ".json") {
+			cleaner, err = snapshotCleaner(base, auther, opts)
+		} else {
+			cleaner, err = auxCleaner(base, auther, 1, opts)
+		}
+		if err != nil {
+			return err
+		}
+		cleaners = append(cleaners, cleaner)
+	}
+
+	diffs, cmpErr := gcrcleaner.Compare(cleaners[0], cleaners[1], args[2:])
+	var differ []*gcrcleaner.RepoDiff
+	for _, d := range diffs {
+		if !d.Empty() {
+			differ = append(differ, d)
+		}
+	}
+
+	if *asJSON {
+		if err := printJSON(differ); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range differ {
+			fmt.Printf("%s: %d digests and %d tags only in A, %d digests and %d tags only in B\n", d.Repo,
+				len(d.DigestsOnlyA), len(d.TagsOnlyA), len(d.DigestsOnlyB), len(d.TagsOnlyB))
+			for _, r := range d.DigestsOnlyA {
+				fmt.Printf("  < %s\n", r)
+			}
+			for _, r := range d.TagsOnlyA {
+				fmt.Printf("  < %s\n", r)
+			}
+			for _, r := range d.DigestsOnlyB {
+				fmt.Printf("  > %s\n", r)
+			}
+			for _, r := range d.TagsOnlyB {
+				fmt.Printf("  > %s\n", r)
+			}
+		}
+		fmt.Printf("%d of %d repos differ\n", len(differ), len(diffs))
+	}
+	if cmpErr != nil {
+		return cmpErr
+	}
+	if len(differ) > 0 {
+		return fmt.Errorf("%d repos differ", len(differ))
+	}
+	return nil
+}
+
+// hasErrors returns true if any of the problems isn't a warning.
+func hasErrors(problems []gcrcleaner.Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// repoStats is the inventory of a single child repo.
+type repoStats struct {
+	Repo      string    `json:"repo"`
+	Tags      int       `json:"tags"`
+	Manifests int       `json:"manifests"`
+	Untagged  int       `json:"untagged"`
+	Size      int64     `json:"size"`
+	Oldest    time.Time `json:"oldest"`
+	Newest    time.Time `json:"newest"`
+}
+
+// runStats prints an inventory of the given child repos, or of every child
+// repo, along with the largest images, without deleting anything.
+//
+//	gcrcleaner stats [-json] [-top N] [REPO...]
+func runStats(cmd string, args []string, cleaners []*gcrcleaner.Cleaner) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the stats as JSON")
+	top := fs.Int("top", 10, "how many of the largest images to list")
+	repos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+
+	plans, planErr := planAll(cleaners, repos)
+	var stats []repoStats
+	var all []*gcrcleaner.Decision
+	for _, p := range plans {
+		st := repoStats{Repo: p.Repo, Manifests: len(p.Decisions)}
+		for _, d := range p.Decisions {
+			st.Tags += len(d.Tags)
+			if len(d.Tags) == 0 {
+				st.Untagged++
+			}
+			st.Size += d.Size
+			if st.Oldest.IsZero() || d.Built.Before(st.Oldest) {
+				st.Oldest = d.Built
+			}
+			if d.Built.After(st.Newest) {
+				st.Newest = d.Built
+			}
+		}
+		stats = append(stats, st)
+		all = append(all, p.Decisions...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Size > all[j].Size })
+	if len(all) > *top {
+		all = all[:*top]
+	}
+
+	if *asJSON {
+		if err := printJSON(map[string]interface{}{"repos": stats, "largest": all}); err != nil {
+			return err
+		}
+		return planErr
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tTAGS\tMANIFESTS\tUNTAGGED\tSIZE\tOLDEST\tNEWEST")
+	for _, st := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\n", st.Repo, st.Tags, st.Manifests, st.Untagged,
+			gcrcleaner.FormatSize(st.Size), age(now, st.Oldest), age(now, st.Newest))
+	}
+	fmt.Fprintf(w, "\nLargest images:\n")
+	for _, d := range all {
+		fmt.Fprintf(w, "%s@%s\t%s\t%s\t%s\n", d.Repo, shortDigest(d.Digest), strings.Join(d.Tags, ","),
+			gcrcleaner.FormatSize(d.Size), age(now, d.Built))
+	}
+	w.Flush()
+	return planErr
+}
+
+// runAdvise prints the age distribution of the tagged manifests of the given
+// child repos, or of every child repo, how often they are pushed to, and the
+// keep that would retain the builds of the window, or with -policy the
+// policy file with those keeps applied.
+//
+//	gcrcleaner advise [-json] [-policy] [-window 30d] [-min-keep N] [REPO...]
+func runAdvise(args []string, cleaners []*gcrcleaner.Cleaner) error {
+	fs := flag.NewFlagSet("advise", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the advice as JSON")
+	asPolicy := fs.Bool("policy", false, "print the policy file with the advised keep and minAge of every repo")
+	windowFlag := fs.String("window", "30d", "how long a window of builds to retain")
+	minKeep := fs.Int("min-keep", 3, "the least tagged manifests to keep, for repos rarely pushed to")
+	repos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	window, err := gcrcleaner.ParseDuration(*windowFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -window: %w", err)
+	}
+
+	now := time.Now()
+	var advice []*gcrcleaner.Advice
+	byName := make(map[string]*gcrcleaner.Advice)
+	var errStrings []string
+	for _, cleaner := range cleaners {
+		if len(cleaners) > 1 {
+			if exists, err := cleaner.Exists(); err != nil || !exists {
+				continue
+			}
+		}
+		plans, err := cleaner.Plan(repos)
+		if err != nil {
+			errStrings = append(errStrings, err.Error())
+		}
+		for _, p := range plans {
+			a := gcrcleaner.Advise(p, window, *minKeep, now)
+			advice = append(advice, a)
+			byName[strings.TrimPrefix(p.Repo, cleaner.BaseRepo()+"/")] = a
+		}
+	}
+	var planErr error
+	if len(errStrings) > 0 {
+		planErr = fmt.Errorf("%s", strings.Join(errStrings, ", "))
+	}
+
+	switch {
+	case *asPolicy:
+		var existing []byte
+		if path := os.Getenv("CLEANER_POLICY_FILE"); path != "" {
+			if existing, err = ioutil.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		b, err := gcrcleaner.AdvisedPolicyFile(existing, byName)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return planErr
+	case *asJSON:
+		if err := printJSON(advice); err != nil {
+			return err
+		}
+		return planErr
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tTAGGED\tAGES\tADVICE")
+	for _, a := range advice {
+		var ages []string
+		for _, b := range a.Histogram {
+			ages = append(ages, fmt.Sprintf("%s:%d", b.Age, b.Count))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", a.Repo, a.Tagged, strings.Join(ages, " "), a.Summary())
+	}
+	w.Flush()
+	return planErr
+}
+
+// runSimulate replays a proposed policy file against the inventory
+// snapshots of the last weeks in CLEANER_INVENTORY, or against the given
+// snapshot files, and prints what it and the current policies would have
+// deleted from each.
+//
+//	gcrcleaner simulate [-json] [-weeks N] POLICY_FILE [SNAPSHOT...]
+func runSimulate(args []string, cleaners []*gcrcleaner.Cleaner, jsonKey []byte) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the simulations as JSON")
+	weeks := fs.Int("weeks", 4, "how many weeks of snapshots to replay")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("usage: simulate [-json] [-weeks N] POLICY_FILE [SNAPSHOT...]")
+	}
+
+	var snapshots []*gcrcleaner.Inventory
+	if len(args) > 1 {
+		for _, path := range args[1:] {
+			inv, err := gcrcleaner.ReadSnapshot(path)
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, inv)
+		}
+		sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Taken.Before(snapshots[j].Taken) })
+	} else {
+		store, err := newInventoryStore(jsonKey)
+		if err != nil {
+			return err
+		}
+		if store == nil {
+			return fmt.Errorf("CLEANER_INVENTORY must be set to the inventory snapshots, or snapshot files given")
+		}
+		if snapshots, err = store.LoadSince(context.Background(), time.Now().AddDate(0, 0, -7*(*weeks))); err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("no inventory snapshots in the last %d weeks", *weeks)
+		}
+	}
+
+	var current, proposed []*gcrcleaner.Simulation
+	for _, cleaner := range cleaners {
+		cur, err := cleaner.Simulate(snapshots, "")
+		if err != nil {
+			return err
+		}
+		prop, err := cleaner.Simulate(snapshots, args[0])
+		if err != nil {
+			return err
+		}
+		current, proposed = append(current, cur), append(proposed, prop)
+	}
+	cur, prop := mergeSimulations(current), mergeSimulations(proposed)
+
+	if *asJSON {
+		return printJSON(map[string]interface{}{"current": cur, "proposed": prop})
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tCURRENT DELETED\tCURRENT FREED\tPROPOSED DELETED\tPROPOSED FREED")
+	for i := range cur.Steps {
+		c, p := cur.Steps[i], prop.Steps[i]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", c.Taken.Format(time.RFC3339), c.Deleted,
+			gcrcleaner.FormatSize(c.Freed), p.Deleted, gcrcleaner.FormatSize(p.Freed))
+	}
+	fmt.Fprintf(w, "TOTAL\t%d\t%s\t%d\t%s\n", cur.Deleted, gcrcleaner.FormatSize(cur.Freed),
+		prop.Deleted, gcrcleaner.FormatSize(prop.Freed))
+	return w.Flush()
+}
+
+// runSnapshot records the repos, tags, digests and sizes of the given child
+// repos, or of every child repo, to a file, as a safety record before a
+// clean or as input to simulate and compare. The file is an OCI image index,
+// like the index.json of an OCI image layout.
+//
+//	gcrcleaner snapshot [-o FILE] [REPO...]
+func runSnapshot(args []string, cleaners []*gcrcleaner.Cleaner) error {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	out := fs.String("o", "", "the file to write, by default snapshot-TIME.json")
+	repos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var inv *gcrcleaner.Inventory
+	var snapErr error
+	for _, cleaner := range cleaners {
+		part, err := cleaner.Snapshot(repos)
+		if part == nil {
+			return err
+		}
+		if err != nil {
+			snapErr = err
+		}
+		if inv == nil {
+			inv = part
+			continue
+		}
+		// Snapshots of several base repos can't be compared as one.
+		inv.Base = ""
+		for name, tags := range part.Repos {
+			inv.Repos[name] = tags
+		}
+	}
+
+	if *out == "" {
+		*out = fmt.Sprintf("snapshot-%s.json", inv.Taken.UTC().Format("20060102T150405Z"))
+	}
+	if err := gcrcleaner.WriteSnapshot(*out, inv); err != nil {
+		return err
+	}
+	fmt.Printf("recorded %d repos to %s\n", len(inv.Repos), *out)
+	return snapErr
+}
+
+// snapshotCleaner creates a cleaner that reads a snapshot file instead of the
+// registry.
+func snapshotCleaner(path string, auther gcrauthn.Authenticator, opts []gcrcleaner.Option) (*gcrcleaner.Cleaner, error) {
+	inv, err := gcrcleaner.ReadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Base == "" {
+		return nil, fmt.Errorf("snapshot %s covers several base repos", path)
+	}
+	return gcrcleaner.NewCleaner(auther, 1, append(opts, gcrcleaner.WithBaseRepo(inv.Base),
+		gcrcleaner.WithoutClusterScan(), gcrcleaner.WithBackend(gcrcleaner.NewSnapshotBackend(inv)))...)
+}
+
+// mergeSimulations adds up simulations of the same snapshots.
+func mergeSimulations(sims []*gcrcleaner.Simulation) *gcrcleaner.Simulation {
+	out := &gcrcleaner.Simulation{}
+	for _, sim := range sims {
+		if out.Steps == nil {
+			out.Steps = make([]gcrcleaner.SimulationStep, len(sim.Steps))
+			for i, step := range sim.Steps {
+				out.Steps[i].Taken = step.Taken
+			}
+		}
+		for i, step := range sim.Steps {
+			out.Steps[i].Deleted += step.Deleted
+			out.Steps[i].Freed += step.Freed
+		}
+		out.Deleted += sim.Deleted
+		out.Freed += sim.Freed
+	}
+	return out
+}
+
+// age formats how long ago t was in days, or - if t is unknown.
+func age(now, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return fmt.Sprintf("%dd", int(now.Sub(t).Hours()/24))
+}
+
+// planAll plans the given child repos, or every child repo, of every base
+// repo that exists.
+func planAll(cleaners []*gcrcleaner.Cleaner, repos []string) ([]*gcrcleaner.RepoPlan, error) {
+	var plans []*gcrcleaner.RepoPlan
+	var errStrings []string
+	for _, cleaner := range cleaners {
+		if len(cleaners) > 1 {
+			if exists, err := cleaner.Exists(); err != nil || !exists {
+				continue
+			}
+		}
+		p, err := cleaner.Plan(repos)
+		if err != nil {
+			errStrings = append(errStrings, err.Error())
+		}
+		plans = append(plans, p...)
+	}
+	if len(errStrings) > 0 {
+		return plans, fmt.Errorf("%s", strings.Join(errStrings, ", "))
+	}
+	return plans, nil
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printPlans writes a table of decisions for every plan.
+func printPlans(plans []*gcrcleaner.RepoPlan, deleteOnly bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, p := range plans {
+		candidates := p.Candidates()
+		fmt.Fprintf(w, "%s: %d manifests, %d to delete", p.Repo, len(p.Decisions), len(candidates))
+		if n := p.WithSeverity(gcrcleaner.SeverityCritical); n > 0 {
+			fmt.Fprintf(w, " (%d of which had %s findings)", n, gcrcleaner.SeverityCritical)
+		}
+		fmt.Fprintf(w, ", %s kept\n", gcrcleaner.FormatSize(p.KeptSize()))
+		fmt.Fprintf(w, "  policy (%s): %s\n", p.PolicySource, p.Policy)
+		if p.ExceptionRepo {
+			fmt.Fprintln(w, "  exception repo, only untagged manifests are deleted")
+		}
+		if len(p.Exceptions) > 0 {
+			fmt.Fprintf(w, "  exceptions: %s\n", formatCounts(p.Exceptions))
+		}
+		fmt.Fprintln(w, "  ACTION\tDIGEST\tTAGS\tBUILT\tSIZE\tREASON\tCODE")
+		for _, d := range p.Decisions {
+			action := "keep"
+			if d.Delete {
+				action = "delete"
+			} else if deleteOnly {
+				continue
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n", action, shortDigest(d.Digest), formatTags(d),
+				d.Built.Format(time.RFC3339), gcrcleaner.FormatSize(d.Size), d.Reason, d.Code)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// formatCounts formats counts by key sorted by key, like a=1, b=2.
+func formatCounts(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatTags lists the tags of a decision, noting what protects each alias of
+// a kept manifest, like v1.2.3,prod[exception],latest[keep window].
+func formatTags(d *gcrcleaner.Decision) string {
+	tags := make([]string, 0, len(d.Tags))
+	for _, t := range d.Tags {
+		if reason := d.Aliases[t]; reason != "" && reason != gcrcleaner.ReasonBeyond {
+			t = fmt.Sprintf("%s[%s]", t, reason)
+		}
+		tags = append(tags, t)
+	}
+	return strings.Join(tags, ",")
+}
+
+// shortDigest abbreviates a digest to its first 12 hex characters.
+func shortDigest(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
@@ -0,0 +1,283 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// dashboardTmpl renders the web dashboard pages.
+var dashboardTmpl = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"size": gcrcleaner.FormatSize,
+	"age": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return time.Since(t).Round(time.Hour).String()
+	},
+	"join": strings.Join,
+	"csrf": func() string { return dashboardCSRFToken },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<title>GCR Cleaner</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.error { color: #b00; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1><a href="/ui/">GCR Cleaner</a>: {{.Base}}</h1>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "runform"}}<form method="POST" action="/ui/run">
+<input type="hidden" name="repo" value="{{.}}">
+<input type="hidden" name="csrf" value="{{csrf}}">
+<button name="dry" value="true">Dry run</button>
+<button name="dry" value="false" onclick="return confirm('Delete the candidates now?')">Clean</button>
+</form>{{end}}
+
+{{define "index"}}{{template "header" .}}
+<h2>Runs</h2>
+<p>All repos: {{template "runform" ""}}</p>
+<table>
+<tr><th>ID</th><th>Repos</th><th>Dry</th><th>Started</th><th>Finished</th><th>Result</th></tr>
+{{range .Runs}}<tr>
+<td>{{.ID}}</td>
+<td>{{if .Repos}}{{join .Repos ", "}}{{else}}all{{end}}</td>
+<td>{{.Dry}}</td>
+<td>{{.Started.Format "2006-01-02 15:04:05"}}</td>
+<td>{{if .Done}}{{.Finished.Format "2006-01-02 15:04:05"}}{{else}}running{{end}}</td>
+<td>{{if .Error}}<span class="error">{{.Error}}</span>{{else}}{{range .Status}}{{.}}<br>{{end}}{{end}}</td>
+</tr>{{end}}
+</table>
+<h2>Repos</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<ul>
+{{range .Repos}}<li><a href="/ui/repos/{{.}}">{{.}}</a></li>
+{{end}}</ul>
+{{template "footer"}}{{end}}
+
+{{define "repo"}}{{template "header" .}}
+<h2>{{.Plan.Repo}}</h2>
+<p>Keeping at least {{.Plan.Policy.Keep}} tags. {{template "runform" .Name}}</p>
+<table>
+<tr><th>Digest</th><th>Tags</th><th>Age</th><th>Size</th><th>Decision</th><th>Reason</th></tr>
+{{range .Plan.Decisions}}<tr>
+<td>{{.Digest}}</td>
+<td>{{join .Tags ", "}}</td>
+<td>{{age .Built}}</td>
+<td>{{size .Size}}</td>
+<td>{{if .Delete}}delete{{else}}keep{{end}}</td>
+<td>{{.Reason}}</td>
+</tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+`))
+
+// dashboardCSRFToken is the token the dashboard's forms must post, so other
+// sites can't start runs through the browsers of its users, see
+// newCSRFToken. It is set by registerDashboard.
+var dashboardCSRFToken string
+
+// newCSRFToken returns the dashboard's CSRF token: an HMAC of the API token,
+// so every replica of the server accepts the forms of the others, or a random
+// token if there is no API token.
+func newCSRFToken(token string) (string, error) {
+	if token != "" {
+		mac := hmac.New(sha256.New, []byte(token))
+		mac.Write([]byte("gcr-cleaner dashboard csrf"))
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate CSRF token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// registerDashboard adds the web dashboard to the mux under /ui/. With
+// CLEANER_API_TOKEN set, browsers sign in with basic auth, with the token as
+// the password.
+func (s *server) registerDashboard(mux *http.ServeMux) error {
+	var err error
+	if dashboardCSRFToken, err = newCSRFToken(os.Getenv("CLEANER_API_TOKEN")); err != nil {
+		return err
+	}
+	mux.HandleFunc("/ui/", s.authorizeDashboard(s.handleDashboard))
+	mux.HandleFunc("/ui/repos/", s.authorizeDashboard(s.handleDashboardRepo))
+	mux.HandleFunc("/ui/run", s.authorizeDashboard(s.handleDashboardRun))
+	return nil
+}
+
+// authorizeDashboard requires the token in CLEANER_API_TOKEN, if one is set,
+// asking browsers for it with a basic auth prompt. Unlike the REST API, the
+// dashboard accepts basic auth, as its forms post a CSRF token.
+func (s *server) authorizeDashboard(next http.HandlerFunc) http.HandlerFunc {
+	token := os.Getenv("CLEANER_API_TOKEN")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !authorized(r, token) && !basicAuthorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gcr-cleaner"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// basicAuthorized returns true if the request sends the token as the
+// password of basic auth, as browsers do.
+func basicAuthorized(r *http.Request, token string) bool {
+	_, password, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1
+}
+
+// sameOrigin returns true if the request comes from a page of the server
+// itself, judged by its Origin or, failing that, Referer header. Requests
+// with neither, like those of scripts, pass, as they carry no ambient
+// credentials of a browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleDashboard renders the run history and the list of repos.
+func (s *server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := struct {
+		Base  string
+		Runs  []*Run
+		Repos []string
+		Error string
+	}{
+		Base: s.cleaner.BaseRepo(),
+		Runs: s.history.list(0),
+	}
+	repos, err := s.cleaner.Repos()
+	if err != nil {
+		data.Error = err.Error()
+	}
+	data.Repos = repos
+
+	s.render(w, "index", data)
+}
+
+// handleDashboardRepo renders the plan of a single repo.
+func (s *server) handleDashboardRepo(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/ui/repos/")
+	if name == "" || strings.Contains(name, "..") {
+		http.NotFound(w, r)
+		return
+	}
+
+	plans, err := s.cleaner.Plan([]string{name})
+	if err != nil || len(plans) == 0 {
+		msg := "repo not found"
+		if err != nil {
+			msg = err.Error()
+		}
+		http.Error(w, msg, http.StatusBadGateway)
+		return
+	}
+
+	s.render(w, "repo", struct {
+		Base string
+		Name string
+		Plan *gcrcleaner.RepoPlan
+	}{
+		Base: s.cleaner.BaseRepo(),
+		Name: name,
+		Plan: plans[0],
+	})
+}
+
+// handleDashboardRun starts a dry or real run of one repo, or of every repo,
+// and redirects back to the dashboard.
+func (s *server) handleDashboardRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	csrf := r.PostFormValue("csrf")
+	if subtle.ConstantTimeCompare([]byte(csrf), []byte(dashboardCSRFToken)) != 1 || !sameOrigin(r) {
+		http.Error(w, "invalid CSRF token or cross-origin request", http.StatusForbidden)
+		return
+	}
+	if !s.isLeader() {
+		http.Error(w, "this replica is not the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	var repos []string
+	if name := r.PostFormValue("repo"); name != "" {
+		if strings.Contains(name, "..") {
+			http.Error(w, "invalid repo name", http.StatusBadRequest)
+			return
+		}
+		repos = []string{name}
+	}
+	dry, err := strconv.ParseBool(r.PostFormValue("dry"))
+	if err != nil {
+		http.Error(w, "invalid dry value", http.StatusBadRequest)
+		return
+	}
+
+	run := s.history.start(repos, dry, nil)
+	go s.execute(run, 0)
+
+	http.Redirect(w, r, "/ui/", http.StatusSeeOther)
+}
+
+// render executes the named dashboard template.
+func (s *server) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTmpl.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("failed to render %s: %s", name, err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// differ compares every full run with the previous one, saved in the state
+// store, and flags the anomalies, see gcrcleaner.DiffRuns.
+type differ struct {
+	store      gcrcleaner.StateStore
+	thresholds gcrcleaner.DiffThresholds
+}
+
+// newDiffer configures run diffs from the environment. It returns nil unless
+// CLEANER_DIFF is true, which needs CLEANER_STATE.
+func newDiffer(jsonKey []byte) (*differ, error) {
+	if getenv("CLEANER_DIFF", "false") != "true" {
+		return nil, nil
+	}
+	store, err := newStateStore(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("CLEANER_DIFF needs CLEANER_STATE to keep the previous run in")
+	}
+	minJump, err := strconv.Atoi(getenv("CLEANER_DIFF_MIN_JUMP", "100"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_DIFF_MIN_JUMP: %w", err)
+	}
+	factor, err := strconv.ParseFloat(getenv("CLEANER_DIFF_FACTOR", "3"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_DIFF_FACTOR: %w", err)
+	}
+	return &differ{store: store, thresholds: gcrcleaner.DiffThresholds{MinJump: minJump, Factor: factor}}, nil
+}
+
+// afterRun compares the run with the previous one, logs the anomalies and
+// records them in the result, and saves the run to compare the next one
+// with. Runs that were skipped or only cleaned some repos aren't compared.
+// Failures are only logged.
+func (d *differ) afterRun(runID string, dry bool, res *runResult) {
+	if d == nil || res.Skipped || res.Partial {
+		return
+	}
+	ctx := context.Background()
+
+	cur := &gcrcleaner.RunSummary{
+		RunID:      runID,
+		Dry:        dry,
+		Finished:   time.Now(),
+		Candidates: res.Candidates,
+		Deleted:    res.Deleted,
+		Failed:     len(res.Failed),
+		Repos:      res.Repos,
+	}
+	if cur.Repos == nil {
+		cur.Repos = make(map[string]*gcrcleaner.RepoSummary)
+	}
+	for repo, size := range res.Freed {
+		cur.Freed += size
+		if s := cur.Repos[repo]; s != nil {
+			s.Freed = size
+		}
+	}
+
+	state, err := d.store.Load(ctx)
+	if err != nil {
+		log.Printf("failed to load state: %s", err)
+		return
+	}
+	if prev := state.LastRun; prev != nil {
+		res.Anomalies = gcrcleaner.DiffRuns(prev, cur, d.thresholds)
+		if len(res.Anomalies) > 0 {
+			log.Printf("ANOMALIES SINCE RUN %s (%d):", prev.RunID, len(res.Anomalies))
+			message := ""
+			for _, a := range res.Anomalies {
+				message += fmt.Sprintf("%s\n", a.Message)
+			}
+			log.Print(message)
+		}
+	}
+	state.LastRun = cur
+	if err := d.store.Save(ctx, state); err != nil {
+		log.Printf("failed to save state: %s", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// version is the version of the cleaner, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// reporter reports errors to Error Reporting, if it is configured.
+var reporter *gcrcleaner.ErrorReporter
+
+// newErrorReporter configures Error Reporting from the environment. It
+// returns nil if CLEANER_ERROR_REPORTING_PROJECT isn't set.
+func newErrorReporter(jsonKey []byte) (*gcrcleaner.ErrorReporter, error) {
+	project := os.Getenv("CLEANER_ERROR_REPORTING_PROJECT")
+	if project == "" {
+		return nil, nil
+	}
+	client, err := googleClient(jsonKey, cloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	return &gcrcleaner.ErrorReporter{
+		Project: project,
+		Service: getenv("CLEANER_ERROR_REPORTING_SERVICE", "gcr-cleaner"),
+		Version: version,
+		Client:  client,
+	}, nil
+}
+
+// fatalf is log.Fatalf that reports the error to Error Reporting first.
+func fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if reporter != nil {
+		if err := reporter.Report(context.Background(), msg, "main"); err != nil {
+			log.Printf("failed to report error: %s", err)
+		}
+	}
+	log.Fatal(msg)
+}
+
+// reportRun reports the failures of a run to Error Reporting, once per cause
+// and repo, so a repo that always fails the same way is a single recurring
+// error.
+func reportRun(res *runResult, runErr error) {
+	if reporter == nil || runErr == nil {
+		return
+	}
+	ctx := context.Background()
+	messages := []string{runErr.Error()}
+	if len(res.Errors) > 0 {
+		messages = nil
+		for _, g := range res.Errors {
+			for _, r := range g.Repos {
+				messages = append(messages, fmt.Sprintf("%s: %s", r, g.Cause))
+			}
+		}
+	}
+	for _, msg := range messages {
+		if err := reporter.Report(ctx, msg, "clean"); err != nil {
+			log.Printf("failed to report error: %s", err)
+			return
+		}
+	}
+}
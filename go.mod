@@ -10,4 +10,5 @@ require (
 	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/google/go-containerregistry v0.0.0-20200128171736-43a8003f9213
 	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 )
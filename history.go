@@ -0,0 +1,163 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// maxHistory is the number of runs the server remembers.
+const maxHistory = 50
+
+// Run is the record of a single clean performed by the server.
+type Run struct {
+	ID       string    `json:"id"`
+	Repos    []string  `json:"repos,omitempty"`
+	Dry      bool      `json:"dry"`
+	Keep     *int      `json:"keep,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Done     bool      `json:"done"`
+	Status   []string  `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+
+	// Errors summarizes the failed deletions by cause.
+	Errors []gcrcleaner.ErrorGroup `json:"errors,omitempty"`
+
+	// FailedRepos are the repos that failed to be planned or cleaned.
+	FailedRepos []*gcrcleaner.RepoFailure `json:"failedRepos,omitempty"`
+
+	// Anomalies are how the run differs from the previous one, with
+	// CLEANER_DIFF.
+	Anomalies []gcrcleaner.Anomaly `json:"anomalies,omitempty"`
+
+	events []ProgressEvent
+}
+
+// ProgressEvent records a single manifest processed by a run.
+type ProgressEvent struct {
+	Time   time.Time `json:"time"`
+	Repo   string    `json:"repo"`
+	Digest string    `json:"digest"`
+	Tags   []string  `json:"tags,omitempty"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+
+	// SBOM summarizes the SBOM of a deleted image, with CLEANER_SBOMS.
+	SBOM *gcrcleaner.SBOMSummary `json:"sbom,omitempty"`
+}
+
+// history is a bounded, concurrency-safe list of runs, newest last.
+type history struct {
+	lock sync.RWMutex
+	runs []*Run
+}
+
+// start records the beginning of a new run and returns it. Keep, if not nil,
+// overrides the keep of the repos' policies.
+func (h *history) start(repos []string, dry bool, keep *int) *Run {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	run := &Run{
+		ID:      gcrcleaner.NewRunID(),
+		Repos:   repos,
+		Dry:     dry,
+		Keep:    keep,
+		Started: time.Now(),
+	}
+	h.runs = append(h.runs, run)
+	if len(h.runs) > maxHistory {
+		h.runs = h.runs[len(h.runs)-maxHistory:]
+	}
+	return run
+}
+
+// progress returns a ProgressFunc that records events on the run.
+func (h *history) progress(run *Run) gcrcleaner.ProgressFunc {
+	return func(d *gcrcleaner.Decision, err error) {
+		ev := ProgressEvent{
+			Time:   time.Now(),
+			Repo:   d.Repo,
+			Digest: d.Digest,
+			Tags:   d.Tags,
+			Reason: d.Reason,
+			SBOM:   d.SBOM,
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+
+		h.lock.Lock()
+		run.events = append(run.events, ev)
+		h.lock.Unlock()
+	}
+}
+
+// finish records the result of the run.
+func (h *history) finish(run *Run, res *runResult, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	run.Finished = time.Now()
+	run.Done = true
+	run.Status = res.Status
+	run.Errors = res.Errors
+	run.FailedRepos = res.Failed
+	run.Anomalies = res.Anomalies
+	if err != nil {
+		run.Error = err.Error()
+	}
+}
+
+// get returns a copy of the run with the given ID along with its events from
+// index since onwards, and the index to get the events after those from. A
+// since out of range is clamped to the end of the events.
+func (h *history) get(id string, since int) (*Run, []ProgressEvent, int, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for _, run := range h.runs {
+		if run.ID != id {
+			continue
+		}
+		cp := *run
+		if since < 0 || since > len(run.events) {
+			since = len(run.events)
+		}
+		events := append([]ProgressEvent(nil), run.events[since:]...)
+		return &cp, events, len(run.events), true
+	}
+	return nil, nil, 0, false
+}
+
+// list returns copies of the most recent limit runs, newest first.
+func (h *history) list(limit int) []*Run {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if limit <= 0 || limit > len(h.runs) {
+		limit = len(h.runs)
+	}
+	out := make([]*Run, 0, limit)
+	for i := len(h.runs) - 1; i >= 0 && len(out) < limit; i-- {
+		cp := *h.runs[i]
+		out = append(out, &cp)
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// newInventoryStore returns the store for CLEANER_INVENTORY, or nil if it
+// isn't set.
+func newInventoryStore(jsonKey []byte) (*gcrcleaner.InventoryStore, error) {
+	location := os.Getenv("CLEANER_INVENTORY")
+	if location == "" {
+		return nil, nil
+	}
+	var client *http.Client
+	if strings.HasPrefix(location, "gs://") {
+		var err error
+		if client, err = storageClient(jsonKey); err != nil {
+			return nil, err
+		}
+	}
+	return gcrcleaner.NewInventoryStore(location, client)
+}
+
+// recordInventory saves a snapshot of the manifests a clean of every child
+// repo started from, for the simulate command. Failures are only logged.
+func recordInventory(store *gcrcleaner.InventoryStore, started time.Time, res *runResult) {
+	if store == nil || res.Skipped || len(res.Plans) == 0 {
+		return
+	}
+	inv := gcrcleaner.InventoryFromPlans(started, res.Plans)
+	if err := store.Save(context.Background(), inv); err != nil {
+		log.Printf("failed to save inventory: %s", err)
+	}
+}
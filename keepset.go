@@ -0,0 +1,85 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// keepSetLocation is where the keep set of every full run is written, see
+// exportKeepSet.
+var keepSetLocation = os.Getenv("CLEANER_KEEP_SET")
+
+// collectKeepSet is true if cleans collect what they kept and deleted, which
+// they do if the keep set is exported or the server indexes it.
+var collectKeepSet = keepSetLocation != ""
+
+// newKeepSetStore returns the store for CLEANER_KEEP_SET, or nil if it
+// isn't set.
+func newKeepSetStore(jsonKey []byte) (*gcrcleaner.KeepSetStore, error) {
+	if keepSetLocation == "" {
+		return nil, nil
+	}
+	var client *http.Client
+	if strings.HasPrefix(keepSetLocation, "gs://") {
+		var err error
+		if client, err = storageClient(jsonKey); err != nil {
+			return nil, err
+		}
+	}
+	return gcrcleaner.NewKeepSetStore(keepSetLocation, client)
+}
+
+// completeKeepSet returns what a clean of every child repo kept and deleted,
+// or nil if the clean didn't collect it or only cleaned some repos, see
+// runResult.Partial.
+func completeKeepSet(runID, base string, dry bool, res *runResult) *gcrcleaner.KeepSet {
+	if res.Skipped || res.KeepSet == nil {
+		return nil
+	}
+	if res.Partial {
+		log.Printf("not using the keep set of a run that only cleaned some repos")
+		return nil
+	}
+	ks := res.KeepSet
+	ks.RunID, ks.Base, ks.Dry, ks.Generated = runID, base, dry, time.Now()
+	for _, f := range res.Failed {
+		if f.Stage == gcrcleaner.StagePlan {
+			ks.FailedRepos = append(ks.FailedRepos, f.Repo)
+		}
+	}
+	return ks
+}
+
+// exportKeepSet writes the keep set of a run, see completeKeepSet, replacing
+// that of the previous run. Failures are only logged.
+func exportKeepSet(store *gcrcleaner.KeepSetStore, ks *gcrcleaner.KeepSet) {
+	if store == nil || ks == nil {
+		return
+	}
+	uri, err := store.Write(context.Background(), ks)
+	if err != nil {
+		log.Printf("failed to export keep set: %s", err)
+		return
+	}
+	log.Printf("exported keep set of %d kept and %d deleted manifests to %s", len(ks.Kept), len(ks.Deleted), uri)
+}
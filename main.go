@@ -15,47 +15,1083 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
-	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
 	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 )
 
+const (
+	storageScope         = "https://www.googleapis.com/auth/devstorage.read_write"
+	resourceManagerScope = "https://www.googleapis.com/auth/cloud-platform.read-only"
+	cloudPlatformScope   = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// fullErrors logs every failed deletion instead of only the summary by cause.
+var fullErrors = flag.Bool("full-errors", false, "log every failed deletion, not only the summary of failures by cause")
+
+// repoBatchSize is how many child repos a clean plans and cleans at a time,
+// to cap its memory in registries too large to hold the plans of every repo
+// at once, or 0 to clean them all at once.
+var repoBatchSize int
+
+// pruneEmptyRepos deletes, or reports, the child repos a clean leaves empty.
+var pruneEmptyRepos = flag.Bool("prune-empty-repos", false, "after cleaning, delete child repos left without manifests (Artifact Registry) or report them (Container Registry)")
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "pin", "unpin", "pins":
+			if err := runPins(os.Args[1], os.Args[2:]); err != nil {
+				fatalf("%s: %s", os.Args[1], err)
+			}
+			return
+		case "webhook":
+			if err := runWebhook(); err != nil {
+				fatalf("webhook: %s", err)
+			}
+			return
+		}
+	}
+
 	dry := flag.Bool("dry", false, "perform a dry run for testing")
+	serve := flag.Bool("server", false, "run as a long-lived server that cleans on an interval")
+	shard := flag.String("shard", "", "only clean shard i/n of the child repos (defaults to the Cloud Run task index/count)")
+	allowFullPrune := flag.Bool("allow-full-prune", false, "allow policies that keep 0 tags, deleting every tag that isn't excepted")
+	verbose := flag.Bool("verbose", false, "log the decision and reason code of every manifest")
+	failFast := flag.Bool("fail-fast", false, "stop deleting in a repo after its first failed deletion, instead of attempting every candidate")
+	events := flag.String("events", "", "write a JSON event for every manifest kept or deleted to this file, or - for stdout")
+	sample := flag.String("sample", "", "only delete this percentage of every repo's candidates, like 10%, to roll out gradually")
+	maxPerRepo := flag.Int("max-per-repo", 0, "only delete up to this many candidates from every repo")
+	sampleRandom := flag.Bool("sample-random", false, "sample candidates at random instead of the oldest ones")
 	flag.Parse()
 
+	// Every log line of a job carries its run ID. Shards and replicas that
+	// should be correlated can share one through CLEANER_RUN_ID. Server runs
+	// get their own, see server.execute.
+	runID := os.Getenv("CLEANER_RUN_ID")
+	if runID == "" {
+		runID = gcrcleaner.NewRunID()
+	}
+	if !*serve {
+		log.SetPrefix("run=" + runID + " ")
+	}
+
+	var opts []gcrcleaner.Option
+	if *allowFullPrune {
+		opts = append(opts, gcrcleaner.WithAllowFullPrune())
+	}
+	if *failFast {
+		opts = append(opts, gcrcleaner.WithFailFast())
+	}
+	if *verbose {
+		opts = append(opts, gcrcleaner.WithVerbose())
+	}
+	if *sample != "" || *maxPerRepo != 0 {
+		s := gcrcleaner.Sample{MaxPerRepo: *maxPerRepo, Random: *sampleRandom}
+		if *sample != "" {
+			var err error
+			if s.Percent, err = gcrcleaner.ParsePercent(*sample); err != nil {
+				fatalf("failed to parse -sample: %s", err)
+			}
+		}
+		opts = append(opts, gcrcleaner.WithSample(s))
+	}
+	switch *events {
+	case "":
+	case "-":
+		opts = append(opts, gcrcleaner.WithEventStream(os.Stdout))
+	default:
+		f, err := os.OpenFile(*events, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fatalf("failed to open event stream: %s", err)
+		}
+		defer f.Close()
+		opts = append(opts, gcrcleaner.WithEventStream(f))
+	}
+	lockKey := ""
+	if *shard == "" && os.Getenv("CLOUD_RUN_TASK_COUNT") != "" {
+		*shard = getenv("CLOUD_RUN_TASK_INDEX", "0") + "/" + os.Getenv("CLOUD_RUN_TASK_COUNT")
+	}
+	if *shard != "" {
+		index, count, err := gcrcleaner.ParseShard(*shard)
+		if err != nil {
+			fatalf("failed to parse shard: %s", err)
+		}
+		opts = append(opts, gcrcleaner.WithShard(index, count))
+		lockKey = fmt.Sprintf("-shard-%d-of-%d", index, count)
+	}
+
+	jsonKey, err := readJSONKey()
+	if err != nil {
+		fatalf("failed to read credentials: %s", err)
+	}
+	if reporter, err = newErrorReporter(jsonKey); err != nil {
+		fatalf("failed to configure Error Reporting: %s", err)
+	}
+	secrets := secretManager(jsonKey)
+	if err := resolveSecretEnv(secrets); err != nil {
+		fatalf("failed to read secrets: %s", err)
+	}
+	if secrets != nil {
+		opts = append(opts, gcrcleaner.WithSecretManager(secrets))
+	}
+	exceptions, err := newExceptionStore(jsonKey)
+	if err != nil {
+		fatalf("failed to configure exceptions: %s", err)
+	}
+	opts = append(opts, gcrcleaner.WithExceptionStore(exceptions))
+	if client, err := registryClient(jsonKey); err == nil {
+		opts = append(opts, gcrcleaner.WithArtifactRegistryClient(client))
+	} else if *pruneEmptyRepos {
+		fatalf("failed to configure Artifact Registry client: %s", err)
+	}
+	if getenv("CLEANER_VULNERABILITIES", "false") == "true" {
+		client, err := googleClient(jsonKey, cloudPlatformScope)
+		if err != nil {
+			fatalf("failed to configure Container Analysis client: %s", err)
+		}
+		opts = append(opts, gcrcleaner.WithContainerAnalysisClient(client))
+	}
+	providers, err := inUseProviders(jsonKey)
+	if err != nil {
+		fatalf("failed to configure in-use providers: %s", err)
+	}
+	for _, p := range providers {
+		opts = append(opts, gcrcleaner.WithInUseProvider(p))
+	}
+	if v := os.Getenv("CLEANER_IN_USE_HISTORY_RUNS"); v != "" {
+		runs, err := strconv.Atoi(v)
+		if err != nil {
+			fatalf("failed to parse CLEANER_IN_USE_HISTORY_RUNS: %s", err)
+		}
+		store, err := newStateStore(jsonKey)
+		if err != nil {
+			fatalf("failed to configure state: %s", err)
+		}
+		if store == nil {
+			fatalf("CLEANER_IN_USE_HISTORY_RUNS needs CLEANER_STATE to record the history in")
+		}
+		opts = append(opts, gcrcleaner.WithInUseHistory(store, runs))
+	}
+	auther, err := registryAuthenticator(jsonKey)
+	if err != nil {
+		fatalf("failed to configure registry credentials: %s", err)
+	}
+	keychain, err := registryKeychain(auther, secrets)
+	if err != nil {
+		fatalf("failed to configure registry credentials: %s", err)
+	}
+	if keychain != nil {
+		opts = append(opts, gcrcleaner.WithKeychain(keychain))
+	}
+	transport, err := registryTransport()
+	if err != nil {
+		fatalf("failed to configure registry transport: %s", err)
+	}
+	if transport != nil {
+		opts = append(opts, gcrcleaner.WithTransport(transport))
+	}
+	concurrency, err := strconv.Atoi(getenv("CLEANER_DELETE_CONCURRENCY", "8"))
+	if err != nil {
+		fatalf("failed to parse CLEANER_DELETE_CONCURRENCY: %s", err)
+	}
+	repoConcurrency, err := strconv.Atoi(getenv("CLEANER_REPO_CONCURRENCY", "1"))
+	if err != nil {
+		fatalf("failed to parse CLEANER_REPO_CONCURRENCY: %s", err)
+	}
+	opts = append(opts, gcrcleaner.WithRepoConcurrency(repoConcurrency))
+	if repoBatchSize, err = strconv.Atoi(getenv("CLEANER_REPO_BATCH_SIZE", "0")); err != nil || repoBatchSize < 0 {
+		fatalf("invalid CLEANER_REPO_BATCH_SIZE %q", os.Getenv("CLEANER_REPO_BATCH_SIZE"))
+	}
+
+	// With CLEANER_PROJECT, every regional host of the project is cleaned.
+	bases := []string{os.Getenv("GCR_BASE_REPO")}
+	label := bases[0]
+	if project := os.Getenv("CLEANER_PROJECT"); project != "" {
+		bases = gcrcleaner.ProjectRepos(project)
+		label = project
+	}
+	if parent := os.Getenv("CLEANER_DISCOVER_PARENT"); parent != "" {
+		var err error
+		if bases, err = discoverBases(jsonKey, parent); err != nil {
+			fatalf("failed to discover projects: %s", err)
+		}
+		label = parent
+	}
+
+	if flag.Arg(0) == "validate" {
+		if err := runValidate(flag.Args()[1:], bases, exceptions, *allowFullPrune, auther, opts); err != nil {
+			fatalf("validate: %s", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "policy" {
+		if err := runPolicy(flag.Args()[1:], *allowFullPrune); err != nil {
+			fatalf("policy: %s", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "bench" {
+		if err := runBench(flag.Args()[1:], bases[0], auther, opts); err != nil {
+			fatalf("bench: %s", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "compare" {
+		if err := runCompare(flag.Args()[1:], auther, opts); err != nil {
+			fatalf("compare: %s", err)
+		}
+		return
+	}
+
+	if dr := os.Getenv("CLEANER_DR_REPO"); dr != "" {
+		if len(bases) > 1 {
+			fatalf("the DR guard needs a single base repo, set GCR_BASE_REPO instead of CLEANER_PROJECT or CLEANER_DISCOVER_PARENT")
+		}
+		drCleaner, err := auxCleaner(dr, auther, concurrency, opts)
+		if err != nil {
+			fatalf("failed to configure DR repo: %s", err)
+		}
+		opts = append(opts, gcrcleaner.WithDRGuard(drCleaner, getenv("CLEANER_DR_REPLICATE", "false") == "true"))
+	}
+
+	if mirrors := splitList(os.Getenv("CLEANER_MIRRORS")); len(mirrors) > 0 {
+		if len(bases) > 1 {
+			fatalf("mirrors need a single base repo, set GCR_BASE_REPO instead of CLEANER_PROJECT or CLEANER_DISCOVER_PARENT")
+		}
+		mirrorOpts, err := mirrorOptions(mirrors, auther, concurrency, opts)
+		if err != nil {
+			fatalf("failed to configure mirrors: %s", err)
+		}
+		opts = append(opts, mirrorOpts...)
+	}
+
+	var cleaners []*gcrcleaner.Cleaner
+	var locks []*gcrcleaner.RunLock
+	for _, base := range bases {
+		backend, err := backendOption(base)
+		if err != nil {
+			fatalf("failed to configure registry backend: %s", err)
+		}
+		baseOpts := append([]gcrcleaner.Option{gcrcleaner.WithBaseRepo(base)}, opts...)
+		if backend != nil {
+			baseOpts = append(baseOpts, backend)
+		}
+
+		cleaner, err := gcrcleaner.NewCleaner(auther, concurrency, baseOpts...)
+		if err != nil {
+			fatalf("failed to create cleaner: %s", err)
+		}
+
+		lock, err := newRunLock(jsonKey, cleaner.BaseRepo()+lockKey)
+		if err != nil {
+			fatalf("failed to create run lock: %s", err)
+		}
+		if lock != nil {
+			// Stop deleting if another run may have broken the lock.
+			cleaner.HaltWhen(lock.Err)
+		}
+		cleaners = append(cleaners, cleaner)
+		locks = append(locks, lock)
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:], cleaners, locks, jsonKey, *dry); err != nil {
+			fatalf("%s: %s", flag.Arg(0), err)
+		}
+		return
+	}
+
+	if *serve {
+		if len(cleaners) > 1 {
+			fatalf("server mode cleans a single base repo, set GCR_BASE_REPO instead of CLEANER_PROJECT or CLEANER_DISCOVER_PARENT")
+		}
+		if err := runServer(cleaners[0], locks[0], jsonKey, *dry); err != nil {
+			fatalf("server exited: %s", err)
+		}
+		return
+	}
+
+	alerts, err := newAlerting(jsonKey, label)
+	if err != nil {
+		fatalf("failed to configure alerting: %s", err)
+	}
+	notes, err := newNotifications(jsonKey, label)
+	if err != nil {
+		fatalf("failed to configure notifications: %s", err)
+	}
+	reps, err := newReports(jsonKey, label)
+	if err != nil {
+		fatalf("failed to configure run reports: %s", err)
+	}
+	inventory, err := newInventoryStore(jsonKey)
+	if err != nil {
+		fatalf("failed to configure inventory snapshots: %s", err)
+	}
+	pushers, err := newMetricsPushers(jsonKey)
+	if err != nil {
+		fatalf("failed to configure metrics: %s", err)
+	}
+	keepSets, err := newKeepSetStore(jsonKey)
+	if err != nil {
+		fatalf("failed to configure keep set export: %s", err)
+	}
+	diffs, err := newDiffer(jsonKey)
+	if err != nil {
+		fatalf("failed to configure run diffs: %s", err)
+	}
+
+	if checkpoints, err = newCheckpointer(jsonKey, runID, label, *dry); err != nil {
+		fatalf("failed to configure checkpoints: %s", err)
+	}
+	if checkpoints != nil && checkpoints.cp.RunID != runID {
+		runID = checkpoints.cp.RunID
+		log.SetPrefix("run=" + runID + " ")
+	}
+
+	started := time.Now()
+	res, err := cleanAll(cleaners, locks, runID, *dry)
+	if err != nil {
+		log.Printf("failed to clean: %s", err)
+	}
+	if checkpoints != nil {
+		checkpoints.finish()
+	}
+	diffs.afterRun(runID, *dry, res)
+	reportRun(res, err)
+	alerts.afterRun(res, *dry, err)
+	notes.afterRun(res, *dry, err)
+	reps.afterRun(runID, started, res, *dry, err)
+	recordInventory(inventory, started, res)
+	exportKeepSet(keepSets, completeKeepSet(runID, label, *dry, res))
+	pushMetrics(pushers, runMetrics(label, runID, res, *dry, started, err))
+}
+
+// cleanAll cleans every base repo in turn, as a single run, and combines the
+// results. Base repos that don't exist, like regional hosts a project never
+// pushed to, are skipped.
+func cleanAll(cleaners []*gcrcleaner.Cleaner, locks []*gcrcleaner.RunLock, runID string, dry bool) (*runResult, error) {
+	opts := gcrcleaner.CleanOptions{
+		PlanOptions:    gcrcleaner.PlanOptions{RunID: runID},
+		ExecuteOptions: gcrcleaner.ExecuteOptions{Dry: dry},
+	}
+	if len(cleaners) == 1 {
+		res, err := clean(cleaners[0], locks[0], nil, opts)
+		logStatus(res, dry)
+		return res, err
+	}
+
+	total := &runResult{Skipped: true, Freed: make(map[string]int64)}
+	var errStrings []string
+	for i, cleaner := range cleaners {
+		exists, err := cleaner.Exists()
+		if err != nil {
+			errStrings = append(errStrings, err.Error())
+			continue
+		}
+		if !exists {
+			log.Printf("skipping %s: no such repo", cleaner.BaseRepo())
+			continue
+		}
+
+		res, err := clean(cleaner, locks[i], nil, opts)
+		if err != nil {
+			errStrings = append(errStrings, fmt.Sprintf("%s: %s", cleaner.BaseRepo(), err))
+		}
+		log.Printf("%s: %d candidates, %d deleted", cleaner.BaseRepo(), res.Candidates, res.Deleted)
+		logStatus(res, dry)
+
+		total.add(res)
+	}
+	if len(errStrings) > 0 {
+		total.Skipped = false
+		return total, errors.New(strings.Join(errStrings, ", "))
+	}
+	return total, nil
+}
+
+// keySecret is the Secret Manager reference the JSON key was read from, and
+// keySecrets the client that reads it again whenever an access token is
+// refreshed, so a rotated key is picked up.
+var (
+	keySecret  string
+	keySecrets *gcrcleaner.SecretManager
+)
+
+// readJSONKey reads the service account JSON key at
+// GOOGLE_APPLICATION_CREDENTIALS, if it is set. It may be a Secret Manager
+// reference instead of a path, which is read with the application default
+// credentials, like Workload Identity.
+func readJSONKey() ([]byte, error) {
 	jsonPath := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	jsonKey, err := ioutil.ReadFile(jsonPath)
-	auther := gcrgoogle.NewJSONKeyAuthenticator(string(jsonKey))
-	concurrency := runtime.NumCPU()
+	if jsonPath == "" {
+		return nil, nil
+	}
+	if !gcrcleaner.IsSecretRef(jsonPath) {
+		return ioutil.ReadFile(jsonPath)
+	}
 
-	cleaner, err := gcrcleaner.NewCleaner(auther, concurrency)
+	// The application default credentials would otherwise be looked for at
+	// the reference itself.
+	os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	ctx := context.Background()
+	client, err := google.DefaultClient(ctx, cloudPlatformScope)
 	if err != nil {
-		log.Fatalf("failed to create cleaner: %s", err)
+		return nil, fmt.Errorf("no credentials to read %s with: %w", jsonPath, err)
 	}
+	keySecret, keySecrets = jsonPath, gcrcleaner.NewSecretManager(client)
+	return keySecrets.Resolve(ctx, jsonPath)
+}
+
+// secretEnvVars are the credentials that may be given as Secret Manager
+// references.
+var secretEnvVars = []string{"GITHUB_TOKEN", "GITHUB_APP_PRIVATE_KEY", "GITLAB_TOKEN", "QUAY_TOKEN"}
 
-	status, err := cleaner.Clean(*dry)
+// secretManager returns a Secret Manager client, or nil if there are no
+// Google credentials to access it with.
+func secretManager(jsonKey []byte) *gcrcleaner.SecretManager {
+	client, err := googleClient(jsonKey, cloudPlatformScope)
 	if err != nil {
-		log.Printf("failed to clean: %w", err)
+		return nil
 	}
+	return gcrcleaner.NewSecretManager(client)
+}
+
+// resolveSecretEnv replaces the Secret Manager references among the
+// credential environment variables with the secrets they point to.
+func resolveSecretEnv(secrets *gcrcleaner.SecretManager) error {
+	for _, name := range secretEnvVars {
+		value := os.Getenv(name)
+		if !gcrcleaner.IsSecretRef(value) {
+			continue
+		}
+		secret, err := secrets.Resolve(context.Background(), value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		os.Setenv(name, strings.TrimSpace(string(secret)))
+	}
+	return nil
+}
+
+// newExceptionStore returns the store for CLEANER_EXCEPTION_FILE, a local path
+// or a gs://bucket/object URI.
+func newExceptionStore(jsonKey []byte) (*gcrcleaner.ExceptionStore, error) {
+	location := getenv("CLEANER_EXCEPTION_FILE", "/config/exceptions.json")
+	var client *http.Client
+	if strings.HasPrefix(location, "gs://") {
+		var err error
+		if client, err = storageClient(jsonKey); err != nil {
+			return nil, err
+		}
+	}
+	return gcrcleaner.NewExceptionStore(location, client)
+}
+
+// impersonate is the service account registries are accessed as, if any,
+// and oauthScopes the scopes of the registry access tokens.
+var (
+	impersonate = flag.String("impersonate-service-account", os.Getenv("CLEANER_IMPERSONATE_SERVICE_ACCOUNT"),
+		"access registries as this service account, impersonating it with the cleaner's own credentials")
+	oauthScopes = flag.String("scopes", getenv("CLEANER_OAUTH_SCOPES", cloudPlatformScope),
+		"comma-separated OAuth scopes of registry access tokens")
+)
 
-	if len(status) > 0 {
-		if *dry {
+// registryScopes returns the scopes of -scopes. Scopes that aren't URLs are
+// short for https://www.googleapis.com/auth/SCOPE, like cloud-platform.
+func registryScopes() []string {
+	var scopes []string
+	for _, s := range splitList(*oauthScopes) {
+		if !strings.Contains(s, "://") {
+			s = "https://www.googleapis.com/auth/" + s
+		}
+		scopes = append(scopes, s)
+	}
+	return scopes
+}
+
+// registryTokenSource returns the source of registry access tokens, from the
+// JSON key if there is one or the application default credentials
+// otherwise, or nil if there are no credentials. With
+// -impersonate-service-account, those credentials only generate the tokens
+// of the impersonated service account.
+func registryTokenSource(jsonKey []byte) (oauth2.TokenSource, error) {
+	ctx := context.Background()
+	scopes := registryScopes()
+	if *impersonate != "" {
+		client, err := googleClient(jsonKey, cloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("no credentials to impersonate %s with: %w", *impersonate, err)
+		}
+		return gcrcleaner.ImpersonatedTokenSource(client, *impersonate, scopes), nil
+	}
+	if jsonKey == nil {
+		creds, err := google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, nil
+		}
+		return creds.TokenSource, nil
+	}
+	creds, err := google.CredentialsFromJSON(ctx, jsonKey, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	if keySecret != "" {
+		return keySecrets.KeyTokenSource(keySecret, scopes...), nil
+	}
+	return creds.TokenSource, nil
+}
+
+// registryAuthenticator returns an authenticator for Google registries that
+// refreshes its access token as needed, see registryTokenSource. Without any
+// credentials, the registries are accessed anonymously.
+func registryAuthenticator(jsonKey []byte) (gcrauthn.Authenticator, error) {
+	ts, err := registryTokenSource(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	if ts == nil {
+		return gcrauthn.Anonymous, nil
+	}
+	return gcrcleaner.NewTokenAuthenticator(ts), nil
+}
+
+// registryClient returns a client for the Artifact Registry API with the
+// registry access tokens, so repos are listed and deleted by the same
+// identity as images.
+func registryClient(jsonKey []byte) (*http.Client, error) {
+	ts, err := registryTokenSource(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	if ts == nil {
+		return nil, fmt.Errorf("no registry credentials")
+	}
+	return oauth2.NewClient(context.Background(), ts), nil
+}
+
+// registryKeychain returns the keychain for the per-host credentials in
+// CLEANER_REGISTRY_CREDENTIALS_FILE, with the Google authenticator for every
+// other host, or nil if the file isn't set. Passwords and tokens may be
+// Secret Manager references.
+func registryKeychain(auther gcrauthn.Authenticator, secrets *gcrcleaner.SecretManager) (gcrauthn.Keychain, error) {
+	path := os.Getenv("CLEANER_REGISTRY_CREDENTIALS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := gcrcleaner.ParseRegistryCredentials(b)
+	if err != nil {
+		return nil, err
+	}
+	for host, c := range creds {
+		for _, value := range []*string{&c.Password, &c.Token} {
+			secret, err := secrets.Resolve(context.Background(), *value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", host, err)
+			}
+			*value = strings.TrimSpace(string(secret))
+		}
+	}
+	return gcrcleaner.NewRegistryKeychain(creds, auther), nil
+}
+
+// newRunLock creates the distributed run lock for the key if
+// CLEANER_LOCK_BUCKET is set. It returns nil if locking is disabled.
+func newRunLock(jsonKey []byte, key string) (*gcrcleaner.RunLock, error) {
+	bucket := os.Getenv("CLEANER_LOCK_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	ttl, err := time.ParseDuration(getenv("CLEANER_LOCK_TTL", "6h"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_LOCK_TTL: %w", err)
+	}
+	wait, err := time.ParseDuration(getenv("CLEANER_LOCK_WAIT", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_LOCK_WAIT: %w", err)
+	}
+
+	client, err := storageClient(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcrcleaner.NewRunLock(client, bucket, key, ttl, wait), nil
+}
+
+// discoverBases returns the base repos of every regional host of the projects
+// under the parent that carry the labels in CLEANER_DISCOVER_LABELS.
+func discoverBases(jsonKey []byte, parent string) ([]string, error) {
+	labels, err := gcrcleaner.ParseLabels(os.Getenv("CLEANER_DISCOVER_LABELS"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_DISCOVER_LABELS: %w", err)
+	}
+	client, err := googleClient(jsonKey, resourceManagerScope)
+	if err != nil {
+		return nil, err
+	}
+	projects, err := gcrcleaner.DiscoverProjects(context.Background(), client, parent, labels)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("discovered %d projects under %s", len(projects), parent)
+
+	var bases []string
+	for _, p := range projects {
+		bases = append(bases, gcrcleaner.ProjectRepos(p)...)
+	}
+	return bases, nil
+}
+
+// storageClient returns an HTTP client authorized for GCS, using the JSON key
+// if there is one or the application default credentials otherwise.
+func storageClient(jsonKey []byte) (*http.Client, error) {
+	return googleClient(jsonKey, storageScope)
+}
+
+// mirrorOptions creates a cleaner for every mirror base repo and returns the
+// options that propagate deletions to them.
+func mirrorOptions(mirrors []string, auther gcrauthn.Authenticator, concurrency int, opts []gcrcleaner.Option) ([]gcrcleaner.Option, error) {
+	var out []gcrcleaner.Option
+	for _, base := range mirrors {
+		mirror, err := auxCleaner(base, auther, concurrency, opts)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s: %w", base, err)
+		}
+		out = append(out, gcrcleaner.WithMirror(mirror))
+	}
+	return out, nil
+}
+
+// auxCleaner creates a cleaner for a base repo the main cleaner only reads
+// from or mirrors to, with the backend for its registry and without
+// scanning for in-use images.
+func auxCleaner(base string, auther gcrauthn.Authenticator, concurrency int, opts []gcrcleaner.Option) (*gcrcleaner.Cleaner, error) {
+	backend, err := backendOption(base)
+	if err != nil {
+		return nil, err
+	}
+	baseOpts := append([]gcrcleaner.Option{gcrcleaner.WithBaseRepo(base), gcrcleaner.WithoutClusterScan()}, opts...)
+	if backend != nil {
+		baseOpts = append(baseOpts, backend)
+	}
+	return gcrcleaner.NewCleaner(auther, concurrency, baseOpts...)
+}
+
+// inUseProviders creates the providers of images in use outside the clusters
+// that are configured in the environment.
+func inUseProviders(jsonKey []byte) ([]gcrcleaner.InUseProvider, error) {
+	runProjects := splitList(os.Getenv("CLEANER_CLOUD_RUN_PROJECTS"))
+	computeProjects := splitList(os.Getenv("CLEANER_COMPUTE_PROJECTS"))
+	appEngineProjects := splitList(os.Getenv("CLEANER_APP_ENGINE_PROJECTS"))
+	functionsProjects := splitList(os.Getenv("CLEANER_FUNCTIONS_PROJECTS"))
+	dataflowProjects := splitList(os.Getenv("CLEANER_DATAFLOW_PROJECTS"))
+	dataflowTemplates := splitList(os.Getenv("CLEANER_DATAFLOW_TEMPLATES"))
+	composerProjects := splitList(os.Getenv("CLEANER_COMPOSER_PROJECTS"))
+	composerDAGPaths := splitList(os.Getenv("CLEANER_COMPOSER_DAG_PATHS"))
+
+	var client *http.Client
+	var providers []gcrcleaner.InUseProvider
+	for _, path := range splitList(os.Getenv("CLEANER_IN_USE_FILES")) {
+		providers = append(providers, gcrcleaner.NewFileProvider(path))
+	}
+	for _, p := range []struct {
+		enabled bool
+		create  func(client *http.Client) gcrcleaner.InUseProvider
+	}{
+		{len(runProjects) > 0, func(client *http.Client) gcrcleaner.InUseProvider {
+			return gcrcleaner.NewCloudRunProvider(client, runProjects, splitList(os.Getenv("CLEANER_CLOUD_RUN_LOCATIONS")))
+		}},
+		{len(computeProjects) > 0, func(client *http.Client) gcrcleaner.InUseProvider {
+			return gcrcleaner.NewComputeProvider(client, computeProjects)
+		}},
+		{len(appEngineProjects) > 0, func(client *http.Client) gcrcleaner.InUseProvider {
+			return gcrcleaner.NewAppEngineProvider(client, appEngineProjects)
+		}},
+		{len(functionsProjects) > 0, func(client *http.Client) gcrcleaner.InUseProvider {
+			return gcrcleaner.NewCloudFunctionsProvider(client, functionsProjects)
+		}},
+		{len(dataflowProjects) > 0 || len(dataflowTemplates) > 0, func(client *http.Client) gcrcleaner.InUseProvider {
+			return gcrcleaner.NewDataflowProvider(client, dataflowProjects, dataflowTemplates)
+		}},
+		{len(composerProjects) > 0 || len(composerDAGPaths) > 0, func(client *http.Client) gcrcleaner.InUseProvider {
+			return gcrcleaner.NewComposerProvider(client, composerProjects, splitList(os.Getenv("CLEANER_COMPOSER_LOCATIONS")), composerDAGPaths)
+		}},
+	} {
+		if !p.enabled {
+			continue
+		}
+		if client == nil {
+			var err error
+			if client, err = googleClient(jsonKey, cloudPlatformScope); err != nil {
+				return nil, err
+			}
+		}
+		providers = append(providers, p.create(client))
+	}
+	return providers, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// registryTransport creates the transport for registry requests from the
+// CLEANER_CA_BUNDLE, CLEANER_CLIENT_CERT, CLEANER_CLIENT_KEY,
+// CLEANER_CLIENT_CERTS_FILE, CLEANER_IDLE_CONN_TIMEOUT and
+// CLEANER_MAX_IDLE_CONNS_PER_HOST environment variables. It returns nil if
+// none are set, to use the default transport.
+func registryTransport() (http.RoundTripper, error) {
+	cfg := gcrcleaner.TransportConfig{
+		CABundle:   os.Getenv("CLEANER_CA_BUNDLE"),
+		ClientCert: os.Getenv("CLEANER_CLIENT_CERT"),
+		ClientKey:  os.Getenv("CLEANER_CLIENT_KEY"),
+	}
+	if v := os.Getenv("CLEANER_IDLE_CONN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CLEANER_IDLE_CONN_TIMEOUT: %w", err)
+		}
+		cfg.IdleConnTimeout = d
+	}
+	if v := os.Getenv("CLEANER_MAX_IDLE_CONNS_PER_HOST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CLEANER_MAX_IDLE_CONNS_PER_HOST: %w", err)
+		}
+		cfg.MaxIdleConnsPerHost = n
+	}
+	if path := os.Getenv("CLEANER_CLIENT_CERTS_FILE"); path != "" {
+		certs, err := gcrcleaner.LoadHostCerts(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HostCerts = certs
+	}
+	if cfg.CABundle == "" && cfg.ClientCert == "" && cfg.ClientKey == "" && cfg.HostCerts == nil &&
+		cfg.IdleConnTimeout == 0 && cfg.MaxIdleConnsPerHost == 0 {
+		return nil, nil
+	}
+	return gcrcleaner.NewTransport(cfg)
+}
+
+// googleClient returns an HTTP client authorized for the scope, using the
+// JSON key if there is one or the application default credentials otherwise.
+func googleClient(jsonKey []byte, scope string) (*http.Client, error) {
+	if jsonKey == nil {
+		return google.DefaultClient(context.Background(), scope)
+	}
+	conf, err := google.JWTConfigFromJSON(jsonKey, scope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	if keySecret != "" {
+		return oauth2.NewClient(context.Background(), keySecrets.KeyTokenSource(keySecret, scope)), nil
+	}
+	return conf.Client(context.Background()), nil
+}
+
+// newStateStore creates the state store at CLEANER_STATE, a local path or a
+// gs://bucket/object URI. It returns nil if no state store is configured.
+func newStateStore(jsonKey []byte) (gcrcleaner.StateStore, error) {
+	location := os.Getenv("CLEANER_STATE")
+	if location == "" {
+		return nil, nil
+	}
+	client, err := storageClient(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcrcleaner.NewStateStore(location, client)
+}
+
+// runResult is the outcome of a single clean.
+type runResult struct {
+	Status     []string
+	Candidates int
+	Deleted    int
+	Skipped    bool
+	Errors     []gcrcleaner.ErrorGroup
+
+	// TagsDeleted is how many tags were deleted, before their manifests or
+	// on their own.
+	TagsDeleted int
+
+	// Freed is the space freed by deleting manifests, by repo.
+	Freed map[string]int64
+
+	// Plans are the plans the clean executed.
+	Plans []*gcrcleaner.RepoPlan
+
+	// Failed are the repos that failed to be planned or cleaned, which have
+	// no status.
+	Failed []*gcrcleaner.RepoFailure
+
+	// KeepSet is what the clean kept and deleted, if CLEANER_KEEP_SET is
+	// set.
+	KeepSet *gcrcleaner.KeepSet
+
+	// Partial is true if a run only cleaned some of its repos: a checkpointed
+	// run that resumed an earlier run or left repos to the next one, or a run
+	// whose canary failed.
+	Partial bool
+
+	// DeletedRefs are the manifests deleted, as repo@digest, only collected
+	// for checkpoints.
+	DeletedRefs []string
+
+	// Repos summarizes what the clean planned for every repo, and Anomalies
+	// are how it differs from the previous run, with CLEANER_DIFF.
+	Repos     map[string]*gcrcleaner.RepoSummary
+	Anomalies []gcrcleaner.Anomaly
+}
+
+// add combines the result of another clean into the result. A combined
+// result is only skipped if all of the cleans were.
+func (r *runResult) add(res *runResult) {
+	r.Status = append(r.Status, res.Status...)
+	r.Candidates += res.Candidates
+	r.Deleted += res.Deleted
+	r.TagsDeleted += res.TagsDeleted
+	for repo, size := range res.Freed {
+		r.Freed[repo] += size
+	}
+	r.Errors = append(r.Errors, res.Errors...)
+	r.Plans = append(r.Plans, res.Plans...)
+	r.Failed = append(r.Failed, res.Failed...)
+	if res.KeepSet != nil {
+		if r.KeepSet == nil {
+			r.KeepSet = &gcrcleaner.KeepSet{}
+		}
+		r.KeepSet.Kept = append(r.KeepSet.Kept, res.KeepSet.Kept...)
+		r.KeepSet.Deleted = append(r.KeepSet.Deleted, res.KeepSet.Deleted...)
+	}
+	r.Skipped = r.Skipped && res.Skipped
+	r.Partial = r.Partial || res.Partial
+	for repo, s := range res.Repos {
+		if r.Repos == nil {
+			r.Repos = make(map[string]*gcrcleaner.RepoSummary)
+		}
+		r.Repos[repo] = s
+	}
+}
+
+// clean plans and executes a clean of the given child repos, or of every
+// child repo if none are given, while holding the run lock, if there is one.
+// If another run holds the lock, the clean is skipped.
+//
+// With CLEANER_REPO_BATCH_SIZE, the repos are cleaned in batches, see
+// repoBatchSize. Checkpointed runs of every child repo are always cleaned in
+// batches, skipping the repos the run already cleaned and saving its
+// progress after every batch, see checkpointer.
+func clean(cleaner *gcrcleaner.Cleaner, lock *gcrcleaner.RunLock, repos []string, opts gcrcleaner.CleanOptions) (*runResult, error) {
+	res := &runResult{Freed: make(map[string]int64)}
+	if lock != nil {
+		ctx := context.Background()
+		if err := lock.Acquire(ctx); err != nil {
+			if errors.Is(err, gcrcleaner.ErrLocked) {
+				log.Printf("skipping clean of %s: %s", cleaner.BaseRepo(), err)
+				res.Skipped = true
+				return res, nil
+			}
+			return res, err
+		}
+		defer func() {
+			if err := lock.Release(ctx); err != nil {
+				log.Printf("failed to release run lock: %s", err)
+			}
+		}()
+	}
+
+	batchSize := repoBatchSize
+	checkpointed := checkpoints != nil && len(repos) == 0
+	if checkpointed && batchSize == 0 {
+		batchSize = checkpointBatchSize
+	}
+	if batchSize == 0 {
+		return cleanBatch(cleaner, repos, opts, res)
+	}
+
+	// Only a batch of repos is planned and cleaned at a time, so only its
+	// plans are held in memory. The plans aren't kept for the result, as
+	// that would hold all of them again. The batches are checked against
+	// the deletion thresholds together.
+	opts.Thresholds = &gcrcleaner.Thresholds{}
+	if len(repos) == 0 {
+		var err error
+		if repos, err = cleaner.Repos(); err != nil {
+			if checkpointed {
+				checkpoints.unfinished = true
+			}
+			return res, err
+		}
+	}
+	if checkpointed {
+		remaining := checkpoints.remaining(cleaner.BaseRepo(), repos)
+		res.Partial = len(remaining) < len(repos)
+		repos = remaining
+	}
+	var errStrings []string
+	for start := 0; start < len(repos); start += batchSize {
+		if checkpointed && checkpoints.expired() {
+			checkpoints.unfinished, res.Partial = true, true
+			break
+		}
+		end := start + batchSize
+		if end > len(repos) {
+			end = len(repos)
+		}
+		batch, err := cleanBatch(cleaner, repos[start:end], opts, &runResult{Freed: make(map[string]int64)})
+		if checkpointed {
+			checkpoints.record(cleaner.BaseRepo(), repos[start:end], batch.DeletedRefs)
+		}
+		batch.Plans, batch.DeletedRefs = nil, nil
+		res.add(batch)
+		if err != nil {
+			errStrings = append(errStrings, err.Error())
+		}
+		if errors.Is(err, gcrcleaner.ErrCanaryFailed) {
+			if checkpointed {
+				checkpoints.unfinished = true
+			}
+			res.Partial = true
+			break
+		}
+		debug.FreeOSMemory()
+	}
+	if len(errStrings) > 0 {
+		return res, errors.New(strings.Join(errStrings, ", "))
+	}
+	return res, nil
+}
+
+// cleanBatch plans and executes a clean of the given child repos, or of
+// every child repo if none are given, recording the outcome in res.
+func cleanBatch(cleaner *gcrcleaner.Cleaner, repos []string, opts gcrcleaner.CleanOptions, res *runResult) (*runResult, error) {
+	dry := opts.Dry
+	var errStrings []string
+	plans, err := cleaner.PlanWith(repos, opts.PlanOptions)
+	if err != nil {
+		if plans == nil {
+			return res, err
+		}
+		var multiErr *gcrcleaner.MultiError
+		if errors.As(err, &multiErr) {
+			res.Errors = multiErr.Groups()
+		}
+		res.Failed = gcrcleaner.RepoFailures(gcrcleaner.StagePlan, err)
+		errStrings = append(errStrings, err.Error())
+	}
+	res.Plans = plans
+	res.Repos = gcrcleaner.SummarizePlans(plans)
+	if collectKeepSet {
+		res.KeepSet = &gcrcleaner.KeepSet{}
+		res.KeepSet.Add(plans)
+	}
+	for _, p := range plans {
+		res.Candidates += len(p.Candidates())
+	}
+
+	results, err := cleaner.ExecuteWith(plans, opts.ExecuteOptions)
+	if results != nil {
+		totals := results.Merge()
+		res.Status = totals.Status
+		res.Deleted = totals.Deleted
+		res.TagsDeleted = totals.TagsDeleted
+		res.Freed = totals.Freed
+		res.Failed = append(res.Failed, totals.Failed...)
+		if checkpoints != nil {
+			for _, r := range results.Repos {
+				if r.Dry {
+					continue
+				}
+				for _, d := range r.Deleted {
+					res.DeletedRefs = append(res.DeletedRefs, d.Repo+"@"+d.Digest)
+				}
+			}
+		}
+	}
+	if err != nil {
+		var multiErr *gcrcleaner.MultiError
+		if errors.As(err, &multiErr) {
+			res.Errors = append(res.Errors, multiErr.Groups()...)
+			if *fullErrors {
+				for _, f := range multiErr.Errors {
+					log.Printf("failed to delete %s: %s", f.Ref, f.Err)
+				}
+			}
+		}
+		errStrings = append(errStrings, err.Error())
+	}
+	if errors.Is(err, gcrcleaner.ErrCanaryFailed) {
+		// Once the registry failed verification, nothing else is deleted,
+		// not even empty repos.
+		return res, err
+	}
+
+	if *pruneEmptyRepos {
+		status, err := cleaner.PruneEmptyRepos(plans, dry)
+		res.Status = append(res.Status, status...)
+		if err != nil {
+			var multiErr *gcrcleaner.MultiError
+			if errors.As(err, &multiErr) {
+				res.Errors = append(res.Errors, multiErr.Groups()...)
+			}
+			errStrings = append(errStrings, err.Error())
+		}
+	}
+	if len(errStrings) > 0 {
+		return res, errors.New(strings.Join(errStrings, ", "))
+	}
+	return res, nil
+}
+
+// logStatus prints the per-repo results of a clean: the status of every repo
+// that was cleaned, and then the repos that failed.
+func logStatus(res *runResult, dry bool) {
+	if len(res.Status) > 0 {
+		if dry {
 			log.Printf("DRY RUN RESULTS:")
-			
 		} else {
 			log.Printf("GCR CLEANER RESULTS:")
 		}
 		message := ""
-		for _, s := range status {
+		for _, s := range res.Status {
 			message += fmt.Sprintf("%s\n", s)
 		}
-		log.Printf(message)
+		log.Print(message)
+	}
+	if len(res.Failed) > 0 {
+		log.Printf("FAILED REPOS (%d):", len(res.Failed))
+		message := ""
+		for _, f := range res.Failed {
+			message += fmt.Sprintf("%s\n", f)
+		}
+		log.Print(message)
 	}
 }
@@ -0,0 +1,86 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// newMetricsPushers configures pushing the metrics of every run from the
+// environment, to a Pushgateway and to Cloud Monitoring.
+func newMetricsPushers(jsonKey []byte) ([]gcrcleaner.MetricsPusher, error) {
+	var pushers []gcrcleaner.MetricsPusher
+	if u := os.Getenv("CLEANER_PUSHGATEWAY_URL"); u != "" {
+		pushers = append(pushers, &gcrcleaner.PushgatewayPusher{
+			URL: u,
+			Job: getenv("CLEANER_PUSHGATEWAY_JOB", "gcr-cleaner"),
+		})
+	}
+	if project := os.Getenv("CLEANER_MONITORING_PROJECT"); project != "" {
+		client, err := googleClient(jsonKey, cloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, &gcrcleaner.CloudMonitoringPusher{Project: project, Client: client})
+	}
+	return pushers, nil
+}
+
+// runMetrics returns the metrics of a finished run, or nil if it was skipped.
+func runMetrics(base, runID string, res *runResult, dry bool, started time.Time, runErr error) *gcrcleaner.RunMetrics {
+	if res.Skipped {
+		return nil
+	}
+	m := &gcrcleaner.RunMetrics{
+		Base:        base,
+		Dry:         dry,
+		Started:     started,
+		Finished:    time.Now(),
+		Success:     runErr == nil,
+		Candidates:  res.Candidates,
+		Deleted:     res.Deleted,
+		TagsDeleted: res.TagsDeleted,
+	}
+	if getenv("CLEANER_METRICS_RUN_ID", "false") == "true" {
+		m.RunID = runID
+	}
+	for _, size := range res.Freed {
+		m.Freed += size
+	}
+	for _, g := range res.Errors {
+		m.Errors += g.Count
+	}
+	if runErr != nil && m.Errors == 0 {
+		m.Errors = 1
+	}
+	return m
+}
+
+// pushMetrics pushes the metrics of a run with every pusher.
+func pushMetrics(pushers []gcrcleaner.MetricsPusher, m *gcrcleaner.RunMetrics) {
+	if m == nil {
+		return
+	}
+	for _, p := range pushers {
+		if err := p.Push(context.Background(), m); err != nil {
+			log.Printf("failed to push metrics: %s", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// digestTopRepos is the number of repos a digest lists by space freed.
+const digestTopRepos = 10
+
+// notifications sends a message after every run, or in digest mode a single
+// message summarizing the real runs of every interval.
+type notifications struct {
+	notifier gcrcleaner.Notifier
+	store    gcrcleaner.StateStore
+	base     string
+	digest   bool
+	interval time.Duration
+
+	// state is used instead of the store when none is configured, so the
+	// digest only survives within a server process.
+	state gcrcleaner.State
+}
+
+// newNotifications configures notifications from the environment. It
+// returns nil if no notifier is configured.
+func newNotifications(jsonKey []byte, baseRepo string) (*notifications, error) {
+	url := os.Getenv("CLEANER_NOTIFY_WEBHOOK_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	interval, err := gcrcleaner.ParseDuration(getenv("CLEANER_NOTIFY_DIGEST_INTERVAL", "7d"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CLEANER_NOTIFY_DIGEST_INTERVAL: %w", err)
+	}
+	store, err := newStateStore(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &notifications{
+		notifier: &gcrcleaner.WebhookNotifier{URL: url},
+		store:    store,
+		base:     baseRepo,
+		digest:   getenv("CLEANER_NOTIFY_DIGEST", "false") == "true",
+		interval: interval,
+	}, nil
+}
+
+// afterRun notifies about the run, or adds it to the digest and sends the
+// digest once the interval is up.
+func (n *notifications) afterRun(res *runResult, dry bool, runErr error) {
+	if n == nil || res.Skipped {
+		return
+	}
+	ctx := context.Background()
+
+	if !n.digest {
+		if err := n.notifier.Notify(ctx, runText(n.base, res, dry, runErr)); err != nil {
+			log.Printf("failed to send notification: %s", err)
+		}
+		return
+	}
+
+	// Dry runs free nothing, so they would only dilute the digest.
+	if dry {
+		return
+	}
+
+	state := &n.state
+	if n.store != nil {
+		var err error
+		if state, err = n.store.Load(ctx); err != nil {
+			log.Printf("failed to load state: %s", err)
+			return
+		}
+	}
+
+	now := time.Now()
+	if state.Digest == nil {
+		state.Digest = &gcrcleaner.Digest{Since: now}
+	}
+	var causes []string
+	for _, g := range res.Errors {
+		causes = append(causes, g.Cause)
+	}
+	if runErr != nil && len(causes) == 0 {
+		causes = append(causes, runErr.Error())
+	}
+	state.Digest.Add(res.Deleted, res.Freed, causes)
+
+	if now.Sub(state.Digest.Since) >= n.interval {
+		if err := n.notifier.Notify(ctx, state.Digest.Text(n.base, digestTopRepos)); err != nil {
+			// Keep aggregating and try again after the next run.
+			log.Printf("failed to send notification digest: %s", err)
+		} else {
+			state.Digest = &gcrcleaner.Digest{Since: now}
+		}
+	}
+
+	if n.store != nil {
+		if err := n.store.Save(ctx, state); err != nil {
+			log.Printf("failed to save state: %s", err)
+		}
+	}
+}
+
+// runText renders the outcome of a single run as a message.
+func runText(base string, res *runResult, dry bool, runErr error) string {
+	var freed int64
+	for _, size := range res.Freed {
+		freed += size
+	}
+	text := fmt.Sprintf("gcr-cleaner deleted %d of %d candidates in %s, freeing %s",
+		res.Deleted, res.Candidates, base, gcrcleaner.FormatSize(freed))
+	if dry {
+		text = fmt.Sprintf("gcr-cleaner dry run found %d candidates in %s", res.Candidates, base)
+	}
+	if runErr != nil {
+		text += fmt.Sprintf("\nThe run failed: %s", runErr)
+	}
+	return text
+}
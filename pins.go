@@ -0,0 +1,148 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// runPins runs the pin, unpin and pins subcommands, which manage exceptions
+// in CLEANER_EXCEPTION_FILE:
+//
+//	gcrcleaner pin gcr.io/project/app:v1.2.3 -reason "rollback target" -until 90d
+//	gcrcleaner unpin gcr.io/project/app:v1.2.3
+//	gcrcleaner pins list
+func runPins(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the image is pinned")
+	until := fs.String("until", "", "when the pin expires, as a duration like 90d or a date like 2025-03-01")
+	refs, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+
+	jsonKey, err := readJSONKey()
+	if err != nil {
+		return fmt.Errorf("failed to read credentials: %w", err)
+	}
+	store, err := newExceptionStore(jsonKey)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if cmd == "pins" {
+		if len(refs) != 1 || refs[0] != "list" {
+			return fmt.Errorf("usage: gcrcleaner pins list")
+		}
+		ex, err := store.Load(ctx)
+		if err != nil {
+			return err
+		}
+		return printPins(ex)
+	}
+
+	if len(refs) != 1 {
+		return fmt.Errorf("usage: gcrcleaner %s REPO[:TAG]", cmd)
+	}
+	name, err := relativeRef(refs[0])
+	if err != nil {
+		return err
+	}
+
+	if cmd == "unpin" {
+		return store.Update(ctx, func(ex *gcrcleaner.Exceptions) error {
+			if !ex.Unpin(name) {
+				return fmt.Errorf("%s is not pinned", refs[0])
+			}
+			return nil
+		})
+	}
+
+	var expires time.Time
+	if *until != "" {
+		if expires, err = time.Parse("2006-01-02", *until); err != nil {
+			d, err := gcrcleaner.ParseDuration(*until)
+			if err != nil {
+				return fmt.Errorf("invalid -until %q", *until)
+			}
+			expires = time.Now().Add(d).UTC().Truncate(time.Second)
+		}
+	}
+	return store.Update(ctx, func(ex *gcrcleaner.Exceptions) error {
+		ex.Pin(name, *reason, expires)
+		return nil
+	})
+}
+
+// relativeRef returns the repo or repo:tag relative to GCR_BASE_REPO, as the
+// exceptions file stores them.
+func relativeRef(ref string) (string, error) {
+	base := strings.TrimSuffix(os.Getenv("GCR_BASE_REPO"), "/")
+	if base == "" {
+		return "", fmt.Errorf("GCR_BASE_REPO must be set")
+	}
+	if !strings.HasPrefix(ref, base+"/") {
+		return "", fmt.Errorf("%s is not in the base repo %s", ref, base)
+	}
+	return strings.TrimPrefix(ref, base+"/"), nil
+}
+
+// printPins writes the exceptions as a table.
+func printPins(ex *gcrcleaner.Exceptions) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tEXPIRES\tREASON")
+	now := time.Now()
+	for _, kind := range []struct {
+		name string
+		list []gcrcleaner.Exception
+	}{{"repo", ex.Repo}, {"tag", ex.Tag}, {"globalTag", ex.GlobalTag}} {
+		for _, e := range kind.list {
+			expires := "never"
+			if !e.Expires.IsZero() {
+				expires = e.Expires.Format(time.RFC3339)
+				if e.Expired(now) {
+					expires += " (expired)"
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", kind.name, e.Name, expires, e.Reason)
+		}
+	}
+	return w.Flush()
+}
+
+// parseInterspersed parses flags that may come before, between or after the
+// positional arguments, and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var adaptiveConcurrency = getenv("CLEANER_ADAPTIVE_CONCURRENCY", "true") == "true"
+
+// throttleCooldown is how long a decrease of the limit covers, so a burst of
+// throttled requests that were in flight together only halves it once.
+const throttleCooldown = time.Second
+
+// adaptiveLimit caps the delete requests in flight. The cap starts at the
+// configured concurrency, is halved whenever the registry throttles a request
+// and grows by one again after as many requests in a row succeed, up to the
+// configured concurrency (additive increase, multiplicative decrease).
+type adaptiveLimit struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	max       int
+	limit     int
+	inFlight  int
+	successes int
+	decreased time.Time
+}
+
+func newAdaptiveLimit(max int) *adaptiveLimit {
+	l := &adaptiveLimit{max: max, limit: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until a request may be sent.
+func (l *adaptiveLimit) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+// release ends a request started with acquire.
+func (l *adaptiveLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.cond.Signal()
+}
+
+// record adjusts the limit to the outcome of a single request attempt.
+func (l *adaptiveLimit) record(err error) {
+	if !adaptiveConcurrency {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch code := statusCode(err); {
+	case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+		l.successes = 0
+		if l.limit == 1 || time.Since(l.decreased) < throttleCooldown {
+			return
+		}
+		l.limit /= 2
+		l.decreased = time.Now()
+		log.Printf("registry is throttling deletions, reducing concurrency to %d", l.limit)
+	case err == nil && l.limit < l.max:
+		l.successes++
+		if l.successes >= l.limit {
+			l.successes = 0
+			l.limit++
+			l.cond.Broadcast()
+		}
+	}
+}
+
+// deleteWithRetries calls fn like withRetries, adjusting the delete limit to
+// the outcome of every attempt.
+func (c *Cleaner) deleteWithRetries(fn func() error) error {
+	return withRetries(func() error {
+		err := fn()
+		c.deleteLimit.record(err)
+		return err
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AdmissionReview is the subset of a Kubernetes admission.k8s.io/v1
+// AdmissionReview that the admission webhook uses.
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+// AdmissionRequest is the object an admission review is about, like a pod or
+// a deployment.
+type AdmissionRequest struct {
+	UID    string          `json:"uid"`
+	Object json.RawMessage `json:"object"`
+}
+
+// AdmissionResponse allows or denies the object of an admission review.
+type AdmissionResponse struct {
+	UID      string           `json:"uid"`
+	Allowed  bool             `json:"allowed"`
+	Warnings []string         `json:"warnings,omitempty"`
+	Status   *AdmissionStatus `json:"status,omitempty"`
+}
+
+// AdmissionStatus is why an object was denied.
+type AdmissionStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// DeletedImages indexes the manifests a keep set deleted, or is about to
+// delete, by repo@digest and repo:tag.
+type DeletedImages struct {
+	digests map[string]*KeepSetEntry
+
+	// tags are the tags of deleted manifests that no kept manifest has.
+	// Tags move, e.g. latest is pushed again after the run, so they only
+	// ever get a warning.
+	tags map[string]*KeepSetEntry
+}
+
+// NewDeletedImages indexes the deleted manifests of the keep set.
+func NewDeletedImages(k *KeepSet) *DeletedImages {
+	kept := make(map[string]bool)
+	for _, e := range k.Kept {
+		for _, t := range e.Tags {
+			kept[e.Repo+":"+t] = true
+		}
+	}
+
+	d := &DeletedImages{
+		digests: make(map[string]*KeepSetEntry),
+		tags:    make(map[string]*KeepSetEntry),
+	}
+	for _, e := range k.Deleted {
+		d.digests[e.Repo+"@"+e.Digest] = e
+		for _, t := range e.Tags {
+			if !kept[e.Repo+":"+t] {
+				d.tags[e.Repo+":"+t] = e
+			}
+		}
+	}
+	return d
+}
+
+// Lookup returns the deleted manifest an image refers to, or nil if it isn't
+// one, and whether it refers to it by digest rather than by a tag, which
+// might have moved since. Images without a tag or digest refer to latest.
+func (d *DeletedImages) Lookup(image string) (*KeepSetEntry, bool) {
+	tag, digest := splitImage(image)
+	if digest != "" {
+		// The digest is what gets pulled, whatever the tag.
+		e := d.digests[digest]
+		return e, e != nil
+	}
+	return d.tags[tag], false
+}
+
+// Review answers the admission review of an object, denying it if any of its
+// images refers to a deleted manifest by digest or, with warnOnly, allowing
+// it with a warning. Images that only refer to a deleted manifest's tag are
+// allowed with a warning, as the tag may have been pushed again.
+func (d *DeletedImages) Review(req *AdmissionRequest, warnOnly bool) *AdmissionResponse {
+	resp := &AdmissionResponse{UID: req.UID, Allowed: true}
+	var object interface{}
+	if err := json.Unmarshal(req.Object, &object); err != nil {
+		return resp
+	}
+
+	var problems, warnings []string
+	seen := make(map[string]bool)
+	for _, image := range appendImageFields(nil, object) {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		e, byDigest := d.Lookup(image)
+		switch {
+		case e == nil:
+		case byDigest:
+			problems = append(problems, fmt.Sprintf("image %s is deleted by gcr-cleaner (%s)", image, e.Reason))
+		default:
+			warnings = append(warnings, fmt.Sprintf("image %s may be deleted by gcr-cleaner, unless the tag was pushed again (%s)", image, e.Reason))
+		}
+	}
+	if len(problems) == 0 || warnOnly {
+		resp.Warnings = append(problems, warnings...)
+		return resp
+	}
+	resp.Warnings = warnings
+	resp.Allowed = false
+	resp.Status = &AdmissionStatus{Code: http.StatusForbidden, Message: strings.Join(problems, "; ")}
+	return resp
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ageBuckets are the upper bounds of the age histogram of Advice.
+var ageBuckets = []struct {
+	label string
+	max   time.Duration
+}{
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+	{"90d", 90 * 24 * time.Hour},
+	{"1y", 365 * 24 * time.Hour},
+}
+
+// AgeBucket counts the tagged manifests up to an age, and older than the
+// bucket before it. The last bucket, "older", has no bound.
+type AgeBucket struct {
+	Age   string `json:"age"`
+	Count int    `json:"count"`
+}
+
+// Advice is the retention recommended for a repo from the ages of its tagged
+// manifests.
+type Advice struct {
+	Repo string `json:"repo"`
+
+	// Tagged is how many manifests have tags.
+	Tagged int `json:"tagged"`
+
+	// Histogram counts the tagged manifests by age.
+	Histogram []AgeBucket `json:"histogram"`
+
+	// PushesPerWeek is how many tagged manifests were built per week over
+	// the last 90 days.
+	PushesPerWeek float64 `json:"pushesPerWeek"`
+
+	// Keep is the repo's current keep, and RetainsDays the age in days of
+	// the oldest manifest its keep window retains.
+	Keep        int `json:"keep"`
+	RetainsDays int `json:"retainsDays"`
+
+	// AdvisedKeep is the recommended keep, and AdvisedRetainsDays the age in
+	// days of the oldest manifest it retains.
+	AdvisedKeep        int `json:"advisedKeep"`
+	AdvisedRetainsDays int `json:"advisedRetainsDays"`
+
+	// AdvisedMinAge is the recommended minAge, the retention window.
+	AdvisedMinAge string `json:"advisedMinAge"`
+}
+
+// Summary describes the advice, like "keep=12 would retain 30 days of
+// builds here".
+func (a *Advice) Summary() string {
+	return fmt.Sprintf("keep=%d would retain %s of builds here (%.1f pushes/week), keep=%d retains %s",
+		a.AdvisedKeep, days(a.AdvisedRetainsDays), a.PushesPerWeek, a.Keep, days(a.RetainsDays))
+}
+
+// days formats a number of days.
+func days(n int) string {
+	if n == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", n)
+}
+
+// Advise recommends a keep for the repo of the plan that retains the builds
+// of the window, and at least minKeep tagged manifests, so repos that are
+// rarely pushed to can still be rolled back. The window is recommended as the
+// minAge, which keeps it however much is pushed later.
+func Advise(plan *RepoPlan, window time.Duration, minKeep int, now time.Time) *Advice {
+	a := &Advice{Repo: plan.Repo, Keep: plan.Policy.Keep, AdvisedMinAge: formatDays(window)}
+
+	var tagged []*Decision
+	for _, d := range plan.Decisions {
+		if len(d.Tags) > 0 {
+			tagged = append(tagged, d)
+		}
+	}
+	sort.SliceStable(tagged, func(i, j int) bool { return tagged[i].Built.After(tagged[j].Built) })
+	a.Tagged = len(tagged)
+
+	a.Histogram = make([]AgeBucket, len(ageBuckets)+1)
+	for i, b := range ageBuckets {
+		a.Histogram[i].Age = b.label
+	}
+	a.Histogram[len(ageBuckets)].Age = "older"
+	recent, inWindow := 0, 0
+	for _, d := range tagged {
+		age := now.Sub(d.Built)
+		i := sort.Search(len(ageBuckets), func(i int) bool { return age <= ageBuckets[i].max })
+		a.Histogram[i].Count++
+		if age <= 90*24*time.Hour {
+			recent++
+		}
+		if age <= window {
+			inWindow++
+		}
+	}
+	a.PushesPerWeek = float64(recent) / (90.0 / 7)
+
+	for _, d := range plan.Decisions {
+		if age := daysSince(now, d.Built); !d.Delete && d.Reason == ReasonKeepWindow && age > a.RetainsDays {
+			a.RetainsDays = age
+		}
+	}
+
+	a.AdvisedKeep = inWindow
+	if a.AdvisedKeep < minKeep {
+		a.AdvisedKeep = minKeep
+	}
+	if n := a.AdvisedKeep; n > 0 && len(tagged) > 0 {
+		if n > len(tagged) {
+			n = len(tagged)
+		}
+		a.AdvisedRetainsDays = daysSince(now, tagged[n-1].Built)
+	}
+	return a
+}
+
+// daysSince returns the whole days from t to now.
+func daysSince(now, t time.Time) int {
+	return int(now.Sub(t).Hours() / 24)
+}
+
+// formatDays formats a duration as a policy duration in days, like 30d.
+func formatDays(d time.Duration) string {
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// AdvisedPolicyFile returns the policy file with the advised keep and minAge
+// of every repo, by child repo name relative to the base repo, set on its
+// repo policy. The other fields of the existing file and of its repo
+// policies are left alone.
+func AdvisedPolicyFile(existing []byte, advice map[string]*Advice) ([]byte, error) {
+	file := make(map[string]interface{})
+	if len(existing) > 0 {
+		if err := json.Unmarshal(existing, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse policy file: %w", err)
+		}
+	}
+	repos, _ := file["repos"].(map[string]interface{})
+	if repos == nil {
+		repos = make(map[string]interface{})
+	}
+	for name, a := range advice {
+		policy, _ := repos[name].(map[string]interface{})
+		if policy == nil {
+			policy = make(map[string]interface{})
+		}
+		policy["keep"] = a.AdvisedKeep
+		policy["minAge"] = a.AdvisedMinAge
+		repos[name] = policy
+	}
+	file["repos"] = repos
+	return json.MarshalIndent(file, "", "  ")
+}
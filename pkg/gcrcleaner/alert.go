@@ -0,0 +1,165 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Alerter opens and resolves incidents. The key identifies the incident so
+// repeated triggers are deduplicated and a later resolve closes it.
+type Alerter interface {
+	Trigger(ctx context.Context, key, summary, details string) error
+	Resolve(ctx context.Context, key string) error
+}
+
+// PagerDutyAlerter sends incidents to the PagerDuty Events API v2.
+type PagerDutyAlerter struct {
+	RoutingKey string
+	Source     string
+	Client     *http.Client
+}
+
+// pagerDutyEvent is a PagerDuty Events API v2 event.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+// Trigger implements Alerter.
+func (p *PagerDutyAlerter) Trigger(ctx context.Context, key, summary, details string) error {
+	return p.send(ctx, &pagerDutyEvent{
+		RoutingKey:  p.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    key,
+		Payload: &pagerDutyPayload{
+			Summary:       summary,
+			Source:        p.Source,
+			Severity:      "error",
+			CustomDetails: map[string]string{"details": details},
+		},
+	})
+}
+
+// Resolve implements Alerter.
+func (p *PagerDutyAlerter) Resolve(ctx context.Context, key string) error {
+	return p.send(ctx, &pagerDutyEvent{
+		RoutingKey:  p.RoutingKey,
+		EventAction: "resolve",
+		DedupKey:    key,
+	})
+}
+
+func (p *PagerDutyAlerter) send(ctx context.Context, ev *pagerDutyEvent) error {
+	return postJSON(ctx, p.Client, "https://events.pagerduty.com/v2/enqueue", nil, ev)
+}
+
+// OpsgenieAlerter sends alerts to the Opsgenie Alert API.
+type OpsgenieAlerter struct {
+	APIKey string
+	Source string
+	Client *http.Client
+
+	// BaseURL is the API endpoint, https://api.opsgenie.com by default. EU
+	// accounts use https://api.eu.opsgenie.com.
+	BaseURL string
+}
+
+// opsgenieAlert is an Opsgenie create alert request.
+type opsgenieAlert struct {
+	Message     string `json:"message"`
+	Alias       string `json:"alias"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Priority    string `json:"priority"`
+}
+
+// Trigger implements Alerter.
+func (o *OpsgenieAlerter) Trigger(ctx context.Context, key, summary, details string) error {
+	if len(summary) > 130 {
+		// Opsgenie rejects messages over 130 characters.
+		summary = summary[:127] + "..."
+	}
+	return postJSON(ctx, o.Client, o.baseURL()+"/v2/alerts", o.headers(), &opsgenieAlert{
+		Message:     summary,
+		Alias:       key,
+		Description: details,
+		Source:      o.Source,
+		Priority:    "P2",
+	})
+}
+
+// Resolve implements Alerter.
+func (o *OpsgenieAlerter) Resolve(ctx context.Context, key string) error {
+	u := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", o.baseURL(), url.PathEscape(key))
+	return postJSON(ctx, o.Client, u, o.headers(), map[string]string{"source": o.Source})
+}
+
+func (o *OpsgenieAlerter) baseURL() string {
+	if o.BaseURL != "" {
+		return o.BaseURL
+	}
+	return "https://api.opsgenie.com"
+}
+
+func (o *OpsgenieAlerter) headers() map[string]string {
+	return map[string]string{"Authorization": "GenieKey " + o.APIKey}
+}
+
+// postJSON posts v as JSON and fails on any non-2xx response.
+func postJSON(ctx context.Context, client *http.Client, u string, headers map[string]string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s: unexpected status %d: %s", u, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// repoAnnotations is whether repo owners can set the policy of their repos
+// with repository labels and policy artifacts, see annotatedPolicy.
+var repoAnnotations = getenv("CLEANER_REPO_ANNOTATIONS", "false") == "true"
+
+// policyTag is the tag of the policy artifact in a repo.
+var policyTag = getenv("CLEANER_POLICY_TAG", "gcr-cleaner-policy")
+
+// labelPrefix prefixes the repository labels that set policy fields.
+const labelPrefix = "gcr-cleaner-"
+
+// RepoLabeler is implemented by backends whose repos can have labels, like
+// Artifact Registry repositories.
+type RepoLabeler interface {
+	// RepoLabels returns the labels of the repo, or of the repository it is
+	// in.
+	RepoLabels(repo string) (map[string]string, error)
+}
+
+// RepoLabels implements RepoLabeler by reading the labels of the Artifact
+// Registry repository. Container Registry repos have none.
+func (g *gcrBackend) RepoLabels(repo string) (map[string]string, error) {
+	path, ok := arRepository(repo)
+	if !ok || g.arClient == nil {
+		return nil, nil
+	}
+	var repository struct {
+		Labels map[string]string `json:"labels"`
+	}
+	if err := g.arGet(fmt.Sprintf("%s/%s", artifactRegistryAPI, path), &repository); err != nil {
+		return nil, err
+	}
+	return repository.Labels, nil
+}
+
+// annotatedPolicy returns the policy of a repo without a policy of its own in
+// the policy file, set by its owners on top of the default: first by the
+// gcr-cleaner-* labels of its repository, then by the JSON policy in the
+// artifact tagged policyTag in the repo itself. It returns false if the repo
+// has no annotations. Labels are fetched once per repository and cached in
+// labels.
+func (c *Cleaner) annotatedPolicy(name string, policy Policy, labels map[string]map[string]string) (Policy, bool, error) {
+	annotated := false
+	if labeler, ok := c.backend.(RepoLabeler); ok {
+		key := name
+		if path, ok := arRepository(name); ok {
+			key = path
+		}
+		l, ok := labels[key]
+		if !ok {
+			var err error
+			if l, err = labeler.RepoLabels(name); err != nil {
+				return policy, false, fmt.Errorf("failed to read repository labels: %w", err)
+			}
+			labels[key] = l
+		}
+		applied, err := applyPolicyLabels(&policy, l)
+		if err != nil {
+			return policy, false, err
+		}
+		annotated = applied
+	}
+
+	if getter, ok := c.backend.(ManifestGetter); ok {
+		doc, err := policyArtifact(getter, name)
+		if err != nil {
+			return policy, false, fmt.Errorf("failed to read policy artifact %s:%s: %w", name, policyTag, err)
+		}
+		if doc != nil {
+			policy = policy.clone()
+			if err := json.Unmarshal(doc, &policy); err != nil {
+				return policy, false, fmt.Errorf("failed to parse policy artifact %s:%s: %w", name, policyTag, err)
+			}
+			annotated = true
+		}
+	}
+
+	if !annotated {
+		return policy, false, nil
+	}
+	if err := policy.compile(); err != nil {
+		return policy, false, fmt.Errorf("invalid repo policy: %w", err)
+	}
+	if err := checkPolicyKeep("repo policy", policy, c.allowFullPrune); err != nil {
+		return policy, false, err
+	}
+	log.Printf("%s: using the policy set by its annotations", name)
+	return policy, true, nil
+}
+
+// applyPolicyLabels sets the policy fields of the gcr-cleaner-* labels, and
+// returns true if there were any.
+func applyPolicyLabels(p *Policy, labels map[string]string) (bool, error) {
+	applied := false
+	for k, v := range labels {
+		var err error
+		switch k {
+		case labelPrefix + "keep":
+			p.Keep, err = strconv.Atoi(v)
+		case labelPrefix + "min-age":
+			p.MinAge = v
+		case labelPrefix + "order-by":
+			p.OrderBy = v
+		case labelPrefix + "untag-only":
+			p.UntagOnly, err = strconv.ParseBool(v)
+		case labelPrefix + "dry-run":
+			p.DryRun, err = strconv.ParseBool(v)
+		default:
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("invalid label %s=%s: %w", k, v, err)
+		}
+		applied = true
+	}
+	return applied, nil
+}
+
+// policyArtifact returns the JSON policy document in the first layer of the
+// artifact tagged policyTag in the repo, like a .gcr-cleaner.json pushed with
+// ORAS, or nil if there is none.
+func policyArtifact(getter ManifestGetter, name string) ([]byte, error) {
+	b, err := getter.GetManifest(name, policyTag)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Layers) == 0 {
+		return nil, fmt.Errorf("artifact has no layers")
+	}
+	return getter.GetBlob(name, m.Layers[0].Digest)
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestApplyPolicyLabels(t *testing.T) {
+	cases := []struct {
+		name    string
+		labels  map[string]string
+		want    Policy
+		applied bool
+		wantErr bool
+	}{
+		{
+			name:   "no labels",
+			labels: nil,
+			want:   Policy{Keep: 5},
+		},
+		{
+			name:   "unrelated labels are ignored",
+			labels: map[string]string{"team": "payments", "gcr-cleaner-unknown": "1"},
+			want:   Policy{Keep: 5},
+		},
+		{
+			name: "every field",
+			labels: map[string]string{
+				"gcr-cleaner-keep":       "20",
+				"gcr-cleaner-min-age":    "14d",
+				"gcr-cleaner-order-by":   "semver",
+				"gcr-cleaner-untag-only": "true",
+				"gcr-cleaner-dry-run":    "1",
+			},
+			want:    Policy{Keep: 20, MinAge: "14d", OrderBy: "semver", UntagOnly: true, DryRun: true},
+			applied: true,
+		},
+		{
+			name:    "keep 0",
+			labels:  map[string]string{"gcr-cleaner-keep": "0"},
+			want:    Policy{Keep: 0},
+			applied: true,
+		},
+		{
+			name:    "invalid keep",
+			labels:  map[string]string{"gcr-cleaner-keep": "twenty"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid untag-only",
+			labels:  map[string]string{"gcr-cleaner-untag-only": "yes"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid dry-run",
+			labels:  map[string]string{"gcr-cleaner-dry-run": ""},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := Policy{Keep: 5}
+			applied, err := applyPolicyLabels(&p, tc.labels)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("applyPolicyLabels() = %v, want an error", applied)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied != tc.applied {
+				t.Errorf("applied = %v, want %v", applied, tc.applied)
+			}
+			if p.Keep != tc.want.Keep || p.MinAge != tc.want.MinAge || p.OrderBy != tc.want.OrderBy ||
+				p.UntagOnly != tc.want.UntagOnly || p.DryRun != tc.want.DryRun {
+				t.Errorf("policy = %+v, want %+v", p, tc.want)
+			}
+		})
+	}
+}
+
+// fakeGetter is a ManifestGetter serving fixed manifests and blobs, and a
+// not found error for everything else.
+type fakeGetter struct {
+	manifests map[string]string
+	blobs     map[string]string
+}
+
+func (g *fakeGetter) GetManifest(repo, ref string) ([]byte, error) {
+	if m, ok := g.manifests[ref]; ok {
+		return []byte(m), nil
+	}
+	return nil, &statusError{method: http.MethodGet, path: repo + ":" + ref, code: http.StatusNotFound}
+}
+
+func (g *fakeGetter) GetBlob(repo, digest string) ([]byte, error) {
+	if b, ok := g.blobs[digest]; ok {
+		return []byte(b), nil
+	}
+	return nil, &statusError{method: http.MethodGet, path: repo + "@" + digest, code: http.StatusNotFound}
+}
+
+func TestPolicyArtifact(t *testing.T) {
+	artifact := func(layers string) map[string]string {
+		return map[string]string{policyTag: fmt.Sprintf(`{"schemaVersion": 2, "layers": [%s]}`, layers)}
+	}
+	cases := []struct {
+		name    string
+		getter  *fakeGetter
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "not found",
+			getter: &fakeGetter{},
+		},
+		{
+			name: "first layer",
+			getter: &fakeGetter{
+				manifests: artifact(`{"digest": "sha256:a"}, {"digest": "sha256:b"}`),
+				blobs:     map[string]string{"sha256:a": `{"keep": 20}`, "sha256:b": `{"keep": 1}`},
+			},
+			want: `{"keep": 20}`,
+		},
+		{
+			name:    "no layers",
+			getter:  &fakeGetter{manifests: artifact("")},
+			wantErr: true,
+		},
+		{
+			name:    "invalid manifest",
+			getter:  &fakeGetter{manifests: map[string]string{policyTag: "not json"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing layer",
+			getter:  &fakeGetter{manifests: artifact(`{"digest": "sha256:a"}`)},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := policyArtifact(tc.getter, "gcr.io/p/app")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("policyArtifact() = %q, want an error", doc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(doc) != tc.want {
+				t.Errorf("policyArtifact() = %q, want %q", doc, tc.want)
+			}
+		})
+	}
+}
+
+func TestAnnotatedPolicyDocument(t *testing.T) {
+	cases := []struct {
+		name     string
+		doc      string
+		wantKeep int
+		wantErr  bool
+	}{
+		{name: "valid", doc: `{"keep": 20, "minAge": "14d"}`, wantKeep: 20},
+		{name: "not json", doc: "keep: 20", wantErr: true},
+		{name: "wrong type", doc: `{"keep": "20"}`, wantErr: true},
+		{name: "invalid policy", doc: `{"orderBy": "random"}`, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			getter := &fakeGetter{
+				manifests: map[string]string{policyTag: `{"layers": [{"digest": "sha256:a"}]}`},
+				blobs:     map[string]string{"sha256:a": tc.doc},
+			}
+			c := &Cleaner{backend: struct {
+				Backend
+				ManifestGetter
+			}{nil, getter}}
+			policy, annotated, err := c.annotatedPolicy("gcr.io/p/app", Policy{Keep: 5}, make(map[string]map[string]string))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("annotatedPolicy() = %+v, want an error", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !annotated || policy.Keep != tc.wantKeep {
+				t.Errorf("annotatedPolicy() = %+v, %v, want keep %d", policy, annotated, tc.wantKeep)
+			}
+		})
+	}
+}
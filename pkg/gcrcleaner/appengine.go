@@ -0,0 +1,102 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const appEngineAPI = "https://appengine.googleapis.com/v1"
+
+// AppEngineProvider is an InUseProvider for the images of App Engine flexible
+// environment versions, which are built into gcr.io/<project>/appengine.
+// Stopped versions are included, so they can still be rolled back to.
+type AppEngineProvider struct {
+	client   *http.Client
+	projects []string
+}
+
+// NewAppEngineProvider creates a provider for the App Engine apps of the
+// projects. The HTTP client must be authorized for the App Engine Admin API.
+func NewAppEngineProvider(client *http.Client, projects []string) *AppEngineProvider {
+	return &AppEngineProvider{client: client, projects: projects}
+}
+
+// Name implements InUseProvider.
+func (p *AppEngineProvider) Name() string { return "App Engine" }
+
+// InUse implements InUseProvider.
+func (p *AppEngineProvider) InUse(ctx context.Context) ([]string, error) {
+	var images []string
+	for _, project := range p.projects {
+		var services []string
+		u := fmt.Sprintf("%s/apps/%s/services", appEngineAPI, url.PathEscape(project))
+		err := googleList(ctx, p.client, u, func(body []byte) (string, error) {
+			var page struct {
+				Services []struct {
+					ID string `json:"id"`
+				} `json:"services"`
+				NextPageToken string `json:"nextPageToken"`
+			}
+			if err := json.Unmarshal(body, &page); err != nil {
+				return "", err
+			}
+			for _, s := range page.Services {
+				services = append(services, s.ID)
+			}
+			return page.NextPageToken, nil
+		})
+		if IsNotFound(err) {
+			// The project has no App Engine app.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, service := range services {
+			u := fmt.Sprintf("%s/apps/%s/services/%s/versions?view=FULL", appEngineAPI, url.PathEscape(project), url.PathEscape(service))
+			err := googleList(ctx, p.client, u, func(body []byte) (string, error) {
+				var page struct {
+					Versions []struct {
+						Deployment struct {
+							Container struct {
+								Image string `json:"image"`
+							} `json:"container"`
+						} `json:"deployment"`
+					} `json:"versions"`
+					NextPageToken string `json:"nextPageToken"`
+				}
+				if err := json.Unmarshal(body, &page); err != nil {
+					return "", err
+				}
+				for _, v := range page.Versions {
+					if image := v.Deployment.Container.Image; image != "" {
+						images = append(images, image)
+					}
+				}
+				return page.NextPageToken, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// arListing lists Artifact Registry repos through the Artifact Registry API
+// rather than the registry's catalog, when there is an Artifact Registry
+// client.
+var arListing = getenv("CLEANER_AR_API_LISTING", "true") == "true"
+
+// arPageSize is the page size of Artifact Registry API listings.
+const arPageSize = 1000
+
+// arPackage is a package returned by the Artifact Registry API.
+type arPackage struct {
+	Name string `json:"name"`
+}
+
+// arVersion is a package version returned by the Artifact Registry API with
+// the full view.
+type arVersion struct {
+	Name        string    `json:"name"`
+	CreateTime  time.Time `json:"createTime"`
+	UpdateTime  time.Time `json:"updateTime"`
+	RelatedTags []struct {
+		Name string `json:"name"`
+	} `json:"relatedTags"`
+	Metadata struct {
+		ImageSizeBytes string    `json:"imageSizeBytes"`
+		MediaType      string    `json:"mediaType"`
+		BuildTime      time.Time `json:"buildTime"`
+	} `json:"metadata"`
+}
+
+// arPackagePath splits an Artifact Registry repo into the API path of its
+// repository and its package, which is empty for the repository itself.
+func arPackagePath(repo string) (string, string, bool) {
+	if !arListing {
+		return "", "", false
+	}
+	repository, ok := arRepository(repo)
+	if !ok {
+		return "", "", false
+	}
+	parts := strings.SplitN(repo, "/", 4)
+	if len(parts) < 4 {
+		return repository, "", true
+	}
+	return repository, parts[3], true
+}
+
+// arGet fetches an Artifact Registry API URL into out.
+func (g *gcrBackend) arGet(u string, out interface{}) error {
+	resp, err := g.arClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{method: http.MethodGet, path: u, code: resp.StatusCode, body: bytes.TrimSpace(body)}
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", u, err)
+	}
+	return nil
+}
+
+// arChildren lists the packages of the Artifact Registry repository under
+// the base repo, relative to it. Unlike the catalog, this includes nested
+// packages, like team/app, and isn't limited in how many it returns.
+func (g *gcrBackend) arChildren(repository, prefix string) ([]string, error) {
+	var children []string
+	for token := ""; ; {
+		var page struct {
+			Packages      []arPackage `json:"packages"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		u := fmt.Sprintf("%s/%s/packages?pageSize=%d&pageToken=%s", artifactRegistryAPI, repository, arPageSize, url.QueryEscape(token))
+		if err := g.arGet(u, &page); err != nil {
+			return nil, err
+		}
+		for _, p := range page.Packages {
+			name, err := url.PathUnescape(p.Name[strings.LastIndex(p.Name, "/")+1:])
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case prefix == "":
+				children = append(children, name)
+			case strings.HasPrefix(name, prefix+"/"):
+				children = append(children, strings.TrimPrefix(name, prefix+"/"))
+			}
+		}
+		if token = page.NextPageToken; token == "" {
+			sort.Strings(children)
+			return children, nil
+		}
+	}
+}
+
+// arList lists the versions of an Artifact Registry package with their
+// tags, sizes and build times. A manifest's upload time is when it was last
+// updated, e.g. tagged, like on GitHub.
+func (g *gcrBackend) arList(repo, repository, pkg string) (*gcrgoogle.Tags, error) {
+	tags := &gcrgoogle.Tags{
+		Name:      repo,
+		Manifests: make(map[string]gcrgoogle.ManifestInfo),
+	}
+	for token := ""; ; {
+		var page struct {
+			Versions      []arVersion `json:"versions"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		u := fmt.Sprintf("%s/%s/packages/%s/versions?view=FULL&pageSize=%d&pageToken=%s", artifactRegistryAPI,
+			repository, url.PathEscape(pkg), arPageSize, url.QueryEscape(token))
+		if err := g.arGet(u, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Versions {
+			digest, err := url.PathUnescape(v.Name[strings.LastIndex(v.Name, "/")+1:])
+			if err != nil {
+				return nil, err
+			}
+			m := gcrgoogle.ManifestInfo{
+				MediaType: v.Metadata.MediaType,
+				Created:   v.CreateTime,
+				Uploaded:  v.UpdateTime,
+			}
+			if !v.Metadata.BuildTime.IsZero() {
+				m.Created = v.Metadata.BuildTime
+			}
+			if v.Metadata.ImageSizeBytes != "" {
+				if m.Size, err = strconv.ParseUint(v.Metadata.ImageSizeBytes, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid size of %s: %w", v.Name, err)
+				}
+			}
+			for _, t := range v.RelatedTags {
+				tag, err := url.PathUnescape(t.Name[strings.LastIndex(t.Name, "/")+1:])
+				if err != nil {
+					return nil, err
+				}
+				m.Tags = append(m.Tags, tag)
+			}
+			tags.Manifests[digest] = m
+			tags.Tags = append(tags.Tags, m.Tags...)
+		}
+		if token = page.NextPageToken; token == "" {
+			break
+		}
+	}
+
+	// Match the alphabetical tag order of the registry API.
+	sort.Strings(tags.Tags)
+	return tags, nil
+}
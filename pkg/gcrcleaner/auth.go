@@ -0,0 +1,118 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	"golang.org/x/oauth2"
+)
+
+// tokenAuthenticator authenticates to Container Registry and Artifact
+// Registry with OAuth2 access tokens from a token source.
+type tokenAuthenticator struct {
+	ts oauth2.TokenSource
+}
+
+// NewTokenAuthenticator returns an authenticator that asks the token source
+// for an access token on every registry call. The token source is wrapped so
+// the token is reused until it is about to expire and then refreshed, so runs
+// that take longer than the token's lifetime don't start failing with 401s.
+func NewTokenAuthenticator(ts oauth2.TokenSource) gcrauthn.Authenticator {
+	return &tokenAuthenticator{ts: oauth2.ReuseTokenSource(nil, ts)}
+}
+
+// Authorization implements gcrauthn.Authenticator.
+func (t *tokenAuthenticator) Authorization() (*gcrauthn.AuthConfig, error) {
+	token, err := t.ts.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh access token: %w", err)
+	}
+	return &gcrauthn.AuthConfig{
+		Username: "oauth2accesstoken",
+		Password: token.AccessToken,
+	}, nil
+}
+
+// RegistryCredential is how to authenticate to a registry host: with a
+// username and password, with a bearer token, or with the credentials of the
+// host in the docker config.json at DOCKER_CONFIG.
+type RegistryCredential struct {
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	Token        string `json:"token,omitempty"`
+	DockerConfig bool   `json:"dockerConfig,omitempty"`
+}
+
+// ParseRegistryCredentials parses a JSON object of registry hosts, like
+// harbor.example.com, to their credentials. Every host must have exactly one
+// way to authenticate.
+func ParseRegistryCredentials(b []byte) (map[string]*RegistryCredential, error) {
+	var creds map[string]*RegistryCredential
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse registry credentials: %w", err)
+	}
+	for host, c := range creds {
+		if c == nil || strings.Contains(host, "/") {
+			return nil, fmt.Errorf("invalid registry credentials for %q", host)
+		}
+		methods := 0
+		if c.Username != "" || c.Password != "" {
+			methods++
+		}
+		if c.Token != "" {
+			methods++
+		}
+		if c.DockerConfig {
+			methods++
+		}
+		if methods != 1 {
+			return nil, fmt.Errorf("registry %s needs exactly one of username and password, token or dockerConfig", host)
+		}
+	}
+	return creds, nil
+}
+
+// registryKeychain authenticates to the hosts with credentials with them,
+// and to every other host with the fallback authenticator.
+type registryKeychain struct {
+	creds    map[string]*RegistryCredential
+	fallback gcrauthn.Authenticator
+}
+
+// NewRegistryKeychain returns a keychain for the credentials by host, which
+// falls back to the authenticator, like the one for Google registries, for
+// hosts without credentials.
+func NewRegistryKeychain(creds map[string]*RegistryCredential, fallback gcrauthn.Authenticator) gcrauthn.Keychain {
+	return &registryKeychain{creds: creds, fallback: fallback}
+}
+
+// Resolve implements gcrauthn.Keychain.
+func (k *registryKeychain) Resolve(target gcrauthn.Resource) (gcrauthn.Authenticator, error) {
+	c, ok := k.creds[target.RegistryStr()]
+	switch {
+	case !ok:
+		return k.fallback, nil
+	case c.DockerConfig:
+		return gcrauthn.DefaultKeychain.Resolve(target)
+	case c.Token != "":
+		return &gcrauthn.Bearer{Token: c.Token}, nil
+	default:
+		return &gcrauthn.Basic{Username: c.Username, Password: c.Password}, nil
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Backend is a container registry the cleaner lists and deletes from. Repos
+// are always fully-qualified, e.g. gcr.io/project/app.
+type Backend interface {
+	// Children lists the child repos of the base repo, relative to it.
+	Children(base string) ([]string, error)
+
+	// List lists the tags and manifests of a repo.
+	List(repo string) (*gcrgoogle.Tags, error)
+
+	// DeleteTag removes a tag from a repo.
+	DeleteTag(repo, tag string) error
+
+	// DeleteManifest deletes a manifest from a repo by digest.
+	DeleteManifest(repo, digest string) error
+}
+
+// ManifestGetter is implemented by backends that can fetch raw manifests and
+// blobs, for features that inspect images, like base image protection.
+type ManifestGetter interface {
+	// GetManifest fetches the manifest of a digest or tag in a repo.
+	GetManifest(repo, ref string) ([]byte, error)
+
+	// GetBlob fetches a blob, e.g. a layer, of a repo by digest.
+	GetBlob(repo, digest string) ([]byte, error)
+}
+
+// statusError is an unexpected HTTP status from a registry API.
+type statusError struct {
+	method, path string
+	code         int
+	body         []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected status %d: %s", e.method, e.path, e.code, e.body)
+}
+
+// statusCode returns the HTTP status code of a registry error, or 0 if the
+// error didn't come from a registry response.
+func statusCode(err error) int {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode
+	}
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.code
+	}
+	if errors.Is(err, errGitLabNotFound) || errors.Is(err, errQuayNotFound) || errors.Is(err, errGHCRNotFound) {
+		return http.StatusNotFound
+	}
+	return 0
+}
+
+// WithBackend makes the cleaner use the given registry backend instead of
+// the Google Container Registry API.
+func WithBackend(b Backend) Option {
+	return func(c *Cleaner) error {
+		c.backend = b
+		return nil
+	}
+}
+
+// gcrBackend is the Backend for Google Container Registry and Artifact
+// Registry.
+type gcrBackend struct {
+	auther    gcrauthn.Authenticator
+	keychain  gcrauthn.Keychain
+	arClient  *http.Client
+	transport http.RoundTripper
+
+	// immutable caches whether Artifact Registry repositories have
+	// immutable tags, by API path.
+	immutable sync.Map
+}
+
+// Children implements Backend. In Artifact Registry, the children are the
+// packages of the repository, see arChildren.
+func (g *gcrBackend) Children(base string) ([]string, error) {
+	if repository, pkg, ok := arPackagePath(base); ok && g.arClient != nil {
+		return g.arChildren(repository, pkg)
+	}
+	tags, err := g.List(base)
+	if err != nil {
+		return nil, err
+	}
+	return tags.Children, nil
+}
+
+// List implements Backend. Artifact Registry packages are listed through the
+// Artifact Registry API, see arList.
+func (g *gcrBackend) List(repo string) (*gcrgoogle.Tags, error) {
+	if repository, pkg, ok := arPackagePath(repo); ok && pkg != "" && g.arClient != nil {
+		return g.arList(repo, repository, pkg)
+	}
+	gcrrepo, err := gcrname.NewRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	opts := []gcrgoogle.ListerOption{gcrgoogle.WithAuth(g.auther)}
+	if g.keychain != nil {
+		opts[0] = gcrgoogle.WithAuthFromKeychain(g.keychain)
+	}
+	if g.transport != nil {
+		opts = append(opts, gcrgoogle.WithTransport(g.transport))
+	}
+	return gcrgoogle.List(gcrrepo, opts...)
+}
+
+// DeleteTag implements Backend.
+func (g *gcrBackend) DeleteTag(repo, tag string) error {
+	return g.deleteOne(repo + ":" + tag)
+}
+
+// DeleteManifest implements Backend.
+func (g *gcrBackend) DeleteManifest(repo, digest string) error {
+	return g.deleteOne(repo + "@" + digest)
+}
+
+// GetManifest implements ManifestGetter.
+func (g *gcrBackend) GetManifest(repo, ref string) ([]byte, error) {
+	sep := ":"
+	if strings.Contains(ref, ":") {
+		sep = "@"
+	}
+	name, err := gcrname.ParseReference(repo + sep + ref)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse reference %s%s%s: %w", repo, sep, ref, err)
+	}
+
+	desc, err := gcrremote.Get(name, g.remoteOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get %s: %w", name, err)
+	}
+	return desc.Manifest, nil
+}
+
+// GetBlob implements ManifestGetter.
+func (g *gcrBackend) GetBlob(repo, digest string) ([]byte, error) {
+	name, err := gcrname.NewDigest(repo + "@" + digest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse reference %s@%s: %w", repo, digest, err)
+	}
+	layer, err := gcrremote.Layer(name, g.remoteOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get blob %s: %w", name, err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get blob %s: %w", name, err)
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// Copy implements Replicator.
+func (g *gcrBackend) Copy(srcRepo, digest, dstRepo string, tags []string) error {
+	src, err := gcrname.NewDigest(srcRepo + "@" + digest)
+	if err != nil {
+		return fmt.Errorf("Failed to parse reference %s@%s: %w", srcRepo, digest, err)
+	}
+	img, err := gcrremote.Image(src, g.remoteOptions()...)
+	if err != nil {
+		return fmt.Errorf("Failed to get %s: %w", src, err)
+	}
+
+	var dsts []gcrname.Reference
+	for _, t := range tags {
+		dst, err := gcrname.NewTag(dstRepo + ":" + t)
+		if err != nil {
+			return fmt.Errorf("Failed to parse reference %s:%s: %w", dstRepo, t, err)
+		}
+		dsts = append(dsts, dst)
+	}
+	if len(dsts) == 0 {
+		dst, err := gcrname.NewDigest(dstRepo + "@" + digest)
+		if err != nil {
+			return fmt.Errorf("Failed to parse reference %s@%s: %w", dstRepo, digest, err)
+		}
+		dsts = append(dsts, dst)
+	}
+	for _, dst := range dsts {
+		if err := gcrremote.Write(dst, img, g.remoteOptions()...); err != nil {
+			return fmt.Errorf("Failed to write %s: %w", dst, err)
+		}
+	}
+	return nil
+}
+
+// remoteOptions returns the options for go-containerregistry calls.
+func (g *gcrBackend) remoteOptions() []gcrremote.Option {
+	opts := []gcrremote.Option{gcrremote.WithAuth(g.auther)}
+	if g.keychain != nil {
+		opts[0] = gcrremote.WithAuthFromKeychain(g.keychain)
+	}
+	if g.transport != nil {
+		opts = append(opts, gcrremote.WithTransport(g.transport))
+	}
+	return opts
+}
+
+// deleteOne deletes a single repo ref using the supplied auth.
+func (g *gcrBackend) deleteOne(ref string) error {
+	name, err := gcrname.ParseReference(ref)
+	if err != nil {
+		return fmt.Errorf("Failed to parse reference %s: %w", ref, err)
+	}
+
+	if err := gcrremote.Delete(name, g.remoteOptions()...); err != nil {
+		return fmt.Errorf("Failed to delete %s: %w", name, err)
+	}
+
+	return nil
+}
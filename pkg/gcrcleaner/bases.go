@@ -0,0 +1,130 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gammazero/workerpool"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+var protectBases = getenv("CLEANER_PROTECT_BASE_IMAGES", "false") == "true"
+
+// OCI annotations that name the base image an image was built from.
+const (
+	annotationBaseDigest = "org.opencontainers.image.base.digest"
+	annotationBaseName   = "org.opencontainers.image.base.name"
+)
+
+// ReasonBaseImage is the reason a manifest is kept because a kept image was
+// built from it.
+const ReasonBaseImage = "base of a kept image"
+
+// baseRef is the base image a manifest's annotations name. Repo is empty if
+// only the digest is annotated.
+type baseRef struct {
+	repo, digest string
+}
+
+// protectBaseImages keeps every candidate of the plans that a kept manifest
+// names as its base image, in any child repo of the base repo, and in turn
+// the bases of those. Others are the plans of the remaining child repos. The
+// manifests are fetched to read their annotations, so this needs a backend
+// that implements ManifestGetter. Manifests that fail to fetch are returned
+// as failures, and their bases can't be protected.
+func (c *Cleaner) protectBaseImages(plans, others []*RepoPlan) []*RefError {
+	getter, ok := c.backend.(ManifestGetter)
+	if !ok {
+		return nil
+	}
+
+	byDigest := make(map[string][]*Decision)
+	for _, plan := range plans {
+		for _, d := range plan.Decisions {
+			if d.Delete {
+				byDigest[d.Digest] = append(byDigest[d.Digest], d)
+			}
+		}
+	}
+
+	var kept []*Decision
+	for _, plan := range append(plans[:len(plans):len(plans)], others...) {
+		for _, d := range plan.Decisions {
+			if !d.Delete {
+				kept = append(kept, d)
+			}
+		}
+	}
+
+	var failures []*RefError
+	for len(kept) > 0 && len(byDigest) > 0 {
+		bases, failed := c.fetchBases(getter, kept)
+		failures = append(failures, failed...)
+
+		// Newly kept bases may name bases of their own.
+		kept = nil
+		for _, b := range bases {
+			for _, d := range byDigest[b.digest] {
+				if d.Delete && (b.repo == "" || b.repo == d.Repo) {
+					d.Delete, d.Reason = false, ReasonBaseImage
+					kept = append(kept, d)
+				}
+			}
+		}
+	}
+	return failures
+}
+
+// fetchBases fetches the manifests of the decisions in parallel and returns
+// the base images their annotations name.
+func (c *Cleaner) fetchBases(getter ManifestGetter, decisions []*Decision) ([]baseRef, []*RefError) {
+	var lock sync.Mutex
+	var bases []baseRef
+	var failures []*RefError
+
+	pool := workerpool.New(c.concurrency)
+	for _, d := range decisions {
+		d := d
+		pool.Submit(func() {
+			b, err := getter.GetManifest(d.Repo, d.Digest)
+			var m struct {
+				Annotations map[string]string `json:"annotations"`
+			}
+			if err == nil {
+				err = json.Unmarshal(b, &m)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				failures = append(failures, &RefError{Repo: d.Repo, Ref: d.Repo + "@" + d.Digest, Err: classify(err)})
+				return
+			}
+			digest := m.Annotations[annotationBaseDigest]
+			if digest == "" {
+				return
+			}
+			base := baseRef{digest: digest}
+			if ref, err := gcrname.ParseReference(m.Annotations[annotationBaseName]); err == nil {
+				base.repo = ref.Context().Name()
+			}
+			bases = append(bases, base)
+		})
+	}
+	pool.StopWait()
+	return bases, failures
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+var cacheRepos = getenv("CLEANER_CACHE_REPOS", "false") == "true"
+
+// Reasons a manifest in a cache repo is kept or deleted.
+const (
+	ReasonCacheFresh   = "cache: fresh"
+	ReasonCacheExpired = "cache: expired"
+)
+
+// defaultCacheMaxAge is how long cache manifests are kept if the policy
+// doesn't set cacheMaxAge.
+const defaultCacheMaxAge = 7 * 24 * time.Hour
+
+// isCacheRepo returns true if the child repo holds build cache, either
+// because its policy says so or, with CLEANER_CACHE_REPOS, because it is
+// named like a BuildKit or Kaniko cache repo (*/cache or *-cache).
+func isCacheRepo(name string, policy Policy) bool {
+	if policy.Cache {
+		return true
+	}
+	return cacheRepos && (strings.HasSuffix(name, "/cache") || strings.HasSuffix(name, "-cache"))
+}
+
+// isIndex returns true if the media type is a manifest list or image index,
+// which must be deleted before the manifests it references.
+func isIndex(mediaType string) bool {
+	switch types.MediaType(mediaType) {
+	case types.DockerManifestList, types.OCIImageIndex:
+		return true
+	}
+	return false
+}
+
+// planCacheRepo classifies every manifest in a cache repo by age alone: cache
+// keys are content hashes, so there is no meaningful keep window. Manifests
+// of any media type, tagged or not, are deleted once they are older than the
+// policy's cacheMaxAge, unless a tag is excepted or the repo is an exception
+// repo.
+func (c *Cleaner) planCacheRepo(name string, policy Policy, tags *gcrgoogle.Tags) *RepoPlan {
+	plan := &RepoPlan{Repo: name, Policy: policy}
+	now := time.Now()
+	for digest, m := range tags.Manifests {
+		d := &Decision{
+			Repo:      name,
+			Digest:    digest,
+			Tags:      m.Tags,
+			Size:      int64(m.Size),
+			MediaType: m.MediaType,
+			Created:   m.Created,
+			Uploaded:  m.Uploaded,
+			Built:     policy.buildTime(m.Tags, m.Uploaded),
+			Delete:    true,
+			Reason:    ReasonCacheExpired,
+		}
+		switch {
+		case now.Sub(d.Built) < policy.cacheMaxAge:
+			d.Delete, d.Reason = false, ReasonCacheFresh
+		case len(m.Tags) > 0 && c.repoExcept[name], c.isDigestExcepted(name, digest):
+			d.Delete, d.Reason = false, ReasonException
+		case len(m.Tags) == 0 && policy.UntagOnly:
+			d.Delete, d.Reason = false, ReasonUntagOnly
+		}
+		for _, t := range m.Tags {
+			if d.Delete && c.isExcepted(fmt.Sprintf("%s:%s", name, t), t) {
+				d.Delete, d.Reason = false, ReasonException
+			}
+		}
+		plan.Decisions = append(plan.Decisions, d)
+	}
+	return plan
+}
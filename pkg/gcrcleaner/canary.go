@@ -0,0 +1,160 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// canarySize is how many candidates a real run deletes before it verifies
+// the registry and deletes the rest, see canary. 0 disables the canary.
+var canarySize, _ = strconv.Atoi(getenv("CLEANER_CANARY", "0"))
+
+// canaryWait is how long the canary waits after its deletions before
+// verifying, for the registry to settle.
+var canaryWait, _ = time.ParseDuration(getenv("CLEANER_CANARY_WAIT", "0s"))
+
+// canaryTags is how many kept tags of every repo the canary pulls.
+const canaryTags = 3
+
+// canary holds back the deletions of a real run after the first size of
+// them, until the registry is verified to still be healthy, see
+// verifyCanary. If it isn't, the held back deletions are abandoned. Every
+// deletion calls admit before and, if admitted, done after deleting.
+type canary struct {
+	cleaner *Cleaner
+	size    int
+
+	lock     sync.Mutex
+	admitted int
+	finished int
+	plans    []*RepoPlan
+	verified chan struct{}
+	err      error
+}
+
+// newCanary returns the canary of a real run, or nil if it is disabled or
+// the run was already verified, as runs cleaning in batches execute several
+// times. Runs that failed verification get a canary that admits nothing.
+func (c *Cleaner) newCanary(plans []*RepoPlan) *canary {
+	if canarySize <= 0 || len(plans) == 0 {
+		return nil
+	}
+	k := &canary{cleaner: c, size: canarySize, verified: make(chan struct{})}
+	if err, ok := c.canaryRuns.Load(plans[0].RunID); ok {
+		if err == nil {
+			return nil
+		}
+		k.size, k.err = 0, err.(error)
+		close(k.verified)
+	}
+	return k
+}
+
+// admit returns nil once the deletion of a candidate of the plan may
+// proceed, right away for the first deletions and after the verification
+// for the rest, or the error of a failed verification.
+func (k *canary) admit(plan *RepoPlan) error {
+	if k == nil {
+		return nil
+	}
+	k.lock.Lock()
+	if k.admitted < k.size {
+		k.admitted++
+		if len(k.plans) == 0 || k.plans[len(k.plans)-1] != plan {
+			k.plans = append(k.plans, plan)
+		}
+		k.lock.Unlock()
+		return nil
+	}
+	k.lock.Unlock()
+
+	<-k.verified
+	return k.err
+}
+
+// done records an admitted deletion as finished, successful or not, and
+// verifies the registry once the last canary deletion is.
+func (k *canary) done() {
+	if k == nil {
+		return
+	}
+	k.lock.Lock()
+	k.finished++
+	last := k.finished == k.size
+	k.lock.Unlock()
+	if !last {
+		return
+	}
+
+	log.Printf("Canary: deleted %d manifests, verifying the registry before deleting the rest", k.size)
+	time.Sleep(canaryWait)
+	k.err = k.cleaner.verifyCanary(k.plans)
+	if k.err != nil {
+		log.Printf("Canary: %s, abandoning the remaining deletions", k.err)
+	} else {
+		log.Printf("Canary: registry verified, deleting the rest")
+	}
+	k.cleaner.canaryRuns.Store(k.plans[0].RunID, k.err)
+	close(k.verified)
+}
+
+// failed returns the error of a failed verification, or nil if it passed or
+// didn't finish, which only happens if there weren't enough candidates.
+func (k *canary) failed() error {
+	if k == nil {
+		return nil
+	}
+	select {
+	case <-k.verified:
+		return k.err
+	default:
+		return nil
+	}
+}
+
+// verifyCanary checks that the repos of the canary deletions still list and
+// that all of their kept manifests are still there, and pulls the first tag
+// of the newest few of them, if the backend implements ManifestHeader.
+func (c *Cleaner) verifyCanary(plans []*RepoPlan) error {
+	header, _ := c.backend.(ManifestHeader)
+	for _, plan := range plans {
+		tags, err := c.backend.List(plan.Repo)
+		if err != nil {
+			return fmt.Errorf("%w: failed to list %s: %s", ErrCanaryFailed, plan.Repo, err)
+		}
+		pulled := 0
+		for _, d := range plan.Decisions {
+			if d.Delete {
+				continue
+			}
+			if _, ok := tags.Manifests[d.Digest]; !ok {
+				return fmt.Errorf("%w: kept %s@%s is gone", ErrCanaryFailed, d.Repo, d.Digest)
+			}
+			if header == nil || len(d.Tags) == 0 || pulled == canaryTags {
+				continue
+			}
+			pulled++
+			if _, err := header.HeadManifest(d.Repo, d.Tags[0]); err != nil {
+				return fmt.Errorf("%w: kept %s:%s doesn't pull: %s", ErrCanaryFailed, d.Repo, d.Tags[0], err)
+			}
+		}
+	}
+	return nil
+}
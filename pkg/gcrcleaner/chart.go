@@ -0,0 +1,75 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+var helmCharts = getenv("CLEANER_HELM_CHARTS", "false") == "true"
+
+// helmChartConfig is the config media type of Helm charts stored as OCI
+// artifacts.
+const helmChartConfig = "application/vnd.cncf.helm.config.v1+json"
+
+// ReasonNotChartVersion is the reason a manifest in a chart repo is kept
+// because none of its tags are chart versions.
+const ReasonNotChartVersion = "not a chart version"
+
+// chartPolicy returns the chart policy the policy implies for Helm charts
+// with CLEANER_HELM_CHARTS, or false if there is none because the policy is a
+// chart policy already or has its own policy for charts.
+func (p *Policy) chartPolicy() (mediaTypePolicy, bool) {
+	if !helmCharts || p.Chart {
+		return mediaTypePolicy{}, false
+	}
+	for _, mp := range p.mediaTypePolicies {
+		if matchMediaType(mp.pattern, helmChartConfig) {
+			return mediaTypePolicy{}, false
+		}
+	}
+	chart := p.withoutMediaTypes()
+	chart.Chart = true
+	return mediaTypePolicy{pattern: helmChartConfig, policy: chart}, true
+}
+
+// planChartRepo classifies the manifests of a Helm chart repo, in which tags
+// are chart versions: the policy's keep window applies to the versions in
+// semver order, with Helm's _ in place of + for build metadata. Manifests
+// whose tags aren't versions are kept, as Helm never pushes them.
+func (c *Cleaner) planChartRepo(name string, policy Policy, tags *gcrgoogle.Tags) *RepoPlan {
+	versions := policy
+	versions.Chart = false
+	versions.OrderBy = OrderSemver
+
+	plan := c.planRepo(name, versions, tags)
+	plan.Policy = policy
+	for _, d := range plan.Decisions {
+		if d.Delete && d.Reason == ReasonBeyond && !hasVersion(d.Tags) {
+			d.Delete, d.Reason = false, ReasonNotChartVersion
+		}
+	}
+	return plan
+}
+
+// hasVersion returns true if any of the tags is a semantic version.
+func hasVersion(tags []string) bool {
+	for _, t := range tags {
+		if _, _, ok := parseSemver(t); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"time"
+)
+
+// Checkpoint is the progress of a run of every child repo, saved as the run
+// goes, so that a run that is interrupted, e.g. evicted or past its
+// deadline, is resumed by the next one instead of started over.
+type Checkpoint struct {
+	// RunID is the ID of the run, which resumed runs keep.
+	RunID string `json:"runId"`
+
+	// Label is what the run cleans, like the base repo or project, so a
+	// checkpoint isn't resumed by a run of something else.
+	Label string `json:"label"`
+
+	// Dry is true for dry runs, which real runs don't resume.
+	Dry bool `json:"dry"`
+
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	// Done are the child repos cleaned so far, by base repo, in the order
+	// they were cleaned.
+	Done map[string][]string `json:"done"`
+
+	// Deleted are the manifests deleted so far, as repo@digest.
+	Deleted []string `json:"deleted,omitempty"`
+
+	done map[string]bool
+}
+
+// NewCheckpoint returns the empty checkpoint of a new run.
+func NewCheckpoint(runID, label string, dry bool, now time.Time) *Checkpoint {
+	return &Checkpoint{RunID: runID, Label: label, Dry: dry, Started: now, Updated: now, Done: make(map[string][]string)}
+}
+
+// IsDone returns true if the child repo of the base repo was cleaned.
+func (c *Checkpoint) IsDone(base, repo string) bool {
+	if c.done == nil {
+		c.done = make(map[string]bool)
+		for b, repos := range c.Done {
+			for _, r := range repos {
+				c.done[b+"/"+r] = true
+			}
+		}
+	}
+	return c.done[base+"/"+repo]
+}
+
+// Record records child repos of the base repo as cleaned, with the manifests
+// deleted from them.
+func (c *Checkpoint) Record(base string, repos, deleted []string, now time.Time) {
+	if c.Done == nil {
+		c.Done = make(map[string][]string)
+	}
+	c.Done[base] = append(c.Done[base], repos...)
+	if c.done != nil {
+		for _, r := range repos {
+			c.done[base+"/"+r] = true
+		}
+	}
+	c.Deleted = append(c.Deleted, deleted...)
+	c.Updated = now
+}
+
+// Repos returns how many child repos were cleaned.
+func (c *Checkpoint) Repos() int {
+	n := 0
+	for _, repos := range c.Done {
+		n += len(repos)
+	}
+	return n
+}
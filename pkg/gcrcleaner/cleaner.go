@@ -15,260 +15,770 @@
 package gcrcleaner
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"os/exec"
+	"time"
 
 	"github.com/gammazero/workerpool"
 	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
-	gcrname "github.com/google/go-containerregistry/pkg/name"
-	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
-	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
 var keep, _ = strconv.Atoi(getenv("CLEANER_KEEP_AMOUNT", "5"))
-var	repo = getenv("GCR_BASE_REPO", "")
-var	exPath = getenv("CLEANER_EXCEPTION_FILE", "/config/exceptions.json")
+var repo = getenv("GCR_BASE_REPO", "")
+var exPath = getenv("CLEANER_EXCEPTION_FILE", "/config/exceptions.json")
+
+// manifestBatchSize caps how many deletions of a repo are queued at a time,
+// see executeRepo. 0 queues all of them at once.
+var manifestBatchSize, _ = strconv.Atoi(getenv("CLEANER_MANIFEST_BATCH_SIZE", "1000"))
 
 // Cleaner is a gcr cleaner.
 type Cleaner struct {
-	auther          gcrauthn.Authenticator
+	base            string
+	exceptions      *ExceptionStore
+	backend         Backend
 	concurrency     int
+	repoConcurrency int
+	deleteLimit     *adaptiveLimit
 	repoExcept      map[string]bool
-	tagExcept       map[string]bool
+	tagExcept       map[string]string
 	globalTagExcept map[string]bool
+	digestExcept    map[string]string
+	overrides       *digestOverrides
+	policies        *policyConfig
+
+	expiredExcept   []string
+	exceptLock      sync.RWMutex
+	exceptFetchedAt time.Time
+
+	shardIndex int
+	shardCount int
+
+	allowFullPrune bool
+	failFast       bool
+	verbose        bool
+	events         *eventStream
+	skipScan       bool
+	arClient       *http.Client
+	vulnClient     *http.Client
+	transport      http.RoundTripper
+	keychain       gcrauthn.Keychain
+	providers      []InUseProvider
+	secrets        *SecretManager
+	mirrors        []*Cleaner
+	dr             *Cleaner
+	drReplicate    bool
+	inUseStore     StateStore
+	inUseRuns      int
+	sample         *Sample
+	halts          []func() error
+
+	// artifactTypes caches the artifact types of fetched manifests by
+	// digest.
+	artifactTypes sync.Map
+
+	// contentKeys caches the content keys of fetched manifests by digest,
+	// see contentKey.
+	contentKeys sync.Map
+
+	// foreignSizes caches the sizes of fetched manifests by digest, see
+	// imageSizes.
+	foreignSizes sync.Map
+
+	// canaryRuns are the errors of the canary verifications of runs, nil if
+	// they passed, by run ID, see canary.
+	canaryRuns sync.Map
 }
 
-// NewCleaner creates a new GCR cleaner with the given token provider and
-// concurrency.
-func NewCleaner(auther gcrauthn.Authenticator, c int) (*Cleaner, error) {
-	repoExcept, tagExcept, globalTagExcept := fetchExceptions()
-	return &Cleaner{
-		auther:          auther,
+// NewCleaner creates a new GCR cleaner with the given token provider,
+// concurrency and options. The concurrency caps the delete requests in flight
+// across all repos. The token provider is unused if the options supply a
+// different backend.
+func NewCleaner(auther gcrauthn.Authenticator, c int, opts ...Option) (*Cleaner, error) {
+	if c < 1 {
+		c = 1
+	}
+	cleaner := &Cleaner{
+		base:            repo,
+		exceptions:      &ExceptionStore{path: exPath},
 		concurrency:     c,
-		repoExcept:      repoExcept,
-		tagExcept:       tagExcept,
-		globalTagExcept: globalTagExcept,
-	}, nil
+		repoConcurrency: 1,
+		deleteLimit:     newAdaptiveLimit(c),
+	}
+	for _, opt := range opts {
+		if err := opt(cleaner); err != nil {
+			return nil, err
+		}
+	}
+	if cleaner.backend == nil {
+		cleaner.backend = &gcrBackend{auther: auther, keychain: cleaner.keychain, arClient: cleaner.arClient}
+	}
+	if ts, ok := cleaner.backend.(transportSetter); ok && cleaner.transport != nil {
+		ts.setTransport(cleaner.transport)
+	}
+	if err := cleaner.RefreshExceptions(); err != nil {
+		return nil, err
+	}
+	return cleaner, nil
 }
 
-// Clean deletes old images from GCR that are untagged and older than "since".
+// RefreshExceptions re-reads the exceptions, policy and digest files and re-scans the
+// clusters and in-use providers for in-use images. Long-running modes call this before every clean
+// so the exceptions never go stale.
+func (c *Cleaner) RefreshExceptions() error {
+	repoExcept, tagExcept, globalTagExcept, expired, err := fetchExceptions(c.base, c.exceptions, !c.skipScan && clusterScan, c.secrets)
+	if err != nil {
+		return err
+	}
+	for _, e := range expired {
+		log.Printf("Ignoring expired exception: %s", e)
+	}
+	digestExcept := make(map[string]string)
+	if !c.skipScan {
+		if digestExcept, err = c.providerExceptions(tagExcept); err != nil {
+			return err
+		}
+		if c.inUseStore != nil {
+			if err := c.rememberInUse(tagExcept, digestExcept); err != nil {
+				return err
+			}
+		}
+	}
+	policies, err := loadPolicies()
+	if err != nil {
+		return err
+	}
+	if err := policies.checkKeep(c.allowFullPrune); err != nil {
+		return err
+	}
+	overrides, err := loadDigestOverrides()
+	if err != nil {
+		return err
+	}
+	if repoAnnotations {
+		// Policy artifacts are never deleted.
+		globalTagExcept[policyTag] = true
+	}
+
+	c.exceptLock.Lock()
+	c.repoExcept = repoExcept
+	c.tagExcept = tagExcept
+	c.globalTagExcept = globalTagExcept
+	c.digestExcept = digestExcept
+	c.overrides = overrides
+	c.policies = policies
+	c.expiredExcept = expired
+	c.exceptFetchedAt = time.Now()
+	c.exceptLock.Unlock()
+	return nil
+}
+
+// ExceptionsFetchedAt returns the time the exceptions were last successfully
+// refreshed.
+func (c *Cleaner) ExceptionsFetchedAt() time.Time {
+	c.exceptLock.RLock()
+	defer c.exceptLock.RUnlock()
+	return c.exceptFetchedAt
+}
+
+// ExpiredExceptions returns the exceptions that were ignored at the last
+// refresh because they expired.
+func (c *Cleaner) ExpiredExceptions() []string {
+	c.exceptLock.RLock()
+	defer c.exceptLock.RUnlock()
+	return c.expiredExcept
+}
+
+// BaseRepo returns the base repo whose children are cleaned.
+func (c *Cleaner) BaseRepo() string {
+	return c.base
+}
+
+// CheckAuth verifies the credentials can still list the base repo.
+func (c *Cleaner) CheckAuth() error {
+	if _, err := c.backend.Children(c.base); err != nil {
+		return fmt.Errorf("failed to list base repo %s: %w", c.base, classify(err))
+	}
+	return nil
+}
+
+// HaltWhen makes real runs call fn before every deletion and abandon their
+// remaining deletions once it returns an error, e.g. because the replica lost
+// its leadership or its run lock. Every repo that had deletions left fails
+// with ErrHalted. It must be called before cleaning.
+func (c *Cleaner) HaltWhen(fn func() error) {
+	c.halts = append(c.halts, fn)
+}
+
+// halted returns the error of the first failing halt check, or nil.
+func (c *Cleaner) halted() error {
+	for _, fn := range c.halts {
+		if err := fn(); err != nil {
+			return fmt.Errorf("%w: %s", ErrHalted, err)
+		}
+	}
+	return nil
+}
+
+// ProgressFunc is called once for every manifest an execution deletes (or
+// would delete, in a dry run), with the error from deleting it, if any.
+type ProgressFunc func(d *Decision, err error)
+
+// Clean deletes old images from every child repo of the base repo.
 func (c *Cleaner) Clean(dry bool) ([]string, error) {
-	var status []string
-	var errStrings []string
+	plans, planErr := c.Plan(nil)
+	if plans == nil && planErr != nil {
+		return nil, planErr
+	}
+	status, err := c.Execute(plans, dry, nil)
+	return status, mergeErrors(planErr, err)
+}
 
-	gcrbase, err := gcrname.NewRepository(repo)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get base repo %s: %w", repo, err)
+// CleanOptions configure a single CleanRepos call.
+type CleanOptions struct {
+	PlanOptions
+	ExecuteOptions
+}
+
+// ExecuteOptions configure a single ExecuteWith call.
+type ExecuteOptions struct {
+	// Dry only logs what would be deleted.
+	Dry bool
+
+	// Progress, if not nil, is called for every candidate.
+	Progress ProgressFunc
+
+	// Thresholds, if not nil, checks the plans against the deletion
+	// thresholds along with those of the earlier calls it checked, for
+	// cleans that execute their repos in batches. Otherwise the plans are
+	// checked on their own, see CheckThresholds.
+	Thresholds *Thresholds
+}
+
+// CleanRepos deletes old images from exactly the given child repos, which are
+// relative to the base repo, instead of walking every child of the base repo.
+// The options can override the keep of the repos' policies for this clean
+// only.
+func (c *Cleaner) CleanRepos(ctx context.Context, repos []string, opts CleanOptions) ([]string, error) {
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("no repos to clean")
+	}
+	plans, planErr := c.PlanWith(repos, opts.PlanOptions)
+	if plans == nil && planErr != nil {
+		return nil, planErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res, err := c.ExecuteWith(plans, opts.ExecuteOptions)
+	if res == nil {
+		return nil, mergeErrors(planErr, err)
 	}
+	return res.Merge().Status, mergeErrors(planErr, err)
+}
 
-	repos, err := gcrgoogle.List(gcrbase, gcrgoogle.WithAuth(c.auther))
-	if err != nil {
-		return nil, fmt.Errorf("failed to list child repos %s: %w", repo, err)
+// mergeErrors combines the errors of planning and executing a clean, merging
+// their failures if both are *MultiErrors.
+func mergeErrors(planErr, err error) error {
+	switch {
+	case planErr == nil:
+		return err
+	case err == nil:
+		return planErr
+	}
+
+	var planMulti, execMulti *MultiError
+	if errors.As(planErr, &planMulti) && errors.As(err, &execMulti) {
+		return &MultiError{Errors: append(planMulti.Errors, execMulti.Errors...)}
 	}
+	return joinErrors([]string{planErr.Error(), err.Error()})
+}
 
+// Execute deletes the candidates of the given plans, or only logs them in a
+// dry run, and returns a status line for every repo. If progress is not nil
+// it is called for every candidate. Failed deletions are returned as an
+// *MultiError. If the plans exceed the deletion thresholds, see
+// CheckThresholds, a real run only performs a dry run and returns the
+// threshold error.
+func (c *Cleaner) Execute(plans []*RepoPlan, dry bool, progress ProgressFunc) ([]string, error) {
+	res, err := c.ExecuteResults(plans, dry, progress)
+	if res == nil {
+		return nil, err
+	}
+	return res.Merge().Status, err
+}
+
+// ExecuteResults is like Execute, but returns the result of every repo. The
+// results are nil if nothing was executed.
+func (c *Cleaner) ExecuteResults(plans []*RepoPlan, dry bool, progress ProgressFunc) (*Results, error) {
+	return c.ExecuteWith(plans, ExecuteOptions{Dry: dry, Progress: progress})
+}
+
+// ExecuteWith is ExecuteResults with options.
+func (c *Cleaner) ExecuteWith(plans []*RepoPlan, opts ExecuteOptions) (*Results, error) {
+	dry, progress := opts.Dry, opts.Progress
+	if progress == nil {
+		progress = func(*Decision, error) {}
+	}
+	thresholds := opts.Thresholds
+	if thresholds == nil {
+		thresholds = &Thresholds{}
+	}
+
+	var thresholdErr error
+	if !dry {
+		if thresholdErr = thresholds.Check(plans); thresholdErr != nil {
+			if !errors.Is(thresholdErr, ErrThresholdExceeded) {
+				return nil, thresholdErr
+			}
+			log.Printf("Deleting nothing, %s", thresholdErr)
+			dry = true
+		}
+	}
+
+	if c.shardCount > 1 {
+		log.Printf("Cleaning shard %d/%d of child repos", c.shardIndex, c.shardCount)
+	}
 	if dry {
-		log.Printf("Performing dry run simulating clean for %s, with at least %d tags unflagged per repo\n", repo, keep)
+		log.Printf("Performing dry run simulating clean for %s\n", c.base)
 	} else {
-		log.Printf("Deleting refs for %s, keeping at least %d tags per repo\n", repo, keep)
+		// Fail before deleting anything rather than deep into the worker
+		// pool if the credentials can't delete.
+		if err := c.Preflight(plans); err != nil {
+			return nil, err
+		}
+		log.Printf("Deleting refs for %s\n", c.base)
+	}
+
+	// Repos are cleaned in parallel, each with its own worker pools, while
+	// the delete semaphore caps the requests in flight across all of them.
+	// Every repo records into its own result, which are only merged once
+	// all of them are done.
+	var k *canary
+	if !dry {
+		k = c.newCanary(plans)
+	}
+	res := newResults(plans)
+	repoPool := workerpool.New(c.repoConcurrency)
+	for i, plan := range plans {
+		plan, r := plan, res.Repos[i]
+		repoPool.Submit(func() {
+			// A repo that panics fails on its own, without taking the
+			// other repos down with it.
+			defer func() {
+				if p := recover(); p != nil {
+					r.fail(true, &RefError{Repo: plan.Repo, Ref: plan.Repo, Err: fmt.Errorf("panic: %v", p)})
+				}
+			}()
+			c.executeRepo(plan, dry, progress, k, r)
+		})
+	}
+	repoPool.StopWait()
+
+	failures := res.Merge().Failures
+	switch {
+	case k.failed() != nil && len(failures) > 0:
+		return res, fmt.Errorf("%w; %s", k.failed(), &MultiError{Errors: failures})
+	case k.failed() != nil:
+		return res, k.failed()
+	case thresholdErr != nil && len(failures) > 0:
+		return res, fmt.Errorf("%w; %s", thresholdErr, &MultiError{Errors: failures})
+	case thresholdErr != nil:
+		return res, thresholdErr
+	case len(failures) > 0:
+		return res, &MultiError{Errors: failures}
 	}
+	return res, nil
+}
 
-	for _, r := range(repos.Children) {
-		name := fmt.Sprintf("%s/%s", repo, r)
-		size := int64(0)
-		del := 0
+// executeRepo deletes the candidates of a single plan, or only logs them in a
+// dry run or if the repo's policy is dry run only, recording the outcome in
+// res. Deletions wait for the canary, if any, to admit them.
+func (c *Cleaner) executeRepo(plan *RepoPlan, dry bool, progress ProgressFunc, k *canary, res *RepoResult) {
+	name := plan.Repo
+	size := plan.KeptSize()
 
-		gcrrepo, err := gcrname.NewRepository(name)
-		if err != nil {
-			errStrings = append(errStrings, fmt.Sprintf("Failed to get child repo %s: %w", name, err.Error()))
-			continue
+	if plan.Policy.DryRun && !dry {
+		log.Printf("%s: policy is dry run only, only flagging manifests", name)
+		dry = true
+	}
+	res.Dry = dry
+
+	c.exceptLock.RLock()
+	if isCacheRepo(name, plan.Policy) {
+		log.Printf("%s: cache repo, keeping manifests younger than %s", name, plan.Policy.cacheMaxAge)
+	} else if c.repoExcept[name] {
+		if dry {
+			log.Printf("Only flagging untagged manifests for exception repo: %s", name)
+		} else {
+			log.Printf("Only deleting untagged manifests for exception repo: %s", name)
 		}
+	} else if dry {
+		log.Printf("%s: at least %d tags unflagged", name, plan.Policy.Keep)
+	} else {
+		log.Printf("%s: keeping at least %d tags", name, plan.Policy.Keep)
+	}
+	c.exceptLock.RUnlock()
 
-		tags, err := gcrgoogle.List(gcrrepo, gcrgoogle.WithAuth(c.auther))
-		if err != nil {
-			errStrings = append(errStrings, fmt.Sprintf("Failed to list tags for child repo %s: %w", name, err.Error()))
+	if c.dr != nil && len(plan.Candidates()) > 0 {
+		if drFailures := c.checkReplicated(plan, dry); len(drFailures) > 0 {
+			res.fail(false, drFailures...)
+			if dry {
+				res.Status = fmt.Sprintf("%s: would delete nothing, %d kept manifests aren't in the DR registry", name, len(drFailures))
+				return
+			}
+			log.Printf("%s: deleting nothing, %d kept manifests aren't in the DR registry", name, len(drFailures))
+			return
+		}
+	}
+
+	immutable := len(plan.Candidates()) > 0 && c.immutableTags(name)
+	if immutable && plan.Policy.UntagOnly {
+		err := fmt.Errorf("%w, so the untag only policy can't untag anything", ErrImmutableTags)
+		res.fail(false, &RefError{Repo: name, Ref: name, Err: err})
+		return
+	}
+	if immutable {
+		log.Printf("%s: tags are immutable, deleting by digest only", name)
+	}
+	if plan.Policy.UntagOnly && len(plan.Candidates()) > 0 && !canUntag(c.backend) {
+		err := fmt.Errorf("%w, so the untag only policy can't untag anything", ErrUntagUnsupported)
+		res.fail(false, &RefError{Repo: name, Ref: name, Err: err})
+		return
+	}
+
+	for _, d := range plan.Decisions {
+		if d.Delete {
 			continue
 		}
+		if c.verbose {
+			log.Printf("%s keeps %s: %s [%s], tags %v", name, d.Digest, d.Reason, d.Code, d.Tags)
+		}
+		c.events.emit(plan.RunID, d, EventKeep, dry, nil)
+	}
 
-		// Create a worker pool for parallel deletion
-		pool := workerpool.New(c.concurrency)
+	verb, done, action := "delete manifest", "deleted manifest", EventDelete
+	if plan.Policy.UntagOnly {
+		verb, done, action = "untag manifest", "untagged manifest", EventUntag
+	}
+
+	candidates := plan.Candidates()
+	if plan.Policy.VulnerableFirst {
+		sortVulnerableFirst(candidates)
+	}
 
-		var deletedLock sync.Mutex
-		var errs = make(map[string]error)
-		var errsLock sync.RWMutex
+	// Manifest lists and indexes go first, as registries refuse to
+	// delete manifests an index still references.
+	var indexes, manifests []*Decision
+	for _, d := range candidates {
+		if isIndex(d.MediaType) {
+			indexes = append(indexes, d)
+		} else {
+			manifests = append(manifests, d)
+		}
+	}
 
-		var keeping = c.tagExcept
-		control := max(len(tags.Tags)-keep, 0)
-		if c.repoExcept[name] {
+	// The deletions of a repo are queued manifestBatchSize at a time, so
+	// repos with many candidates don't hold a queued deletion for every one.
+	for _, batch := range append(pageDecisions(indexes, manifestBatchSize), pageDecisions(manifests, manifestBatchSize)...) {
+		// Create a worker pool for parallel deletion
+		pool := workerpool.New(c.concurrency)
+		for _, d := range batch {
 			if dry {
-				log.Printf("Only flagging untagged manifests for exception repo: %s", name)
-			} else {
-				log.Printf("Only deleting untagged manifests for exception repo: %s", name)
+				log.Printf("%s would %s %s: %s [%s], tags %v", name, verb, d.Digest, d.Reason, d.Code, d.Tags)
+				progress(d, nil)
+				c.events.emit(plan.RunID, d, action, true, nil)
+				res.deleted(d)
+				continue
 			}
-			control = 0
-		}
-		for t := len(tags.Tags)-1; t >= control; t-- {
-			tagName := fmt.Sprintf("%s:%s", name, tags.Tags[t])
-			if c.globalTagExcept[tags.Tags[t]] || c.tagExcept[tagName] {
-				//If it's a tag exception we want to keep it but not count it towards the total
-				control = max(control-1, 0)
+			if res.isAborted() {
+				break
 			}
-			keeping[tagName] = true
-		}
-
-		for k, m := range tags.Manifests {
-			if c.shouldDelete(name, m, keeping, &size) {
-				if dry {
-					del += 1
-					log.Printf("%s would delete manifest %s: %+v", name, k, m)
-					continue
+			d := d
+			pool.Submit(func() {
+				// In fail-fast mode, do not process once a previous invocation
+				// failed.
+				if res.isAborted() || k.admit(plan) != nil {
+					return
 				}
-				// Deletes all tags before deleting the image
-				for _, tag := range m.Tags {
-					tagged := name + ":" + tag
-					c.deleteOne(tagged)
+				defer k.done()
+				if err := c.halted(); err != nil {
+					res.halt(&RefError{Repo: name, Ref: name, Err: err})
+					return
 				}
-				ref := name + "@" + k
-				pool.Submit(func() {
-					// Do not process if previous invocations failed. This prevents a large
-					// build-up of failed requests and rate limit exceeding (e.g. bad auth).
-					errsLock.RLock()
-					if len(errs) > 0 {
-						errsLock.RUnlock()
-						return
-					}
-					errsLock.RUnlock()
-
-					if err := c.deleteOne(ref); err != nil {
-						cause := errors.Unwrap(err).Error()
-
-						errsLock.Lock()
-						if _, ok := errs[cause]; !ok {
-							errs[cause] = err
-							errsLock.Unlock()
-							return
-						}
-						errsLock.Unlock()
-					}
-
-					deletedLock.Lock()
-					del += 1
-					deletedLock.Unlock()
-				})
-			}
-		}
 
-		// Wait for everything to finish
-		if !dry {
-			pool.StopWait()
+				c.recordSBOM(d)
 
-			// Aggregate any errors
-			if len(errs) > 0 {
-				for _, v := range errs {
-					errStrings = append(errStrings, v.Error())
+				ref, err := c.deleteDecision(name, d, plan.Policy.UntagOnly, immutable, res)
+				if err != nil && immutable {
+					err = immutableError(d, err)
 				}
-			} else {
-				// Add status update for child repo
-				status = append(status, fmt.Sprintf("%s: %d manifests deleted, %d manifests kept, remaining size %s", name, del, len(tags.Manifests)-del, getSize(size)))
-			}
-		} else {
-			status = append(status, fmt.Sprintf("%s: %d manifests would be deleted, %d manifests would be kept, would be remaining size %s", name, del, len(tags.Manifests)-del, getSize(size)))
+				if err != nil {
+					progress(d, err)
+					c.events.emit(plan.RunID, d, action, false, err)
+
+					res.fail(c.failFast, &RefError{Repo: name, Ref: ref, Err: classify(err)})
+					return
+				}
+
+				progress(d, nil)
+				c.events.emit(plan.RunID, d, action, false, nil)
+				if c.verbose {
+					log.Printf("%s %s %s: %s [%s], tags %v", name, done, d.Digest, d.Reason, d.Code, d.Tags)
+				}
+				res.deleted(d)
+			})
 		}
+
+		// Wait for the batch to finish
+		pool.StopWait()
+	}
+	if k.failed() != nil {
+		// The run's error reports the failed verification.
+		return
+	}
+	if err := c.halted(); err != nil && !dry {
+		// Propagating to mirrors and deleting orphaned tags delete too.
+		res.halt(&RefError{Repo: name, Ref: name, Err: err})
+		return
 	}
 
-	if len(errStrings) > 0 {
-		if len(errStrings) == 1 {
-			return status, fmt.Errorf(errStrings[0])
+	mirrored := 0
+	if len(c.mirrors) > 0 && len(res.Deleted) > 0 {
+		var mirrorFailures []*RefError
+		mirrored, mirrorFailures = c.propagate(plan, res.Deleted, dry)
+		if len(mirrorFailures) > 0 {
+			res.fail(false, mirrorFailures...)
 		}
+	}
+
+	orphans := c.cleanOrphanedTags(plan, dry, res)
 
-		return status, fmt.Errorf("%d errors occurred: %s",
-			len(errStrings), strings.Join(errStrings, ", "))
+	del := len(res.Deleted)
+	var status string
+	if !dry {
+		// Add status update for child repo, failures are reported in the
+		// error
+		if len(res.Failures) > 0 {
+			return
+		}
+		if plan.Policy.UntagOnly {
+			status = fmt.Sprintf("%s: %d manifests untagged, %d manifests kept", name, del, len(plan.Decisions)-del)
+		} else {
+			status = fmt.Sprintf("%s: %d manifests deleted, %d manifests kept, remaining size %s", name, del, len(plan.Decisions)-del, FormatSize(size))
+		}
+	} else if plan.Policy.UntagOnly {
+		status = fmt.Sprintf("%s: %d manifests would be untagged, %d manifests would be kept", name, del, len(plan.Decisions)-del)
+	} else {
+		status = fmt.Sprintf("%s: %d manifests would be deleted, %d manifests would be kept, would be remaining size %s", name, del, len(plan.Decisions)-del, FormatSize(size))
 	}
-	return status, nil
+	if mirrored > 0 && dry {
+		status += fmt.Sprintf(", %d would also be deleted from mirrors", mirrored)
+	} else if mirrored > 0 {
+		status += fmt.Sprintf(", %d also deleted from mirrors", mirrored)
+	}
+	if orphans > 0 && dry {
+		status += fmt.Sprintf(", %d orphaned tags would be deleted", orphans)
+	} else if orphans > 0 {
+		status += fmt.Sprintf(", %d orphaned tags deleted", orphans)
+	}
+	if n := plan.WithSeverity(SeverityCritical); n > 0 {
+		status += fmt.Sprintf(", %d candidates had %s findings", n, SeverityCritical)
+	}
+	res.Status = status
 }
 
-// deleteOne deletes a single repo ref using the supplied auth.
-func (c *Cleaner) deleteOne(ref string) error {
-	name, err := gcrname.ParseReference(ref)
-	if err != nil {
-		return fmt.Errorf("Failed to parse reference %s: %w", ref, err)
+// pageDecisions splits the decisions into pages of at most size decisions,
+// or returns them as one page if size isn't positive.
+func pageDecisions(decisions []*Decision, size int) [][]*Decision {
+	if size <= 0 || len(decisions) <= size {
+		return [][]*Decision{decisions}
 	}
-
-	if err := gcrremote.Delete(name, gcrremote.WithAuth(c.auther)); err != nil {
-		return fmt.Errorf("Failed to delete %s: %w", name, err)
+	var pages [][]*Decision
+	for len(decisions) > size {
+		pages = append(pages, decisions[:size])
+		decisions = decisions[size:]
 	}
-
-	return nil
+	return append(pages, decisions)
 }
 
-// shouldDelete returns true if the manifest has no tags or isn't in use by images being kept
-func (c *Cleaner) shouldDelete(n string, m gcrgoogle.ManifestInfo, keeping map[string]bool, total *int64) bool {
-	if len(m.Tags) > 0 {
-		for _, t := range(m.Tags) {
-			name := fmt.Sprintf("%s:%s", n, t)
-			if keeping[name] {
-				// cannot delete manifest since it's used by images being kept
-				*total += int64(m.Size)
-				return false
+// deleteDecision deletes the tags of a candidate and then, unless the policy
+// only untags, its manifest, leaving manifests in repos with immutable tags
+// to be deleted by digest with their tags. Every tag and manifest is its own
+// request within the delete concurrency limit, with retries, and those that
+// are already gone, e.g. deleted by an earlier, interrupted run, count as
+// deleted. It returns the ref that was deleted last, or that failed.
+func (c *Cleaner) deleteDecision(name string, d *Decision, untagOnly, immutable bool, res *RepoResult) (string, error) {
+	if !immutable {
+		for _, tag := range d.Tags {
+			ref := name + ":" + tag
+			err := c.deleteRef(func() error { return c.backend.DeleteTag(name, tag) })
+			if errors.Is(err, ErrUntagUnsupported) && !untagOnly {
+				// Deleting the manifest removes its tags.
+				break
+			}
+			if err != nil {
+				return ref, err
 			}
+			res.untagged()
 		}
 	}
-	return true
+	ref := name + "@" + d.Digest
+	if untagOnly {
+		// Leave the manifest for the registry's own garbage collection.
+		return ref, nil
+	}
+	return ref, c.deleteRef(func() error { return c.backend.DeleteManifest(name, d.Digest) })
+}
+
+// canUntag returns false for backends that can't remove single tags, and so
+// can't apply untag only policies.
+func canUntag(b Backend) bool {
+	_, ghcr := b.(*GHCRBackend)
+	return !ghcr
+}
+
+// deleteRef performs a single delete request within the delete concurrency
+// limit, with retries. A ref that is already gone counts as deleted.
+func (c *Cleaner) deleteRef(fn func() error) error {
+	c.deleteLimit.acquire()
+	defer c.deleteLimit.release()
+	if err := c.deleteWithRetries(fn); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
 }
 
-// fetches in-use tags across all clusters in kube config
-func fetchExceptions() (map[string]bool, map[string]bool, map[string]bool) {
+// fetches in-use tags across all clusters in kube config, along with the
+// exceptions file. Expired exceptions are ignored and returned separately.
+func fetchExceptions(base string, store *ExceptionStore, scan bool, secrets *SecretManager) (map[string]bool, map[string]string, map[string]bool, []string, error) {
 	repoExceptions := make(map[string]bool)
-	tagExceptions := make(map[string]bool)
+	tagExceptions := make(map[string]string)
 	globalTagExceptions := make(map[string]bool)
 
-	out, err := exec.Command("/bin/bash", "-c", `for ctx in $(kubectl config get-contexts -o name)
-	do
-	  { kubectl --context $ctx get cj --all-namespaces -o jsonpath="{..image}" & kubectl --context $ctx get job --all-namespaces -o jsonpath="{..image}" & kubectl --context $ctx get po --all-namespaces -o jsonpath="{..image}"; }
-	done |  tr -s '[[:space:]]' ',' | sort |  uniq;`).Output()
-	if err != nil {
-		log.Fatalf(fmt.Sprintf("Failed to retrieve in-use images across clusters: %s", err.Error()))
-	} else {
-		tags := strings.SplitAfter(string(out), ",")
-		for _, tag := range tags {
-			tagExceptions[tag] = true
+	if scan {
+		inUse, err := inUseImages(secrets)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		for tag, context := range inUse {
+			tagExceptions[tag] = inUseCode(CodeInUseCluster, context)
 		}
 	}
 
-	exFile, _ := ioutil.ReadFile(exPath)
-	result := make(map[string][]string)
-	parseErr := json.Unmarshal([]byte(exFile), &result)
-	if parseErr != nil {
-		log.Fatalf(fmt.Sprintf("Failed to parse JSON exceptions file: %s", parseErr.Error()))
+	result, err := store.Load(context.Background())
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
-	for _, r := range(result["repo"]) {
-		name := fmt.Sprintf("%s/%s", repo, r)
+
+	var expired []string
+	now := time.Now()
+	for _, r := range active("repo", result.Repo, now, &expired) {
+		name := fmt.Sprintf("%s/%s", base, r)
 		repoExceptions[name] = true
 	}
-	for _, t := range(result["tag"]) {
-		name := fmt.Sprintf("%s/%s", repo, t)
-		tagExceptions[name] = true
+	for _, t := range active("tag", result.Tag, now, &expired) {
+		name := fmt.Sprintf("%s/%s", base, t)
+		tagExceptions[name] = CodeExceptionTag
 	}
-	for _, t := range(result["globalTag"]) {
+	for _, t := range active("globalTag", result.GlobalTag, now, &expired) {
 		globalTagExceptions[t] = true
 	}
 
-	return repoExceptions, tagExceptions, globalTagExceptions
+	return repoExceptions, tagExceptions, globalTagExceptions, expired, nil
+}
+
+// inUseScanTTL is how long a scan of the clusters for in-use images is reused,
+// so cleaners of many base repos created together share a single scan.
+const inUseScanTTL = time.Minute
+
+var inUseScan struct {
+	sync.Mutex
+	images map[string]string
+	at     time.Time
+}
+
+// inUseImages returns the images used by cron jobs, jobs and pods across all
+// clusters in the kube config, or the clusters scanned through their API
+// servers, with the context or name of the first cluster found using each.
+// Secret Manager references in the cluster configuration are resolved with
+// secrets. If any cluster fails to be scanned, the scan fails as a whole, as
+// the images only that cluster uses would otherwise be deleted.
+func inUseImages(secrets *SecretManager) (map[string]string, error) {
+	inUseScan.Lock()
+	defer inUseScan.Unlock()
+	if time.Since(inUseScan.at) < inUseScanTTL {
+		return inUseScan.images, nil
+	}
+
+	scan := contextImages
+	var names []string
+	if scansAPIClusters() {
+		clusters, err := apiClusters(secrets)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve in-use images across clusters: %w", err)
+		}
+		for name := range clusters {
+			names = append(names, name)
+		}
+		scan = func(name string) ([]string, error) {
+			return clusterImages(context.Background(), name, clusters[name])
+		}
+	} else {
+		out, err := exec.Command("kubectl", "config", "get-contexts", "-o", "name").Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve in-use images across clusters: %w", err)
+		}
+		names = strings.Fields(string(out))
+	}
+	sort.Strings(names)
+
+	images := make(map[string]string)
+	var failed []string
+	for _, name := range names {
+		inUse, err := scan(name)
+		if err != nil {
+			log.Printf("Failed to retrieve in-use images of cluster %s: %s", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		for _, image := range inUse {
+			if _, ok := images[image]; !ok {
+				images[image] = name
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("Failed to retrieve in-use images of clusters %s", strings.Join(failed, ", "))
+	}
+	inUseScan.images, inUseScan.at = images, time.Now()
+	return images, nil
+}
+
+// contextImages returns the images used by cron jobs, jobs and pods in the
+// scanned namespaces of the cluster of a kube config context.
+func contextImages(ctx string) ([]string, error) {
+	out, err := exec.Command("kubectl", "--context", ctx, "get", "cj,job,po", "--all-namespaces", "-o", "json").Output()
+	if err != nil {
+		return nil, err
+	}
+	return workloadImages(ctx, out)
 }
 
 // for repos with size less than or equal to keep amount
 func max(x, y int) int {
- if x > y {
-   return x
- }
- return y
+	if x > y {
+		return x
+	}
+	return y
 }
 
 // get environment variables with default
@@ -280,8 +790,8 @@ func getenv(key, fallback string) string {
 	return value
 }
 
-// get human readable size
-func getSize(b int64) string {
+// FormatSize returns a human readable size.
+func FormatSize(b int64) string {
 	const unit = 1000
 	if b < unit {
 		return fmt.Sprintf("%d B", b)
@@ -293,4 +803,4 @@ func getSize(b int64) string {
 	}
 	return fmt.Sprintf("%.1f %cB",
 		float64(b)/float64(div), "kMGTPE"[exp])
-}
\ No newline at end of file
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const cloudRunAPI = "https://run.googleapis.com/v2"
+
+// cloudRunContainer is a container of a Cloud Run template or revision.
+type cloudRunContainer struct {
+	Image string `json:"image"`
+}
+
+// CloudRunProvider is an InUseProvider for the images of Cloud Run services,
+// all of their revisions, so rollbacks keep working, and jobs.
+type CloudRunProvider struct {
+	client    *http.Client
+	projects  []string
+	locations []string
+}
+
+// NewCloudRunProvider creates a provider for the Cloud Run workloads in the
+// locations of the projects, or in every location if none are given. The
+// HTTP client must be authorized for the Cloud Run API.
+func NewCloudRunProvider(client *http.Client, projects, locations []string) *CloudRunProvider {
+	if len(locations) == 0 {
+		locations = []string{"-"}
+	}
+	return &CloudRunProvider{client: client, projects: projects, locations: locations}
+}
+
+// Name implements InUseProvider.
+func (p *CloudRunProvider) Name() string { return "Cloud Run" }
+
+// InUse implements InUseProvider.
+func (p *CloudRunProvider) InUse(ctx context.Context) ([]string, error) {
+	var images []string
+	for _, project := range p.projects {
+		for _, location := range p.locations {
+			parent := fmt.Sprintf("%s/projects/%s/locations/%s", cloudRunAPI, project, location)
+
+			var services []string
+			err := googleList(ctx, p.client, parent+"/services", func(body []byte) (string, error) {
+				var page struct {
+					Services []struct {
+						Name     string `json:"name"`
+						Template struct {
+							Containers []cloudRunContainer `json:"containers"`
+						} `json:"template"`
+					} `json:"services"`
+					NextPageToken string `json:"nextPageToken"`
+				}
+				if err := json.Unmarshal(body, &page); err != nil {
+					return "", err
+				}
+				for _, s := range page.Services {
+					services = append(services, s.Name)
+					images = appendImages(images, s.Template.Containers)
+				}
+				return page.NextPageToken, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			for _, service := range services {
+				revisions, err := cloudRunRevisionImages(ctx, p.client, service)
+				if err != nil {
+					return nil, err
+				}
+				images = append(images, revisions...)
+			}
+
+			err = googleList(ctx, p.client, parent+"/jobs", func(body []byte) (string, error) {
+				var page struct {
+					Jobs []struct {
+						Template struct {
+							Template struct {
+								Containers []cloudRunContainer `json:"containers"`
+							} `json:"template"`
+						} `json:"template"`
+					} `json:"jobs"`
+					NextPageToken string `json:"nextPageToken"`
+				}
+				if err := json.Unmarshal(body, &page); err != nil {
+					return "", err
+				}
+				for _, j := range page.Jobs {
+					images = appendImages(images, j.Template.Template.Containers)
+				}
+				return page.NextPageToken, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return images, nil
+}
+
+// cloudRunRevisionImages returns the images of every revision of the Cloud
+// Run service, a projects/*/locations/*/services/* name.
+func cloudRunRevisionImages(ctx context.Context, client *http.Client, service string) ([]string, error) {
+	var images []string
+	err := googleList(ctx, client, fmt.Sprintf("%s/%s/revisions", cloudRunAPI, service), func(body []byte) (string, error) {
+		var page struct {
+			Revisions []struct {
+				Containers []cloudRunContainer `json:"containers"`
+			} `json:"revisions"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return "", err
+		}
+		for _, r := range page.Revisions {
+			images = appendImages(images, r.Containers)
+		}
+		return page.NextPageToken, nil
+	})
+	return images, err
+}
+
+// appendImages appends the images of the containers.
+func appendImages(images []string, containers []cloudRunContainer) []string {
+	for _, c := range containers {
+		images = append(images, c.Image)
+	}
+	return images
+}
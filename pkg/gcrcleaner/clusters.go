@@ -0,0 +1,183 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// In-cluster mode scans the cluster the cleaner runs in through its service
+// account, and CLEANER_CLUSTERS_FILE lists further clusters to scan through
+// their API servers. Either replaces the scan of the kube config contexts.
+var inCluster = getenv("CLEANER_IN_CLUSTER", "false") == "true"
+var inClusterName = getenv("CLEANER_IN_CLUSTER_NAME", "in-cluster")
+var clustersFile = getenv("CLEANER_CLUSTERS_FILE", "")
+
+// clusterConfig is a remote cluster of CLEANER_CLUSTERS_FILE.
+type clusterConfig struct {
+	// Name identifies the cluster in reason codes and namespace patterns,
+	// like a kube config context.
+	Name string `json:"name"`
+
+	// Server is the URL of the API server.
+	Server string `json:"server"`
+
+	// Token or TokenFile is the bearer token of a service account that can
+	// list pods, jobs and cron jobs. Token may be a Secret Manager reference,
+	// like an image pull secret.
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+
+	// CAData, base64-encoded PEM like a kube config's
+	// certificate-authority-data, or CAFile is the CA of the API server.
+	// CAData may be a Secret Manager reference to the PEM instead. Without
+	// either, the system roots are used.
+	CAData string `json:"caData,omitempty"`
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// scansAPIClusters returns true if the clusters are scanned through their
+// API servers rather than kubectl.
+func scansAPIClusters() bool {
+	return inCluster || clustersFile != ""
+}
+
+// apiClusters returns the clients of the local cluster in in-cluster mode and
+// of the clusters of CLEANER_CLUSTERS_FILE, by name.
+func apiClusters(secrets *SecretManager) (map[string]*kubeClient, error) {
+	clusters := make(map[string]*kubeClient)
+	if inCluster {
+		kube, err := inClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		clusters[inClusterName] = kube
+	}
+	if clustersFile == "" {
+		return clusters, nil
+	}
+
+	b, err := ioutil.ReadFile(clustersFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clusters file: %w", err)
+	}
+	var configs []clusterConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse clusters file %s: %w", clustersFile, err)
+	}
+	for _, cfg := range configs {
+		if cfg.Name == "" || cfg.Server == "" {
+			return nil, fmt.Errorf("clusters file %s: every cluster needs a name and a server", clustersFile)
+		}
+		if _, ok := clusters[cfg.Name]; ok {
+			return nil, fmt.Errorf("clusters file %s: cluster %s is listed twice", clustersFile, cfg.Name)
+		}
+		kube, err := cfg.client(secrets)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", cfg.Name, err)
+		}
+		clusters[cfg.Name] = kube
+	}
+	return clusters, nil
+}
+
+// client builds a client for the cluster, resolving its Secret Manager
+// references.
+func (cfg *clusterConfig) client(secrets *SecretManager) (*kubeClient, error) {
+	ctx := context.Background()
+	token := cfg.Token
+	if IsSecretRef(token) {
+		b, err := secrets.Resolve(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	var ca []byte
+	switch {
+	case IsSecretRef(cfg.CAData):
+		var err error
+		if ca, err = secrets.Resolve(ctx, cfg.CAData); err != nil {
+			return nil, err
+		}
+	case cfg.CAData != "":
+		var err error
+		if ca, err = base64.StdEncoding.DecodeString(cfg.CAData); err != nil {
+			return nil, fmt.Errorf("failed to decode caData: %w", err)
+		}
+	case cfg.CAFile != "":
+		var err error
+		if ca, err = ioutil.ReadFile(cfg.CAFile); err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse CA")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &kubeClient{
+		client:    &http.Client{Transport: transport},
+		host:      strings.TrimSuffix(cfg.Server, "/"),
+		token:     token,
+		tokenFile: cfg.TokenFile,
+	}, nil
+}
+
+// workloadPaths are the API paths listing the workloads whose images are in
+// use, each with the fallback for clusters that don't serve it yet.
+var workloadPaths = [][]string{
+	{"/api/v1/pods"},
+	{"/apis/batch/v1/jobs"},
+	{"/apis/batch/v1/cronjobs", "/apis/batch/v1beta1/cronjobs"},
+}
+
+// clusterImages returns the images used by cron jobs, jobs and pods in the
+// scanned namespaces of a cluster.
+func clusterImages(ctx context.Context, name string, kube *kubeClient) ([]string, error) {
+	var images []string
+	for _, paths := range workloadPaths {
+		var list json.RawMessage
+		var err error
+		for _, path := range paths {
+			if err = kube.do(ctx, http.MethodGet, path, nil, &list); !errors.Is(err, errKubeNotFound) {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		inUse, err := workloadImages(name, list)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, inUse...)
+	}
+	return images, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reason codes are the machine-readable counterparts of the reasons of
+// decisions. In-use codes name their source after a colon, like
+// IN_USE_CLUSTER:prod-eu.
+const (
+	CodeUntagged           = "UNTAGGED"
+	CodeNothingToUntag     = "NOTHING_TO_UNTAG"
+	CodeKeepWindow         = "KEEP_WINDOW"
+	CodeBeyondKeepWindow   = "BEYOND_KEEP_WINDOW"
+	CodeTooYoung           = "TOO_YOUNG"
+	CodeExceptionRepo      = "EXCEPTION_REPO"
+	CodeExceptionTag       = "EXCEPTION_TAG"
+	CodeExceptionGlobalTag = "EXCEPTION_GLOBAL_TAG"
+	CodeInUseCluster       = "IN_USE_CLUSTER"
+	CodeInUse              = "IN_USE"
+	CodeCacheFresh         = "CACHE_FRESH"
+	CodeAgeExceeded        = "AGE_EXCEEDED"
+	CodeGFSRecent          = "GFS_RECENT"
+	CodeGFSDaily           = "GFS_DAILY"
+	CodeGFSWeekly          = "GFS_WEEKLY"
+	CodeGFSMonthly         = "GFS_MONTHLY"
+	CodeBaseImage          = "BASE_IMAGE"
+	CodeKeptElsewhere      = "KEPT_ELSEWHERE"
+	CodeAttachedKept       = "ATTACHED_TO_KEPT"
+	CodeAttachedDeleted    = "ATTACHED_TO_DELETED"
+	CodeMediaType          = "MEDIA_TYPE_NOT_CLEANED"
+	CodeMediaTypeUnknown   = "MEDIA_TYPE_UNKNOWN"
+	CodeNotChartVersion    = "NOT_CHART_VERSION"
+	CodeDuplicate          = "DUPLICATE_CONTENT"
+	CodeForceKeep          = "FORCE_KEEP"
+	CodeForceDelete        = "FORCE_DELETE"
+	CodeNotSampled         = "NOT_SAMPLED"
+	CodeKeptMissing        = "KEPT_MISSING"
+	CodeFallback           = "FALLBACK_FOR_MISSING"
+	CodeWindowExcluded     = "WINDOW_EXCLUDED_TAG"
+	CodeFlagged            = "SCANNER_FLAGGED"
+	CodeUntaggedNewest     = "UNTAGGED_NEWEST"
+	CodeUntaggedRecent     = "UNTAGGED_RECENT"
+	CodeNotFlagged         = "NOT_SCANNER_FLAGGED"
+)
+
+// reasonCodes maps reasons to their codes. Exceptions are missing, as their
+// code depends on what protected the manifest.
+var reasonCodes = map[string]string{
+	ReasonUntagged:         CodeUntagged,
+	ReasonUntagOnly:        CodeNothingToUntag,
+	ReasonKeepWindow:       CodeKeepWindow,
+	ReasonBeyond:           CodeBeyondKeepWindow,
+	ReasonTooYoung:         CodeTooYoung,
+	ReasonCacheFresh:       CodeCacheFresh,
+	ReasonCacheExpired:     CodeAgeExceeded,
+	ReasonGFSRecent:        CodeGFSRecent,
+	ReasonGFSDaily:         CodeGFSDaily,
+	ReasonGFSWeekly:        CodeGFSWeekly,
+	ReasonGFSMonthly:       CodeGFSMonthly,
+	ReasonBaseImage:        CodeBaseImage,
+	ReasonKeptElsewhere:    CodeKeptElsewhere,
+	ReasonAttachedKept:     CodeAttachedKept,
+	ReasonAttachedDeleted:  CodeAttachedDeleted,
+	ReasonMediaType:        CodeMediaType,
+	ReasonMediaTypeUnknown: CodeMediaTypeUnknown,
+	ReasonNotChartVersion:  CodeNotChartVersion,
+	ReasonDuplicate:        CodeDuplicate,
+	ReasonForceKeep:        CodeForceKeep,
+	ReasonForceDelete:      CodeForceDelete,
+	ReasonNotSampled:       CodeNotSampled,
+	ReasonKeptMissing:      CodeKeptMissing,
+	ReasonFallback:         CodeFallback,
+	ReasonWindowExcluded:   CodeWindowExcluded,
+	ReasonFlagged:          CodeFlagged,
+	ReasonUntaggedNewest:   CodeUntaggedNewest,
+	ReasonUntaggedRecent:   CodeUntaggedRecent,
+	ReasonNotFlagged:       CodeNotFlagged,
+}
+
+// inUseCode returns the code of manifests in use by source, e.g. a cluster
+// context.
+func inUseCode(code, source string) string {
+	return fmt.Sprintf("%s:%s", code, strings.ReplaceAll(source, " ", "_"))
+}
+
+// setCodes sets the code of every decision of the plan from its reason.
+func (c *Cleaner) setCodes(plan *RepoPlan) {
+	for _, d := range plan.Decisions {
+		if d.Reason == ReasonException {
+			d.Code = c.exceptionCode(d)
+			continue
+		}
+		d.Code = reasonCodes[d.Reason]
+	}
+}
+
+// exceptionCode returns the code of what protects an excepted manifest, in
+// the order planning checks them.
+func (c *Cleaner) exceptionCode(d *Decision) string {
+	for _, t := range d.Tags {
+		if c.globalTagExcept[t] {
+			return CodeExceptionGlobalTag
+		}
+		if code := c.tagExcept[fmt.Sprintf("%s:%s", d.Repo, t)]; code != "" {
+			return code
+		}
+	}
+	if code := c.digestExcept[d.Repo+"@"+d.Digest]; code != "" {
+		return code
+	}
+	if c.repoExcept[d.Repo] {
+		return CodeExceptionRepo
+	}
+	return CodeExceptionTag
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"sort"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// RepoDiff is the difference between a child repo of two base repos, A and
+// B. Tags are written as tag@digest, so a tag that points to different
+// digests in A and B is listed on both sides.
+type RepoDiff struct {
+	Repo         string   `json:"repo"`
+	DigestsOnlyA []string `json:"digestsOnlyA,omitempty"`
+	DigestsOnlyB []string `json:"digestsOnlyB,omitempty"`
+	TagsOnlyA    []string `json:"tagsOnlyA,omitempty"`
+	TagsOnlyB    []string `json:"tagsOnlyB,omitempty"`
+}
+
+// Empty returns true if the repo is the same in A and B.
+func (d *RepoDiff) Empty() bool {
+	return len(d.DigestsOnlyA)+len(d.DigestsOnlyB)+len(d.TagsOnlyA)+len(d.TagsOnlyB) == 0
+}
+
+// Compare lists the given child repos, or every child repo, of the base
+// repos of a and b and returns the digests and tags that only one of them
+// has, by child repo relative to the base repos. Repos that only exist in one
+// base repo have all of their digests and tags listed. Repos that fail to
+// list are skipped and reported in a *MultiError.
+func Compare(a, b *Cleaner, repos []string) ([]*RepoDiff, error) {
+	if len(repos) == 0 {
+		seen := make(map[string]bool)
+		for _, c := range []*Cleaner{a, b} {
+			children, err := c.Repos()
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range children {
+				if !seen[r] {
+					seen[r] = true
+					repos = append(repos, r)
+				}
+			}
+		}
+		sort.Strings(repos)
+	}
+
+	var diffs []*RepoDiff
+	var failures []*RefError
+	for _, r := range repos {
+		tagsA, err := a.listChild(r)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		tagsB, err := b.listChild(r)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+
+		d := &RepoDiff{Repo: r}
+		digestsA, refsA := refSets(tagsA)
+		digestsB, refsB := refSets(tagsB)
+		d.DigestsOnlyA, d.DigestsOnlyB = difference(digestsA, digestsB), difference(digestsB, digestsA)
+		d.TagsOnlyA, d.TagsOnlyB = difference(refsA, refsB), difference(refsB, refsA)
+		diffs = append(diffs, d)
+	}
+
+	if len(failures) > 0 {
+		return diffs, &MultiError{Errors: failures}
+	}
+	return diffs, nil
+}
+
+// listChild lists a child repo relative to the base repo. A repo that
+// doesn't exist is empty.
+func (c *Cleaner) listChild(r string) (*gcrgoogle.Tags, *RefError) {
+	name := fmt.Sprintf("%s/%s", c.base, r)
+	tags, err := c.backend.List(name)
+	if IsNotFound(err) {
+		return &gcrgoogle.Tags{}, nil
+	}
+	if err != nil {
+		return nil, &RefError{Repo: name, Ref: name, Err: classify(err)}
+	}
+	return tags, nil
+}
+
+// refSets returns the digests and tag@digest refs of a listing.
+func refSets(tags *gcrgoogle.Tags) (map[string]bool, map[string]bool) {
+	digests := make(map[string]bool)
+	refs := make(map[string]bool)
+	for digest, m := range tags.Manifests {
+		digests[digest] = true
+		for _, t := range m.Tags {
+			refs[t+"@"+digest] = true
+		}
+	}
+	return digests, refs
+}
+
+// difference returns the sorted members of a that aren't in b.
+func difference(a, b map[string]bool) []string {
+	var out []string
+	for k := range a {
+		if !b[k] {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	composerAPI  = "https://composer.googleapis.com/v1"
+	containerAPI = "https://container.googleapis.com/v1"
+)
+
+// dagImageRe matches the images in DAG files and their configs, like the
+// image argument of a KubernetesPodOperator, in Python, YAML or JSON.
+var dagImageRe = regexp.MustCompile(`\bimage["']?\s*[:=]\s*["']([^"'\s]+/[^"'\s]+)["']`)
+
+// dagFileSuffixes are the files under a DAG path that are read for images.
+var dagFileSuffixes = []string{".py", ".yaml", ".yml", ".json"}
+
+// ComposerProvider is an InUseProvider for Cloud Composer environments: the
+// images of the pods running in each environment's GKE cluster, which include
+// the Airflow components built with custom PyPI packages, and the images that
+// the environment's DAGs and any further DAG configs in GCS reference, like
+// those of KubernetesPodOperator tasks that aren't running right now.
+type ComposerProvider struct {
+	client    *http.Client
+	projects  []string
+	locations []string
+	dagPaths  []string
+}
+
+// NewComposerProvider creates a provider for the environments in the
+// locations of the projects, or in every location if none are given, and the
+// DAG configs under the gs://bucket/prefix paths. The HTTP client must be
+// authorized for the Composer, GKE and GCS APIs.
+func NewComposerProvider(client *http.Client, projects, locations, dagPaths []string) *ComposerProvider {
+	if len(locations) == 0 {
+		locations = []string{"-"}
+	}
+	return &ComposerProvider{client: client, projects: projects, locations: locations, dagPaths: dagPaths}
+}
+
+// Name implements InUseProvider.
+func (p *ComposerProvider) Name() string { return "Cloud Composer" }
+
+// InUse implements InUseProvider.
+func (p *ComposerProvider) InUse(ctx context.Context) ([]string, error) {
+	dagPaths := append([]string(nil), p.dagPaths...)
+	var images []string
+	for _, project := range p.projects {
+		for _, location := range p.locations {
+			u := fmt.Sprintf("%s/projects/%s/locations/%s/environments", composerAPI, project, location)
+			var clusters []string
+			err := googleList(ctx, p.client, u, func(body []byte) (string, error) {
+				var page struct {
+					Environments []struct {
+						Config struct {
+							GKECluster   string `json:"gkeCluster"`
+							DAGGCSPrefix string `json:"dagGcsPrefix"`
+						} `json:"config"`
+					} `json:"environments"`
+					NextPageToken string `json:"nextPageToken"`
+				}
+				if err := json.Unmarshal(body, &page); err != nil {
+					return "", err
+				}
+				for _, e := range page.Environments {
+					if e.Config.GKECluster != "" {
+						clusters = append(clusters, e.Config.GKECluster)
+					}
+					if e.Config.DAGGCSPrefix != "" {
+						dagPaths = append(dagPaths, strings.TrimSuffix(e.Config.DAGGCSPrefix, "/")+"/")
+					}
+				}
+				return page.NextPageToken, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			for _, cluster := range clusters {
+				pods, err := p.clusterImages(ctx, cluster)
+				if err != nil {
+					return nil, fmt.Errorf("failed to list pods of %s: %w", cluster, err)
+				}
+				images = append(images, pods...)
+			}
+		}
+	}
+
+	dags, err := p.dagImages(ctx, dagPaths)
+	if err != nil {
+		return nil, err
+	}
+	return append(images, dags...), nil
+}
+
+// clusterImages returns the images of the pods running in the GKE cluster, a
+// projects/*/locations/*/clusters/* name.
+func (p *ComposerProvider) clusterImages(ctx context.Context, cluster string) ([]string, error) {
+	var info struct {
+		Endpoint   string `json:"endpoint"`
+		MasterAuth struct {
+			ClusterCACertificate string `json:"clusterCaCertificate"`
+		} `json:"masterAuth"`
+	}
+	err := googleList(ctx, p.client, fmt.Sprintf("%s/%s", containerAPI, cluster), func(body []byte) (string, error) {
+		return "", json.Unmarshal(body, &info)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := base64.StdEncoding.DecodeString(info.MasterAuth.ClusterCACertificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("failed to parse cluster CA")
+	}
+
+	// GKE accepts the same OAuth access tokens as the Google APIs.
+	base := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	var transport http.RoundTripper = base
+	if t, ok := p.client.Transport.(*oauth2.Transport); ok {
+		transport = &oauth2.Transport{Source: t.Source, Base: base}
+	}
+	kube := &kubeClient{client: &http.Client{Transport: transport}, host: "https://" + info.Endpoint}
+
+	var pods struct {
+		Items []struct {
+			Spec struct {
+				Containers     []cloudRunContainer `json:"containers"`
+				InitContainers []cloudRunContainer `json:"initContainers"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := kube.do(ctx, http.MethodGet, "/api/v1/pods", nil, &pods); err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, pod := range pods.Items {
+		images = appendImages(images, pod.Spec.Containers)
+		images = appendImages(images, pod.Spec.InitContainers)
+	}
+	return images, nil
+}
+
+// dagImages returns the images referenced by the DAG files under the
+// gs://bucket/prefix paths.
+func (p *ComposerProvider) dagImages(ctx context.Context, paths []string) ([]string, error) {
+	var images []string
+	for _, path := range paths {
+		parts := strings.SplitN(strings.TrimPrefix(path, "gs://"), "/", 2)
+		if !strings.HasPrefix(path, "gs://") || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid DAG path %q, expected gs://bucket/prefix", path)
+		}
+		store := &storageClient{client: p.client, bucket: parts[0]}
+		names, err := store.list(ctx, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !hasAnySuffix(name, dagFileSuffixes) {
+				continue
+			}
+			b, err := store.get(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range dagImageRe.FindAllStringSubmatch(string(b), -1) {
+				images = append(images, match[1])
+			}
+		}
+	}
+	return images, nil
+}
+
+// hasAnySuffix returns true if s ends with any of the suffixes.
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
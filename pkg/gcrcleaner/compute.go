@@ -0,0 +1,130 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const computeAPI = "https://compute.googleapis.com/compute/v1"
+
+// containerDeclarationKey is the metadata key of the container declaration
+// of Container-Optimized OS VMs.
+const containerDeclarationKey = "gce-container-declaration"
+
+// declarationImageRe matches the images in a container declaration, which is
+// YAML.
+var declarationImageRe = regexp.MustCompile(`(?m)^[\s-]*image:\s*["']?([^"'\s]+)`)
+
+// computeMetadata is the metadata of an instance or instance template.
+type computeMetadata struct {
+	Items []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"items"`
+}
+
+// images returns the images of the container declaration in the metadata.
+func (m computeMetadata) images() []string {
+	var images []string
+	for _, item := range m.Items {
+		if item.Key != containerDeclarationKey {
+			continue
+		}
+		for _, match := range declarationImageRe.FindAllStringSubmatch(item.Value, -1) {
+			images = append(images, match[1])
+		}
+	}
+	return images
+}
+
+// ComputeProvider is an InUseProvider for the container images declared by
+// Container-Optimized OS VMs: those of instance templates, global and
+// regional, which managed instance groups create their VMs from, and those of
+// instances, whether or not they belong to a group.
+type ComputeProvider struct {
+	client   *http.Client
+	projects []string
+}
+
+// NewComputeProvider creates a provider for the VMs of the projects. The HTTP
+// client must be authorized for the Compute Engine API.
+func NewComputeProvider(client *http.Client, projects []string) *ComputeProvider {
+	return &ComputeProvider{client: client, projects: projects}
+}
+
+// Name implements InUseProvider.
+func (p *ComputeProvider) Name() string { return "Compute Engine" }
+
+// InUse implements InUseProvider.
+func (p *ComputeProvider) InUse(ctx context.Context) ([]string, error) {
+	var images []string
+	for _, project := range p.projects {
+		u := fmt.Sprintf("%s/projects/%s/aggregated/instanceTemplates", computeAPI, project)
+		err := googleList(ctx, p.client, u, func(body []byte) (string, error) {
+			var page struct {
+				Items map[string]struct {
+					InstanceTemplates []struct {
+						Properties struct {
+							Metadata computeMetadata `json:"metadata"`
+						} `json:"properties"`
+					} `json:"instanceTemplates"`
+				} `json:"items"`
+				NextPageToken string `json:"nextPageToken"`
+			}
+			if err := json.Unmarshal(body, &page); err != nil {
+				return "", err
+			}
+			for _, scope := range page.Items {
+				for _, t := range scope.InstanceTemplates {
+					images = append(images, t.Properties.Metadata.images()...)
+				}
+			}
+			return page.NextPageToken, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		u = fmt.Sprintf("%s/projects/%s/aggregated/instances", computeAPI, project)
+		err = googleList(ctx, p.client, u, func(body []byte) (string, error) {
+			var page struct {
+				Items map[string]struct {
+					Instances []struct {
+						Metadata computeMetadata `json:"metadata"`
+					} `json:"instances"`
+				} `json:"items"`
+				NextPageToken string `json:"nextPageToken"`
+			}
+			if err := json.Unmarshal(body, &page); err != nil {
+				return "", err
+			}
+			for _, scope := range page.Items {
+				for _, i := range scope.Instances {
+					images = append(images, i.Metadata.images()...)
+				}
+			}
+			return page.NextPageToken, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const dataflowAPI = "https://dataflow.googleapis.com/v1b3"
+
+// dataflowImageOptions are the pipeline options that name a custom worker
+// container image.
+var dataflowImageOptions = []string{
+	"sdkContainerImage",
+	"sdk_container_image",
+	"workerHarnessContainerImage",
+	"worker_harness_container_image",
+}
+
+// DataflowProvider is an InUseProvider for the images of Dataflow Flex
+// Templates: the launcher and worker images named by template spec files in
+// GCS, and the worker images of active jobs.
+type DataflowProvider struct {
+	client    *http.Client
+	projects  []string
+	templates []string
+}
+
+// NewDataflowProvider creates a provider for the active jobs of the projects
+// and the template specs at the gs://bucket/object locations, where a location
+// ending in / stands for every .json object under it. The HTTP client must be
+// authorized for the Dataflow and GCS APIs.
+func NewDataflowProvider(client *http.Client, projects, templates []string) *DataflowProvider {
+	return &DataflowProvider{client: client, projects: projects, templates: templates}
+}
+
+// Name implements InUseProvider.
+func (p *DataflowProvider) Name() string { return "Dataflow" }
+
+// InUse implements InUseProvider.
+func (p *DataflowProvider) InUse(ctx context.Context) ([]string, error) {
+	images, err := p.templateImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range p.projects {
+		jobs, err := p.jobImages(ctx, project)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, jobs...)
+	}
+	return images, nil
+}
+
+// templateImages returns the images of the template specs.
+func (p *DataflowProvider) templateImages(ctx context.Context) ([]string, error) {
+	var images []string
+	for _, location := range p.templates {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		if !strings.HasPrefix(location, "gs://") || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid template location %q, expected gs://bucket/object", location)
+		}
+		store := &storageClient{client: p.client, bucket: parts[0]}
+
+		objects := []string{parts[1]}
+		if strings.HasSuffix(location, "/") || parts[1] == "" {
+			names, err := store.list(ctx, parts[1])
+			if err != nil {
+				return nil, err
+			}
+			objects = nil
+			for _, name := range names {
+				if strings.HasSuffix(name, ".json") {
+					objects = append(objects, name)
+				}
+			}
+		}
+
+		for _, object := range objects {
+			b, err := store.get(ctx, object)
+			if err != nil {
+				return nil, err
+			}
+			var spec struct {
+				Image string `json:"image"`
+			}
+			if err := json.Unmarshal(b, &spec); err != nil {
+				// Not a flex template spec, e.g. a classic template.
+				continue
+			}
+			if spec.Image != "" {
+				images = append(images, spec.Image)
+			}
+		}
+	}
+	return images, nil
+}
+
+// jobImages returns the worker images of the active jobs of the project.
+func (p *DataflowProvider) jobImages(ctx context.Context, project string) ([]string, error) {
+	type jobRef struct{ id, location string }
+	var jobs []jobRef
+	u := fmt.Sprintf("%s/projects/%s/jobs:aggregated?filter=ACTIVE", dataflowAPI, url.PathEscape(project))
+	err := googleList(ctx, p.client, u, func(body []byte) (string, error) {
+		var page struct {
+			Jobs []struct {
+				ID       string `json:"id"`
+				Location string `json:"location"`
+			} `json:"jobs"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return "", err
+		}
+		for _, j := range page.Jobs {
+			jobs = append(jobs, jobRef{j.ID, j.Location})
+		}
+		return page.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var images []string
+	for _, j := range jobs {
+		u := fmt.Sprintf("%s/projects/%s/locations/%s/jobs/%s?view=JOB_VIEW_ALL", dataflowAPI,
+			url.PathEscape(project), url.PathEscape(j.location), url.PathEscape(j.id))
+		err := googleList(ctx, p.client, u, func(body []byte) (string, error) {
+			var job struct {
+				Environment struct {
+					WorkerPools []struct {
+						SDKHarnessContainerImages []struct {
+							ContainerImage string `json:"containerImage"`
+						} `json:"sdkHarnessContainerImages"`
+					} `json:"workerPools"`
+					SDKPipelineOptions struct {
+						Options map[string]interface{} `json:"options"`
+					} `json:"sdkPipelineOptions"`
+				} `json:"environment"`
+			}
+			if err := json.Unmarshal(body, &job); err != nil {
+				return "", err
+			}
+			for _, pool := range job.Environment.WorkerPools {
+				for _, c := range pool.SDKHarnessContainerImages {
+					if c.ContainerImage != "" {
+						images = append(images, c.ContainerImage)
+					}
+				}
+			}
+			for _, key := range dataflowImageOptions {
+				if image, ok := job.Environment.SDKPipelineOptions.Options[key].(string); ok && image != "" {
+					images = append(images, image)
+				}
+			}
+			return "", nil
+		})
+		if IsNotFound(err) {
+			// The job finished since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
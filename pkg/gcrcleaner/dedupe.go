@@ -0,0 +1,137 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gammazero/workerpool"
+)
+
+// ReasonDuplicate is the reason a manifest in the keep window is deleted
+// because a newer kept image has the same content.
+const ReasonDuplicate = "duplicate of a newer image"
+
+// dedupeContent deletes the manifests the plan's keep window keeps whose
+// content, their platform and the diff_ids of their layers, is the same as
+// that of a newer kept manifest, like rebuilds of unchanged sources under a
+// rolling tag. The image configs are fetched, so this needs a backend that
+// implements ManifestGetter. Manifests whose content fails to fetch are
+// kept and returned as failures.
+func (c *Cleaner) dedupeContent(plan *RepoPlan) []*RefError {
+	getter, ok := c.backend.(ManifestGetter)
+	if !ok {
+		return nil
+	}
+
+	var kept []*Decision
+	for _, d := range plan.Decisions {
+		if !d.Delete && !isIndex(d.MediaType) {
+			kept = append(kept, d)
+		}
+	}
+	keys, failures := c.fetchContentKeys(getter, kept)
+
+	// Decisions are sorted newest first, so the first of every content is
+	// the one to keep.
+	seen := make(map[string]bool)
+	for _, d := range kept {
+		key, ok := keys[d.Digest]
+		if !ok {
+			continue
+		}
+		if seen[key] && d.Reason == ReasonKeepWindow {
+			d.Delete, d.Reason = true, ReasonDuplicate
+		}
+		seen[key] = true
+	}
+	return failures
+}
+
+// fetchContentKeys fetches the image configs of the decisions in parallel
+// and returns their content keys by digest. Manifests that aren't images,
+// like SBOMs, have no key.
+func (c *Cleaner) fetchContentKeys(getter ManifestGetter, decisions []*Decision) (map[string]string, []*RefError) {
+	var lock sync.Mutex
+	keys := make(map[string]string)
+	var failures []*RefError
+
+	pool := workerpool.New(c.concurrency)
+	for _, d := range decisions {
+		d := d
+		pool.Submit(func() {
+			key, err := c.contentKey(getter, d.Repo, d.Digest)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				failures = append(failures, &RefError{Repo: d.Repo, Ref: d.Repo + "@" + d.Digest, Err: classify(err)})
+				return
+			}
+			if key != "" {
+				keys[d.Digest] = key
+			}
+		})
+	}
+	pool.StopWait()
+	return keys, failures
+}
+
+// contentKey returns the platform and layer diff_ids of the image config of a
+// manifest, cached by digest, or "" if it has none.
+func (c *Cleaner) contentKey(getter ManifestGetter, repo, digest string) (string, error) {
+	if key, ok := c.contentKeys.Load(digest); ok {
+		return key.(string), nil
+	}
+
+	b, err := getter.GetManifest(repo, digest)
+	if err != nil {
+		return "", err
+	}
+	var m struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", err
+	}
+
+	key := ""
+	if m.Config.Digest != "" {
+		b, err := getter.GetBlob(repo, m.Config.Digest)
+		if err != nil {
+			return "", err
+		}
+		var config struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+			RootFS       struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		// Configs of other artifacts needn't even be JSON.
+		if json.Unmarshal(b, &config) == nil && len(config.RootFS.DiffIDs) > 0 {
+			key = fmt.Sprintf("%s/%s/%s:%s", config.OS, config.Architecture, config.Variant,
+				strings.Join(config.RootFS.DiffIDs, ","))
+		}
+	}
+	c.contentKeys.Store(digest, key)
+	return key, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RepoSummary is what a run planned for, and freed in, a repo.
+type RepoSummary struct {
+	Candidates int   `json:"candidates"`
+	Exceptions int   `json:"exceptions"`
+	Freed      int64 `json:"freed,omitempty"`
+}
+
+// RunSummary is what a run planned and did, saved to compare the next run
+// with.
+type RunSummary struct {
+	RunID      string                  `json:"runId"`
+	Dry        bool                    `json:"dry"`
+	Finished   time.Time               `json:"finished"`
+	Candidates int                     `json:"candidates"`
+	Deleted    int                     `json:"deleted"`
+	Freed      int64                   `json:"freed"`
+	Failed     int                     `json:"failed"`
+	Repos      map[string]*RepoSummary `json:"repos"`
+}
+
+// SummarizePlans returns the summaries of the repos of the plans, by repo.
+func SummarizePlans(plans []*RepoPlan) map[string]*RepoSummary {
+	repos := make(map[string]*RepoSummary, len(plans))
+	for _, p := range plans {
+		s := &RepoSummary{Candidates: len(p.Candidates())}
+		for _, n := range p.Exceptions {
+			s.Exceptions += n
+		}
+		repos[p.Repo] = s
+	}
+	return repos
+}
+
+// DiffThresholds are how much the candidates of a run must grow over the
+// previous run to be an anomaly: by at least MinJump, and to at least Factor
+// times what they were.
+type DiffThresholds struct {
+	MinJump int
+	Factor  float64
+}
+
+// jumped returns true if the candidates grew past the thresholds.
+func (t DiffThresholds) jumped(prev, cur int) bool {
+	return cur-prev >= t.MinJump && float64(cur) >= t.Factor*float64(prev)
+}
+
+// Anomaly is a change from the previous run that usually means something
+// broke, like CI pushing far more than usual or an exception source that no
+// longer reports anything in use.
+type Anomaly struct {
+	Repo    string `json:"repo,omitempty"`
+	Message string `json:"message"`
+}
+
+// DiffRuns compares a run with the previous one and returns the anomalies:
+// repos, or the whole run, whose candidates jumped, freed space that dropped
+// to zero, exceptions that no longer keep anything and repos failing where
+// none did. Freed space is only compared between real runs.
+func DiffRuns(prev, cur *RunSummary, t DiffThresholds) []Anomaly {
+	var anomalies []Anomaly
+	var repos []string
+	for r := range cur.Repos {
+		repos = append(repos, r)
+	}
+	sort.Strings(repos)
+	for _, r := range repos {
+		before, ok := prev.Repos[r]
+		if !ok {
+			continue
+		}
+		if now := cur.Repos[r].Candidates; t.jumped(before.Candidates, now) {
+			anomalies = append(anomalies, Anomaly{Repo: r, Message: fmt.Sprintf(
+				"%s suddenly has %d new candidates (%d, was %d)", r, now-before.Candidates, now, before.Candidates)})
+		}
+	}
+	if t.jumped(prev.Candidates, cur.Candidates) {
+		anomalies = append(anomalies, Anomaly{Message: fmt.Sprintf(
+			"the run has %d new candidates (%d, was %d)", cur.Candidates-prev.Candidates, cur.Candidates, prev.Candidates)})
+	}
+	if !prev.Dry && !cur.Dry && prev.Freed > 0 && cur.Freed == 0 {
+		anomalies = append(anomalies, Anomaly{Message: fmt.Sprintf(
+			"bytes freed dropped to zero (was %s)", FormatSize(prev.Freed))})
+	}
+	if before, now := prev.exceptions(), cur.exceptions(); before > 0 && now == 0 {
+		anomalies = append(anomalies, Anomaly{Message: fmt.Sprintf(
+			"exceptions no longer keep any manifests (was %d), check the exception sources", before)})
+	}
+	if prev.Failed == 0 && cur.Failed > 0 {
+		anomalies = append(anomalies, Anomaly{Message: fmt.Sprintf(
+			"%d repos failed, the previous run had none", cur.Failed)})
+	}
+	return anomalies
+}
+
+// exceptions returns how many manifests exceptions kept in the run.
+func (s *RunSummary) exceptions() int {
+	n := 0
+	for _, r := range s.Repos {
+		n += r.Exceptions
+	}
+	return n
+}
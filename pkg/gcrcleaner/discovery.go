@@ -0,0 +1,155 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const crmBaseURL = "https://cloudresourcemanager.googleapis.com/v3"
+
+// DiscoverProjects returns the IDs of the active projects anywhere under the
+// parent, an organizations/{id} or folders/{id} resource, that carry all of
+// the given labels. The HTTP client must be authorized for Cloud Resource
+// Manager, e.g. with the cloud-platform.read-only scope.
+func DiscoverProjects(ctx context.Context, client *http.Client, parent string, labels map[string]string) ([]string, error) {
+	var projects []string
+	parents := []string{parent}
+	for len(parents) > 0 {
+		p := parents[0]
+		parents = parents[1:]
+
+		var page struct {
+			Projects []struct {
+				ProjectID string            `json:"projectId"`
+				State     string            `json:"state"`
+				Labels    map[string]string `json:"labels"`
+			} `json:"projects"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err := crmList(ctx, client, "projects", p, func(body []byte) (string, error) {
+			page.Projects = nil
+			if err := json.Unmarshal(body, &page); err != nil {
+				return "", err
+			}
+			for _, proj := range page.Projects {
+				if proj.State == "ACTIVE" && hasLabels(proj.Labels, labels) {
+					projects = append(projects, proj.ProjectID)
+				}
+			}
+			return page.NextPageToken, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var folders struct {
+			Folders []struct {
+				Name  string `json:"name"`
+				State string `json:"state"`
+			} `json:"folders"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = crmList(ctx, client, "folders", p, func(body []byte) (string, error) {
+			folders.Folders = nil
+			if err := json.Unmarshal(body, &folders); err != nil {
+				return "", err
+			}
+			for _, f := range folders.Folders {
+				if f.State == "ACTIVE" {
+					parents = append(parents, f.Name)
+				}
+			}
+			return folders.NextPageToken, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(projects)
+	return projects, nil
+}
+
+// ParseLabels parses a comma-separated list of key=value labels.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", kv)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// hasLabels returns true if have contains every label in want.
+func hasLabels(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// crmList pages through a Cloud Resource Manager list of the children of the
+// parent, passing every page to handle, which returns the next page token.
+func crmList(ctx context.Context, client *http.Client, kind, parent string, handle func(body []byte) (string, error)) error {
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("parent", parent)
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s?%s", crmBaseURL, kind, q.Encode()), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to list %s under %s: %w", kind, parent, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to list %s under %s: %w", kind, parent, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to list %s under %s: unexpected status %d: %s", kind, parent, resp.StatusCode, bytes.TrimSpace(body))
+		}
+
+		if token, err = handle(body); err != nil {
+			return fmt.Errorf("failed to parse %s under %s: %w", kind, parent, err)
+		}
+		if token == "" {
+			return nil
+		}
+	}
+}
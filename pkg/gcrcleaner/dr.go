@@ -0,0 +1,84 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ErrNotReplicated means a manifest the cleaner keeps is missing from the DR
+// registry, so nothing was deleted from its repo.
+var ErrNotReplicated = errors.New("kept manifest missing from DR registry")
+
+// Replicator is implemented by backends that can copy images to another
+// repo, which the DR guard uses to replicate missing kept images.
+type Replicator interface {
+	// Copy copies the image with the digest from one repo to another, under
+	// the given tags, or only by digest if there are none.
+	Copy(srcRepo, digest, dstRepo string, tags []string) error
+}
+
+// WithDRGuard makes the cleaner verify, before deleting anything from a
+// child repo, that every manifest it keeps there also exists in the same
+// child repo of the DR base repo, and refuse to delete from the repo if any
+// are missing. With replicate, missing images are copied to the DR repo
+// first, if the backend implements Replicator. The DR cleaner supplies the
+// DR base repo and backend.
+func WithDRGuard(dr *Cleaner, replicate bool) Option {
+	return func(c *Cleaner) error {
+		c.dr = dr
+		c.drReplicate = replicate
+		return nil
+	}
+}
+
+// checkReplicated returns a failure for every manifest the plan keeps that is
+// missing from the DR repo, after copying them there with drReplicate. In a
+// dry run nothing is copied.
+func (c *Cleaner) checkReplicated(plan *RepoPlan, dry bool) []*RefError {
+	name := fmt.Sprintf("%s/%s", c.dr.base, strings.TrimPrefix(plan.Repo, c.base+"/"))
+	tags, err := c.dr.backend.List(name)
+	if err != nil && !IsNotFound(err) {
+		return []*RefError{{Repo: plan.Repo, Ref: name, Err: classify(err)}}
+	}
+
+	replicator, canReplicate := c.backend.(Replicator)
+	var failures []*RefError
+	for _, d := range plan.Decisions {
+		if d.Delete {
+			continue
+		}
+		if tags != nil {
+			if _, ok := tags.Manifests[d.Digest]; ok {
+				continue
+			}
+		}
+		if c.drReplicate && canReplicate && !dry {
+			err := withRetries(func() error {
+				return replicator.Copy(plan.Repo, d.Digest, name, d.Tags)
+			})
+			if err == nil {
+				log.Printf("%s: replicated %s to %s", plan.Repo, d.Digest, name)
+				continue
+			}
+			log.Printf("%s: failed to replicate %s to %s: %s", plan.Repo, d.Digest, name, err)
+		}
+		failures = append(failures, &RefError{Repo: plan.Repo, Ref: name + "@" + d.Digest, Err: ErrNotReplicated})
+	}
+	return failures
+}
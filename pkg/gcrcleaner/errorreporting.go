@@ -0,0 +1,64 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const errorReportingAPI = "https://clouderrorreporting.googleapis.com/v1beta1"
+
+// ErrorReporter reports errors to Google Cloud Error Reporting, which groups
+// recurring errors and tracks how often they occur. The client must be
+// authorized for the cloud-platform scope.
+type ErrorReporter struct {
+	Project string
+	Service string
+	Version string
+	Client  *http.Client
+}
+
+// errorEvent is an Error Reporting event. Messages without a stack trace
+// need a report location.
+type errorEvent struct {
+	ServiceContext struct {
+		Service string `json:"service"`
+		Version string `json:"version,omitempty"`
+	} `json:"serviceContext"`
+	Message string `json:"message"`
+	Context struct {
+		ReportLocation struct {
+			FilePath     string `json:"filePath"`
+			LineNumber   int    `json:"lineNumber"`
+			FunctionName string `json:"functionName"`
+		} `json:"reportLocation"`
+	} `json:"context"`
+}
+
+// Report reports an error that happened in the named function, like clean.
+// Error Reporting groups errors by their message and function, so messages
+// should not contain counts or times.
+func (r *ErrorReporter) Report(ctx context.Context, message, function string) error {
+	ev := &errorEvent{Message: message}
+	ev.ServiceContext.Service = r.Service
+	ev.ServiceContext.Version = r.Version
+	ev.Context.ReportLocation.FilePath = "gcrcleaner"
+	ev.Context.ReportLocation.FunctionName = function
+	u := fmt.Sprintf("%s/projects/%s/events:report", errorReportingAPI, url.PathEscape(r.Project))
+	return postJSON(ctx, r.Client, u, nil, ev)
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Classes of errors, for use with errors.Is on the errors the cleaner
+// returns.
+var (
+	// ErrAuth means the registry rejected the credentials (401 or 403).
+	ErrAuth = errors.New("not authorized")
+
+	// ErrRateLimited means the registry rate limited the cleaner (429).
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrRepoNotFound means a repo doesn't exist (404).
+	ErrRepoNotFound = errors.New("repo not found")
+
+	// ErrImmutableTags means a repo's tags can't be deleted, like those of
+	// Artifact Registry repositories with immutable tags.
+	ErrImmutableTags = errors.New("tags are immutable in the repository")
+
+	// ErrThresholdExceeded means a real run would have deleted more than the
+	// configured thresholds allow, so it only performed a dry run.
+	ErrThresholdExceeded = errors.New("deletion threshold exceeded")
+
+	// ErrCanaryFailed means the registry failed verification after the
+	// first deletions of a real run, so the rest were abandoned.
+	ErrCanaryFailed = errors.New("canary verification failed")
+
+	// ErrHalted means a real run abandoned its remaining deletions because
+	// a halt check failed, see Cleaner.HaltWhen.
+	ErrHalted = errors.New("run halted")
+
+	// ErrUntagUnsupported means the registry can't remove a single tag from
+	// a manifest, like GitHub Container Registry.
+	ErrUntagUnsupported = errors.New("registry can't remove single tags")
+)
+
+// classifiedError is a registry error marked with its class.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+
+func (e *classifiedError) Unwrap() error { return e.err }
+
+func (e *classifiedError) Is(target error) bool { return target == e.class }
+
+// classify marks the registry error with its class, if it has one, so
+// errors.Is(err, ErrAuth) and the like work on it.
+func classify(err error) error {
+	var class error
+	switch statusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		class = ErrAuth
+	case http.StatusTooManyRequests:
+		class = ErrRateLimited
+	case http.StatusNotFound:
+		class = ErrRepoNotFound
+	default:
+		return err
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// maxErrorExamples is how many failed refs an ErrorGroup lists.
+const maxErrorExamples = 3
+
+// RefError is the failure of a single ref: a manifest that failed to delete,
+// or a repo that failed to list, in which case Ref is the repo.
+type RefError struct {
+	Repo string
+	Ref  string
+	Err  error
+}
+
+func (e *RefError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Ref, e.Err)
+}
+
+func (e *RefError) Unwrap() error { return e.Err }
+
+// ErrorGroup is a summary of the failures that share a cause.
+type ErrorGroup struct {
+	Cause    string   `json:"cause"`
+	Count    int      `json:"count"`
+	Repos    []string `json:"repos"`
+	Examples []string `json:"examples,omitempty"`
+
+	repoErrors bool
+}
+
+func (g ErrorGroup) String() string {
+	if g.repoErrors {
+		return fmt.Sprintf("%s: %s", g.Cause, strings.Join(g.Repos, ", "))
+	}
+	noun := "manifests"
+	if g.Count == 1 {
+		noun = "manifest"
+	}
+	if len(g.Repos) == 1 {
+		return fmt.Sprintf("%s: %d %s in %s", g.Cause, g.Count, noun, g.Repos[0])
+	}
+	return fmt.Sprintf("%s: %d %s across %d repos", g.Cause, g.Count, noun, len(g.Repos))
+}
+
+// MultiError is returned by Plan and Execute when some refs fail. Its
+// message summarizes the failures by cause; Errors has every one of them.
+// errors.Is reports whether any of them matches.
+type MultiError struct {
+	Errors []*RefError
+}
+
+func (e *MultiError) Error() string {
+	groups := e.Groups()
+	parts := make([]string, 0, len(groups))
+	for _, g := range groups {
+		parts = append(parts, g.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Is implements errors.Is by matching any of the errors.
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups returns the failures grouped by cause, largest group first.
+func (e *MultiError) Groups() []ErrorGroup {
+	var causes []string
+	groups := make(map[string]*ErrorGroup)
+	repos := make(map[string]map[string]bool)
+	for _, f := range e.Errors {
+		cause := errorCause(f.Err)
+		if f.Ref == f.Repo && !errors.Is(f.Err, ErrHalted) {
+			cause = "failed to list: " + cause
+		}
+		g, ok := groups[cause]
+		if !ok {
+			g = &ErrorGroup{Cause: cause, repoErrors: f.Ref == f.Repo}
+			groups[cause] = g
+			repos[cause] = make(map[string]bool)
+			causes = append(causes, cause)
+		}
+		g.Count++
+		if !repos[cause][f.Repo] {
+			repos[cause][f.Repo] = true
+			g.Repos = append(g.Repos, f.Repo)
+		}
+		if len(g.Examples) < maxErrorExamples {
+			g.Examples = append(g.Examples, f.Ref)
+		}
+	}
+
+	out := make([]ErrorGroup, 0, len(causes))
+	for _, c := range causes {
+		out = append(out, *groups[c])
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Count > out[j].Count
+	})
+	return out
+}
+
+// errorCause returns what the error has in common with others like it: the
+// HTTP status if it came from a registry response, or the innermost error
+// message otherwise, without the refs the outer errors add.
+func errorCause(err error) string {
+	if code := statusCode(err); code != 0 {
+		return fmt.Sprintf("%d %s", code, http.StatusText(code))
+	}
+	for inner := errors.Unwrap(err); inner != nil; inner = errors.Unwrap(err) {
+		err = inner
+	}
+	return err.Error()
+}
+
+// Stages of a clean a repo can fail in.
+const (
+	StagePlan    = "plan"
+	StageExecute = "execute"
+)
+
+// RepoFailure is why a single repo of a clean has no status: it failed to
+// be planned, or some of its refs failed to delete. Other repos are cleaned
+// regardless.
+type RepoFailure struct {
+	Repo  string `json:"repo"`
+	Stage string `json:"stage"`
+
+	// Cause is the most common cause of the repo's errors.
+	Cause string `json:"cause"`
+
+	// Count is how many refs of the repo failed.
+	Count int `json:"count"`
+
+	// Errors are the failures of the repo.
+	Errors []*RefError `json:"-"`
+}
+
+func (f *RepoFailure) String() string {
+	noun := "failures"
+	if f.Count == 1 {
+		noun = "failure"
+	}
+	return fmt.Sprintf("%s: failed to %s: %d %s, %s", f.Repo, f.Stage, f.Count, noun, f.Cause)
+}
+
+// RepoFailures returns the failures of a MultiError by repo, in the order
+// the repos first failed, or nil for any other error.
+func RepoFailures(stage string, err error) []*RepoFailure {
+	var multiErr *MultiError
+	if !errors.As(err, &multiErr) {
+		return nil
+	}
+	var out []*RepoFailure
+	byRepo := make(map[string]*RepoFailure)
+	for _, f := range multiErr.Errors {
+		rf, ok := byRepo[f.Repo]
+		if !ok {
+			rf = &RepoFailure{Repo: f.Repo, Stage: stage}
+			byRepo[f.Repo] = rf
+			out = append(out, rf)
+		}
+		rf.Errors = append(rf.Errors, f)
+		rf.Count++
+	}
+	for _, rf := range out {
+		rf.Cause = (&MultiError{Errors: rf.Errors}).Groups()[0].Cause
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Actions of events.
+const (
+	EventKeep   = "keep"
+	EventDelete = "delete"
+	EventUntag  = "untag"
+)
+
+// Event is a record of the event stream: the outcome of a single manifest of
+// a clean, as it happens.
+type Event struct {
+	RunID  string    `json:"runId,omitempty"`
+	Time   time.Time `json:"time"`
+	Repo   string    `json:"repo"`
+	Digest string    `json:"digest"`
+	Tags   []string  `json:"tags,omitempty"`
+	Size   int64     `json:"size"`
+	Action string    `json:"action"`
+	Dry    bool      `json:"dry"`
+	Reason string    `json:"reason"`
+	Code   string    `json:"code"`
+
+	// Error is why deleting or untagging the manifest failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// eventStream writes events as newline-delimited JSON.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// WithEventStream writes an Event for every manifest a clean keeps, deletes
+// or fails to delete to w as newline-delimited JSON, while the clean runs.
+func WithEventStream(w io.Writer) Option {
+	return func(c *Cleaner) error {
+		c.events = &eventStream{enc: json.NewEncoder(w)}
+		return nil
+	}
+}
+
+// emit writes the event of a decision, if there is an event stream. Failures
+// to write are only logged, so they don't interrupt the clean.
+func (s *eventStream) emit(runID string, d *Decision, action string, dry bool, err error) {
+	if s == nil {
+		return
+	}
+	ev := &Event{
+		RunID:  runID,
+		Time:   time.Now(),
+		Repo:   d.Repo,
+		Digest: d.Digest,
+		Tags:   d.Tags,
+		Size:   d.Size,
+		Action: action,
+		Dry:    dry,
+		Reason: d.Reason,
+		Code:   d.Code,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(ev); err != nil {
+		log.Printf("failed to write event: %s", err)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exception is an entry of the exceptions file: a child repo, a repo:tag or
+// a global tag, optionally protected only until it expires. Entries are
+// either plain strings or objects with these fields.
+type Exception struct {
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// UnmarshalJSON accepts a plain name as well as an object. Expiry dates may
+// be RFC 3339 timestamps or dates like 2025-03-01, which expire at the start
+// of that day in UTC.
+func (e *Exception) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &e.Name); err == nil {
+		return nil
+	}
+
+	var raw struct {
+		Name    string `json:"name"`
+		Expires string `json:"expires"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw.Name == "" {
+		return fmt.Errorf("exception without a name")
+	}
+	e.Name, e.Reason = raw.Name, raw.Reason
+	if raw.Expires != "" {
+		t, err := time.Parse(time.RFC3339, raw.Expires)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", raw.Expires); err != nil {
+				return fmt.Errorf("invalid expiry %q for exception %s", raw.Expires, raw.Name)
+			}
+		}
+		e.Expires = t
+	}
+	return nil
+}
+
+// MarshalJSON writes exceptions without an expiry or reason as plain names.
+func (e Exception) MarshalJSON() ([]byte, error) {
+	if e.Expires.IsZero() && e.Reason == "" {
+		return json.Marshal(e.Name)
+	}
+	raw := struct {
+		Name    string `json:"name"`
+		Expires string `json:"expires,omitempty"`
+		Reason  string `json:"reason,omitempty"`
+	}{Name: e.Name, Reason: e.Reason}
+	if !e.Expires.IsZero() {
+		raw.Expires = e.Expires.Format(time.RFC3339)
+	}
+	return json.Marshal(raw)
+}
+
+// Expired returns true if the exception has an expiry that has passed.
+func (e Exception) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// Exceptions is the contents of the exceptions file. Repo and tag names are
+// relative to the base repo.
+type Exceptions struct {
+	Repo      []Exception `json:"repo,omitempty"`
+	Tag       []Exception `json:"tag,omitempty"`
+	GlobalTag []Exception `json:"globalTag,omitempty"`
+}
+
+// active returns the names of the exceptions that haven't expired, and
+// appends the expired ones to expired, labelled with their kind.
+func active(kind string, exceptions []Exception, now time.Time, expired *[]string) []string {
+	var names []string
+	for _, e := range exceptions {
+		if e.Expired(now) {
+			*expired = append(*expired, fmt.Sprintf("%s %s (expired %s)", kind, e.Name, e.Expires.Format(time.RFC3339)))
+			continue
+		}
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// Pin adds an exception for the child repo, or the repo:tag if it has a tag,
+// replacing any existing exception for it.
+func (e *Exceptions) Pin(name, reason string, expires time.Time) {
+	e.Unpin(name)
+	ex := Exception{Name: name, Reason: reason, Expires: expires}
+	if strings.Contains(name, ":") {
+		e.Tag = append(e.Tag, ex)
+	} else {
+		e.Repo = append(e.Repo, ex)
+	}
+}
+
+// Unpin removes the exceptions for the child repo or repo:tag, and returns
+// whether there were any.
+func (e *Exceptions) Unpin(name string) bool {
+	found := false
+	remove := func(list []Exception) []Exception {
+		var out []Exception
+		for _, ex := range list {
+			if ex.Name == name {
+				found = true
+				continue
+			}
+			out = append(out, ex)
+		}
+		return out
+	}
+	e.Repo = remove(e.Repo)
+	e.Tag = remove(e.Tag)
+	return found
+}
+
+// ExceptionStore reads and updates the exceptions file, a local path or a
+// gs://bucket/object URI.
+type ExceptionStore struct {
+	path   string
+	gcs    *storageClient
+	object string
+}
+
+// NewExceptionStore returns a store for the given location. The client must
+// be authorized for the devstorage scope when using GCS, and is unused
+// otherwise.
+func NewExceptionStore(location string, client *http.Client) (*ExceptionStore, error) {
+	if strings.HasPrefix(location, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid exceptions location %q, expected gs://bucket/object", location)
+		}
+		return &ExceptionStore{gcs: &storageClient{client: client, bucket: parts[0]}, object: parts[1]}, nil
+	}
+	return &ExceptionStore{path: location}, nil
+}
+
+// WithExceptionStore makes the cleaner read its exceptions from the store
+// instead of CLEANER_EXCEPTION_FILE.
+func WithExceptionStore(s *ExceptionStore) Option {
+	return func(c *Cleaner) error {
+		c.exceptions = s
+		return nil
+	}
+}
+
+// Load reads the exceptions. Unlike Update, a missing exceptions file is an
+// error, so a mistake like a missing mount can't silently drop every
+// exception.
+func (s *ExceptionStore) Load(ctx context.Context) (*Exceptions, error) {
+	b, _, err := s.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ex Exceptions
+	if err := json.Unmarshal(b, &ex); err != nil {
+		return nil, fmt.Errorf("Failed to parse JSON exceptions file: %w", err)
+	}
+	return &ex, nil
+}
+
+// Update applies fn to the exceptions and writes them back, creating the file
+// if it doesn't exist. In GCS, the write only succeeds if nobody else wrote
+// in the meantime, and is retried otherwise.
+func (s *ExceptionStore) Update(ctx context.Context, fn func(*Exceptions) error) error {
+	for {
+		b, generation, err := s.read(ctx)
+		switch {
+		case errors.Is(err, os.ErrNotExist), errors.Is(err, errObjectNotExist):
+			b, generation = []byte("{}"), 0
+		case err != nil:
+			return err
+		}
+
+		var ex Exceptions
+		if err := json.Unmarshal(b, &ex); err != nil {
+			return fmt.Errorf("Failed to parse JSON exceptions file: %w", err)
+		}
+		if err := fn(&ex); err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(&ex, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if s.gcs == nil {
+			if err := ioutil.WriteFile(s.path, append(out, '\n'), 0644); err != nil {
+				return fmt.Errorf("failed to write exceptions: %w", err)
+			}
+			return nil
+		}
+		_, err = s.gcs.put(ctx, s.object, out, generation)
+		if errors.Is(err, errPreconditionFailed) {
+			continue
+		}
+		return err
+	}
+}
+
+// read returns the raw exceptions file and, in GCS, its generation.
+func (s *ExceptionStore) read(ctx context.Context) ([]byte, int64, error) {
+	if s.gcs == nil {
+		b, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read exceptions: %w", err)
+		}
+		return b, 0, nil
+	}
+
+	attrs, err := s.gcs.stat(ctx, s.object)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := s.gcs.get(ctx, s.object)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, attrs.Generation, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gammazero/workerpool"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// excludeForeign is whether to leave foreign layers, like the base layers of
+// Windows images that are pulled from mcr.microsoft.com, out of the sizes of
+// images, which needs the manifest of every image.
+var excludeForeign = getenv("CLEANER_EXCLUDE_FOREIGN_LAYERS", "false") == "true"
+
+// imageSizes are the sizes of an image's blobs stored in the registry and of
+// its foreign layers, which are stored elsewhere.
+type imageSizes struct {
+	stored, foreign int64
+}
+
+// excludeForeignLayers sets the size of every image of the plan that has
+// foreign or non-distributable layers to the size of only the blobs the
+// registry stores, as deleting the image frees nothing of the rest. Images
+// whose manifests fail to fetch keep the size the registry reported.
+func (c *Cleaner) excludeForeignLayers(plan *RepoPlan) {
+	getter, ok := c.backend.(ManifestGetter)
+	if !ok {
+		return
+	}
+
+	pool := workerpool.New(c.concurrency)
+	for _, d := range plan.Decisions {
+		if isIndex(d.MediaType) {
+			continue
+		}
+		d := d
+		pool.Submit(func() {
+			sizes, err := c.imageSizes(getter, d.Repo, d.Digest)
+			if err != nil {
+				log.Printf("%s: failed to get the layers of %s, keeping its reported size: %s", d.Repo, d.Digest, err)
+				return
+			}
+			if sizes.foreign == 0 {
+				return
+			}
+			d.Size, d.ForeignSize = sizes.stored, sizes.foreign
+		})
+	}
+	pool.StopWait()
+}
+
+// imageSizes returns the stored and foreign sizes of the image, cached by
+// digest.
+func (c *Cleaner) imageSizes(getter ManifestGetter, repo, digest string) (imageSizes, error) {
+	if sizes, ok := c.foreignSizes.Load(digest); ok {
+		return sizes.(imageSizes), nil
+	}
+
+	b, err := getter.GetManifest(repo, digest)
+	if err != nil {
+		return imageSizes{}, err
+	}
+	var m struct {
+		Config struct {
+			Size int64 `json:"size"`
+		} `json:"config"`
+		Layers []struct {
+			MediaType types.MediaType `json:"mediaType"`
+			Size      int64           `json:"size"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return imageSizes{}, err
+	}
+
+	sizes := imageSizes{stored: m.Config.Size}
+	for _, l := range m.Layers {
+		if l.MediaType.IsDistributable() {
+			sizes.stored += l.Size
+		} else {
+			sizes.foreign += l.Size
+		}
+	}
+	c.foreignSizes.Store(digest, sizes)
+	return sizes, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const cloudFunctionsAPI = "https://cloudfunctions.googleapis.com/v2"
+
+// CloudFunctionsProvider is an InUseProvider for the images of 2nd gen Cloud
+// Functions. Each function runs on a Cloud Run service, whose revisions hold
+// the images built into Artifact Registry.
+type CloudFunctionsProvider struct {
+	client   *http.Client
+	projects []string
+}
+
+// NewCloudFunctionsProvider creates a provider for the functions of the
+// projects. The HTTP client must be authorized for the Cloud Functions and
+// Cloud Run APIs.
+func NewCloudFunctionsProvider(client *http.Client, projects []string) *CloudFunctionsProvider {
+	return &CloudFunctionsProvider{client: client, projects: projects}
+}
+
+// Name implements InUseProvider.
+func (p *CloudFunctionsProvider) Name() string { return "Cloud Functions" }
+
+// InUse implements InUseProvider.
+func (p *CloudFunctionsProvider) InUse(ctx context.Context) ([]string, error) {
+	var images []string
+	for _, project := range p.projects {
+		var services []string
+		u := fmt.Sprintf("%s/projects/%s/locations/-/functions", cloudFunctionsAPI, project)
+		err := googleList(ctx, p.client, u, func(body []byte) (string, error) {
+			var page struct {
+				Functions []struct {
+					Environment   string `json:"environment"`
+					ServiceConfig struct {
+						Service string `json:"service"`
+					} `json:"serviceConfig"`
+				} `json:"functions"`
+				NextPageToken string `json:"nextPageToken"`
+			}
+			if err := json.Unmarshal(body, &page); err != nil {
+				return "", err
+			}
+			for _, f := range page.Functions {
+				if f.Environment == "GEN_2" && f.ServiceConfig.Service != "" {
+					services = append(services, f.ServiceConfig.Service)
+				}
+			}
+			return page.NextPageToken, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, service := range services {
+			revisions, err := cloudRunRevisionImages(ctx, p.client, service)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, revisions...)
+		}
+	}
+	return images, nil
+}
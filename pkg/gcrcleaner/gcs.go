@@ -0,0 +1,194 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const gcsBaseURL = "https://storage.googleapis.com"
+
+// errPreconditionFailed is returned by the storage client when a generation
+// precondition does not match.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// errObjectNotExist is returned by the storage client when an object is
+// missing.
+var errObjectNotExist = errors.New("object does not exist")
+
+// storageClient is a minimal client for the GCS JSON API. The supplied HTTP
+// client must already be authorized for the devstorage scope.
+type storageClient struct {
+	client *http.Client
+	bucket string
+}
+
+// objectAttrs is the subset of GCS object metadata the cleaner uses.
+type objectAttrs struct {
+	Name        string    `json:"name"`
+	Generation  int64     `json:"generation,string"`
+	TimeCreated time.Time `json:"timeCreated"`
+	Updated     time.Time `json:"updated"`
+}
+
+// put uploads data to the named object. If ifGeneration is non-negative the
+// upload only succeeds when the object's current generation matches it; 0
+// means the object must not exist yet.
+func (s *storageClient) put(ctx context.Context, name string, data []byte, ifGeneration int64) (*objectAttrs, error) {
+	q := url.Values{}
+	q.Set("uploadType", "media")
+	q.Set("name", name)
+	if ifGeneration >= 0 {
+		q.Set("ifGenerationMatch", strconv.FormatInt(ifGeneration, 10))
+	}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", gcsBaseURL, url.PathEscape(s.bucket), q.Encode())
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var attrs objectAttrs
+	if err := s.do(ctx, req, &attrs); err != nil {
+		return nil, fmt.Errorf("failed to write gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return &attrs, nil
+}
+
+// get downloads the contents of the named object.
+func (s *storageClient) get(ctx context.Context, name string) ([]byte, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", gcsBaseURL, url.PathEscape(s.bucket), url.PathEscape(name))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if err := s.do(ctx, req, &data); err != nil {
+		return nil, fmt.Errorf("failed to read gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return data, nil
+}
+
+// stat returns the metadata of the named object.
+func (s *storageClient) stat(ctx context.Context, name string) (*objectAttrs, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", gcsBaseURL, url.PathEscape(s.bucket), url.PathEscape(name))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs objectAttrs
+	if err := s.do(ctx, req, &attrs); err != nil {
+		return nil, fmt.Errorf("failed to stat gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return &attrs, nil
+}
+
+// delete removes the named object, only if its generation matches when
+// ifGeneration is positive.
+func (s *storageClient) delete(ctx context.Context, name string, ifGeneration int64) error {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", gcsBaseURL, url.PathEscape(s.bucket), url.PathEscape(name))
+	if ifGeneration > 0 {
+		u += "?ifGenerationMatch=" + strconv.FormatInt(ifGeneration, 10)
+	}
+	req, err := http.NewRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := s.do(ctx, req, nil); err != nil {
+		return fmt.Errorf("failed to delete gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return nil
+}
+
+// list returns the names of the objects whose names start with prefix.
+func (s *storageClient) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("prefix", prefix)
+		q.Set("fields", "items/name,nextPageToken")
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", gcsBaseURL, url.PathEscape(s.bucket), q.Encode())
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Items         []objectAttrs `json:"items"`
+			NextPageToken string        `json:"nextPageToken"`
+		}
+		if err := s.do(ctx, req, &page); err != nil {
+			return nil, fmt.Errorf("failed to list gs://%s/%s: %w", s.bucket, prefix, err)
+		}
+		for _, o := range page.Items {
+			names = append(names, o.Name)
+		}
+		if token = page.NextPageToken; token == "" {
+			return names, nil
+		}
+	}
+}
+
+// do sends the request and decodes the response into out. A *[]byte out
+// receives the raw body.
+func (s *storageClient) do(ctx context.Context, req *http.Request, out interface{}) error {
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusPreconditionFailed:
+		return errPreconditionFailed
+	case http.StatusNotFound:
+		return errObjectNotExist
+	default:
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	switch o := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*o = body
+		return nil
+	default:
+		return json.Unmarshal(body, out)
+	}
+}
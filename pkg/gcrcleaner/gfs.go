@@ -0,0 +1,104 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"time"
+)
+
+// Reasons a manifest is kept by a GFS schedule.
+const (
+	ReasonGFSRecent  = "gfs: recent"
+	ReasonGFSDaily   = "gfs: daily"
+	ReasonGFSWeekly  = "gfs: weekly"
+	ReasonGFSMonthly = "gfs: monthly"
+)
+
+// GFS is a grandfather-father-son schedule that keeps every manifest built
+// within All, the newest manifest of every day within Daily, of every week
+// within Weekly and of every month after that. The durations are measured
+// back from now, accept days such as 30d, and default to 7d, 30d and 182d.
+type GFS struct {
+	All    string `json:"all,omitempty"`
+	Daily  string `json:"daily,omitempty"`
+	Weekly string `json:"weekly,omitempty"`
+
+	all, daily, weekly time.Duration
+}
+
+// compile parses the schedule's durations.
+func (g *GFS) compile() error {
+	for _, f := range []struct {
+		name     string
+		value    string
+		fallback time.Duration
+		out      *time.Duration
+	}{
+		{"all", g.All, 7 * 24 * time.Hour, &g.all},
+		{"daily", g.Daily, 30 * 24 * time.Hour, &g.daily},
+		{"weekly", g.Weekly, 182 * 24 * time.Hour, &g.weekly},
+	} {
+		*f.out = f.fallback
+		if f.value == "" {
+			continue
+		}
+		d, err := ParseDuration(f.value)
+		if err != nil {
+			return fmt.Errorf("invalid gfs.%s: %w", f.name, err)
+		}
+		*f.out = d
+	}
+	if g.all > g.daily || g.daily > g.weekly {
+		return fmt.Errorf("gfs durations must satisfy all <= daily <= weekly")
+	}
+	return nil
+}
+
+// keep marks the tagged manifests the schedule retains as kept. Decisions
+// must be sorted by build time, newest first, so the first manifest seen in a
+// bucket is the newest one.
+func (g *GFS) keep(decisions []*Decision, now time.Time) {
+	seen := make(map[string]bool)
+	for _, d := range decisions {
+		if len(d.Tags) == 0 || isAttachment(d.Tags) {
+			continue
+		}
+
+		age := now.Sub(d.Built)
+		var bucket, reason string
+		switch {
+		case age < g.all:
+			reason = ReasonGFSRecent
+		case age < g.daily:
+			bucket, reason = d.Built.Format("day 2006-01-02"), ReasonGFSDaily
+		case age < g.weekly:
+			year, week := d.Built.ISOWeek()
+			bucket, reason = fmt.Sprintf("week %d-%02d", year, week), ReasonGFSWeekly
+		default:
+			bucket, reason = d.Built.Format("month 2006-01"), ReasonGFSMonthly
+		}
+
+		if bucket != "" {
+			if seen[bucket] {
+				continue
+			}
+			seen[bucket] = true
+		}
+		if d.Delete {
+			d.Delete, d.Reason = false, reason
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGFSKeep(t *testing.T) {
+	// A Friday in ISO week 11, which runs from Monday March 11th.
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	at := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2024, month, day, hour, 0, 0, 0, time.UTC)
+	}
+
+	type manifest struct {
+		built  time.Time
+		tags   []string
+		kept   string // the reason of a manifest the keep window already kept
+		reason string // the expected reason, or "" if it is still deleted
+	}
+	cases := []struct {
+		name      string
+		manifests []manifest // newest first
+	}{
+		{
+			name: "everything within all is kept",
+			manifests: []manifest{
+				{built: now.Add(-time.Hour), tags: []string{"a"}, reason: ReasonGFSRecent},
+				{built: now.Add(-23 * time.Hour), tags: []string{"b"}, reason: ReasonGFSRecent},
+			},
+		},
+		{
+			name: "all ends exactly a day back",
+			manifests: []manifest{
+				{built: now.Add(-24 * time.Hour), tags: []string{"a"}, reason: ReasonGFSDaily},
+				{built: now.Add(-25 * time.Hour), tags: []string{"b"}},
+			},
+		},
+		{
+			name: "daily buckets are calendar days",
+			manifests: []manifest{
+				{built: at(time.March, 14, 1), tags: []string{"a"}, reason: ReasonGFSDaily},
+				{built: at(time.March, 13, 23), tags: []string{"b"}, reason: ReasonGFSDaily},
+				{built: at(time.March, 13, 0), tags: []string{"c"}},
+			},
+		},
+		{
+			name: "weekly buckets are ISO weeks",
+			manifests: []manifest{
+				{built: at(time.March, 12, 12), tags: []string{"a"}, reason: ReasonGFSWeekly},
+				{built: at(time.March, 11, 0), tags: []string{"b"}},
+				{built: at(time.March, 10, 23), tags: []string{"c"}, reason: ReasonGFSWeekly},
+				{built: at(time.March, 4, 0), tags: []string{"d"}},
+			},
+		},
+		{
+			name: "monthly buckets are calendar months",
+			manifests: []manifest{
+				{built: at(time.February, 20, 0), tags: []string{"a"}, reason: ReasonGFSMonthly},
+				{built: at(time.February, 1, 0), tags: []string{"b"}},
+				{built: at(time.January, 31, 23), tags: []string{"c"}, reason: ReasonGFSMonthly},
+			},
+		},
+		{
+			name: "a manifest the keep window kept fills its bucket",
+			manifests: []manifest{
+				{built: at(time.March, 14, 11), tags: []string{"a"}, kept: ReasonKeepWindow, reason: ReasonKeepWindow},
+				{built: at(time.March, 14, 10), tags: []string{"b"}},
+				{built: at(time.February, 20, 0), tags: []string{"c"}, kept: ReasonKeepWindow, reason: ReasonKeepWindow},
+				{built: at(time.February, 19, 0), tags: []string{"d"}},
+			},
+		},
+		{
+			name: "untagged manifests are neither kept nor fill their bucket",
+			manifests: []manifest{
+				{built: at(time.March, 14, 11)},
+				{built: at(time.March, 14, 10), tags: []string{"a"}, reason: ReasonGFSDaily},
+				{built: now.Add(-time.Hour)},
+			},
+		},
+	}
+
+	g := &GFS{All: "1d", Daily: "3d", Weekly: "21d"}
+	if err := g.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var decisions []*Decision
+			for _, m := range tc.manifests {
+				d := &Decision{Tags: m.tags, Built: m.built, Delete: true, Reason: ReasonUntagged}
+				if m.kept != "" {
+					d.Delete, d.Reason = false, m.kept
+				}
+				decisions = append(decisions, d)
+			}
+			g.keep(decisions, now)
+			for i, d := range decisions {
+				want := tc.manifests[i].reason
+				switch {
+				case want == "" && !d.Delete:
+					t.Errorf("manifest %d built %s kept: %s, want deleted", i, d.Built, d.Reason)
+				case want != "" && (d.Delete || d.Reason != want):
+					t.Errorf("manifest %d built %s = %v %q, want kept: %s", i, d.Built, d.Delete, d.Reason, want)
+				}
+			}
+		})
+	}
+}
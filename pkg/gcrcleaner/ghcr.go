@@ -0,0 +1,352 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+const githubAPI = "https://api.github.com"
+
+// GHCRBackend is the Backend for GitHub Container Registry. The OCI API on
+// ghcr.io doesn't allow deletes, so it lists and deletes package versions
+// through the GitHub packages API instead. Child repos are the container
+// packages of the owner in the base repo, e.g. ghcr.io/my-org.
+type GHCRBackend struct {
+	// User is true if the owner is a user rather than an organization.
+	User bool
+
+	client *http.Client
+	token  func() (string, error)
+	app    *githubAppToken
+
+	lock     sync.Mutex
+	versions map[string]int64
+}
+
+// NewGHCRBackendWithToken creates a GHCR backend authenticated with a
+// personal access token with the read:packages and delete:packages scopes.
+func NewGHCRBackendWithToken(token string) *GHCRBackend {
+	return &GHCRBackend{
+		client:   http.DefaultClient,
+		token:    func() (string, error) { return token, nil },
+		versions: make(map[string]int64),
+	}
+}
+
+// NewGHCRBackendWithApp creates a GHCR backend authenticated as a GitHub App
+// installation with packages read and write permission. The installation
+// token is refreshed before it expires.
+func NewGHCRBackendWithApp(appID, installationID string, privateKeyPEM []byte) (*GHCRBackend, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode GitHub App private key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GitHub App private key: %w", err)
+	}
+
+	app := &githubAppToken{
+		appID:          appID,
+		installationID: installationID,
+		key:            key,
+		client:         http.DefaultClient,
+	}
+	return &GHCRBackend{
+		client:   http.DefaultClient,
+		token:    app.Token,
+		app:      app,
+		versions: make(map[string]int64),
+	}, nil
+}
+
+// githubPackage is a package returned by the GitHub packages API.
+type githubPackage struct {
+	Name string `json:"name"`
+}
+
+// githubVersion is a package version returned by the GitHub packages API.
+type githubVersion struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Metadata  struct {
+		Container struct {
+			Tags []string `json:"tags"`
+		} `json:"container"`
+	} `json:"metadata"`
+}
+
+// Children implements Backend.
+func (g *GHCRBackend) Children(base string) ([]string, error) {
+	owner, err := ghcrOwner(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for page := 1; ; page++ {
+		var pkgs []githubPackage
+		path := fmt.Sprintf("%s/packages?package_type=container&per_page=100&page=%d", g.ownerPath(owner), page)
+		if err := g.do(http.MethodGet, path, &pkgs); err != nil {
+			return nil, err
+		}
+		for _, p := range pkgs {
+			children = append(children, p.Name)
+		}
+		if len(pkgs) < 100 {
+			return children, nil
+		}
+	}
+}
+
+// List implements Backend. GitHub doesn't report sizes, so every manifest has
+// a size of zero.
+func (g *GHCRBackend) List(repo string) (*gcrgoogle.Tags, error) {
+	owner, pkg, err := ghcrPackage(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := &gcrgoogle.Tags{
+		Name:      repo,
+		Manifests: make(map[string]gcrgoogle.ManifestInfo),
+	}
+	for page := 1; ; page++ {
+		var versions []githubVersion
+		path := fmt.Sprintf("%s/packages/container/%s/versions?per_page=100&page=%d",
+			g.ownerPath(owner), url.PathEscape(pkg), page)
+		if err := g.do(http.MethodGet, path, &versions); err != nil {
+			return nil, err
+		}
+
+		g.lock.Lock()
+		for _, v := range versions {
+			g.versions[repo+"@"+v.Name] = v.ID
+			tags.Manifests[v.Name] = gcrgoogle.ManifestInfo{
+				Tags:     v.Metadata.Container.Tags,
+				Created:  v.CreatedAt,
+				Uploaded: v.UpdatedAt,
+			}
+			tags.Tags = append(tags.Tags, v.Metadata.Container.Tags...)
+		}
+		g.lock.Unlock()
+
+		if len(versions) < 100 {
+			break
+		}
+	}
+
+	// Match the alphabetical tag order of the GCR API.
+	sort.Strings(tags.Tags)
+	return tags, nil
+}
+
+// DeleteTag implements Backend. The packages API can't remove a single tag,
+// only delete the manifest's version with all of its tags, so this always
+// fails with ErrUntagUnsupported.
+func (g *GHCRBackend) DeleteTag(repo, tag string) error {
+	return fmt.Errorf("Failed to untag %s:%s: %w", repo, tag, ErrUntagUnsupported)
+}
+
+// DeleteManifest implements Backend by deleting the package version.
+func (g *GHCRBackend) DeleteManifest(repo, digest string) error {
+	owner, pkg, err := ghcrPackage(repo)
+	if err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	id, ok := g.versions[repo+"@"+digest]
+	g.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("Failed to delete %s@%s: %w", repo, digest, errGHCRNotFound)
+	}
+
+	path := fmt.Sprintf("%s/packages/container/%s/versions/%d", g.ownerPath(owner), url.PathEscape(pkg), id)
+	if err := g.do(http.MethodDelete, path, nil); err != nil {
+		return fmt.Errorf("Failed to delete %s@%s: %w", repo, digest, err)
+	}
+	return nil
+}
+
+// errGHCRNotFound is returned when deleting a digest that is not a known
+// package version.
+var errGHCRNotFound = errors.New("unknown package version")
+
+// ownerPath returns the API path of the package owner.
+func (g *GHCRBackend) ownerPath(owner string) string {
+	if g.User {
+		return "/users/" + url.PathEscape(owner)
+	}
+	return "/orgs/" + url.PathEscape(owner)
+}
+
+// do sends an authenticated request to the GitHub API and decodes the JSON
+// response into out.
+func (g *GHCRBackend) do(method, path string, out interface{}) error {
+	token, err := g.token()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, githubAPI+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{method: method, path: path, code: resp.StatusCode, body: bytes.TrimSpace(body)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// ghcrOwner returns the owner of a ghcr.io/owner base repo.
+func ghcrOwner(base string) (string, error) {
+	parts := strings.Split(base, "/")
+	if len(parts) != 2 || parts[0] != "ghcr.io" || parts[1] == "" {
+		return "", fmt.Errorf("invalid GHCR base repo %q, expected ghcr.io/owner", base)
+	}
+	return parts[1], nil
+}
+
+// ghcrPackage splits a ghcr.io/owner/package repo. Package names may contain
+// slashes.
+func ghcrPackage(repo string) (string, string, error) {
+	parts := strings.SplitN(repo, "/", 3)
+	if len(parts) != 3 || parts[0] != "ghcr.io" || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("invalid GHCR repo %q, expected ghcr.io/owner/package", repo)
+	}
+	return parts[1], parts[2], nil
+}
+
+// githubAppToken mints and caches GitHub App installation tokens.
+type githubAppToken struct {
+	appID          string
+	installationID string
+	key            *rsa.PrivateKey
+	client         *http.Client
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Token returns a valid installation token, minting a new one when the
+// cached token is within five minutes of expiring.
+func (a *githubAppToken) Token() (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.token != "" && time.Until(a.expires) > 5*time.Minute {
+		return a.token, nil
+	}
+
+	jwt, err := a.jwt()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("%s/app/installations/%s/access_tokens", githubAPI, url.PathEscape(a.installationID)), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get GitHub App installation token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("failed to get GitHub App installation token: unexpected status %d: %s",
+			resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var out struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", err
+	}
+	a.token, a.expires = out.Token, out.ExpiresAt
+	return a.token, nil
+}
+
+// jwt returns an RS256-signed JWT identifying the app, valid for ten minutes.
+func (a *githubAppToken) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// Backdate to allow for clock drift, as GitHub recommends.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// errGitLabNotFound is returned by the GitLab client on a 404.
+var errGitLabNotFound = errors.New("not found")
+
+// GitLabBackend is the Backend for the GitLab container registry, using the
+// GitLab registry API. The base repo is a group or project path under the
+// registry host, e.g. registry.gitlab.com/my-group, and every registry
+// repository below it is a child repo.
+//
+// The API only exposes tags, so manifests are grouped by the digest their
+// tags point at, untagged manifests are never listed, and deleting a manifest
+// deletes its tags and leaves the blobs to GitLab's garbage collection. Tags
+// are listed and deleted in bulk through the GraphQL API, as the REST API
+// only lists the digest of one tag at a time.
+type GitLabBackend struct {
+	baseURL string
+	token   string
+	client  *http.Client
+
+	lock  sync.Mutex
+	repos map[string]gitlabRepository
+	tags  map[string][]string
+}
+
+// gitlabRepository is a registry repository returned by the GitLab API.
+type gitlabRepository struct {
+	ID        int64  `json:"id"`
+	ProjectID int64  `json:"project_id"`
+	Path      string `json:"path"`
+}
+
+// gitlabTag is a registry tag returned by the GitLab GraphQL API.
+type gitlabTag struct {
+	Name      string      `json:"name"`
+	Digest    string      `json:"digest"`
+	TotalSize json.Number `json:"totalSize"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// gitlabTagsQuery lists a page of the tags of a registry repository with
+// their digests.
+const gitlabTagsQuery = `query($id: ContainerRepositoryID!, $after: String) {
+  containerRepository(id: $id) {
+    tags(first: 100, after: $after) {
+      nodes { name digest totalSize createdAt }
+      pageInfo { hasNextPage endCursor }
+    }
+  }
+}`
+
+// gitlabDeleteTagsMutation deletes tags of a registry repository by name.
+const gitlabDeleteTagsMutation = `mutation($id: ContainerRepositoryID!, $tags: [String!]!) {
+  destroyContainerRepositoryTags(input: {id: $id, tagNames: $tags}) {
+    errors
+  }
+}`
+
+// gitlabDeleteTagsLimit is how many tags a single mutation may delete.
+const gitlabDeleteTagsLimit = 20
+
+// NewGitLabBackend creates a GitLab backend for the GitLab instance at
+// baseURL (https://gitlab.com if empty) authenticated with a project, group
+// or personal access token with the api scope.
+func NewGitLabBackend(baseURL, token string) *GitLabBackend {
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+	return &GitLabBackend{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  http.DefaultClient,
+		repos:   make(map[string]gitlabRepository),
+		tags:    make(map[string][]string),
+	}
+}
+
+// Children implements Backend. The base path is tried as a group first and
+// as a project second.
+func (g *GitLabBackend) Children(base string) ([]string, error) {
+	host, path := splitHost(base)
+
+	var repos []gitlabRepository
+	err := g.paginate(fmt.Sprintf("/groups/%s/registry/repositories", url.PathEscape(path)), &repos)
+	if errors.Is(err, errGitLabNotFound) {
+		repos = nil
+		err = g.paginate(fmt.Sprintf("/projects/%s/registry/repositories", url.PathEscape(path)), &repos)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	g.lock.Lock()
+	for _, r := range repos {
+		g.repos[host+"/"+r.Path] = r
+		if child := strings.TrimPrefix(r.Path, path+"/"); child != r.Path {
+			children = append(children, child)
+		}
+	}
+	g.lock.Unlock()
+	return children, nil
+}
+
+// List implements Backend.
+func (g *GitLabBackend) List(repo string) (*gcrgoogle.Tags, error) {
+	r, err := g.repository(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []gitlabTag
+	var after *string
+	for {
+		var out struct {
+			ContainerRepository *struct {
+				Tags struct {
+					Nodes    []gitlabTag `json:"nodes"`
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+				} `json:"tags"`
+			} `json:"containerRepository"`
+		}
+		vars := map[string]interface{}{"id": r.globalID(), "after": after}
+		if err := g.graphql(gitlabTagsQuery, vars, &out); err != nil {
+			return nil, err
+		}
+		if out.ContainerRepository == nil {
+			return nil, errGitLabNotFound
+		}
+		page := out.ContainerRepository.Tags
+		list = append(list, page.Nodes...)
+		if !page.PageInfo.HasNextPage {
+			break
+		}
+		after = &page.PageInfo.EndCursor
+	}
+
+	tags := &gcrgoogle.Tags{
+		Name:      repo,
+		Manifests: make(map[string]gcrgoogle.ManifestInfo),
+	}
+	byDigest := make(map[string][]string)
+	for _, t := range list {
+		m := tags.Manifests[t.Digest]
+		m.Tags = append(m.Tags, t.Name)
+		m.Size, _ = strconv.ParseUint(t.TotalSize.String(), 10, 64)
+		if !t.CreatedAt.IsZero() && (m.Created.IsZero() || t.CreatedAt.Before(m.Created)) {
+			m.Created, m.Uploaded = t.CreatedAt, t.CreatedAt
+		}
+		tags.Manifests[t.Digest] = m
+		tags.Tags = append(tags.Tags, t.Name)
+		byDigest[repo+"@"+t.Digest] = append(byDigest[repo+"@"+t.Digest], t.Name)
+	}
+	sort.Strings(tags.Tags)
+
+	g.lock.Lock()
+	for k, v := range byDigest {
+		g.tags[k] = v
+	}
+	g.lock.Unlock()
+	return tags, nil
+}
+
+// DeleteTag implements Backend. Tags that are already gone count as deleted.
+func (g *GitLabBackend) DeleteTag(repo, tag string) error {
+	r, err := g.repository(repo)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("/projects/%d/registry/repositories/%d/tags/%s", r.ProjectID, r.ID, url.PathEscape(tag))
+	if err := g.do(http.MethodDelete, path, nil, nil); err != nil && !errors.Is(err, errGitLabNotFound) {
+		return fmt.Errorf("Failed to delete %s:%s: %w", repo, tag, err)
+	}
+	return nil
+}
+
+// DeleteManifest implements Backend by deleting every tag pointing at the
+// digest, up to gitlabDeleteTagsLimit per request. Tags that are already
+// gone count as deleted.
+func (g *GitLabBackend) DeleteManifest(repo, digest string) error {
+	g.lock.Lock()
+	tags := g.tags[repo+"@"+digest]
+	g.lock.Unlock()
+	if len(tags) == 0 {
+		return nil
+	}
+
+	r, err := g.repository(repo)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(tags); start += gitlabDeleteTagsLimit {
+		end := start + gitlabDeleteTagsLimit
+		if end > len(tags) {
+			end = len(tags)
+		}
+		var out struct {
+			DestroyContainerRepositoryTags struct {
+				Errors []string `json:"errors"`
+			} `json:"destroyContainerRepositoryTags"`
+		}
+		vars := map[string]interface{}{"id": r.globalID(), "tags": tags[start:end]}
+		if err := g.graphql(gitlabDeleteTagsMutation, vars, &out); err != nil {
+			return fmt.Errorf("Failed to delete %s@%s: %w", repo, digest, err)
+		}
+		if errs := out.DestroyContainerRepositoryTags.Errors; len(errs) > 0 {
+			return fmt.Errorf("Failed to delete %s@%s: %s", repo, digest, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// globalID returns the GraphQL ID of the registry repository.
+func (r gitlabRepository) globalID() string {
+	return fmt.Sprintf("gid://gitlab/ContainerRepository/%d", r.ID)
+}
+
+// repository returns the registry repository for a fully-qualified repo,
+// listing the repo's parent if it hasn't been seen yet.
+func (g *GitLabBackend) repository(repo string) (gitlabRepository, error) {
+	g.lock.Lock()
+	r, ok := g.repos[repo]
+	g.lock.Unlock()
+	if ok {
+		return r, nil
+	}
+
+	if i := strings.LastIndex(repo, "/"); i > 0 {
+		if _, err := g.Children(repo[:i]); err != nil && !errors.Is(err, errGitLabNotFound) {
+			return r, err
+		}
+	}
+
+	g.lock.Lock()
+	r, ok = g.repos[repo]
+	g.lock.Unlock()
+	if !ok {
+		return r, fmt.Errorf("GitLab registry repository %s not found", repo)
+	}
+	return r, nil
+}
+
+// paginate fetches every page of a list endpoint into out, a pointer to a
+// slice.
+func (g *GitLabBackend) paginate(path string, out interface{}) error {
+	var all []json.RawMessage
+	for page := 1; ; page++ {
+		var items []json.RawMessage
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		if err := g.do(http.MethodGet, fmt.Sprintf("%s%sper_page=100&page=%d", path, sep, page), nil, &items); err != nil {
+			return err
+		}
+		all = append(all, items...)
+		if len(items) < 100 {
+			break
+		}
+	}
+
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// graphql sends a query or mutation to the GitLab GraphQL API and decodes
+// the data of the response into out.
+func (g *GitLabBackend) graphql(query string, vars map[string]interface{}, out interface{}) error {
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	in := map[string]interface{}{"query": query, "variables": vars}
+	if err := g.do(http.MethodPost, "/graphql", in, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		msgs := make([]string, 0, len(resp.Errors))
+		for _, e := range resp.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("GraphQL: %s", strings.Join(msgs, ", "))
+	}
+	return json.Unmarshal(resp.Data, out)
+}
+
+// do sends an authenticated request to the GitLab API, with in as the JSON
+// body if not nil, and decodes the JSON response into out. The /graphql path
+// is the GraphQL API, and the rest are REST API paths.
+func (g *GitLabBackend) do(method, path string, in, out interface{}) error {
+	var reqBody io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	graphql := strings.HasPrefix(path, "/graphql")
+	u := g.baseURL + "/api/v4" + path
+	if graphql {
+		u = g.baseURL + "/api" + path
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	if graphql {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	} else {
+		req.Header.Set("PRIVATE-TOKEN", g.token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errGitLabNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{method: method, path: path, code: resp.StatusCode, body: bytes.TrimSpace(body)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// splitHost splits a repo into its registry host and path.
+func splitHost(repo string) (string, string) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// gcrHosts are the Container Registry hosts and the Artifact Registry
+// repositories that serve them once a project moves to Artifact Registry.
+var gcrHosts = []struct {
+	host      string
+	artifacts string
+}{
+	{"gcr.io", "us-docker.pkg.dev/%s/gcr.io"},
+	{"us.gcr.io", "us-docker.pkg.dev/%s/us.gcr.io"},
+	{"eu.gcr.io", "europe-docker.pkg.dev/%s/eu.gcr.io"},
+	{"asia.gcr.io", "asia-docker.pkg.dev/%s/asia.gcr.io"},
+}
+
+// ProjectRepos returns the base repos of every Container Registry host of
+// the project, followed by their Artifact Registry equivalents.
+func ProjectRepos(project string) []string {
+	var repos []string
+	for _, h := range gcrHosts {
+		repos = append(repos, fmt.Sprintf("%s/%s", h.host, project))
+	}
+	for _, h := range gcrHosts {
+		repos = append(repos, fmt.Sprintf(h.artifacts, project))
+	}
+	return repos
+}
+
+// IsNotFound returns true if the error is a registry reporting that a repo
+// or manifest doesn't exist.
+func IsNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// Exists returns true if the base repo exists. Registries that have never
+// been pushed to in a region report the base repo as not found.
+func (c *Cleaner) Exists() (bool, error) {
+	if _, err := c.backend.Children(c.base); err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to list base repo %s: %w", c.base, err)
+	}
+	return true, nil
+}
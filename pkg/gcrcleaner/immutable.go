@@ -0,0 +1,93 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ImmutableTagChecker is implemented by backends whose repos can forbid
+// deleting or moving tags, like Artifact Registry repositories with immutable
+// tags.
+type ImmutableTagChecker interface {
+	// ImmutableTags returns true if the tags of the repo can't be deleted.
+	ImmutableTags(repo string) (bool, error)
+}
+
+// arRepository returns the Artifact Registry API path of the repository a
+// repo is in, and false if the repo isn't in Artifact Registry.
+func arRepository(repo string) (string, bool) {
+	parts := strings.SplitN(repo, "/", 4)
+	if len(parts) < 3 || !strings.HasSuffix(parts[0], "-docker.pkg.dev") {
+		return "", false
+	}
+	location := strings.TrimSuffix(parts[0], "-docker.pkg.dev")
+	return fmt.Sprintf("projects/%s/locations/%s/repositories/%s",
+		url.PathEscape(parts[1]), url.PathEscape(location), url.PathEscape(parts[2])), true
+}
+
+// ImmutableTags implements ImmutableTagChecker by reading the Artifact
+// Registry repository's Docker settings, once per repository. Container
+// Registry tags are always mutable, and without an Artifact Registry client
+// tags are assumed to be mutable.
+func (g *gcrBackend) ImmutableTags(repo string) (bool, error) {
+	path, ok := arRepository(repo)
+	if !ok || g.arClient == nil {
+		return false, nil
+	}
+	if immutable, ok := g.immutable.Load(path); ok {
+		return immutable.(bool), nil
+	}
+
+	var repository struct {
+		DockerConfig struct {
+			ImmutableTags bool `json:"immutableTags"`
+		} `json:"dockerConfig"`
+	}
+	if err := g.arGet(fmt.Sprintf("%s/%s", artifactRegistryAPI, path), &repository); err != nil {
+		return false, err
+	}
+	g.immutable.Store(path, repository.DockerConfig.ImmutableTags)
+	return repository.DockerConfig.ImmutableTags, nil
+}
+
+// immutableTags returns true if the backend reports the repo's tags as
+// immutable. Failures to check are logged and treated as mutable tags.
+func (c *Cleaner) immutableTags(repo string) bool {
+	checker, ok := c.backend.(ImmutableTagChecker)
+	if !ok {
+		return false
+	}
+	immutable, err := checker.ImmutableTags(repo)
+	if err != nil {
+		log.Printf("%s: failed to check for immutable tags: %s", repo, err)
+		return false
+	}
+	return immutable
+}
+
+// immutableError replaces the error of deleting a tagged manifest from a repo
+// with immutable tags, which registries report as an opaque 400, with
+// ErrImmutableTags.
+func immutableError(d *Decision, err error) error {
+	if len(d.Tags) == 0 || statusCode(err) != http.StatusBadRequest {
+		return err
+	}
+	return fmt.Errorf("%w, so manifests tagged %v can't be deleted (%s)", ErrImmutableTags, d.Tags, err)
+}
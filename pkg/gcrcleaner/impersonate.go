@@ -0,0 +1,81 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const iamCredentialsAPI = "https://iamcredentials.googleapis.com/v1"
+
+// ImpersonatedTokenSource returns a token source for access tokens of the
+// target service account with the given scopes, generated through the IAM
+// Credentials API with the client, whose identity needs the Service Account
+// Token Creator role on the target. Tokens last an hour, so callers should
+// wrap it in oauth2.ReuseTokenSource, as NewTokenAuthenticator and
+// oauth2.NewClient do.
+func ImpersonatedTokenSource(client *http.Client, target string, scopes []string) oauth2.TokenSource {
+	return &impersonatedTokenSource{client: client, target: target, scopes: scopes}
+}
+
+// impersonatedTokenSource generates access tokens of a service account.
+type impersonatedTokenSource struct {
+	client *http.Client
+	target string
+	scopes []string
+}
+
+// Token implements oauth2.TokenSource.
+func (i *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	b, err := json.Marshal(map[string]interface{}{"scope": i.scopes, "lifetime": "3600s"})
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("%s/projects/-/serviceAccounts/%s:generateAccessToken", iamCredentialsAPI, url.PathEscape(i.target))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := i.client.Do(req.WithContext(context.Background()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", i.target, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", i.target,
+			&statusError{method: http.MethodPost, path: u, code: resp.StatusCode, body: bytes.TrimSpace(body)})
+	}
+
+	var token struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token of %s: %w", i.target, err)
+	}
+	return &oauth2.Token{AccessToken: token.AccessToken, TokenType: "Bearer", Expiry: token.ExpireTime}, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InUseProvider lists the images used by workloads the Kubernetes scan
+// doesn't see, like Cloud Run services. The images it returns are protected
+// like in-use images in the clusters.
+type InUseProvider interface {
+	// Name describes the provider in errors, e.g. "Cloud Run".
+	Name() string
+
+	// InUse returns the images in use, as repo:tag, repo@digest or
+	// repo:tag@digest references.
+	InUse(ctx context.Context) ([]string, error)
+}
+
+// WithInUseProvider protects the images the provider lists as in use on top
+// of those found by the cluster scan. Like the scan, it is skipped with
+// WithoutClusterScan. The images are reused for a minute, so cleaners of many
+// base repos created together share a single listing.
+func WithInUseProvider(p InUseProvider) Option {
+	cached := &cachedProvider{InUseProvider: p}
+	return func(c *Cleaner) error {
+		c.providers = append(c.providers, cached)
+		return nil
+	}
+}
+
+// cachedProvider reuses the images of a provider for inUseScanTTL.
+type cachedProvider struct {
+	InUseProvider
+
+	lock   sync.Mutex
+	images []string
+	at     time.Time
+}
+
+func (p *cachedProvider) InUse(ctx context.Context) ([]string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if time.Since(p.at) < inUseScanTTL {
+		return p.images, nil
+	}
+	images, err := p.InUseProvider.InUse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.images, p.at = images, time.Now()
+	return images, nil
+}
+
+// providerExceptions lists the images of every provider and adds them to the
+// tag exceptions, or, for images referenced by digest, to the returned digest
+// exceptions, keyed by repo@digest.
+func (c *Cleaner) providerExceptions(tagExcept map[string]string) (map[string]string, error) {
+	digestExcept := make(map[string]string)
+	for _, p := range c.providers {
+		images, err := p.InUse(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list images in use by %s: %w", p.Name(), err)
+		}
+		code := inUseCode(CodeInUse, p.Name())
+		for _, image := range images {
+			tag, digest := splitImage(image)
+			if tag != "" {
+				tagExcept[tag] = code
+			}
+			if digest != "" {
+				digestExcept[digest] = code
+			}
+		}
+	}
+	return digestExcept, nil
+}
+
+// splitImage splits an image reference into its repo:tag and repo@digest
+// forms, either of which may be empty. Images without a tag or digest use
+// latest.
+func splitImage(image string) (string, string) {
+	image = strings.TrimSpace(image)
+	if image == "" {
+		return "", ""
+	}
+	var tag, digest string
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, digest = image[:i], image[i:]
+	}
+	repo := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repo = image[:i]
+		tag = image
+	} else if digest == "" {
+		tag = image + ":latest"
+	}
+	if digest != "" {
+		digest = repo + digest
+	}
+	return tag, digest
+}
+
+// isDigestExcepted returns true if the manifest is in use by digest.
+func (c *Cleaner) isDigestExcepted(repo, digest string) bool {
+	return c.digestExcept[repo+"@"+digest] != ""
+}
+
+// googleList pages through a Google Cloud list API, passing every page to
+// handle, which returns the next page token.
+func googleList(ctx context.Context, client *http.Client, u string, handle func(body []byte) (string, error)) error {
+	token := ""
+	for {
+		pageURL := u
+		if token != "" {
+			sep := "?"
+			if strings.Contains(u, "?") {
+				sep = "&"
+			}
+			pageURL += sep + "pageToken=" + url.QueryEscape(token)
+		}
+		req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &statusError{method: http.MethodGet, path: pageURL, code: resp.StatusCode, body: bytes.TrimSpace(body)}
+		}
+
+		if token, err = handle(body); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", u, err)
+		}
+		if token == "" {
+			return nil
+		}
+	}
+}
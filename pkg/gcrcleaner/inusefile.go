@@ -0,0 +1,93 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// clusterScan is whether to scan the clusters for in-use images. It can be
+// turned off to only protect the images of the in-use providers, like those
+// listed in files by other tooling.
+var clusterScan = getenv("CLEANER_CLUSTER_SCAN", "true") == "true"
+
+// FileProvider lists the images in use from a file written by other tooling,
+// with one image per line, or a JSON array of images. Blank lines and lines
+// starting with # are ignored. The path "-" reads the images from stdin,
+// which is only read once.
+type FileProvider struct {
+	path string
+
+	stdin  sync.Once
+	images []string
+	err    error
+}
+
+// NewFileProvider creates a provider of the images listed in the file.
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+// Name implements InUseProvider.
+func (p *FileProvider) Name() string {
+	if p.path == "-" {
+		return "stdin"
+	}
+	return "file " + p.path
+}
+
+// InUse implements InUseProvider. The file is read again every time.
+func (p *FileProvider) InUse(ctx context.Context) ([]string, error) {
+	if p.path == "-" {
+		p.stdin.Do(func() {
+			var b []byte
+			if b, p.err = ioutil.ReadAll(os.Stdin); p.err == nil {
+				p.images, p.err = parseImageList(b)
+			}
+		})
+		return p.images, p.err
+	}
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return parseImageList(b)
+}
+
+// parseImageList parses a JSON array of images, or one image per line.
+func parseImageList(b []byte) ([]string, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		var images []string
+		if err := json.Unmarshal(b, &images); err != nil {
+			return nil, err
+		}
+		return images, nil
+	}
+	var images []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	return images, nil
+}
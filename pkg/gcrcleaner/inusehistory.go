@@ -0,0 +1,99 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CodeRecentlyInUse is the code of manifests that aren't in use now but were
+// at one of the last scans, see WithInUseHistory.
+const CodeRecentlyInUse = "RECENTLY_IN_USE"
+
+// InUseSnapshot is the set of images in use under a base repo at a scan.
+type InUseSnapshot struct {
+	At     time.Time `json:"at"`
+	Images []string  `json:"images"`
+}
+
+// WithInUseHistory records the images found in use under the base repo at
+// every scan in the state store, and keeps protecting the images that were in
+// use at any of the last runs scans, so the images of workloads that scale to
+// zero between scans aren't deleted the one time they weren't running.
+func WithInUseHistory(store StateStore, runs int) Option {
+	return func(c *Cleaner) error {
+		if runs < 1 {
+			return fmt.Errorf("in-use history of %d runs must be at least 1", runs)
+		}
+		c.inUseStore, c.inUseRuns = store, runs
+		return nil
+	}
+}
+
+// rememberInUse records the images in use now, the in-use tag and digest
+// exceptions under the base repo, and adds the images that were in use at
+// the previous scans to the exceptions. Failing to save the history is only
+// logged, as the exceptions of this scan are complete either way.
+func (c *Cleaner) rememberInUse(tagExcept, digestExcept map[string]string) error {
+	ctx := context.Background()
+	state, err := c.inUseStore.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load in-use history: %w", err)
+	}
+
+	var images []string
+	for ref, code := range tagExcept {
+		if strings.HasPrefix(code, CodeInUse) && strings.HasPrefix(ref, c.base+"/") {
+			images = append(images, ref)
+		}
+	}
+	for ref := range digestExcept {
+		if strings.HasPrefix(ref, c.base+"/") {
+			images = append(images, ref)
+		}
+	}
+	sort.Strings(images)
+
+	history := state.InUse[c.base]
+	for _, snapshot := range history {
+		for _, ref := range snapshot.Images {
+			if strings.Contains(ref, "@") {
+				if digestExcept[ref] == "" {
+					digestExcept[ref] = CodeRecentlyInUse
+				}
+			} else if tagExcept[ref] == "" {
+				tagExcept[ref] = CodeRecentlyInUse
+			}
+		}
+	}
+
+	history = append(history, InUseSnapshot{At: time.Now(), Images: images})
+	if len(history) > c.inUseRuns {
+		history = history[len(history)-c.inUseRuns:]
+	}
+	if state.InUse == nil {
+		state.InUse = make(map[string][]InUseSnapshot)
+	}
+	state.InUse[c.base] = history
+	if err := c.inUseStore.Save(ctx, state); err != nil {
+		log.Printf("failed to save in-use history: %s", err)
+	}
+	return nil
+}
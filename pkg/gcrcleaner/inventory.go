@@ -0,0 +1,156 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// inventoryTimeLayout names inventory snapshots so they sort by time.
+const inventoryTimeLayout = "20060102T150405Z"
+
+// Inventory is a snapshot of the manifests of child repos at a point in
+// time, keyed by fully-qualified repo. Base is the base repo the repos are
+// children of, if known.
+type Inventory struct {
+	Taken time.Time                  `json:"taken"`
+	Base  string                     `json:"base,omitempty"`
+	Repos map[string]*gcrgoogle.Tags `json:"repos"`
+}
+
+// InventoryFromPlans returns the inventory the plans were made from.
+func InventoryFromPlans(taken time.Time, plans []*RepoPlan) *Inventory {
+	inv := &Inventory{Taken: taken, Repos: make(map[string]*gcrgoogle.Tags)}
+	for _, p := range plans {
+		tags := &gcrgoogle.Tags{Name: p.Repo, Manifests: make(map[string]gcrgoogle.ManifestInfo)}
+		for _, d := range p.Decisions {
+			tags.Manifests[d.Digest] = gcrgoogle.ManifestInfo{
+				Size:      uint64(d.Size),
+				MediaType: d.MediaType,
+				Created:   d.Created,
+				Uploaded:  d.Uploaded,
+				Tags:      d.Tags,
+			}
+			tags.Tags = append(tags.Tags, d.Tags...)
+		}
+		sort.Strings(tags.Tags)
+		inv.Repos[p.Repo] = tags
+	}
+	return inv
+}
+
+// InventoryStore keeps inventory snapshots in a local directory or under a
+// gs://bucket/prefix URI.
+type InventoryStore struct {
+	dir    string
+	store  *storageClient
+	prefix string
+}
+
+// NewInventoryStore returns a store for the given location. The client must
+// be authorized for the devstorage scope when using GCS.
+func NewInventoryStore(location string, client *http.Client) (*InventoryStore, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return &InventoryStore{dir: location}, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("invalid inventory location %q, expected gs://bucket/prefix", location)
+	}
+	prefix := ""
+	if len(parts) == 2 && parts[1] != "" {
+		prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	return &InventoryStore{store: &storageClient{client: client, bucket: parts[0]}, prefix: prefix}, nil
+}
+
+// Save stores the inventory as a snapshot named by the time it was taken.
+func (s *InventoryStore) Save(ctx context.Context, inv *Inventory) error {
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	name := inv.Taken.UTC().Format(inventoryTimeLayout) + ".json"
+	if s.store != nil {
+		_, err := s.store.put(ctx, s.prefix+name, b, -1)
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create inventory directory: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.dir, name), b, 0600); err != nil {
+		return fmt.Errorf("failed to write inventory: %w", err)
+	}
+	return nil
+}
+
+// LoadSince loads the snapshots taken at or after since, oldest first.
+func (s *InventoryStore) LoadSince(ctx context.Context, since time.Time) ([]*Inventory, error) {
+	var names []string
+	if s.store != nil {
+		objects, err := s.store.list(ctx, s.prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			names = append(names, strings.TrimPrefix(o, s.prefix))
+		}
+	} else {
+		files, err := ioutil.ReadDir(s.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read inventory directory: %w", err)
+		}
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var out []*Inventory
+	for _, name := range names {
+		taken, err := time.Parse(inventoryTimeLayout, strings.TrimSuffix(name, ".json"))
+		if err != nil || path.Ext(name) != ".json" || taken.Before(since) {
+			continue
+		}
+
+		var b []byte
+		if s.store != nil {
+			b, err = s.store.get(ctx, s.prefix+name)
+		} else {
+			b, err = ioutil.ReadFile(filepath.Join(s.dir, name))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read inventory %s: %w", name, err)
+		}
+		var inv Inventory
+		if err := json.Unmarshal(b, &inv); err != nil {
+			return nil, fmt.Errorf("failed to parse inventory %s: %w", name, err)
+		}
+		out = append(out, &inv)
+	}
+	return out, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// KeepSet is what a run kept and deleted, for consumers outside the cleaner,
+// like an admission controller that blocks deployments of images about to
+// be deleted.
+type KeepSet struct {
+	RunID     string    `json:"runId"`
+	Base      string    `json:"base"`
+	Dry       bool      `json:"dry"`
+	Generated time.Time `json:"generated"`
+
+	// Kept are the manifests the run kept, with why.
+	Kept []*KeepSetEntry `json:"kept"`
+
+	// Deleted are the manifests the run deleted or, in a dry run, would
+	// have deleted.
+	Deleted []*KeepSetEntry `json:"deleted"`
+
+	// FailedRepos are the repos that failed to be planned, which aren't in
+	// either list, so consumers can't tell what they keep.
+	FailedRepos []string `json:"failedRepos,omitempty"`
+}
+
+// KeepSetEntry is a single manifest of a KeepSet.
+type KeepSetEntry struct {
+	Repo   string   `json:"repo"`
+	Digest string   `json:"digest"`
+	Tags   []string `json:"tags,omitempty"`
+	Reason string   `json:"reason"`
+	Code   string   `json:"code"`
+}
+
+// Add adds the decisions of the plans to the keep set.
+func (k *KeepSet) Add(plans []*RepoPlan) {
+	for _, p := range plans {
+		for _, d := range p.Decisions {
+			e := &KeepSetEntry{Repo: d.Repo, Digest: d.Digest, Tags: d.Tags, Reason: d.Reason, Code: d.Code}
+			if d.Delete {
+				k.Deleted = append(k.Deleted, e)
+			} else {
+				k.Kept = append(k.Kept, e)
+			}
+		}
+	}
+}
+
+// KeepSetStore keeps the keep set of the last run in a local file or a GCS
+// object.
+type KeepSetStore struct {
+	path   string
+	store  *storageClient
+	object string
+}
+
+// NewKeepSetStore returns a store for the given location, either a local
+// path or a gs://bucket/object URI. The client must be authorized for the
+// devstorage scope when using GCS.
+func NewKeepSetStore(location string, client *http.Client) (*KeepSetStore, error) {
+	if strings.HasPrefix(location, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid keep set location %q, expected gs://bucket/object", location)
+		}
+		return &KeepSetStore{store: &storageClient{client: client, bucket: parts[0]}, object: parts[1]}, nil
+	}
+	return &KeepSetStore{path: location}, nil
+}
+
+// Write replaces the keep set at the location. Local files are replaced by
+// renaming, so readers never see half of one.
+func (s *KeepSetStore) Write(ctx context.Context, k *KeepSet) (string, error) {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	if s.store != nil {
+		if _, err := s.store.put(ctx, s.object, b, -1); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("gs://%s/%s", s.store.bucket, s.object), nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".keepset-")
+	if err != nil {
+		return "", fmt.Errorf("failed to write keep set: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write keep set: %w", err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write keep set: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write keep set: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return "", fmt.Errorf("failed to write keep set: %w", err)
+	}
+	return s.path, nil
+}
+
+// Load reads the keep set at the location.
+func (s *KeepSetStore) Load(ctx context.Context) (*KeepSet, error) {
+	var b []byte
+	var err error
+	if s.store != nil {
+		b, err = s.store.get(ctx, s.object)
+	} else {
+		b, err = ioutil.ReadFile(s.path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keep set: %w", err)
+	}
+	var k KeepSet
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, fmt.Errorf("failed to parse keep set: %w", err)
+	}
+	return &k, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeptIndex is the index of every manifest that still exists after the last
+// full run, with its tags, for tools that sync against the registry, like
+// SBOM indexers. It is safe for concurrent use, and every update replaces
+// the whole index at once, so readers never see half of a run.
+type KeptIndex struct {
+	lock      sync.RWMutex
+	runID     string
+	dry       bool
+	generated time.Time
+	repos     map[string]map[string][]string
+	failed    []string
+}
+
+// KeptDigest is a single manifest of a KeptIndex.
+type KeptDigest struct {
+	Repo   string   `json:"repo"`
+	Digest string   `json:"digest"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// KeptIndexSnapshot is the content of a KeptIndex at a point in time.
+type KeptIndexSnapshot struct {
+	RunID     string        `json:"runId"`
+	Dry       bool          `json:"dry"`
+	Generated time.Time     `json:"generated"`
+	Digests   []*KeptDigest `json:"digests"`
+
+	// StaleRepos are the repos that failed to be planned in the last run,
+	// whose digests are those of the run before.
+	StaleRepos []string `json:"staleRepos,omitempty"`
+}
+
+// NewKeptIndex returns an empty index, which is Ready once it is updated.
+func NewKeptIndex() *KeptIndex {
+	return &KeptIndex{}
+}
+
+// Update replaces the index with the manifests the keep set's run kept, and
+// for dry runs also those it would have deleted, as they still exist. Repos
+// that failed to be planned keep their digests from the previous update.
+func (x *KeptIndex) Update(ks *KeepSet) {
+	repos := make(map[string]map[string][]string)
+	add := func(entries []*KeepSetEntry) {
+		for _, e := range entries {
+			if repos[e.Repo] == nil {
+				repos[e.Repo] = make(map[string][]string)
+			}
+			repos[e.Repo][e.Digest] = e.Tags
+		}
+	}
+	add(ks.Kept)
+	if ks.Dry {
+		add(ks.Deleted)
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, repo := range ks.FailedRepos {
+		if prev, ok := x.repos[repo]; ok && repos[repo] == nil {
+			repos[repo] = prev
+		}
+	}
+	x.runID, x.dry, x.generated = ks.RunID, ks.Dry, ks.Generated
+	x.repos, x.failed = repos, ks.FailedRepos
+}
+
+// Ready returns true once the index was updated.
+func (x *KeptIndex) Ready() bool {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.repos != nil
+}
+
+// Lookup returns the tags of the manifest, and whether it still exists.
+func (x *KeptIndex) Lookup(repo, digest string) ([]string, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	tags, ok := x.repos[repo][digest]
+	return tags, ok
+}
+
+// Snapshot returns the manifests of the given repo, or of every repo if it
+// is empty, sorted by repo and digest.
+func (x *KeptIndex) Snapshot(repo string) *KeptIndexSnapshot {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	snap := &KeptIndexSnapshot{RunID: x.runID, Dry: x.dry, Generated: x.generated, Digests: []*KeptDigest{}}
+	for r, digests := range x.repos {
+		if repo != "" && r != repo {
+			continue
+		}
+		for digest, tags := range digests {
+			snap.Digests = append(snap.Digests, &KeptDigest{Repo: r, Digest: digest, Tags: tags})
+		}
+	}
+	for _, r := range x.failed {
+		if repo == "" || r == repo {
+			snap.StaleRepos = append(snap.StaleRepos, r)
+		}
+	}
+	sort.Slice(snap.Digests, func(i, j int) bool {
+		a, b := snap.Digests[i], snap.Digests[j]
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Digest < b.Digest
+	})
+	return snap
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// microTimeFormat is the Kubernetes MicroTime serialization format.
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is the subset of a coordination.k8s.io/v1 Lease used for election.
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// LeaderElector elects a single leader among replicas using a Kubernetes
+// Lease. Replicas that are not the leader stand by and keep trying to acquire
+// the lease in case the leader goes away.
+type LeaderElector struct {
+	kube      *kubeClient
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+
+	lock      sync.RWMutex
+	leader    bool
+	renewedAt time.Time
+}
+
+// NewLeaderElector creates an elector for the named Lease in the pod's own
+// namespace, using the in-cluster service account.
+func NewLeaderElector(name, identity string, duration time.Duration) (*LeaderElector, error) {
+	kube, err := inClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	return &LeaderElector{
+		kube:      kube,
+		namespace: inClusterNamespace(),
+		name:      name,
+		identity:  identity,
+		duration:  duration,
+	}, nil
+}
+
+// Run tries to acquire or renew the lease every third of the lease duration
+// until the context is cancelled.
+func (e *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		leader, err := e.tryAcquire(ctx)
+		if err != nil {
+			log.Printf("failed to acquire lease %s/%s: %s", e.namespace, e.name, err)
+		}
+
+		e.lock.Lock()
+		if leader != e.leader {
+			if leader {
+				log.Printf("%s became the leader", e.identity)
+			} else {
+				log.Printf("%s is standing by", e.identity)
+			}
+		}
+		e.leader = leader
+		if leader {
+			e.renewedAt = time.Now()
+		}
+		e.lock.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// IsLeader returns true if this replica holds an unexpired lease.
+func (e *LeaderElector) IsLeader() bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.leader && time.Since(e.renewedAt) < e.duration
+}
+
+// tryAcquire creates, renews or takes over the lease and returns whether this
+// replica is the leader.
+func (e *LeaderElector) tryAcquire(ctx context.Context) (bool, error) {
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", e.namespace, e.name)
+	now := time.Now()
+
+	var current lease
+	err := e.kube.do(ctx, http.MethodGet, path, nil, &current)
+	if errors.Is(err, errKubeNotFound) {
+		l := &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: e.name, Namespace: e.namespace},
+			Spec: leaseSpec{
+				HolderIdentity:       e.identity,
+				LeaseDurationSeconds: int(e.duration.Seconds()),
+				AcquireTime:          now.Format(microTimeFormat),
+				RenewTime:            now.Format(microTimeFormat),
+			},
+		}
+		createPath := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", e.namespace)
+		if err := e.kube.do(ctx, http.MethodPost, createPath, l, nil); err != nil {
+			if errors.Is(err, errKubeConflict) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if current.Spec.HolderIdentity != e.identity {
+		renewed, err := time.Parse(microTimeFormat, current.Spec.RenewTime)
+		expiry := time.Duration(current.Spec.LeaseDurationSeconds) * time.Second
+		if err == nil && now.Sub(renewed) < expiry {
+			// Someone else holds a live lease.
+			return false, nil
+		}
+		current.Spec.HolderIdentity = e.identity
+		current.Spec.AcquireTime = now.Format(microTimeFormat)
+		current.Spec.LeaseTransitions++
+	}
+	current.Spec.LeaseDurationSeconds = int(e.duration.Seconds())
+	current.Spec.RenewTime = now.Format(microTimeFormat)
+
+	// The resourceVersion makes this an optimistic update, so two replicas
+	// taking over an expired lease can't both win.
+	if err := e.kube.do(ctx, http.MethodPut, path, &current, nil); err != nil {
+		if errors.Is(err, errKubeConflict) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockPollInterval is how often a waiting run checks whether the lock has
+// been released.
+const lockPollInterval = 15 * time.Second
+
+// ErrLocked is returned by RunLock.Acquire when another run still holds the
+// lock after the wait period.
+var ErrLocked = errors.New("another run holds the lock")
+
+// ErrLockLost is returned by RunLock.Err once the lock couldn't be refreshed,
+// so another run may break it.
+var ErrLockLost = errors.New("lost the run lock")
+
+// RunLock is a distributed lock stored as a GCS object. Creation uses a
+// generation-match precondition so only one run can hold it at a time, and a
+// lock not refreshed within its TTL is considered abandoned and broken. The
+// holder refreshes the lock every third of the TTL while it holds it.
+type RunLock struct {
+	store  *storageClient
+	object string
+	ttl    time.Duration
+	wait   time.Duration
+	holder string
+
+	lock       sync.Mutex
+	generation int64
+	err        error
+	stop       chan struct{}
+	stopped    chan struct{}
+}
+
+// lockInfo is the body of the lock object, kept for debugging.
+type lockInfo struct {
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+}
+
+// NewRunLock creates a lock for the given key, usually the base repo, in the
+// bucket. The client
+// must be authorized for the devstorage scope. A run waits up to wait for the
+// lock before giving up, and a lock held for longer than ttl is broken.
+func NewRunLock(client *http.Client, bucket, key string, ttl, wait time.Duration) *RunLock {
+	host, _ := os.Hostname()
+	return &RunLock{
+		store:  &storageClient{client: client, bucket: bucket},
+		object: fmt.Sprintf("gcr-cleaner/locks/%s.lock", strings.ReplaceAll(key, "/", "_")),
+		ttl:    ttl,
+		wait:   wait,
+		holder: fmt.Sprintf("%s/%d", host, os.Getpid()),
+	}
+}
+
+// Acquire takes the lock, waiting for an existing holder to release it. It
+// returns ErrLocked if the lock is still held once the wait period expires.
+func (l *RunLock) Acquire(ctx context.Context) error {
+	deadline := time.Now().Add(l.wait)
+
+	body, err := json.Marshal(&lockInfo{Holder: l.holder, Acquired: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	for {
+		attrs, err := l.store.put(ctx, l.object, body, 0)
+		if err == nil {
+			l.lock.Lock()
+			l.generation, l.err = attrs.Generation, nil
+			l.stop, l.stopped = make(chan struct{}), make(chan struct{})
+			l.lock.Unlock()
+			go l.refresh(body, l.stop, l.stopped)
+			return nil
+		}
+		if !errors.Is(err, errPreconditionFailed) {
+			return fmt.Errorf("failed to acquire lock: %w", err)
+		}
+
+		// Someone else holds the lock. Break it if it was abandoned.
+		existing, err := l.store.stat(ctx, l.object)
+		if errors.Is(err, errObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to inspect lock: %w", err)
+		}
+		if time.Since(existing.Updated) > l.ttl {
+			log.Printf("Breaking stale lock gs://%s/%s held since %s", l.store.bucket, l.object, existing.Updated)
+			err := l.store.delete(ctx, l.object, existing.Generation)
+			if err != nil && !errors.Is(err, errPreconditionFailed) && !errors.Is(err, errObjectNotExist) {
+				return fmt.Errorf("failed to break stale lock: %w", err)
+			}
+			continue
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrLocked
+		}
+		if remaining > lockPollInterval {
+			remaining = lockPollInterval
+		}
+		select {
+		case <-time.After(remaining):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// refresh rewrites the lock every third of the TTL, so it isn't broken while
+// held, until stop is closed. Once a refresh fails and the lock might be
+// broken before the next one, or it was already broken, Err returns
+// ErrLockLost and the lock isn't refreshed anymore.
+func (l *RunLock) refresh(body []byte, stop, stopped chan struct{}) {
+	defer close(stopped)
+	if l.ttl <= 0 {
+		<-stop
+		return
+	}
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	refreshed := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		l.lock.Lock()
+		generation := l.generation
+		l.lock.Unlock()
+		attrs, err := l.store.put(context.Background(), l.object, body, generation)
+		if err == nil {
+			refreshed = time.Now()
+			l.lock.Lock()
+			l.generation = attrs.Generation
+			l.lock.Unlock()
+			continue
+		}
+
+		broken := errors.Is(err, errPreconditionFailed)
+		if !broken && time.Since(refreshed)+l.ttl/3 < l.ttl {
+			log.Printf("Failed to refresh lock gs://%s/%s, retrying: %s", l.store.bucket, l.object, err)
+			continue
+		}
+		log.Printf("Lost lock gs://%s/%s: %s", l.store.bucket, l.object, err)
+		l.lock.Lock()
+		l.err = fmt.Errorf("%w: %s", ErrLockLost, err)
+		l.lock.Unlock()
+		return
+	}
+}
+
+// Err returns ErrLockLost if the lock couldn't be refreshed while held, in
+// which case the run should stop, as another run may hold the lock by now.
+// It returns nil for a nil lock.
+func (l *RunLock) Err() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.err
+}
+
+// Release gives up the lock if this run still holds it.
+func (l *RunLock) Release(ctx context.Context) error {
+	l.lock.Lock()
+	stop, stopped := l.stop, l.stopped
+	l.stop, l.stopped = nil, nil
+	l.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+
+	l.lock.Lock()
+	generation := l.generation
+	l.generation = 0
+	l.lock.Unlock()
+	if generation == 0 {
+		return nil
+	}
+
+	err := l.store.delete(ctx, l.object, generation)
+	if err != nil && !errors.Is(err, errObjectNotExist) && !errors.Is(err, errPreconditionFailed) {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	return nil
+}
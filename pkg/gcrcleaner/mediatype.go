@@ -0,0 +1,259 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gammazero/workerpool"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// Reasons a manifest is kept because of its media type.
+const (
+	ReasonMediaType        = "media type not cleaned"
+	ReasonMediaTypeUnknown = "media type unknown"
+)
+
+// ociManifest is the media type of OCI manifests, the only ones whose
+// artifact type has to be fetched. Helm charts, WASM modules and signatures
+// are all pushed as OCI manifests.
+const ociManifest = "application/vnd.oci.image.manifest.v1+json"
+
+// mediaTypePolicy is a compiled entry of Policy.MediaTypePolicies.
+type mediaTypePolicy struct {
+	pattern string
+	policy  Policy
+}
+
+// compileMediaTypes compiles the media type policies, which inherit the
+// fields they don't set from p. The most specific pattern wins.
+func (p *Policy) compileMediaTypes() error {
+	p.mediaTypePolicies = nil
+	for pattern, msg := range p.MediaTypePolicies {
+		sub := p.withoutMediaTypes().clone()
+		if err := json.Unmarshal(msg, &sub); err != nil {
+			return fmt.Errorf("invalid mediaTypePolicies[%s]: %w", pattern, err)
+		}
+		if sub.hasMediaTypeRules() {
+			return fmt.Errorf("invalid mediaTypePolicies[%s]: media type rules can't be nested", pattern)
+		}
+		if err := sub.compile(); err != nil {
+			return fmt.Errorf("invalid mediaTypePolicies[%s]: %w", pattern, err)
+		}
+		sub.mediaTypePolicies = nil
+		p.mediaTypePolicies = append(p.mediaTypePolicies, mediaTypePolicy{pattern: pattern, policy: sub})
+	}
+	sort.Slice(p.mediaTypePolicies, func(i, j int) bool {
+		a, b := p.mediaTypePolicies[i].pattern, p.mediaTypePolicies[j].pattern
+		if wa, wb := strings.HasSuffix(a, "*"), strings.HasSuffix(b, "*"); wa != wb {
+			return !wa
+		}
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	if chart, ok := p.chartPolicy(); ok {
+		p.mediaTypePolicies = append(p.mediaTypePolicies, chart)
+	}
+	return nil
+}
+
+// hasMediaTypeRules returns true if the policy treats manifests differently
+// by media type.
+func (p *Policy) hasMediaTypeRules() bool {
+	return len(p.MediaTypes) > 0 || len(p.ExcludeMediaTypes) > 0 ||
+		len(p.MediaTypePolicies) > 0 || len(p.mediaTypePolicies) > 0
+}
+
+// withoutMediaTypes returns a copy of the policy without its media type
+// rules.
+func (p Policy) withoutMediaTypes() Policy {
+	p.MediaTypes, p.ExcludeMediaTypes, p.MediaTypePolicies = nil, nil, nil
+	p.mediaTypePolicies = nil
+	return p
+}
+
+// forMediaType returns the policy that cleans manifests of the media type and
+// the pattern of its media type policy, if any, or false if they aren't
+// cleaned. Exclusions win over media type policies, which win over
+// MediaTypes.
+func (p *Policy) forMediaType(t string) (Policy, string, bool) {
+	if matchesMediaType(p.ExcludeMediaTypes, t) {
+		return Policy{}, "", false
+	}
+	for _, mp := range p.mediaTypePolicies {
+		if matchMediaType(mp.pattern, t) {
+			return mp.policy, mp.pattern, true
+		}
+	}
+	if len(p.MediaTypes) > 0 && !matchesMediaType(p.MediaTypes, t) {
+		return Policy{}, "", false
+	}
+	return p.withoutMediaTypes(), "", true
+}
+
+// matchesMediaType returns true if any of the patterns match the media type.
+func matchesMediaType(patterns []string, t string) bool {
+	for _, pattern := range patterns {
+		if matchMediaType(pattern, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMediaType matches a media type against a pattern, which is either a
+// media type or a prefix ending in *, e.g. application/vnd.cncf.helm.*.
+func matchMediaType(pattern, t string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(t, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == t
+}
+
+// planMediaTypes plans the repo's manifests under the policy for their media
+// type. Each policy's keep window only counts the tags of its own manifests.
+// Manifests whose media type isn't cleaned, or couldn't be found, are kept.
+func (c *Cleaner) planMediaTypes(name string, policy Policy, tags *gcrgoogle.Tags) *RepoPlan {
+	types := c.mediaTypes(name, tags)
+
+	plan := &RepoPlan{Repo: name, Policy: policy}
+	var parts []*gcrgoogle.Tags
+	var policies []Policy
+	index := make(map[string]int)
+	for digest, m := range tags.Manifests {
+		t, ok := types[digest]
+		if !ok {
+			plan.Decisions = append(plan.Decisions, keptForMediaType(name, digest, m, policy, ReasonMediaTypeUnknown))
+			continue
+		}
+		p, key, ok := policy.forMediaType(t)
+		if !ok {
+			d := keptForMediaType(name, digest, m, policy, ReasonMediaType)
+			d.ArtifactType = t
+			plan.Decisions = append(plan.Decisions, d)
+			continue
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(parts)
+			index[key] = i
+			parts = append(parts, &gcrgoogle.Tags{Name: tags.Name, Manifests: make(map[string]gcrgoogle.ManifestInfo)})
+			policies = append(policies, p)
+		}
+		parts[i].Manifests[digest] = m
+		parts[i].Tags = append(parts[i].Tags, m.Tags...)
+	}
+
+	for i, part := range parts {
+		for _, d := range c.planRepo(name, policies[i], part).Decisions {
+			d.ArtifactType = types[d.Digest]
+			plan.Decisions = append(plan.Decisions, d)
+		}
+	}
+	sortDecisions(plan.Decisions)
+	return plan
+}
+
+// keptForMediaType is the decision for a manifest kept because of its media
+// type.
+func keptForMediaType(name, digest string, m gcrgoogle.ManifestInfo, policy Policy, reason string) *Decision {
+	return &Decision{
+		Repo:      name,
+		Digest:    digest,
+		Tags:      m.Tags,
+		Size:      int64(m.Size),
+		MediaType: m.MediaType,
+		Created:   m.Created,
+		Uploaded:  m.Uploaded,
+		Built:     policy.buildTime(m.Tags, m.Uploaded),
+		Reason:    reason,
+	}
+}
+
+// mediaTypes returns the media type of every manifest in the repo that could
+// be found. For OCI manifests this is their artifact type, or else the media
+// type of their config, which is fetched in parallel if the backend
+// implements ManifestGetter. Manifests are immutable, so fetched types are
+// cached for the life of the cleaner.
+func (c *Cleaner) mediaTypes(name string, tags *gcrgoogle.Tags) map[string]string {
+	types := make(map[string]string, len(tags.Manifests))
+	var fetch []string
+	for digest, m := range tags.Manifests {
+		if m.MediaType != "" && m.MediaType != ociManifest {
+			types[digest] = m.MediaType
+		} else if t, ok := c.artifactTypes.Load(digest); ok {
+			types[digest] = t.(string)
+		} else {
+			fetch = append(fetch, digest)
+		}
+	}
+
+	getter, ok := c.backend.(ManifestGetter)
+	if !ok {
+		for _, digest := range fetch {
+			if t := tags.Manifests[digest].MediaType; t != "" {
+				types[digest] = t
+			}
+		}
+		return types
+	}
+
+	var lock sync.Mutex
+	pool := workerpool.New(c.concurrency)
+	for _, digest := range fetch {
+		digest := digest
+		pool.Submit(func() {
+			b, err := getter.GetManifest(name, digest)
+			var m struct {
+				MediaType    string `json:"mediaType"`
+				ArtifactType string `json:"artifactType"`
+				Config       struct {
+					MediaType string `json:"mediaType"`
+				} `json:"config"`
+			}
+			if err == nil {
+				err = json.Unmarshal(b, &m)
+			}
+			if err != nil {
+				return
+			}
+
+			t := m.ArtifactType
+			if t == "" {
+				t = m.Config.MediaType
+			}
+			if t == "" {
+				t = m.MediaType
+			}
+			if t == "" {
+				return
+			}
+			c.artifactTypes.Store(digest, t)
+			lock.Lock()
+			types[digest] = t
+			lock.Unlock()
+		})
+	}
+	pool.StopWait()
+	return types
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RunMetrics are the metrics of a single clean, the same whether the cleaner
+// serves them or pushes them at exit.
+type RunMetrics struct {
+	Base        string
+	RunID       string
+	Dry         bool
+	Started     time.Time
+	Finished    time.Time
+	Success     bool
+	Candidates  int
+	Deleted     int
+	TagsDeleted int
+	Freed       int64
+	Errors      int
+}
+
+// metric is a single metric of a run.
+type metric struct {
+	name, help string
+	value      float64
+	integer    bool
+}
+
+// metrics returns the metrics of the run. The time of the last success is
+// only included if the run succeeded, so pushes of failed runs keep the
+// previous one.
+func (m *RunMetrics) metrics() []metric {
+	success := 0.0
+	if m.Success {
+		success = 1
+	}
+	out := []metric{
+		{"last_run_candidates", "Manifests the last run planned to delete.", float64(m.Candidates), true},
+		{"last_run_deleted", "Manifests the last run deleted.", float64(m.Deleted), true},
+		{"last_run_tags_deleted", "Tags the last run deleted.", float64(m.TagsDeleted), true},
+		{"last_run_freed_bytes", "Bytes the last run freed.", float64(m.Freed), true},
+		{"last_run_errors", "Failures of the last run.", float64(m.Errors), true},
+		{"last_run_duration_seconds", "How long the last run took.", m.Finished.Sub(m.Started).Seconds(), false},
+		{"last_run_success", "Whether the last run succeeded.", success, true},
+		{"last_run_timestamp_seconds", "When the last run finished.", float64(m.Finished.Unix()), true},
+	}
+	if m.Success {
+		out = append(out, metric{"last_success_timestamp_seconds", "When the last successful run finished.", float64(m.Finished.Unix()), true})
+	}
+	return out
+}
+
+// labels returns the labels of the metrics. The run ID is only a label if it
+// is set, as every run then starts new time series.
+func (m *RunMetrics) labels() map[string]string {
+	labels := map[string]string{"base": m.Base, "dry": strconv.FormatBool(m.Dry)}
+	if m.RunID != "" {
+		labels["run_id"] = m.RunID
+	}
+	return labels
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format, named
+// gcr_cleaner_* and labeled with the base repo, whether the run was dry and
+// the run ID, if set.
+func (m *RunMetrics) WritePrometheus(w io.Writer) error {
+	labels := fmt.Sprintf("{base=%q,dry=%q}", m.Base, strconv.FormatBool(m.Dry))
+	if m.RunID != "" {
+		labels = fmt.Sprintf("{base=%q,dry=%q,run_id=%q}", m.Base, strconv.FormatBool(m.Dry), m.RunID)
+	}
+	for _, mt := range m.metrics() {
+		name := "gcr_cleaner_" + mt.name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n", name, mt.help, name, name, labels,
+			strconv.FormatFloat(mt.value, 'f', -1, 64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetricsPusher pushes the metrics of a run, for short-lived runs that
+// nothing scrapes.
+type MetricsPusher interface {
+	Push(ctx context.Context, m *RunMetrics) error
+}
+
+// PushgatewayPusher pushes metrics to a Prometheus Pushgateway, grouped by
+// job and base repo. The base repo is base64-encoded in the grouping key, as
+// it contains slashes.
+type PushgatewayPusher struct {
+	URL    string
+	Job    string
+	Client *http.Client
+}
+
+// Push implements MetricsPusher. Metrics are POSTed, so the metrics a push
+// doesn't include, like the time of the last success, keep their values.
+func (p *PushgatewayPusher) Push(ctx context.Context, m *RunMetrics) error {
+	var body bytes.Buffer
+	if err := m.WritePrometheus(&body); err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/metrics/job/%s/base@base64/%s", strings.TrimSuffix(p.URL, "/"),
+		url.PathEscape(p.Job), base64.URLEncoding.EncodeToString([]byte(m.Base)))
+	req, err := http.NewRequest(http.MethodPost, u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s: unexpected status %d: %s", u, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// CloudMonitoringPusher writes metrics to Cloud Monitoring as custom metrics
+// custom.googleapis.com/gcr_cleaner/*. The client must be authorized for the
+// cloud-platform scope.
+type CloudMonitoringPusher struct {
+	Project string
+	Client  *http.Client
+}
+
+// Push implements MetricsPusher.
+func (p *CloudMonitoringPusher) Push(ctx context.Context, m *RunMetrics) error {
+	type point struct {
+		Interval struct {
+			EndTime time.Time `json:"endTime"`
+		} `json:"interval"`
+		Value map[string]interface{} `json:"value"`
+	}
+	type timeSeries struct {
+		Metric struct {
+			Type   string            `json:"type"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metric"`
+		Resource struct {
+			Type   string            `json:"type"`
+			Labels map[string]string `json:"labels"`
+		} `json:"resource"`
+		Points []point `json:"points"`
+	}
+
+	var series []timeSeries
+	for _, mt := range m.metrics() {
+		var ts timeSeries
+		ts.Metric.Type = "custom.googleapis.com/gcr_cleaner/" + mt.name
+		ts.Metric.Labels = m.labels()
+		ts.Resource.Type = "global"
+		ts.Resource.Labels = map[string]string{"project_id": p.Project}
+		var pt point
+		pt.Interval.EndTime = m.Finished
+		if mt.integer {
+			pt.Value = map[string]interface{}{"int64Value": strconv.FormatInt(int64(mt.value), 10)}
+		} else {
+			pt.Value = map[string]interface{}{"doubleValue": mt.value}
+		}
+		ts.Points = []point{pt}
+		series = append(series, ts)
+	}
+	u := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/timeSeries", url.PathEscape(p.Project))
+	return postJSON(ctx, p.Client, u, nil, map[string]interface{}{"timeSeries": series})
+}
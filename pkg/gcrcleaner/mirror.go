@@ -0,0 +1,147 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/gammazero/workerpool"
+)
+
+// WithMirror makes the cleaner propagate its deletions to the same child
+// repos of another base repo, such as a pull-through mirror or a replica, so
+// it doesn't keep storage the cleaner reclaimed. The mirror cleaner supplies
+// the mirror's base repo and backend.
+func WithMirror(m *Cleaner) Option {
+	return func(c *Cleaner) error {
+		c.mirrors = append(c.mirrors, m)
+		return nil
+	}
+}
+
+// propagate deletes the manifests the plan deleted from the same child repo
+// of every mirror, or only counts them in a dry run, and returns how many it
+// deleted. In untag-only repos only the same tags are removed. Manifests that
+// have tags in a mirror that the plan didn't delete are left alone, as
+// something else pushed them there. Child repos missing from a mirror are
+// skipped.
+func (c *Cleaner) propagate(plan *RepoPlan, deleted []*Decision, dry bool) (int, []*RefError) {
+	var lock sync.Mutex
+	var failures []*RefError
+	count := 0
+
+	rel := strings.TrimPrefix(plan.Repo, c.base+"/")
+	for _, m := range c.mirrors {
+		name := fmt.Sprintf("%s/%s", m.base, rel)
+		tags, err := m.backend.List(name)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			failures = append(failures, &RefError{Repo: name, Ref: name, Err: classify(err)})
+			continue
+		}
+
+		var indexes, manifests []*Decision
+		for _, d := range deleted {
+			mm, ok := tags.Manifests[d.Digest]
+			if !ok {
+				continue
+			}
+			if extra := missingFrom(mm.Tags, d.Tags); len(extra) > 0 && !plan.Policy.UntagOnly {
+				log.Printf("%s: keeping %s, it has tags %v in the mirror only", name, d.Digest, extra)
+				continue
+			}
+			if dry {
+				count++
+				log.Printf("%s would delete mirrored manifest %s", name, d.Digest)
+				continue
+			}
+			if isIndex(d.MediaType) {
+				indexes = append(indexes, d)
+			} else {
+				manifests = append(manifests, d)
+			}
+		}
+
+		for _, batch := range [][]*Decision{indexes, manifests} {
+			pool := workerpool.New(c.concurrency)
+			for _, d := range batch {
+				d, mirrorTags := d, tags.Manifests[d.Digest].Tags
+				pool.Submit(func() {
+					m.deleteLimit.acquire()
+					err := m.deleteMirrored(name, d, mirrorTags, plan.Policy.UntagOnly)
+					m.deleteLimit.release()
+
+					lock.Lock()
+					defer lock.Unlock()
+					if err != nil && !IsNotFound(err) {
+						failures = append(failures, &RefError{Repo: name, Ref: name + "@" + d.Digest, Err: classify(err)})
+						return
+					}
+					count++
+				})
+			}
+			pool.StopWait()
+		}
+	}
+	return count, failures
+}
+
+// deleteMirrored deletes a manifest and its tags from a mirror repo, or only
+// removes the tags the primary removed if untagOnly.
+func (c *Cleaner) deleteMirrored(name string, d *Decision, mirrorTags []string, untagOnly bool) error {
+	tags := mirrorTags
+	if untagOnly {
+		tags = d.Tags
+	}
+	for _, tag := range tags {
+		err := c.deleteWithRetries(func() error {
+			return c.backend.DeleteTag(name, tag)
+		})
+		if errors.Is(err, ErrUntagUnsupported) && !untagOnly {
+			// Deleting the manifest removes its tags.
+			break
+		}
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+	if untagOnly {
+		return nil
+	}
+	return c.deleteWithRetries(func() error {
+		return c.backend.DeleteManifest(name, d.Digest)
+	})
+}
+
+// missingFrom returns the tags of a that aren't in b.
+func missingFrom(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, t := range b {
+		in[t] = true
+	}
+	var out []string
+	for _, t := range a {
+		if !in[t] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// scanNamespaces and scanExcludeNamespaces scope the cluster scan. See
+// namespaceScope.
+var scanNamespaces = parseNamespaceScope(getenv("CLEANER_SCAN_NAMESPACES", ""))
+var scanExcludeNamespaces = parseNamespaceScope(getenv("CLEANER_SCAN_EXCLUDE_NAMESPACES", ""))
+
+// namespaceScope is a list of namespace patterns by cluster context. Patterns
+// under the empty context apply to every context.
+type namespaceScope map[string][]string
+
+// parseNamespaceScope parses a comma-separated list of namespaces, each
+// optionally prefixed by a context and a slash, like
+// prod-eu/ci,ephemeral-*. Namespaces are path.Match patterns. Contexts may
+// contain slashes themselves, but namespaces can't.
+func parseNamespaceScope(s string) namespaceScope {
+	scope := make(namespaceScope)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		context, ns := "", item
+		if i := strings.LastIndex(item, "/"); i >= 0 {
+			context, ns = item[:i], item[i+1:]
+		}
+		scope[context] = append(scope[context], ns)
+	}
+	return scope
+}
+
+// matches returns true if the namespace matches a pattern of the context, and
+// whether the context has any patterns at all.
+func (s namespaceScope) matches(context, ns string) (bool, bool) {
+	patterns := append(append([]string{}, s[""]...), s[context]...)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ns); ok {
+			return true, true
+		}
+	}
+	return false, len(patterns) > 0
+}
+
+// scanned returns true if the scan of the context includes the namespace:
+// it matches CLEANER_SCAN_NAMESPACES, if there are any for the context, and
+// doesn't match CLEANER_SCAN_EXCLUDE_NAMESPACES.
+func scanned(context, ns string) bool {
+	if ok, any := scanNamespaces.matches(context, ns); any && !ok {
+		return false
+	}
+	excluded, _ := scanExcludeNamespaces.matches(context, ns)
+	return !excluded
+}
+
+// workloadImages returns the images of the items of a Kubernetes list of
+// workloads, like pods, jobs or cron jobs, in the namespaces the scan of the
+// context includes.
+func workloadImages(context string, list []byte) ([]string, error) {
+	var workloads struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if err := json.Unmarshal(list, &workloads); err != nil {
+		return nil, err
+	}
+
+	var images []string
+	for _, item := range workloads.Items {
+		metadata, _ := item["metadata"].(map[string]interface{})
+		ns, _ := metadata["namespace"].(string)
+		if !scanned(context, ns) {
+			continue
+		}
+		images = appendImageFields(images, item)
+	}
+	return images, nil
+}
+
+// appendImageFields appends every image field found anywhere in v, like
+// those of the containers of a cron job's job template.
+func appendImageFields(images []string, v interface{}) []string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if image, ok := field.(string); ok && k == "image" {
+				images = append(images, image)
+				continue
+			}
+			images = appendImageFields(images, field)
+		}
+	case []interface{}:
+		for _, item := range v {
+			images = appendImageFields(images, item)
+		}
+	}
+	return images
+}
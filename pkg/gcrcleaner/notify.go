@@ -0,0 +1,128 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notifier sends informational messages about runs, unlike an Alerter,
+// which opens incidents.
+type Notifier interface {
+	Notify(ctx context.Context, text string) error
+}
+
+// WebhookNotifier posts messages to an incoming webhook that accepts Slack's
+// {"text": "..."} payload, like those of Slack and Google Chat.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify implements Notifier.
+func (w *WebhookNotifier) Notify(ctx context.Context, text string) error {
+	return postJSON(ctx, w.Client, w.URL, nil, map[string]string{"text": text})
+}
+
+// Digest aggregates the results of the runs since the last digest was sent.
+type Digest struct {
+	Since   time.Time `json:"since"`
+	Runs    int       `json:"runs"`
+	Deleted int       `json:"deleted"`
+	Freed   int64     `json:"freed"`
+
+	// Repos is the space freed by repo.
+	Repos map[string]int64 `json:"repos,omitempty"`
+
+	// Failures is the number of runs that failed with each cause.
+	Failures map[string]int `json:"failures,omitempty"`
+}
+
+// Add adds the results of a run: the manifests it deleted, the space it freed
+// by repo and the causes of its failures.
+func (d *Digest) Add(deleted int, freed map[string]int64, causes []string) {
+	if d.Repos == nil {
+		d.Repos = make(map[string]int64)
+	}
+	if d.Failures == nil {
+		d.Failures = make(map[string]int)
+	}
+	d.Runs++
+	d.Deleted += deleted
+	for r, size := range freed {
+		d.Repos[r] += size
+		d.Freed += size
+	}
+	seen := make(map[string]bool)
+	for _, c := range causes {
+		if !seen[c] {
+			seen[c] = true
+			d.Failures[c]++
+		}
+	}
+}
+
+// Text renders the digest as a message: the totals, the top repos by space
+// freed and the failures that happened in more than one run.
+func (d *Digest) Text(base string, top int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gcr-cleaner digest for %s since %s: %d runs deleted %d manifests and freed %s\n",
+		base, d.Since.Format("2006-01-02"), d.Runs, d.Deleted, FormatSize(d.Freed))
+
+	repos := make([]string, 0, len(d.Repos))
+	for r := range d.Repos {
+		repos = append(repos, r)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		if d.Repos[repos[i]] != d.Repos[repos[j]] {
+			return d.Repos[repos[i]] > d.Repos[repos[j]]
+		}
+		return repos[i] < repos[j]
+	})
+	if len(repos) > top {
+		repos = repos[:top]
+	}
+	if len(repos) > 0 {
+		b.WriteString("Top repos by space freed:\n")
+		for _, r := range repos {
+			fmt.Fprintf(&b, "- %s: %s\n", r, FormatSize(d.Repos[r]))
+		}
+	}
+
+	var causes []string
+	for c, n := range d.Failures {
+		if n > 1 {
+			causes = append(causes, c)
+		}
+	}
+	sort.Slice(causes, func(i, j int) bool {
+		if d.Failures[causes[i]] != d.Failures[causes[j]] {
+			return d.Failures[causes[i]] > d.Failures[causes[j]]
+		}
+		return causes[i] < causes[j]
+	})
+	if len(causes) > 0 {
+		b.WriteString("Repeated failures:\n")
+		for _, c := range causes {
+			fmt.Fprintf(&b, "- %s (%d runs)\n", c, d.Failures[c])
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+)
+
+// Option configures a Cleaner.
+type Option func(c *Cleaner) error
+
+// WithBaseRepo makes the cleaner clean the children of the given base repo
+// instead of GCR_BASE_REPO.
+func WithBaseRepo(base string) Option {
+	return func(c *Cleaner) error {
+		c.base = strings.TrimSuffix(base, "/")
+		return nil
+	}
+}
+
+// WithAllowFullPrune allows policies that keep 0 tags, which delete every tag
+// that isn't excepted. Without it, such policies are rejected.
+func WithAllowFullPrune() Option {
+	return func(c *Cleaner) error {
+		c.allowFullPrune = true
+		return nil
+	}
+}
+
+// WithFailFast stops deleting in a repo after its first failed deletion.
+// Without it, every candidate is attempted and all failures are reported at
+// the end.
+func WithFailFast() Option {
+	return func(c *Cleaner) error {
+		c.failFast = true
+		return nil
+	}
+}
+
+// WithVerbose logs the decision and reason code of every manifest a clean
+// keeps or deletes.
+func WithVerbose() Option {
+	return func(c *Cleaner) error {
+		c.verbose = true
+		return nil
+	}
+}
+
+// WithoutClusterScan skips scanning the clusters for in-use images, for
+// commands that only read the configuration. Cleaning without the scan can
+// delete images that are in use.
+func WithoutClusterScan() Option {
+	return func(c *Cleaner) error {
+		c.skipScan = true
+		return nil
+	}
+}
+
+// WithRepoConcurrency makes the cleaner clean up to n child repos in
+// parallel instead of one at a time. The concurrency given to NewCleaner
+// still caps the delete requests in flight across all of them.
+func WithRepoConcurrency(n int) Option {
+	return func(c *Cleaner) error {
+		if n < 1 {
+			return fmt.Errorf("repo concurrency must be at least 1, got %d", n)
+		}
+		c.repoConcurrency = n
+		return nil
+	}
+}
+
+// WithArtifactRegistryClient gives the default backend an HTTP client
+// authorized for the Artifact Registry API, which it needs to delete empty
+// repos and to detect repositories with immutable tags.
+func WithArtifactRegistryClient(client *http.Client) Option {
+	return func(c *Cleaner) error {
+		c.arClient = client
+		return nil
+	}
+}
+
+// WithTransport sends the backend's registry requests through the transport,
+// e.g. one created by NewTransport, instead of the default one.
+func WithTransport(t http.RoundTripper) Option {
+	return func(c *Cleaner) error {
+		c.transport = t
+		return nil
+	}
+}
+
+// WithKeychain authenticates the backend's registry requests with the
+// keychain, e.g. one created by NewRegistryKeychain, instead of the
+// authenticator the cleaner was created with, so every registry host can
+// have its own credentials.
+func WithKeychain(k gcrauthn.Keychain) Option {
+	return func(c *Cleaner) error {
+		c.keychain = k
+		return nil
+	}
+}
+
+// WithContainerAnalysisClient adds the vulnerability findings of Container
+// Analysis to the candidates of plans, using an HTTP client authorized for
+// the Container Analysis API.
+func WithContainerAnalysisClient(client *http.Client) Option {
+	return func(c *Cleaner) error {
+		c.vulnClient = client
+		return nil
+	}
+}
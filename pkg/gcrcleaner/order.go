@@ -0,0 +1,158 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+var tagOrder = getenv("CLEANER_TAG_ORDER", OrderAlphabetical)
+
+// Tag orders, from oldest to newest, that the keep window is applied to.
+const (
+	OrderAlphabetical = "alphabetical"
+	OrderUploaded     = "uploaded"
+	OrderCreated      = "created"
+	OrderSemver       = "semver"
+	OrderNumeric      = "numeric"
+)
+
+var numericSuffix = regexp.MustCompile(`(\d+)$`)
+
+// validOrder returns an error if the order isn't one of the tag orders.
+func validOrder(order string) error {
+	switch order {
+	case "", OrderAlphabetical, OrderUploaded, OrderCreated, OrderSemver, OrderNumeric:
+		return nil
+	}
+	return fmt.Errorf("unknown tag order %q", order)
+}
+
+// sortTags returns the tags of the listing from oldest to newest by the
+// order. Tags that the order can't place, like tags that aren't versions
+// when sorting by semver, are oldest, and ties are broken alphabetically.
+func sortTags(order string, tags *gcrgoogle.Tags) []string {
+	out := append([]string(nil), tags.Tags...)
+	sort.Strings(out)
+
+	var less func(a, b string) bool
+	switch order {
+	case OrderUploaded, OrderCreated:
+		times := make(map[string]time.Time)
+		for _, m := range tags.Manifests {
+			t := m.Uploaded
+			if order == OrderCreated {
+				t = m.Created
+			}
+			for _, tag := range m.Tags {
+				times[tag] = t
+			}
+		}
+		less = func(a, b string) bool { return times[a].Before(times[b]) }
+	case OrderSemver:
+		less = func(a, b string) bool { return compareSemver(a, b) < 0 }
+	case OrderNumeric:
+		less = func(a, b string) bool {
+			x, okX := suffixNumber(a)
+			y, okY := suffixNumber(b)
+			if okX != okY {
+				return !okX
+			}
+			return x < y
+		}
+	default:
+		return out
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return less(out[i], out[j]) })
+	return out
+}
+
+// suffixNumber returns the number at the end of the tag, e.g. 42 in build-42.
+func suffixNumber(tag string) (uint64, bool) {
+	m := numericSuffix.FindString(tag)
+	if m == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(m, 10, 64)
+	return n, err == nil
+}
+
+// compareSemver compares two tags as semantic versions, with an optional v
+// prefix. Tags that aren't versions sort before those that are, and
+// pre-releases before their release.
+func compareSemver(a, b string) int {
+	x, preX, okX := parseSemver(a)
+	y, preY, okY := parseSemver(b)
+	switch {
+	case !okX && !okY:
+		return 0
+	case !okX:
+		return -1
+	case !okY:
+		return 1
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			if x[i] < y[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preX == preY:
+		return 0
+	case preX == "":
+		return 1
+	case preY == "":
+		return -1
+	}
+	return strings.Compare(preX, preY)
+}
+
+// parseSemver splits a version like v1.2.3-rc.1+build into its numbers and
+// pre-release. Missing minor and patch numbers are zero. Build metadata may
+// also follow an _, as in the tags Helm pushes charts with.
+func parseSemver(tag string) ([3]uint64, string, bool) {
+	var nums [3]uint64
+	v := strings.TrimPrefix(tag, "v")
+	if i := strings.IndexAny(v, "+_"); i >= 0 {
+		v = v[:i]
+	}
+	pre := ""
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return nums, "", false
+	}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return nums, "", false
+		}
+		nums[i] = n
+	}
+	return nums, pre, true
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+func TestSortTags(t *testing.T) {
+	day := func(n int) time.Time {
+		return time.Date(2024, 1, n, 0, 0, 0, 0, time.UTC)
+	}
+	type manifest struct {
+		uploaded, created int
+		tags              []string
+	}
+	// listing returns a listing of the manifests, uploaded and created on
+	// the given days of January.
+	listing := func(manifests map[string]manifest) *gcrgoogle.Tags {
+		tags := &gcrgoogle.Tags{Manifests: make(map[string]gcrgoogle.ManifestInfo)}
+		for digest, m := range manifests {
+			tags.Manifests[digest] = gcrgoogle.ManifestInfo{Uploaded: day(m.uploaded), Created: day(m.created), Tags: m.tags}
+			tags.Tags = append(tags.Tags, m.tags...)
+		}
+		return tags
+	}
+	times := listing(map[string]manifest{
+		"sha256:a": {uploaded: 3, created: 1, tags: []string{"first"}},
+		"sha256:b": {uploaded: 2, created: 2, tags: []string{"second"}},
+		"sha256:c": {uploaded: 1, created: 3, tags: []string{"third"}},
+		"sha256:d": {uploaded: 4, created: 3, tags: []string{"tie-b", "tie-a"}},
+	})
+	versions := func(tags ...string) *gcrgoogle.Tags {
+		return &gcrgoogle.Tags{Tags: tags}
+	}
+
+	cases := []struct {
+		name  string
+		order string
+		tags  *gcrgoogle.Tags
+		want  []string
+	}{
+		{
+			name:  "alphabetical by default",
+			order: "",
+			tags:  versions("b", "c", "a"),
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:  "uploaded",
+			order: OrderUploaded,
+			tags:  times,
+			want:  []string{"third", "second", "first", "tie-a", "tie-b"},
+		},
+		{
+			name:  "created, with ties broken alphabetically",
+			order: OrderCreated,
+			tags:  times,
+			want:  []string{"first", "second", "third", "tie-a", "tie-b"},
+		},
+		{
+			name:  "semver",
+			order: OrderSemver,
+			tags:  versions("v1.10.0", "1.2.0", "v1.9.3", "v2", "v1.2.0-rc.1"),
+			want:  []string{"v1.2.0-rc.1", "1.2.0", "v1.9.3", "v1.10.0", "v2"},
+		},
+		{
+			name:  "semver ties keep alphabetical order",
+			order: OrderSemver,
+			tags:  versions("v1.2.0+build.2", "v1.2.0", "1.2.0_chart", "1.2"),
+			want:  []string{"1.2", "1.2.0_chart", "v1.2.0", "v1.2.0+build.2"},
+		},
+		{
+			name:  "semver puts unparsable tags first",
+			order: OrderSemver,
+			tags:  versions("v1.0.0", "latest", "1.2.3.4", "main", "v0.1.0", "vx"),
+			want:  []string{"1.2.3.4", "latest", "main", "vx", "v0.1.0", "v1.0.0"},
+		},
+		{
+			name:  "numeric by suffix, unnumbered first",
+			order: OrderNumeric,
+			tags:  versions("build-10", "build-9", "latest", "pr-100", "build-9-x"),
+			want:  []string{"build-9-x", "latest", "build-9", "build-10", "pr-100"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sortTags(tc.order, tc.tags); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("sortTags(%q) = %v, want %v", tc.order, got, tc.want)
+			}
+		})
+	}
+}
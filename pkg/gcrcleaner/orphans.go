@@ -0,0 +1,84 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"log"
+	"sort"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// orphanedTagsMode is what to do with orphaned tags: "report" only logs
+// them, "delete" deletes them.
+var orphanedTagsMode = getenv("CLEANER_ORPHANED_TAGS", "report")
+
+// findOrphanedTags returns the tags of the listing that no listed manifest
+// has, which are left pointing at manifests that no longer exist, e.g. by
+// deletions interrupted between a manifest and its tags.
+func findOrphanedTags(tags *gcrgoogle.Tags) []string {
+	tagged := make(map[string]bool)
+	for _, m := range tags.Manifests {
+		for _, t := range m.Tags {
+			tagged[t] = true
+		}
+	}
+	var orphans []string
+	for _, t := range tags.Tags {
+		if !tagged[t] {
+			orphans = append(orphans, t)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// cleanOrphanedTags logs the orphaned tags of the plan and, with
+// CLEANER_ORPHANED_TAGS=delete, deletes them, unless this is a dry run. If the
+// backend can fetch manifests, a tag is only deleted once fetching it
+// confirms that its manifest is gone. It returns how many tags were, or would
+// be, deleted.
+func (c *Cleaner) cleanOrphanedTags(plan *RepoPlan, dry bool, res *RepoResult) int {
+	if len(plan.OrphanedTags) == 0 {
+		return 0
+	}
+	if orphanedTagsMode != "delete" {
+		log.Printf("%s: %d tags point at manifests that no longer exist: %v", plan.Repo, len(plan.OrphanedTags), plan.OrphanedTags)
+		return 0
+	}
+	if dry {
+		log.Printf("%s would delete %d orphaned tags: %v", plan.Repo, len(plan.OrphanedTags), plan.OrphanedTags)
+		return len(plan.OrphanedTags)
+	}
+
+	getter, canGet := c.backend.(ManifestGetter)
+	deleted := 0
+	for _, tag := range plan.OrphanedTags {
+		if canGet {
+			if _, err := getter.GetManifest(plan.Repo, tag); !IsNotFound(err) {
+				log.Printf("%s: keeping orphaned tag %s, as it resolves now", plan.Repo, tag)
+				continue
+			}
+		}
+		if err := c.deleteRef(func() error { return c.backend.DeleteTag(plan.Repo, tag) }); err != nil {
+			res.fail(false, &RefError{Repo: plan.Repo, Ref: plan.Repo + ":" + tag, Err: classify(err)})
+			continue
+		}
+		log.Printf("%s: deleted orphaned tag %s", plan.Repo, tag)
+		res.untagged()
+		deleted++
+	}
+	return deleted
+}
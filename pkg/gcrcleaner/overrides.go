@@ -0,0 +1,121 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+var digestsPath = getenv("CLEANER_DIGEST_FILE", "")
+
+// Reasons of decisions forced by the digest file.
+const (
+	ReasonForceKeep   = "forced keep"
+	ReasonForceDelete = "forced delete"
+)
+
+// digestOverrides are the digests the digest file forces to be kept or
+// deleted, as digests that apply to every repo or repo@digest references.
+type digestOverrides struct {
+	Keep   []string `json:"keep"`
+	Delete []string `json:"delete"`
+
+	keep, delete map[string]bool
+}
+
+// loadDigestOverrides reads CLEANER_DIGEST_FILE, if it is set. The file is
+// either JSON with keep and delete lists, or has a line per digest, each
+// starting with keep or delete, like "delete gcr.io/project/app@sha256:...".
+// Blank lines and lines starting with # are ignored.
+func loadDigestOverrides() (*digestOverrides, error) {
+	o := &digestOverrides{}
+	if digestsPath != "" {
+		b, err := ioutil.ReadFile(digestsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read digest file: %w", err)
+		}
+		if err := o.parse(b); err != nil {
+			return nil, fmt.Errorf("failed to parse digest file %s: %w", digestsPath, err)
+		}
+	}
+
+	o.keep, o.delete = make(map[string]bool), make(map[string]bool)
+	for _, ref := range o.Keep {
+		o.keep[ref] = true
+	}
+	for _, ref := range o.Delete {
+		o.delete[ref] = true
+	}
+	return o, nil
+}
+
+// parse parses the JSON or line format of the digest file.
+func (o *digestOverrides) parse(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return json.Unmarshal(b, o)
+	}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected keep or delete and a digest", i+1)
+		}
+		switch fields[0] {
+		case "keep":
+			o.Keep = append(o.Keep, fields[1])
+		case "delete":
+			o.Delete = append(o.Delete, fields[1])
+		default:
+			return fmt.Errorf("line %d: expected keep or delete, not %q", i+1, fields[0])
+		}
+	}
+	return nil
+}
+
+// matches returns true if the set has the manifest's digest or its
+// repo@digest.
+func matches(set map[string]bool, d *Decision) bool {
+	return set[d.Digest] || set[d.Repo+"@"+d.Digest]
+}
+
+// apply forces the decisions of the plans whose digests the file lists. A
+// digest listed to be both kept and deleted is kept. Forcing a deletion
+// overrides every protection, so it is logged.
+func (o *digestOverrides) apply(plans []*RepoPlan) {
+	if o == nil || len(o.keep)+len(o.delete) == 0 {
+		return
+	}
+	for _, plan := range plans {
+		for _, d := range plan.Decisions {
+			switch {
+			case matches(o.keep, d):
+				d.Delete, d.Reason = false, ReasonForceKeep
+			case matches(o.delete, d):
+				if !d.Delete {
+					log.Printf("%s: forcing deletion of %s (%s) by the digest file", plan.Repo, d.Digest, d.Reason)
+				}
+				d.Delete, d.Reason = true, ReasonForceDelete
+			}
+		}
+	}
+}
@@ -0,0 +1,488 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// Reasons a manifest is kept or deleted.
+const (
+	ReasonException  = "exception"
+	ReasonKeepWindow = "keep window"
+	ReasonUntagged   = "untagged"
+	ReasonBeyond     = "beyond keep window"
+	ReasonUntagOnly  = "untagged, untag only"
+	ReasonTooYoung   = "younger than minAge"
+
+	ReasonWindowExcluded = "tag excluded from keep window"
+)
+
+// Decision is the keep-or-delete classification of a single manifest.
+type Decision struct {
+	Repo      string    `json:"repo"`
+	Digest    string    `json:"digest"`
+	Tags      []string  `json:"tags,omitempty"`
+	Size      int64     `json:"size"`
+	MediaType string    `json:"mediaType,omitempty"`
+	Created   time.Time `json:"created"`
+	Uploaded  time.Time `json:"uploaded"`
+	Built     time.Time `json:"built"`
+	Delete    bool      `json:"delete"`
+	Reason    string    `json:"reason"`
+	Code      string    `json:"code"`
+
+	// Attached are the digests of the artifacts attached to the image, like
+	// SBOMs, that are deleted with it.
+	Attached []string `json:"attached,omitempty"`
+
+	// SBOM summarizes the image's SBOM once it has been deleted.
+	SBOM *SBOMSummary `json:"sbom,omitempty"`
+
+	// Vulnerabilities counts the Container Analysis findings of a candidate
+	// by severity.
+	Vulnerabilities map[string]int `json:"vulnerabilities,omitempty"`
+
+	// ArtifactType is the media type the policy's media type rules matched,
+	// if it has any.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Aliases maps every tag of a manifest with several tags, like v1.2.3,
+	// prod and latest, to the reason of its own decision. The manifest is
+	// kept if any of them is.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// ForeignSize is the size of the image's foreign layers, which the
+	// registry doesn't store, with CLEANER_EXCLUDE_FOREIGN_LAYERS. Size
+	// leaves them out.
+	ForeignSize int64 `json:"foreignSize,omitempty"`
+}
+
+// RepoPlan is the set of decisions for a single child repo.
+type RepoPlan struct {
+	Repo      string      `json:"repo"`
+	Policy    Policy      `json:"policy"`
+	Decisions []*Decision `json:"decisions"`
+
+	// OrphanedTags are the tags whose manifests no longer exist, see
+	// findOrphanedTags.
+	OrphanedTags []string `json:"orphanedTags,omitempty"`
+
+	// PolicySource is where the policy came from, see the PolicySource
+	// constants, followed by ", keep override" if the keep was overridden
+	// for the plan.
+	PolicySource string `json:"policySource,omitempty"`
+
+	// ExceptionRepo is true if the repo is an exception repo, which only
+	// loses its untagged manifests.
+	ExceptionRepo bool `json:"exceptionRepo,omitempty"`
+
+	// Exceptions counts the manifests kept by exceptions, by the code of
+	// what protected them, like IN_USE_CLUSTER:prod-eu.
+	Exceptions map[string]int `json:"exceptions,omitempty"`
+
+	// RunID identifies the clean the plan is for, in its events.
+	RunID string `json:"runId,omitempty"`
+}
+
+// Sources of the policy of a plan.
+const (
+	PolicySourceDefault     = "default"
+	PolicySourceFile        = "policy file"
+	PolicySourceAnnotations = "annotations"
+)
+
+// countExceptions counts the manifests of the plan kept by exceptions, once
+// the codes are set.
+func (p *RepoPlan) countExceptions() {
+	p.Exceptions = nil
+	for _, d := range p.Decisions {
+		if d.Delete || d.Reason != ReasonException {
+			continue
+		}
+		if p.Exceptions == nil {
+			p.Exceptions = make(map[string]int)
+		}
+		p.Exceptions[d.Code]++
+	}
+}
+
+// Candidates returns the decisions that delete a manifest.
+func (p *RepoPlan) Candidates() []*Decision {
+	var out []*Decision
+	for _, d := range p.Decisions {
+		if d.Delete {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// KeptSize returns the total size of the manifests the plan keeps.
+func (p *RepoPlan) KeptSize() int64 {
+	var size int64
+	for _, d := range p.Decisions {
+		if !d.Delete {
+			size += d.Size
+		}
+	}
+	return size
+}
+
+// Repos lists the child repos of the base repo in this cleaner's shard,
+// relative to the base repo.
+func (c *Cleaner) Repos() ([]string, error) {
+	children, err := c.backend.Children(c.base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list child repos %s: %w", c.base, classify(err))
+	}
+
+	var repos []string
+	for _, r := range children {
+		if c.inShard(r) {
+			repos = append(repos, r)
+		}
+	}
+	return repos, nil
+}
+
+// Plan lists the given child repos and classifies every manifest in them
+// without deleting anything. Repos are names relative to the base repo; if
+// none are given, every child repo of the base repo (in this cleaner's shard)
+// is planned. Repos that fail to list are skipped and reported in a
+// *MultiError.
+func (c *Cleaner) Plan(repos []string) ([]*RepoPlan, error) {
+	return c.PlanWith(repos, PlanOptions{})
+}
+
+// PlanOptions override the configured policies for a single plan.
+type PlanOptions struct {
+	// Keep, if not nil, replaces the keep of every planned repo's policy.
+	// Like policies, 0 requires WithAllowFullPrune.
+	Keep *int
+
+	// RaiseKeepOnly only lets Keep replace the keeps it is higher than, for
+	// callers that may make a clean keep more, but never delete more, than
+	// the policies do.
+	RaiseKeepOnly bool
+
+	// RunID identifies the clean the plans are for, see NewRunID. A new one
+	// is generated if it is empty.
+	RunID string
+
+	// Flagged, if not nil, turns the plans into deleting exactly the images
+	// a vulnerability scanner flagged, unless they are excepted, see
+	// FlaggedImages.apply.
+	Flagged *FlaggedImages
+}
+
+// planOne plans a single repo on its own, before the protections that span
+// repos. A repo that fails to list, or to be planned at all, has no plan and
+// fails alone, and the other repos are planned regardless.
+func (c *Cleaner) planOne(name string, opts PlanOptions, labels map[string]map[string]string) (plan *RepoPlan, failures []*RefError) {
+	defer func() {
+		if p := recover(); p != nil {
+			plan, failures = nil, []*RefError{{Repo: name, Ref: name, Err: fmt.Errorf("panic: %v", p)}}
+		}
+	}()
+
+	tags, err := c.backend.List(name)
+	if err != nil {
+		return nil, []*RefError{{Repo: name, Ref: name, Err: classify(err)}}
+	}
+
+	policy := c.policyFor(name)
+	source := PolicySourceDefault
+	if c.hasRepoPolicy(name) {
+		source = PolicySourceFile
+	} else if repoAnnotations {
+		var annotated bool
+		if policy, annotated, err = c.annotatedPolicy(name, policy, labels); err != nil {
+			return nil, []*RefError{{Repo: name, Ref: name, Err: err}}
+		}
+		if annotated {
+			source = PolicySourceAnnotations
+		}
+	}
+	if opts.Keep != nil && (!opts.RaiseKeepOnly || *opts.Keep > policy.Keep) {
+		policy.Keep = *opts.Keep
+		source += ", keep override"
+	}
+	plan = c.planRepo(name, policy, tags)
+	plan.PolicySource = source
+	plan.ExceptionRepo = c.repoExcept[name]
+	plan.OrphanedTags = findOrphanedTags(tags)
+	if excludeForeign {
+		c.excludeForeignLayers(plan)
+	}
+	if policy.DedupeContent {
+		failures = c.dedupeContent(plan)
+	}
+	if verifyKeptTags {
+		failures = append(failures, c.verifyKeepWindow(plan)...)
+	}
+	return plan, failures
+}
+
+// PlanWith is Plan with the policies overridden by the options.
+func (c *Cleaner) PlanWith(repos []string, opts PlanOptions) ([]*RepoPlan, error) {
+	if opts.Keep != nil {
+		switch {
+		case *opts.Keep < 0:
+			return nil, fmt.Errorf("keep override %d is negative", *opts.Keep)
+		case *opts.Keep == 0 && !c.allowFullPrune && !opts.RaiseKeepOnly:
+			return nil, fmt.Errorf("keep override 0 deletes every tag that isn't excepted; " +
+				"run with -allow-full-prune if that is intended")
+		}
+	}
+
+	c.exceptLock.RLock()
+	defer c.exceptLock.RUnlock()
+
+	if len(repos) == 0 {
+		var err error
+		if repos, err = c.Repos(); err != nil {
+			return nil, err
+		}
+	}
+
+	var plans []*RepoPlan
+	var failures []*RefError
+	labels := make(map[string]map[string]string)
+	for _, r := range repos {
+		name := fmt.Sprintf("%s/%s", c.base, strings.TrimPrefix(r, c.base+"/"))
+		plan, repoFailures := c.planOne(name, opts, labels)
+		failures = append(failures, repoFailures...)
+		if plan != nil {
+			plans = append(plans, plan)
+		}
+	}
+	if protectShared || protectBases {
+		others, otherFailures := c.planOthers(plans, failures)
+		failures = append(failures, otherFailures...)
+		if protectBases {
+			failures = append(failures, c.protectBaseImages(plans, others)...)
+		}
+		if protectShared {
+			c.protectSharedDigests(plans, others)
+		}
+	}
+	if sboms {
+		for _, plan := range plans {
+			linkAttachments(plan)
+		}
+	}
+	if c.vulnClient != nil {
+		c.annotateVulnerabilities(plans)
+	}
+	c.overrides.apply(plans)
+	if opts.Flagged != nil {
+		opts.Flagged.apply(plans)
+	}
+	if c.sample != nil {
+		for _, plan := range plans {
+			c.sample.apply(plan)
+		}
+	}
+	// The protections, overrides and sampling above may have changed reasons.
+	runID := opts.RunID
+	if runID == "" {
+		runID = NewRunID()
+	}
+	for _, plan := range plans {
+		c.setCodes(plan)
+		plan.countExceptions()
+		plan.RunID = runID
+	}
+
+	if len(failures) > 0 {
+		return plans, &MultiError{Errors: failures}
+	}
+	return plans, nil
+}
+
+// planRepo classifies every manifest in the listed repo under the policy, see
+// planManifests, and sets the reason codes of the decisions.
+func (c *Cleaner) planRepo(name string, policy Policy, tags *gcrgoogle.Tags) *RepoPlan {
+	plan := c.planManifests(name, policy, tags)
+	c.setCodes(plan)
+	return plan
+}
+
+// planManifests classifies every manifest in the listed repo under the policy. The most recent
+// policy.Keep tags (in the policy's tag order) of every tag group are kept, with excepted
+// tags kept on top of that window rather than counting towards it. Manifests
+// are kept if any of their tags are kept, with exceptions taking precedence
+// as the reason, and aliases of a manifest only count once towards the
+// window. Tags matching the policy's windowExcludeTags are left out of it. Everything else is deleted,
+// including untagged manifests, unless the repo has no tags at all, see
+// UntaggedOnly. Exception repos keep every tag and only lose
+// their untagged manifests. In untag-only mode, deleting means removing the
+// tags, so untagged manifests are kept. Manifests built within the policy's
+// minAge are always kept, as are those retained by its GFS schedule. Policies
+// with media type rules plan each media type separately, see planMediaTypes,
+// and chart policies plan Helm charts, see planChartRepo.
+func (c *Cleaner) planManifests(name string, policy Policy, tags *gcrgoogle.Tags) *RepoPlan {
+	if policy.hasMediaTypeRules() {
+		return c.planMediaTypes(name, policy, tags)
+	}
+	if policy.Chart {
+		return c.planChartRepo(name, policy, tags)
+	}
+	if isCacheRepo(name, policy) {
+		plan := c.planCacheRepo(name, policy, tags)
+		sortDecisions(plan.Decisions)
+		return plan
+	}
+
+	keeping := make(map[string]string)
+	digests := tagDigests(tags)
+	for _, group := range policy.groupTags(withoutAttachments(sortTags(policy.OrderBy, tags))) {
+		c.keepWindow(name, policy.windowTags(group), policy.Keep, digests, keeping)
+	}
+
+	plan := &RepoPlan{Repo: name, Policy: policy}
+	for digest, m := range tags.Manifests {
+		d := &Decision{
+			Repo:      name,
+			Digest:    digest,
+			Tags:      m.Tags,
+			Size:      int64(m.Size),
+			MediaType: m.MediaType,
+			Created:   m.Created,
+			Uploaded:  m.Uploaded,
+			Built:     policy.buildTime(m.Tags, m.Uploaded),
+			Delete:    true,
+			Reason:    ReasonUntagged,
+		}
+		if len(m.Tags) == 0 && policy.UntagOnly {
+			// There is nothing to untag.
+			d.Delete, d.Reason = false, ReasonUntagOnly
+		}
+		if len(m.Tags) > 1 {
+			d.Aliases = make(map[string]string, len(m.Tags))
+		}
+		for _, t := range m.Tags {
+			tagName := fmt.Sprintf("%s:%s", name, t)
+			reason, ok := keeping[tagName]
+			if !ok && c.isExcepted(tagName, t) {
+				reason, ok = ReasonException, true
+			}
+			if !ok {
+				reason = ReasonBeyond
+				if policy.windowExcluded(t) {
+					reason = ReasonWindowExcluded
+				}
+			}
+			if d.Aliases != nil {
+				d.Aliases[t] = reason
+			}
+			switch {
+			case ok && (d.Delete || reason == ReasonException):
+				d.Delete, d.Reason = false, reason
+			case d.Delete && (d.Reason == ReasonUntagged || reason == ReasonBeyond):
+				d.Reason = reason
+			}
+		}
+		if d.Delete && c.isDigestExcepted(name, digest) {
+			d.Delete, d.Reason = false, ReasonException
+		}
+		if d.Delete && policy.minAge > 0 && time.Since(d.Built) < policy.minAge {
+			d.Delete, d.Reason = false, ReasonTooYoung
+		}
+		plan.Decisions = append(plan.Decisions, d)
+	}
+
+	sortDecisions(plan.Decisions)
+	if !policy.UntagOnly && isUntaggedOnly(tags) {
+		policy.keepUntagged(plan.Decisions, time.Now())
+	}
+	if policy.GFS != nil {
+		policy.GFS.keep(plan.Decisions, time.Now())
+	}
+	return plan
+}
+
+// sortDecisions sorts decisions by build time, newest first.
+func sortDecisions(decisions []*Decision) {
+	sort.Slice(decisions, func(i, j int) bool {
+		return decisions[i].Built.After(decisions[j].Built)
+	})
+}
+
+// keepWindow marks the most recent keep tags (the end of tags) as kept, with
+// excepted tags and aliases of manifests already in the window extending the
+// window rather than counting towards it. digests maps tags to their
+// manifests.
+func (c *Cleaner) keepWindow(name string, tags []string, keep int, digests, keeping map[string]string) {
+	control := max(len(tags)-keep, 0)
+	if c.repoExcept[name] {
+		control = 0
+	}
+	windowed := make(map[string]bool)
+	for t := len(tags) - 1; t >= control; t-- {
+		tagName := fmt.Sprintf("%s:%s", name, tags[t])
+		digest := digests[tags[t]]
+		if c.isExcepted(tagName, tags[t]) {
+			// If it's a tag exception we want to keep it but not count it towards the total
+			control = max(control-1, 0)
+			keeping[tagName] = ReasonException
+			windowed[digest] = true
+			continue
+		}
+		if windowed[digest] {
+			// The manifest is already kept under another tag.
+			control = max(control-1, 0)
+		}
+		windowed[digest] = true
+		keeping[tagName] = ReasonKeepWindow
+	}
+}
+
+// tagDigests maps the tags of the listed repo to their manifests.
+func tagDigests(tags *gcrgoogle.Tags) map[string]string {
+	digests := make(map[string]string, len(tags.Tags))
+	for digest, m := range tags.Manifests {
+		for _, t := range m.Tags {
+			digests[t] = digest
+		}
+	}
+	return digests
+}
+
+// isExcepted returns true if the fully-qualified tag is protected by a tag
+// exception, a global tag exception or a cluster that is using it.
+func (c *Cleaner) isExcepted(tagName, tag string) bool {
+	return c.globalTagExcept[tag] || c.tagExcept[tagName] != ""
+}
+
+// joinErrors combines error strings into a single error, or nil if there are
+// none.
+func joinErrors(errStrings []string) error {
+	switch len(errStrings) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s", errStrings[0])
+	default:
+		return fmt.Errorf("%d errors occurred: %s",
+			len(errStrings), strings.Join(errStrings, ", "))
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// benchManifests is how many manifests the benchmark repos have.
+const benchManifests = 10000
+
+// benchRepo returns a listing of a repo with n manifests uploaded an hour
+// apart: every fifth is untagged, every tenth has an extra latest-style
+// alias and the rest have a single version tag.
+func benchRepo(n int) *gcrgoogle.Tags {
+	name := fixtureBase + "/bench"
+	tags := &gcrgoogle.Tags{Name: name, Manifests: make(map[string]gcrgoogle.ManifestInfo, n)}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		var mtags []string
+		switch {
+		case i%5 == 0:
+		case i%10 == 1:
+			mtags = []string{fmt.Sprintf("v%d", i), fmt.Sprintf("build-%d", i)}
+		default:
+			mtags = []string{fmt.Sprintf("v%d", i)}
+		}
+		uploaded := now.Add(-time.Duration(n-i) * time.Hour)
+		tags.Manifests[fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(fmt.Sprint(i))))] = gcrgoogle.ManifestInfo{
+			Size:      1 << 20,
+			MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+			Created:   uploaded,
+			Uploaded:  uploaded,
+			Tags:      mtags,
+		}
+		tags.Tags = append(tags.Tags, mtags...)
+	}
+	return tags
+}
+
+// planCleaner returns a cleaner planning under the policy file, like
+// TestPolicies does.
+func planCleaner(tb testing.TB, policy string) *Cleaner {
+	tb.Helper()
+	path, cleanup := writePolicyFile(tb, policy)
+	defer cleanup()
+	policies, err := loadPolicyFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Cleaner{
+		base:            fixtureBase,
+		concurrency:     1,
+		policies:        policies,
+		repoExcept:      make(map[string]bool),
+		tagExcept:       make(map[string]string),
+		globalTagExcept: make(map[string]bool),
+		digestExcept:    make(map[string]string),
+	}
+}
+
+func benchmarkPlan(b *testing.B, policy string) {
+	c := planCleaner(b, policy)
+	tags := benchRepo(benchManifests)
+	p := c.policies.forRepo("bench")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.planRepo(tags.Name, p, tags)
+	}
+}
+
+func BenchmarkPlanKeep10k(b *testing.B) {
+	benchmarkPlan(b, `{"default": {"keep": 10}}`)
+}
+
+func BenchmarkPlanGroupBy10k(b *testing.B) {
+	benchmarkPlan(b, `{"default": {"keep": 10, "groupBy": "^([a-z]+)"}}`)
+}
+
+func BenchmarkPlanGFS10k(b *testing.B) {
+	benchmarkPlan(b, `{"default": {"keep": 10, "gfs": {"all": "2d", "daily": "30d", "weekly": "180d"}}}`)
+}
+
+func BenchmarkPlanMinAge10k(b *testing.B) {
+	benchmarkPlan(b, `{"default": {"keep": 10, "minAge": "90d"}}`)
+}
+
+func BenchmarkKeepSet10k(b *testing.B) {
+	c := planCleaner(b, `{"default": {"keep": 10}}`)
+	tags := benchRepo(benchManifests)
+	plans := []*RepoPlan{c.planRepo(tags.Name, c.policies.forRepo("bench"), tags)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ks := &KeepSet{Base: fixtureBase}
+		ks.Add(plans)
+		NewDeletedImages(ks)
+		NewKeptIndex().Update(ks)
+	}
+}
+
+func TestPlanAliases(t *testing.T) {
+	type manifest struct {
+		tags    []string
+		delete  bool
+		reason  string
+		aliases map[string]string
+	}
+	cases := []struct {
+		name       string
+		keep       int
+		tagExcept  []string
+		globalTags []string
+		manifests  []manifest
+	}{
+		{
+			name: "a manifest straddling the window edge is kept",
+			keep: 2,
+			manifests: []manifest{
+				{tags: []string{"v1"}, delete: true, reason: ReasonBeyond},
+				{
+					tags:    []string{"v2", "latest"},
+					reason:  ReasonKeepWindow,
+					aliases: map[string]string{"v2": ReasonKeepWindow, "latest": ReasonBeyond},
+				},
+				{tags: []string{"v3"}, reason: ReasonKeepWindow},
+			},
+		},
+		{
+			name: "aliases in the window count once",
+			keep: 2,
+			manifests: []manifest{
+				{tags: []string{"v1"}, delete: true, reason: ReasonBeyond},
+				{tags: []string{"v2"}, reason: ReasonKeepWindow},
+				{
+					tags:    []string{"v3", "v3.0"},
+					reason:  ReasonKeepWindow,
+					aliases: map[string]string{"v3": ReasonKeepWindow, "v3.0": ReasonKeepWindow},
+				},
+			},
+		},
+		{
+			name:       "an alias that is an exception keeps its manifest beyond the window",
+			keep:       1,
+			globalTags: []string{"pinned"},
+			manifests: []manifest{
+				{tags: []string{"v1"}, delete: true, reason: ReasonBeyond},
+				{
+					tags:    []string{"v2", "pinned"},
+					reason:  ReasonException,
+					aliases: map[string]string{"v2": ReasonBeyond, "pinned": ReasonException},
+				},
+				{tags: []string{"v3"}, reason: ReasonKeepWindow},
+			},
+		},
+		{
+			name:      "an excepted alias of a manifest in the window is its reason",
+			keep:      1,
+			tagExcept: []string{"v3"},
+			manifests: []manifest{
+				{tags: []string{"v1"}, delete: true, reason: ReasonBeyond},
+				{tags: []string{"v2"}, delete: true, reason: ReasonBeyond},
+				{
+					tags:    []string{"v3", "v3.0"},
+					reason:  ReasonException,
+					aliases: map[string]string{"v3": ReasonException, "v3.0": ReasonKeepWindow},
+				},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := planCleaner(t, fmt.Sprintf(`{"default": {"keep": %d, "orderBy": "semver"}}`, tc.keep))
+			name := fixtureBase + "/app"
+			for _, tag := range tc.tagExcept {
+				c.tagExcept[name+":"+tag] = CodeExceptionTag
+			}
+			for _, tag := range tc.globalTags {
+				c.globalTagExcept[tag] = true
+			}
+
+			tags := &gcrgoogle.Tags{Name: name, Manifests: make(map[string]gcrgoogle.ManifestInfo)}
+			now := time.Now()
+			for i, m := range tc.manifests {
+				uploaded := now.Add(-time.Duration(len(tc.manifests)-i) * 24 * time.Hour)
+				tags.Manifests[fmt.Sprintf("sha256:%d", i)] = gcrgoogle.ManifestInfo{Created: uploaded, Uploaded: uploaded, Tags: m.tags}
+				tags.Tags = append(tags.Tags, m.tags...)
+			}
+
+			plan := c.planRepo(name, c.policies.forRepo("app"), tags)
+			byDigest := make(map[string]*Decision)
+			for _, d := range plan.Decisions {
+				byDigest[d.Digest] = d
+			}
+			for i, m := range tc.manifests {
+				d := byDigest[fmt.Sprintf("sha256:%d", i)]
+				if d.Delete != m.delete || d.Reason != m.reason {
+					t.Errorf("%v: delete %v, %q, want delete %v, %q", m.tags, d.Delete, d.Reason, m.delete, m.reason)
+				}
+				if len(d.Aliases) != len(m.aliases) {
+					t.Errorf("%v: aliases %v, want %v", m.tags, d.Aliases, m.aliases)
+					continue
+				}
+				for tag, reason := range m.aliases {
+					if d.Aliases[tag] != reason {
+						t.Errorf("%v: alias %s is %q, want %q", m.tags, tag, d.Aliases[tag], reason)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var policyPath = getenv("CLEANER_POLICY_FILE", "")
+var untagOnly = getenv("CLEANER_UNTAG_ONLY", "false") == "true"
+var windowExcludeTags = splitPatterns(getenv("CLEANER_WINDOW_EXCLUDE_TAGS", ""))
+
+// Policy is the retention policy applied to a child repo.
+type Policy struct {
+	// Keep is the number of most recent tags to keep.
+	Keep int `json:"keep"`
+
+	// UntagOnly removes the tags of candidates without deleting their
+	// manifests, leaving untagged manifests alone entirely.
+	UntagOnly bool `json:"untagOnly"`
+
+	// OrderBy is the tag order the keep window is applied to, see the Order
+	// constants. Tags are ordered alphabetically by default.
+	OrderBy string `json:"orderBy,omitempty"`
+
+	// GroupBy is a regular expression that groups tags by its first capture
+	// group (or the whole match if it has none), e.g. the branch name in
+	// main-abc123. Keep applies within each group, and tags that don't match
+	// form a group of their own.
+	GroupBy string `json:"groupBy,omitempty"`
+
+	// TagTimeLayout is a Go time layout, e.g. 20060102-1504, used to read the
+	// build time embedded in tags like 20240112-1432-abc123. The build time
+	// is used instead of the upload time, which re-pushes and mirroring skew.
+	TagTimeLayout string `json:"tagTimeLayout,omitempty"`
+
+	// TagTimePattern is a regular expression whose first capture group is
+	// the timestamp within the tag. If empty, the timestamp is expected at
+	// the start of the tag.
+	TagTimePattern string `json:"tagTimePattern,omitempty"`
+
+	// WindowExcludeTags are glob patterns, like tmp-*, of tags that never
+	// count toward the keep window nor are kept by it, so junk tags don't
+	// push releases out of it.
+	WindowExcludeTags []string `json:"windowExcludeTags,omitempty"`
+
+	// MinAge is a duration such as 72h or 14d. Manifests built more recently
+	// are never deleted.
+	MinAge string `json:"minAge,omitempty"`
+
+	// GFS keeps manifests on a grandfather-father-son schedule on top of
+	// the keep window.
+	GFS *GFS `json:"gfs,omitempty"`
+
+	// UntaggedOnly configures repos without any tags, see UntaggedOnly.
+	UntaggedOnly *UntaggedOnly `json:"untaggedOnly,omitempty"`
+
+	// Cache marks the repo as a build cache repo, see isCacheRepo.
+	Cache bool `json:"cache,omitempty"`
+
+	// CacheMaxAge is how long manifests in a cache repo are kept, 7d by
+	// default.
+	CacheMaxAge string `json:"cacheMaxAge,omitempty"`
+
+	// VulnerableFirst deletes the candidates with the most severe
+	// vulnerability findings first, and the oldest among equally severe
+	// ones, so they are gone first if a run is cut short.
+	VulnerableFirst bool `json:"vulnerableFirst,omitempty"`
+
+	// MediaTypes, if set, limits cleaning to manifests of these media
+	// types; the rest are kept. A manifest's media type is its artifact
+	// type, e.g. application/vnd.cncf.helm.config.v1+json, and entries
+	// ending in * match by prefix.
+	MediaTypes []string `json:"mediaTypes,omitempty"`
+
+	// ExcludeMediaTypes keeps every manifest of these media types.
+	ExcludeMediaTypes []string `json:"excludeMediaTypes,omitempty"`
+
+	// MediaTypePolicies cleans the manifests of a media type under their own
+	// policy, which inherits the fields it doesn't set from this one.
+	MediaTypePolicies map[string]json.RawMessage `json:"mediaTypePolicies,omitempty"`
+
+	// Chart cleans Helm charts, keeping the Keep most recent chart versions,
+	// see planChartRepo.
+	Chart bool `json:"chart,omitempty"`
+
+	// DedupeContent deletes manifests in the keep window that have the same
+	// content as a newer kept manifest, see dedupeContent.
+	DedupeContent bool `json:"dedupeContent,omitempty"`
+
+	// DryRun only logs what would be deleted from the repo, even in real
+	// runs, so the cleaner can be rolled out repo by repo.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	groupRe   *regexp.Regexp
+	tagTimeRe *regexp.Regexp
+	minAge    time.Duration
+
+	cacheMaxAge time.Duration
+
+	mediaTypePolicies []mediaTypePolicy
+}
+
+// clone returns a copy of the policy that shares nothing json.Unmarshal
+// writes into, so a policy can be parsed on top of it without changing it.
+func (p Policy) clone() Policy {
+	if p.GFS != nil {
+		gfs := *p.GFS
+		p.GFS = &gfs
+	}
+	if p.UntaggedOnly != nil {
+		untagged := *p.UntaggedOnly
+		p.UntaggedOnly = &untagged
+	}
+	if p.MediaTypePolicies != nil {
+		policies := make(map[string]json.RawMessage, len(p.MediaTypePolicies))
+		for pattern, msg := range p.MediaTypePolicies {
+			policies[pattern] = msg
+		}
+		p.MediaTypePolicies = policies
+	}
+	// Slices are decoded into their existing backing arrays.
+	p.WindowExcludeTags = append([]string(nil), p.WindowExcludeTags...)
+	p.MediaTypes = append([]string(nil), p.MediaTypes...)
+	p.ExcludeMediaTypes = append([]string(nil), p.ExcludeMediaTypes...)
+	return p
+}
+
+// compile validates the policy and prepares its regular expressions.
+func (p *Policy) compile() error {
+	if err := validOrder(p.OrderBy); err != nil {
+		return err
+	}
+
+	p.groupRe = nil
+	if p.GroupBy != "" {
+		re, err := regexp.Compile(p.GroupBy)
+		if err != nil {
+			return fmt.Errorf("invalid groupBy: %w", err)
+		}
+		p.groupRe = re
+	}
+
+	p.tagTimeRe = nil
+	if p.TagTimePattern != "" {
+		re, err := regexp.Compile(p.TagTimePattern)
+		if err != nil {
+			return fmt.Errorf("invalid tagTimePattern: %w", err)
+		}
+		p.tagTimeRe = re
+	}
+
+	for _, pattern := range p.WindowExcludeTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid windowExcludeTags pattern %q: %w", pattern, err)
+		}
+	}
+
+	p.minAge = 0
+	if p.MinAge != "" {
+		d, err := ParseDuration(p.MinAge)
+		if err != nil {
+			return fmt.Errorf("invalid minAge: %w", err)
+		}
+		p.minAge = d
+	}
+
+	if p.GFS != nil {
+		if err := p.GFS.compile(); err != nil {
+			return err
+		}
+	}
+
+	if p.UntaggedOnly != nil {
+		if err := p.UntaggedOnly.compile(); err != nil {
+			return err
+		}
+	}
+
+	p.cacheMaxAge = defaultCacheMaxAge
+	if p.CacheMaxAge != "" {
+		d, err := ParseDuration(p.CacheMaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid cacheMaxAge: %w", err)
+		}
+		p.cacheMaxAge = d
+	}
+	return p.compileMediaTypes()
+}
+
+// String summarizes the settings of the policy that decide what is deleted,
+// like keep 10, order semver, minAge 14d.
+func (p Policy) String() string {
+	var parts []string
+	if p.Cache {
+		parts = append(parts, "cache, maxAge "+p.cacheMaxAge.String())
+	} else {
+		parts = append(parts, fmt.Sprintf("keep %d", p.Keep))
+	}
+	for _, f := range []struct{ name, value string }{
+		{"order", p.OrderBy},
+		{"groupBy", p.GroupBy},
+		{"tagTimeLayout", p.TagTimeLayout},
+		{"tagTimePattern", p.TagTimePattern},
+		{"minAge", p.MinAge},
+		{"windowExcludeTags", strings.Join(p.WindowExcludeTags, ",")},
+		{"mediaTypes", strings.Join(p.MediaTypes, ",")},
+		{"excludeMediaTypes", strings.Join(p.ExcludeMediaTypes, ",")},
+	} {
+		if f.value != "" {
+			parts = append(parts, f.name+" "+f.value)
+		}
+	}
+	if p.GFS != nil {
+		parts = append(parts, fmt.Sprintf("gfs all %s, daily %s, weekly %s", p.GFS.all, p.GFS.daily, p.GFS.weekly))
+	}
+	if p.UntaggedOnly != nil {
+		parts = append(parts, fmt.Sprintf("untaggedOnly keep %d, maxAge %s", p.UntaggedOnly.Keep, p.UntaggedOnly.maxAge))
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"untagOnly", p.UntagOnly},
+		{"chart", p.Chart},
+		{"dedupeContent", p.DedupeContent},
+		{"vulnerableFirst", p.VulnerableFirst},
+		{"dryRun", p.DryRun},
+	} {
+		if f.set {
+			parts = append(parts, f.name)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// splitPatterns splits a comma-separated list of tag patterns.
+func splitPatterns(s string) []string {
+	var out []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			out = append(out, pattern)
+		}
+	}
+	return out
+}
+
+// windowExcluded returns true if the tag matches WindowExcludeTags.
+func (p *Policy) windowExcluded(tag string) bool {
+	for _, pattern := range p.WindowExcludeTags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// windowTags returns the tags that may count toward the keep window.
+func (p *Policy) windowTags(tags []string) []string {
+	if len(p.WindowExcludeTags) == 0 {
+		return tags
+	}
+	var out []string
+	for _, t := range tags {
+		if !p.windowExcluded(t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// buildTime returns the build time of a manifest: the latest timestamp
+// embedded in its tags if the policy reads them, or its upload time.
+func (p *Policy) buildTime(tags []string, uploaded time.Time) time.Time {
+	if p.TagTimeLayout == "" {
+		return uploaded
+	}
+
+	var latest time.Time
+	for _, t := range tags {
+		stamp := t
+		if p.tagTimeRe != nil {
+			m := p.tagTimeRe.FindStringSubmatch(t)
+			if m == nil {
+				continue
+			}
+			stamp = m[0]
+			if len(m) > 1 {
+				stamp = m[1]
+			}
+		} else if len(stamp) > len(p.TagTimeLayout) {
+			stamp = stamp[:len(p.TagTimeLayout)]
+		}
+
+		parsed, err := time.Parse(p.TagTimeLayout, stamp)
+		if err == nil && parsed.After(latest) {
+			latest = parsed
+		}
+	}
+	if latest.IsZero() {
+		return uploaded
+	}
+	return latest
+}
+
+// ParseDuration parses a Go duration, additionally accepting a number of days
+// such as 90d.
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// groupTags splits the tags into groups by GroupBy, keeping their order
+// within each group.
+func (p *Policy) groupTags(tags []string) [][]string {
+	if p.groupRe == nil {
+		return [][]string{tags}
+	}
+
+	var keys []string
+	groups := make(map[string][]string)
+	for _, t := range tags {
+		key := ""
+		if m := p.groupRe.FindStringSubmatch(t); m != nil {
+			key = m[0]
+			if len(m) > 1 {
+				key = m[1]
+			}
+			key = "=" + key
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], t)
+	}
+
+	out := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, groups[k])
+	}
+	return out
+}
+
+// policyConfig is the policy file. Repo policies are keyed by child repo name
+// relative to the base repo and override the default field by field.
+type policyConfig struct {
+	Default Policy
+	Repos   map[string]Policy
+}
+
+// rawPolicyConfig is the on-disk form of the policy file.
+type rawPolicyConfig struct {
+	Default json.RawMessage            `json:"default"`
+	Repos   map[string]json.RawMessage `json:"repos"`
+}
+
+// loadPolicies reads the policy file, if there is one. The default policy
+// starts from CLEANER_KEEP_AMOUNT, CLEANER_UNTAG_ONLY, CLEANER_TAG_ORDER and
+// CLEANER_WINDOW_EXCLUDE_TAGS.
+func loadPolicies() (*policyConfig, error) {
+	return loadPolicyFile(policyPath)
+}
+
+// loadPolicyFile is loadPolicies for the policy file at path, if not empty.
+func loadPolicyFile(path string) (*policyConfig, error) {
+	cfg := &policyConfig{
+		Default: Policy{Keep: keep, UntagOnly: untagOnly, OrderBy: tagOrder, WindowExcludeTags: windowExcludeTags},
+		Repos:   make(map[string]Policy),
+	}
+	if path == "" {
+		return cfg, cfg.Default.compile()
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy file: %w", err)
+	}
+	var raw rawPolicyConfig
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("Failed to parse JSON policy file: %w", err)
+	}
+
+	if len(raw.Default) > 0 {
+		if err := json.Unmarshal(raw.Default, &cfg.Default); err != nil {
+			return nil, fmt.Errorf("Failed to parse default policy: %w", err)
+		}
+	}
+	if err := cfg.Default.compile(); err != nil {
+		return nil, fmt.Errorf("Failed to parse default policy: %w", err)
+	}
+	for r, msg := range raw.Repos {
+		// Start from the default so unset fields are inherited.
+		p := cfg.Default.clone()
+		if err := json.Unmarshal(msg, &p); err != nil {
+			return nil, fmt.Errorf("Failed to parse policy for %s: %w", r, err)
+		}
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("Failed to parse policy for %s: %w", r, err)
+		}
+		cfg.Repos[r] = p
+	}
+	return cfg, nil
+}
+
+// checkKeep rejects negative keep amounts, and policies that keep 0 tags
+// unless full prunes are allowed. Cache policies don't use the keep window.
+func (cfg *policyConfig) checkKeep(allowFullPrune bool) error {
+	if err := checkPolicyKeep("default policy", cfg.Default, allowFullPrune); err != nil {
+		return err
+	}
+	for r, p := range cfg.Repos {
+		if err := checkPolicyKeep("policy for "+r, p, allowFullPrune); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPolicyKeep is checkKeep for a single policy and its media type
+// policies.
+func checkPolicyKeep(name string, p Policy, allowFullPrune bool) error {
+	for _, mp := range p.mediaTypePolicies {
+		if err := checkPolicyKeep(name+" for "+mp.pattern, mp.policy, allowFullPrune); err != nil {
+			return err
+		}
+	}
+	switch {
+	case p.Cache:
+		return nil
+	case p.Keep < 0:
+		return fmt.Errorf("%s keeps %d tags, which is negative", name, p.Keep)
+	case p.Keep == 0 && !allowFullPrune:
+		return fmt.Errorf("%s keeps 0 tags, which deletes every tag that isn't excepted; "+
+			"run with -allow-full-prune if that is intended", name)
+	}
+	return nil
+}
+
+// policyFor returns the policy for the fully-qualified child repo. The caller
+// must hold exceptLock.
+func (c *Cleaner) policyFor(name string) Policy {
+	return c.policies.forRepo(strings.TrimPrefix(name, c.base+"/"))
+}
+
+// hasRepoPolicy returns true if the policy file has a policy of its own for
+// the fully-qualified child repo. The caller must hold exceptLock.
+func (c *Cleaner) hasRepoPolicy(name string) bool {
+	_, ok := c.policies.Repos[strings.TrimPrefix(name, c.base+"/")]
+	return ok
+}
+
+// forRepo returns the policy for the child repo relative to the base repo.
+func (cfg *policyConfig) forRepo(rel string) Policy {
+	if p, ok := cfg.Repos[rel]; ok {
+		return p
+	}
+	return cfg.Default
+}
+
+// PolicyFor returns the policy that applies to the given child repo, which
+// may be fully-qualified or relative to the base repo.
+func (c *Cleaner) PolicyFor(name string) Policy {
+	c.exceptLock.RLock()
+	defer c.exceptLock.RUnlock()
+	return c.policyFor(fmt.Sprintf("%s/%s", c.base, strings.TrimPrefix(name, c.base+"/")))
+}
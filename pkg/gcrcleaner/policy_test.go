@@ -0,0 +1,191 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePolicyFile writes the policy file to a temporary directory and
+// returns its path and a function that removes it.
+func writePolicyFile(t testing.TB, policy string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(path, []byte(policy), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// checkFixtures runs the fixtures under the policy file and fails the test
+// for every unexpected decision.
+func checkFixtures(t *testing.T, policy string, fixtures []PolicyFixture) {
+	t.Helper()
+	path, cleanup := writePolicyFile(t, policy)
+	defer cleanup()
+	results, err := TestPolicies(path, fixtures, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		for _, f := range res.Failures {
+			t.Errorf("%s: %s", res.Fixture, f)
+		}
+	}
+}
+
+func TestLoadPolicyFileRepoPoliciesDontChangeDefault(t *testing.T) {
+	path, cleanup := writePolicyFile(t, `{
+		"default": {"keep": 10, "gfs": {"all": "1d"}, "untaggedOnly": {"keep": 10, "maxAge": "30d"}},
+		"repos": {"a": {"gfs": {"all": "2d"}, "untaggedOnly": {"keep": 1}}}
+	}`)
+	defer cleanup()
+	cfg, err := loadPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Default.UntaggedOnly.Keep; got != 10 {
+		t.Errorf("default untaggedOnly.keep = %d, want 10", got)
+	}
+	if got := cfg.Default.GFS.All; got != "1d" {
+		t.Errorf("default gfs.all = %q, want 1d", got)
+	}
+	a := cfg.Repos["a"]
+	if a.UntaggedOnly.Keep != 1 || a.UntaggedOnly.MaxAge != "30d" {
+		t.Errorf("repo untaggedOnly = %+v, want keep 1 and the default's maxAge 30d", *a.UntaggedOnly)
+	}
+}
+
+func TestLoadPolicyFileMediaTypePoliciesArePerRepo(t *testing.T) {
+	path, cleanup := writePolicyFile(t, `{
+		"default": {
+			"keep": 5,
+			"mediaTypes": ["application/vnd.oci.image.manifest.v1+json", "application/vnd.docker.distribution.manifest.v2+json"],
+			"mediaTypePolicies": {"application/vnd.cncf.helm.*": {"keep": 3}}
+		},
+		"repos": {
+			"a": {"mediaTypes": ["x"], "mediaTypePolicies": {"application/vnd.dev.cosign.*": {"keep": 1}}},
+			"b": {}
+		}
+	}`)
+	defer cleanup()
+	// Repos are parsed in random order, so parse a few times.
+	for i := 0; i < 10; i++ {
+		cfg, err := loadPolicyFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(cfg.Default.MediaTypePolicies); n != 1 {
+			t.Errorf("default has %d media type policies, want 1", n)
+		}
+		if got := cfg.Default.MediaTypes[0]; got != "application/vnd.oci.image.manifest.v1+json" {
+			t.Errorf("default mediaTypes[0] = %q", got)
+		}
+		if n := len(cfg.Repos["a"].MediaTypePolicies); n != 2 {
+			t.Errorf("repo a has %d media type policies, want the default's and its own", n)
+		}
+		if n := len(cfg.Repos["b"].MediaTypePolicies); n != 1 {
+			t.Errorf("repo b has %d media type policies, want only the default's", n)
+		}
+	}
+}
+
+func TestUntaggedOnlyRepos(t *testing.T) {
+	policy := `{
+		"default": {"keep": 2},
+		"repos": {
+			"digests": {"untaggedOnly": {"keep": 1, "maxAge": "10d"}},
+			"wipe": {"untaggedOnly": {"keep": 0}},
+			"untag": {"untagOnly": true}
+		}
+	}`
+	checkFixtures(t, policy, []PolicyFixture{
+		{
+			Name: "without a policy, the newest keep manifests are kept",
+			Repo: "plain",
+			Manifests: []FixtureManifest{
+				{Age: "30d", Expect: "delete", Reason: CodeUntagged},
+				{Age: "20d", Expect: "keep", Reason: CodeUntaggedNewest},
+				{Age: "1d", Expect: "keep", Reason: CodeUntaggedNewest},
+			},
+		},
+		{
+			Name: "untaggedOnly keeps its newest and those within maxAge",
+			Repo: "digests",
+			Manifests: []FixtureManifest{
+				{Age: "30d", Expect: "delete", Reason: CodeUntagged},
+				{Age: "5d", Expect: "keep", Reason: CodeUntaggedRecent},
+				{Age: "1d", Expect: "keep", Reason: CodeUntaggedNewest},
+			},
+		},
+		{
+			Name: "untaggedOnly with keep 0 deletes every manifest",
+			Repo: "wipe",
+			Manifests: []FixtureManifest{
+				{Age: "2d", Expect: "delete", Reason: CodeUntagged},
+				{Age: "1d", Expect: "delete", Reason: CodeUntagged},
+			},
+		},
+		{
+			Name: "tagged repos still lose every untagged manifest",
+			Repo: "plain",
+			Manifests: []FixtureManifest{
+				{Age: "3d", Expect: "delete", Reason: CodeUntagged},
+				{Age: "2d", Expect: "delete", Reason: CodeUntagged},
+				{Tags: []string{"v1"}, Age: "4d", Expect: "keep", Reason: CodeKeepWindow},
+			},
+		},
+		{
+			Name: "untag only repos keep untagged manifests",
+			Repo: "untag",
+			Manifests: []FixtureManifest{
+				{Age: "30d", Expect: "keep", Reason: ReasonUntagOnly},
+				{Age: "20d", Expect: "keep", Reason: ReasonUntagOnly},
+				{Age: "10d", Expect: "keep", Reason: ReasonUntagOnly},
+			},
+		},
+	})
+}
+
+func TestPolicyFixturesFile(t *testing.T) {
+	fixtures, err := LoadPolicyFixtures(filepath.Join("testdata", "fixtures.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) != 2 {
+		t.Fatalf("loaded %d fixtures, want 2", len(fixtures))
+	}
+	if got := fixtures[0].Manifests[2].Tags; len(got) != 2 || got[1] != "latest" {
+		t.Errorf("tags = %v, want [v1.2.0 latest]", got)
+	}
+
+	results, err := TestPolicies(filepath.Join("testdata", "policy.json"), fixtures, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		for _, f := range res.Failures {
+			t.Errorf("%s: %s", res.Fixture, f)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// fixtureBase is the base repo fixtures are planned in.
+const fixtureBase = "registry.invalid/fixtures"
+
+// PolicyFixture is a child repo and the outcome a policy must produce for
+// every manifest in it.
+type PolicyFixture struct {
+	Name string `json:"name"`
+
+	// Repo is the child repo, relative to the base repo, whose policy
+	// applies.
+	Repo string `json:"repo"`
+
+	// InUse are tags that are in use, like tags a cluster runs.
+	InUse []string `json:"inUse,omitempty"`
+
+	Manifests []FixtureManifest `json:"manifests"`
+}
+
+// FixtureManifest is a manifest of a fixture and its expected outcome.
+type FixtureManifest struct {
+	// Digest defaults to one derived from the fixture and the manifest's
+	// position.
+	Digest    string   `json:"digest,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	MediaType string   `json:"mediaType,omitempty"`
+	Size      int64    `json:"size,omitempty"`
+
+	// Age is how long ago the manifest was uploaded, such as 36h or 14d.
+	// Manifests without one are a day apart, listed oldest first.
+	Age string `json:"age,omitempty"`
+
+	// Expect is keep or delete.
+	Expect string `json:"expect"`
+
+	// Reason, if set, is the reason or reason code the decision must have.
+	Reason string `json:"reason,omitempty"`
+}
+
+// FixtureResult is the outcome of testing a policy against a fixture.
+// Failures is empty if the policy produced exactly the expected decisions.
+type FixtureResult struct {
+	Fixture  string   `json:"fixture"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+// LoadPolicyFixtures reads a JSON file with a list of fixtures.
+func LoadPolicyFixtures(path string) ([]PolicyFixture, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixtures: %w", err)
+	}
+	var fixtures []PolicyFixture
+	if err := json.Unmarshal(b, &fixtures); err != nil {
+		return nil, fmt.Errorf("failed to parse fixtures %s: %w", path, err)
+	}
+	return fixtures, nil
+}
+
+// TestPolicies plans every fixture under the policy file at path, or the
+// default policy if path is empty, and reports every manifest whose decision
+// differs from the expected one. Nothing but the fixture is consulted: no
+// registry, exceptions file or cluster. It returns an error if the policy
+// file or a fixture is invalid.
+func TestPolicies(path string, fixtures []PolicyFixture, allowFullPrune bool) ([]FixtureResult, error) {
+	policies, err := loadPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := policies.checkKeep(allowFullPrune); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var results []FixtureResult
+	for _, f := range fixtures {
+		c := &Cleaner{
+			base:            fixtureBase,
+			concurrency:     1,
+			policies:        policies,
+			repoExcept:      make(map[string]bool),
+			tagExcept:       make(map[string]string),
+			globalTagExcept: make(map[string]bool),
+			digestExcept:    make(map[string]string),
+		}
+		name := fmt.Sprintf("%s/%s", fixtureBase, f.Repo)
+		for _, t := range f.InUse {
+			c.tagExcept[name+":"+t] = inUseCode(CodeInUse, "fixture")
+		}
+
+		tags := &gcrgoogle.Tags{Name: name, Manifests: make(map[string]gcrgoogle.ManifestInfo)}
+		expected := make(map[string]FixtureManifest)
+		for i, m := range f.Manifests {
+			if m.Expect != "keep" && m.Expect != "delete" {
+				return nil, fmt.Errorf("fixture %s: manifest %d expects %q, not keep or delete", f.Name, i, m.Expect)
+			}
+			digest := m.Digest
+			if digest == "" {
+				digest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(fmt.Sprintf("%s/%d", f.Name, i))))
+			}
+			uploaded := now.Add(-time.Duration(len(f.Manifests)-i) * 24 * time.Hour)
+			if m.Age != "" {
+				age, err := ParseDuration(m.Age)
+				if err != nil {
+					return nil, fmt.Errorf("fixture %s: manifest %d: %w", f.Name, i, err)
+				}
+				uploaded = now.Add(-age)
+			}
+			tags.Manifests[digest] = gcrgoogle.ManifestInfo{
+				Size:      uint64(m.Size),
+				MediaType: m.MediaType,
+				Created:   uploaded,
+				Uploaded:  uploaded,
+				Tags:      m.Tags,
+			}
+			tags.Tags = append(tags.Tags, m.Tags...)
+			expected[digest] = m
+		}
+
+		res := FixtureResult{Fixture: f.Name}
+		for _, d := range c.planRepo(name, policies.forRepo(f.Repo), tags).Decisions {
+			m := expected[d.Digest]
+			got := "keep"
+			if d.Delete {
+				got = "delete"
+			}
+			if got != m.Expect || (m.Reason != "" && m.Reason != d.Reason && m.Reason != d.Code) {
+				res.Failures = append(res.Failures, fmt.Sprintf("%s %v: expected %s%s, got %s (%s)",
+					shortRef(d.Digest), d.Tags, m.Expect, reasonSuffix(m.Reason), got, d.Reason))
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// shortRef abbreviates a digest for messages.
+func shortRef(digest string) string {
+	if len(digest) > 19 {
+		return digest[:19]
+	}
+	return digest
+}
+
+// reasonSuffix formats an expected reason for messages.
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return " (" + reason + ")"
+}
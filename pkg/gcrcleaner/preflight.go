@@ -0,0 +1,83 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Sentinels that never exist in a registry. Deleting them succeeds up to the
+// permission check and then fails with not found.
+const (
+	preflightDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	preflightTag    = "gcr-cleaner-preflight"
+)
+
+// Preflight verifies the credentials can delete from the first plan with
+// candidates by deleting a sentinel that doesn't exist, which registries
+// answer with not found only after checking permissions. It returns an error
+// naming the missing roles if they can't. Other unexpected answers are only
+// logged, as they say nothing about permissions. Registries that can't delete
+// without finding the manifest first, like GitHub Container Registry, only
+// have their listing permission verified.
+func (c *Cleaner) Preflight(plans []*RepoPlan) error {
+	for _, plan := range plans {
+		if len(plan.Candidates()) == 0 || plan.Policy.DryRun {
+			continue
+		}
+
+		var err error
+		if plan.Policy.UntagOnly {
+			err = c.backend.DeleteTag(plan.Repo, preflightTag)
+		} else {
+			err = c.backend.DeleteManifest(plan.Repo, preflightDigest)
+		}
+		switch statusCode(err) {
+		case 0:
+			if err != nil {
+				return fmt.Errorf("preflight delete in %s failed: %w", plan.Repo, err)
+			}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("credentials cannot delete from %s, grant %s: %w", plan.Repo, deleteRoles(plan.Repo), classify(err))
+		case http.StatusNotFound:
+		default:
+			log.Printf("Preflight delete in %s was inconclusive: %s", plan.Repo, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// deleteRoles describes the roles needed to delete from the repo's registry.
+func deleteRoles(repo string) string {
+	host := strings.SplitN(repo, "/", 2)[0]
+	switch {
+	case host == "gcr.io" || strings.HasSuffix(host, ".gcr.io"):
+		project := strings.SplitN(strings.TrimPrefix(repo, host+"/"), "/", 2)[0]
+		return fmt.Sprintf("roles/storage.admin on the Container Registry bucket of %s "+
+			"(or roles/artifactregistry.repoAdmin if it moved to Artifact Registry)", project)
+	case strings.HasSuffix(host, "-docker.pkg.dev"):
+		return "roles/artifactregistry.repoAdmin on the repository"
+	case host == "ghcr.io":
+		return "a token with the delete:packages scope and admin access to the package"
+	case host == "quay.io":
+		return "a token with repo:write and repo:admin"
+	default:
+		return "a token that can delete images, e.g. GitLab's api scope with the Maintainer role"
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const artifactRegistryAPI = "https://artifactregistry.googleapis.com/v1"
+
+// RepoDeleter is implemented by backends that can delete empty child repos.
+type RepoDeleter interface {
+	// DeleteRepo deletes an empty repo. It returns errRepoDeleteUnsupported
+	// if the repo's registry can't delete repos.
+	DeleteRepo(repo string) error
+}
+
+// errRepoDeleteUnsupported is returned by DeleteRepo for registries that
+// don't support deleting repos, like Container Registry, where empty repos
+// linger until their path is reused.
+var errRepoDeleteUnsupported = fmt.Errorf("registry can't delete repos")
+
+// DeleteRepo implements RepoDeleter by deleting the Artifact Registry
+// package of the repo.
+func (g *gcrBackend) DeleteRepo(repo string) error {
+	parts := strings.SplitN(repo, "/", 4)
+	if len(parts) != 4 || !strings.HasSuffix(parts[0], "-docker.pkg.dev") || g.arClient == nil {
+		return errRepoDeleteUnsupported
+	}
+	location := strings.TrimSuffix(parts[0], "-docker.pkg.dev")
+	u := fmt.Sprintf("%s/projects/%s/locations/%s/repositories/%s/packages/%s", artifactRegistryAPI,
+		url.PathEscape(parts[1]), url.PathEscape(location), url.PathEscape(parts[2]), url.PathEscape(parts[3]))
+
+	req, err := http.NewRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.arClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to delete repo %s: %w", repo, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Failed to delete repo %s: %w", repo,
+			&statusError{method: http.MethodDelete, path: u, code: resp.StatusCode, body: bytes.TrimSpace(body)})
+	}
+	return nil
+}
+
+// PruneEmptyRepos deletes the child repos of the plans that no longer hold
+// any manifests or child repos, or only reports them in a dry run or if the
+// registry can't delete repos. It returns a status line for every empty repo.
+func (c *Cleaner) PruneEmptyRepos(plans []*RepoPlan, dry bool) ([]string, error) {
+	deleter, _ := c.backend.(RepoDeleter)
+
+	var status []string
+	var failures []*RefError
+	for _, plan := range plans {
+		if plan.Repo == c.base || len(plan.Decisions) != len(plan.Candidates()) {
+			continue
+		}
+
+		// Check again, as deletions may have failed or new images may have
+		// been pushed since planning.
+		tags, err := c.backend.List(plan.Repo)
+		if err != nil {
+			if !IsNotFound(err) {
+				failures = append(failures, &RefError{Repo: plan.Repo, Ref: plan.Repo, Err: classify(err)})
+			}
+			continue
+		}
+		if len(tags.Manifests) > 0 || len(tags.Children) > 0 {
+			continue
+		}
+
+		switch {
+		case dry || plan.Policy.DryRun:
+			status = append(status, fmt.Sprintf("%s: empty repo would be deleted", plan.Repo))
+			continue
+		case deleter == nil:
+			err = errRepoDeleteUnsupported
+		default:
+			err = deleter.DeleteRepo(plan.Repo)
+		}
+		switch {
+		case err == errRepoDeleteUnsupported:
+			log.Printf("%s is empty but can't be deleted: %s", plan.Repo, err)
+			status = append(status, fmt.Sprintf("%s: empty repo", plan.Repo))
+		case err != nil:
+			failures = append(failures, &RefError{Repo: plan.Repo, Ref: plan.Repo, Err: classify(err)})
+		default:
+			status = append(status, fmt.Sprintf("%s: empty repo deleted", plan.Repo))
+		}
+	}
+
+	if len(failures) > 0 {
+		return status, &MultiError{Errors: failures}
+	}
+	return status, nil
+}
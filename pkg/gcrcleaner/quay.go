@@ -0,0 +1,258 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// QuayBackend is the Backend for Quay, using the Quay API. The base repo is a
+// namespace, e.g. quay.io/my-org, and every repository in it is a child repo.
+//
+// Quay garbage collects manifests once no tag references them, so deleting a
+// manifest removes its tags. If Expire is set, tags are given an expiration
+// that far in the future instead of being deleted, which leaves a window to
+// restore them from Quay's tag history. Expirations are never moved later,
+// so tags expired by an earlier run still expire on time.
+type QuayBackend struct {
+	// Expire is how far in the future to expire tags instead of deleting
+	// them. Zero deletes tags immediately.
+	Expire time.Duration
+
+	baseURL string
+	token   string
+	client  *http.Client
+
+	lock     sync.Mutex
+	tags     map[string][]string
+	expiring map[string]int64
+}
+
+// quayTag is a tag returned by the Quay API.
+type quayTag struct {
+	Name           string `json:"name"`
+	ManifestDigest string `json:"manifest_digest"`
+	Size           uint64 `json:"size"`
+	StartTS        int64  `json:"start_ts"`
+
+	// EndTS is when the tag expires, or 0 if it doesn't.
+	EndTS int64 `json:"end_ts"`
+}
+
+// NewQuayBackend creates a Quay backend for the Quay instance at baseURL
+// (https://quay.io if empty) authenticated with an OAuth application token
+// with the repo:read and repo:write scopes.
+func NewQuayBackend(baseURL, token string) *QuayBackend {
+	if baseURL == "" {
+		baseURL = "https://quay.io"
+	}
+	return &QuayBackend{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		token:    token,
+		client:   http.DefaultClient,
+		tags:     make(map[string][]string),
+		expiring: make(map[string]int64),
+	}
+}
+
+// Children implements Backend.
+func (q *QuayBackend) Children(base string) ([]string, error) {
+	_, namespace := splitHost(base)
+
+	var children []string
+	next := ""
+	for {
+		v := url.Values{}
+		v.Set("namespace", namespace)
+		if next != "" {
+			v.Set("next_page", next)
+		}
+		var out struct {
+			Repositories []struct {
+				Name string `json:"name"`
+			} `json:"repositories"`
+			NextPage string `json:"next_page"`
+		}
+		if err := q.do(http.MethodGet, "/repository?"+v.Encode(), nil, &out); err != nil {
+			return nil, err
+		}
+		for _, r := range out.Repositories {
+			children = append(children, r.Name)
+		}
+		if out.NextPage == "" {
+			return children, nil
+		}
+		next = out.NextPage
+	}
+}
+
+// List implements Backend. Only active tags are listed, so manifests without
+// tags never show up.
+func (q *QuayBackend) List(repo string) (*gcrgoogle.Tags, error) {
+	_, path := splitHost(repo)
+
+	tags := &gcrgoogle.Tags{
+		Name:      repo,
+		Manifests: make(map[string]gcrgoogle.ManifestInfo),
+	}
+	byDigest := make(map[string][]string)
+	expiring := make(map[string]int64)
+	for page := 1; ; page++ {
+		var out struct {
+			Tags          []quayTag `json:"tags"`
+			HasAdditional bool      `json:"has_additional"`
+		}
+		p := fmt.Sprintf("/repository/%s/tag/?onlyActiveTags=true&limit=100&page=%d", path, page)
+		if err := q.do(http.MethodGet, p, nil, &out); err != nil {
+			return nil, err
+		}
+
+		for _, t := range out.Tags {
+			created := time.Unix(t.StartTS, 0)
+			m := tags.Manifests[t.ManifestDigest]
+			m.Tags = append(m.Tags, t.Name)
+			m.Size = t.Size
+			if m.Created.IsZero() || created.Before(m.Created) {
+				m.Created, m.Uploaded = created, created
+			}
+			tags.Manifests[t.ManifestDigest] = m
+			tags.Tags = append(tags.Tags, t.Name)
+			byDigest[repo+"@"+t.ManifestDigest] = append(byDigest[repo+"@"+t.ManifestDigest], t.Name)
+			if t.EndTS > 0 {
+				expiring[repo+":"+t.Name] = t.EndTS
+			}
+		}
+		if !out.HasAdditional {
+			break
+		}
+	}
+	sort.Strings(tags.Tags)
+
+	q.lock.Lock()
+	for k, v := range byDigest {
+		q.tags[k] = v
+	}
+	for k, v := range expiring {
+		q.expiring[k] = v
+	}
+	q.lock.Unlock()
+	return tags, nil
+}
+
+// DeleteTag implements Backend, expiring the tag instead if Expire is set.
+// Tags that are already gone count as deleted.
+func (q *QuayBackend) DeleteTag(repo, tag string) error {
+	_, path := splitHost(repo)
+	p := fmt.Sprintf("/repository/%s/tag/%s", path, url.PathEscape(tag))
+
+	var err error
+	if q.Expire > 0 {
+		expiration := time.Now().Add(q.Expire).Unix()
+		q.lock.Lock()
+		end := q.expiring[repo+":"+tag]
+		q.lock.Unlock()
+		if end > 0 && end <= expiration {
+			// An earlier run expired the tag already.
+			return nil
+		}
+		body := map[string]int64{"expiration": expiration}
+		err = q.do(http.MethodPut, p, body, nil)
+		if err == nil {
+			q.lock.Lock()
+			q.expiring[repo+":"+tag] = expiration
+			q.lock.Unlock()
+		}
+	} else {
+		err = q.do(http.MethodDelete, p, nil, nil)
+	}
+	if err != nil && !errors.Is(err, errQuayNotFound) {
+		return fmt.Errorf("Failed to delete %s:%s: %w", repo, tag, err)
+	}
+	return nil
+}
+
+// DeleteManifest implements Backend by deleting (or expiring) every tag
+// pointing at the digest.
+func (q *QuayBackend) DeleteManifest(repo, digest string) error {
+	q.lock.Lock()
+	tags := q.tags[repo+"@"+digest]
+	q.lock.Unlock()
+
+	for _, t := range tags {
+		if err := q.DeleteTag(repo, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errQuayNotFound is returned by the Quay client on a 404.
+var errQuayNotFound = errors.New("not found")
+
+// do sends an authenticated request to the Quay API, encoding in as the JSON
+// body and decoding the JSON response into out.
+func (q *QuayBackend) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, q.baseURL+"/api/v1"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+q.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errQuayNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{method: method, path: path, code: resp.StatusCode, body: bytes.TrimSpace(respBody)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// reportPrefix is the prefix of report objects, for lifecycle rules to match.
+const reportPrefix = "gcr-cleaner/"
+
+// ReportStore uploads run reports to a GCS bucket. The client must be
+// authorized for the devstorage scope.
+type ReportStore struct {
+	store *storageClient
+}
+
+// NewReportStore returns a store that uploads reports to the bucket.
+func NewReportStore(bucket string, client *http.Client) *ReportStore {
+	return &ReportStore{store: &storageClient{client: client, bucket: bucket}}
+}
+
+// Upload uploads the report of a run that started at the given time as
+// gcr-cleaner/<date>-<run-id>.json, so reports sort by date and can be
+// expired with a lifecycle rule on the prefix. It returns the gs:// URI of
+// the report.
+func (r *ReportStore) Upload(ctx context.Context, started time.Time, runID string, report interface{}) (string, error) {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	object := fmt.Sprintf("%s%s-%s.json", reportPrefix, started.UTC().Format("2006-01-02"), runID)
+	if _, err := r.store.put(ctx, object, b, -1); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s", r.store.bucket, object), nil
+}
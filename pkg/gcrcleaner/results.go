@@ -0,0 +1,163 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"sync"
+)
+
+// RepoResult is the outcome of executing a single repo plan. Every repo
+// records into its own result, so repos executed in parallel share nothing,
+// and the deletion workers of a repo only share its result.
+type RepoResult struct {
+	Repo string
+
+	// Dry is true if nothing was deleted because the run, or the repo's
+	// policy, was dry run only.
+	Dry bool
+
+	// UntagOnly is true if manifests were only untagged, which frees nothing.
+	UntagOnly bool
+
+	// Status is the status line of the repo, empty if deleting failed.
+	Status string
+
+	// Deleted are the candidates deleted, or that would be deleted in a dry
+	// run.
+	Deleted []*Decision
+
+	// TagsDeleted is how many tags were deleted, on their own or before
+	// their manifests.
+	TagsDeleted int
+
+	// Failures are the refs that failed to delete.
+	Failures []*RefError
+
+	lock    sync.Mutex
+	aborted bool
+	halted  bool
+}
+
+// deleted records a deleted candidate.
+func (r *RepoResult) deleted(d *Decision) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Deleted = append(r.Deleted, d)
+}
+
+// untagged records a deleted tag.
+func (r *RepoResult) untagged() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.TagsDeleted++
+}
+
+// fail records failures. If abort is true, the repo's remaining deletions are
+// abandoned.
+func (r *RepoResult) fail(abort bool, failures ...*RefError) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Failures = append(r.Failures, failures...)
+	r.aborted = r.aborted || abort
+}
+
+// halt abandons the repo's remaining deletions because the run was halted,
+// recording the failure once however many deletions were abandoned.
+func (r *RepoResult) halt(failure *RefError) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.halted {
+		r.Failures = append(r.Failures, failure)
+	}
+	r.halted, r.aborted = true, true
+}
+
+// isAborted returns true if the repo's remaining deletions were abandoned.
+func (r *RepoResult) isAborted() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.aborted
+}
+
+// Freed returns the space freed by the deletions, which is zero for dry runs
+// and for untagging.
+func (r *RepoResult) Freed() int64 {
+	if r.Dry || r.UntagOnly {
+		return 0
+	}
+	var freed int64
+	for _, d := range r.Deleted {
+		freed += d.Size
+	}
+	return freed
+}
+
+// Results are the results of executing plans, one per repo in the order of
+// the plans.
+type Results struct {
+	Repos []*RepoResult
+}
+
+// newResults returns results with an empty result for every plan.
+func newResults(plans []*RepoPlan) *Results {
+	res := &Results{Repos: make([]*RepoResult, len(plans))}
+	for i, p := range plans {
+		res.Repos[i] = &RepoResult{Repo: p.Repo, UntagOnly: p.Policy.UntagOnly}
+	}
+	return res
+}
+
+// ResultTotals are the results of all repos merged.
+type ResultTotals struct {
+	// Status are the status lines of the repos that had any.
+	Status []string
+
+	// Deleted is how many manifests were actually deleted or untagged.
+	Deleted int
+
+	// TagsDeleted is how many tags were actually deleted.
+	TagsDeleted int
+
+	// Freed is the space freed, by repo.
+	Freed map[string]int64
+
+	// Failures are the failures of every repo.
+	Failures []*RefError
+
+	// Failed are the repos that have no status as some of their refs failed.
+	Failed []*RepoFailure
+}
+
+// Merge merges the results of every repo, once all of them are done.
+func (res *Results) Merge() *ResultTotals {
+	totals := &ResultTotals{Freed: make(map[string]int64)}
+	for _, r := range res.Repos {
+		if r.Status != "" {
+			totals.Status = append(totals.Status, r.Status)
+		}
+		if !r.Dry {
+			totals.Deleted += len(r.Deleted)
+		}
+		if freed := r.Freed(); freed > 0 {
+			totals.Freed[r.Repo] += freed
+		}
+		totals.TagsDeleted += r.TagsDeleted
+		totals.Failures = append(totals.Failures, r.Failures...)
+		if len(r.Failures) > 0 {
+			totals.Failed = append(totals.Failed, RepoFailures(StageExecute, &MultiError{Errors: r.Failures})...)
+		}
+	}
+	return totals
+}
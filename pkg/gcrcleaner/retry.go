@@ -0,0 +1,53 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var deleteRetries, _ = strconv.Atoi(getenv("CLEANER_DELETE_RETRIES", "3"))
+
+// retryBackoff is the wait before the first retry, doubled for every retry
+// after it.
+var retryBackoff = time.Second
+
+// isTransient returns true if the error is worth retrying: network timeouts,
+// rate limiting and server errors.
+func isTransient(err error) bool {
+	var nerr net.Error
+	if errors.As(err, &nerr) && (nerr.Timeout() || nerr.Temporary()) {
+		return true
+	}
+	code := statusCode(err)
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// withRetries calls fn, retrying it with exponential backoff for as long as
+// it fails with transient errors, up to CLEANER_DELETE_RETRIES times.
+func withRetries(fn func() error) error {
+	wait := retryBackoff
+	err := fn()
+	for i := 0; i < deleteRetries && err != nil && isTransient(err); i++ {
+		time.Sleep(wait)
+		wait *= 2
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// timeoutError is a network error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// httpStatusError returns a registry error with the status code.
+func httpStatusError(code int) error {
+	return &statusError{method: http.MethodDelete, path: "/v2/p/app/manifests/sha256:a", code: code}
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"429", httpStatusError(http.StatusTooManyRequests), true},
+		{"500", httpStatusError(http.StatusInternalServerError), true},
+		{"503", httpStatusError(http.StatusServiceUnavailable), true},
+		{"registry 502", &transport.Error{StatusCode: http.StatusBadGateway}, true},
+		{"wrapped 503", fmt.Errorf("failed to delete: %w", httpStatusError(http.StatusServiceUnavailable)), true},
+		{"network timeout", timeoutError{}, true},
+		{"wrapped network timeout", fmt.Errorf("failed to delete: %w", timeoutError{}), true},
+		{"400", httpStatusError(http.StatusBadRequest), false},
+		{"401", httpStatusError(http.StatusUnauthorized), false},
+		{"403", &transport.Error{StatusCode: http.StatusForbidden}, false},
+		{"404", httpStatusError(http.StatusNotFound), false},
+		{"409", httpStatusError(http.StatusConflict), false},
+		{"plain error", errors.New("manifest is referenced by an index"), false},
+	}
+	for _, tc := range cases {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("isTransient(%s) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	oldBackoff, oldRetries := retryBackoff, deleteRetries
+	retryBackoff, deleteRetries = time.Nanosecond, 3
+	defer func() { retryBackoff, deleteRetries = oldBackoff, oldRetries }()
+
+	cases := []struct {
+		name      string
+		errs      []error // the errors of the calls in turn, nil after them
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "transient then success", errs: []error{httpStatusError(503), timeoutError{}}, wantCalls: 3},
+		{name: "client error isn't retried", errs: []error{httpStatusError(404)}, wantCalls: 1, wantErr: true},
+		{name: "transient then client error", errs: []error{httpStatusError(429), httpStatusError(403)}, wantCalls: 2, wantErr: true},
+		{
+			name:      "gives up after the retries",
+			errs:      []error{httpStatusError(500), httpStatusError(500), httpStatusError(500), httpStatusError(500), httpStatusError(500)},
+			wantCalls: 4,
+			wantErr:   true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := withRetries(func() error {
+				calls++
+				if calls <= len(tc.errs) {
+					return tc.errs[calls-1]
+				}
+				return nil
+			})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("withRetries() = %v, want error %v", err, tc.wantErr)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("called %d times, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
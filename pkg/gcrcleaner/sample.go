@@ -0,0 +1,93 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReasonNotSampled is the reason a candidate is kept because it wasn't
+// sampled, see WithSample.
+const ReasonNotSampled = "not sampled"
+
+// Sample limits the candidates deleted from every repo to a subset, so early
+// real runs only delete a little while operators watch for breakage.
+type Sample struct {
+	// Percent is the percentage of every repo's candidates to delete,
+	// rounded up, or 0 for all of them.
+	Percent float64
+
+	// MaxPerRepo is the most candidates to delete from a repo, or 0 for no
+	// limit.
+	MaxPerRepo int
+
+	// Random samples candidates at random instead of the oldest ones.
+	Random bool
+}
+
+// WithSample makes the cleaner delete only a sample of the candidates of
+// every repo and keep the others with the reason ReasonNotSampled.
+func WithSample(s Sample) Option {
+	return func(c *Cleaner) error {
+		if s.Percent < 0 || s.Percent > 100 {
+			return fmt.Errorf("sample of %g%% must be between 0%% and 100%%", s.Percent)
+		}
+		if s.MaxPerRepo < 0 {
+			return fmt.Errorf("sample of %d candidates per repo is negative", s.MaxPerRepo)
+		}
+		c.sample = &s
+		return nil
+	}
+}
+
+// ParsePercent parses a percentage like 10% or 10.
+func ParsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return p, nil
+}
+
+// apply keeps the candidates of the plan that aren't in the sample.
+// Decisions are sorted newest first, so the oldest candidates are last.
+func (s *Sample) apply(plan *RepoPlan) {
+	candidates := plan.Candidates()
+	n := len(candidates)
+	if s.Percent > 0 {
+		n = int(math.Ceil(float64(len(candidates)) * s.Percent / 100))
+	}
+	if s.MaxPerRepo > 0 && n > s.MaxPerRepo {
+		n = s.MaxPerRepo
+	}
+	if n >= len(candidates) {
+		return
+	}
+
+	if s.Random {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		rnd.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+	for _, d := range candidates[:len(candidates)-n] {
+		d.Delete, d.Reason = false, ReasonNotSampled
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var sboms = getenv("CLEANER_SBOMS", "false") == "true"
+
+// Reasons a manifest attached to another one, like an SBOM, is kept or
+// deleted.
+const (
+	ReasonAttachedKept    = "attached to kept image"
+	ReasonAttachedDeleted = "attached to deleted image"
+)
+
+// attachmentTagRe matches the tags that attach artifacts to the image with
+// the digest in the tag: cosign's sha256-<hex>.sbom and the OCI referrers tag
+// schema's sha256-<hex> index.
+var attachmentTagRe = regexp.MustCompile(`^sha256-([0-9a-f]{64})(\.sbom)?$`)
+
+// SBOMSummary summarizes the SBOM attached to a deleted image.
+type SBOMSummary struct {
+	Format   string         `json:"format"`
+	Packages int            `json:"packages"`
+	Licenses map[string]int `json:"licenses,omitempty"`
+}
+
+// isAttachment returns true if, with CLEANER_SBOMS, every tag attaches the
+// manifest to another image, so it follows that image instead of counting
+// towards the keep window or a GFS schedule.
+func isAttachment(tags []string) bool {
+	if !sboms || len(tags) == 0 {
+		return false
+	}
+	for _, t := range tags {
+		if !attachmentTagRe.MatchString(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutAttachments returns the tags that don't attach artifacts.
+func withoutAttachments(tags []string) []string {
+	if !sboms {
+		return tags
+	}
+	var out []string
+	for _, t := range tags {
+		if !attachmentTagRe.MatchString(t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// linkAttachments makes the attached artifacts in the plan, like SBOMs,
+// follow the image they are attached to: they are kept with a kept image and
+// deleted with a deleted one, which lists them in Attached. Artifacts of
+// images that are gone already, and excepted ones, are left as they are.
+func linkAttachments(plan *RepoPlan) {
+	byDigest := make(map[string]*Decision)
+	for _, d := range plan.Decisions {
+		byDigest[d.Digest] = d
+	}
+	for _, d := range plan.Decisions {
+		if !isAttachment(d.Tags) || d.Reason == ReasonException || d.Reason == ReasonMediaType {
+			continue
+		}
+		for _, t := range d.Tags {
+			subject := byDigest["sha256:"+attachmentTagRe.FindStringSubmatch(t)[1]]
+			if subject == nil {
+				continue
+			}
+			if !subject.Delete {
+				d.Delete, d.Reason = false, ReasonAttachedKept
+				break
+			}
+			d.Delete, d.Reason = true, ReasonAttachedDeleted
+			subject.Attached = append(subject.Attached, d.Digest)
+		}
+	}
+}
+
+// recordSBOM summarizes the SBOM attached to the image in the decision, if
+// there is one and the backend can fetch it, before the image is deleted.
+// Failures are only logged, as they don't affect the deletion.
+func (c *Cleaner) recordSBOM(d *Decision) {
+	getter, ok := c.backend.(ManifestGetter)
+	if !ok || len(d.Attached) == 0 {
+		return
+	}
+	summary, err := summarizeSBOM(getter, d.Repo, d.Attached)
+	if err != nil {
+		log.Printf("Failed to summarize SBOM of %s@%s: %s", d.Repo, d.Digest, err)
+		return
+	}
+	d.SBOM = summary
+}
+
+// summarizeSBOM finds an SBOM among the artifacts attached to the image and
+// summarizes its packages and licenses. It returns nil if there is none.
+func summarizeSBOM(getter ManifestGetter, repo string, attached []string) (*SBOMSummary, error) {
+	for _, digest := range attached {
+		summary, err := summarizeArtifact(getter, repo, digest, true)
+		if summary != nil || err != nil {
+			return summary, err
+		}
+	}
+	return nil, nil
+}
+
+// summarizeArtifact summarizes the SBOM in the layers of the manifest, or, if
+// it is a referrers index, in the SBOMs it lists.
+func summarizeArtifact(getter ManifestGetter, repo, digest string, followIndex bool) (*SBOMSummary, error) {
+	b, err := getter.GetManifest(repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+		} `json:"layers"`
+		Manifests []struct {
+			MediaType    string `json:"mediaType"`
+			ArtifactType string `json:"artifactType"`
+			Digest       string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s@%s: %w", repo, digest, err)
+	}
+
+	for _, l := range m.Layers {
+		if !isSBOMType(l.MediaType) {
+			continue
+		}
+		blob, err := getter.GetBlob(repo, l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return parseSBOM(blob)
+	}
+	if followIndex {
+		for _, child := range m.Manifests {
+			if isSBOMType(child.ArtifactType) {
+				return summarizeArtifact(getter, repo, child.Digest, false)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// isSBOMType returns true if the media or artifact type is an SPDX or
+// CycloneDX document.
+func isSBOMType(t string) bool {
+	t = strings.ToLower(t)
+	return strings.Contains(t, "spdx") || strings.Contains(t, "cyclonedx")
+}
+
+// parseSBOM summarizes an SPDX or CycloneDX JSON document.
+func parseSBOM(b []byte) (*SBOMSummary, error) {
+	var doc struct {
+		SPDXVersion string `json:"spdxVersion"`
+		Packages    []struct {
+			LicenseConcluded string `json:"licenseConcluded"`
+			LicenseDeclared  string `json:"licenseDeclared"`
+		} `json:"packages"`
+
+		BOMFormat  string `json:"bomFormat"`
+		Components []struct {
+			Licenses []struct {
+				License struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"license"`
+				Expression string `json:"expression"`
+			} `json:"licenses"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse SBOM: %w", err)
+	}
+
+	summary := &SBOMSummary{Licenses: make(map[string]int)}
+	switch {
+	case doc.SPDXVersion != "":
+		summary.Format = "spdx"
+		for _, p := range doc.Packages {
+			license := p.LicenseConcluded
+			if license == "" || license == "NOASSERTION" {
+				license = p.LicenseDeclared
+			}
+			summary.addPackage(license)
+		}
+	case doc.BOMFormat != "":
+		summary.Format = "cyclonedx"
+		for _, c := range doc.Components {
+			license := ""
+			if len(c.Licenses) > 0 {
+				l := c.Licenses[0]
+				switch {
+				case l.Expression != "":
+					license = l.Expression
+				case l.License.ID != "":
+					license = l.License.ID
+				default:
+					license = l.License.Name
+				}
+			}
+			summary.addPackage(license)
+		}
+	default:
+		return nil, fmt.Errorf("failed to parse SBOM: neither SPDX nor CycloneDX JSON")
+	}
+	return summary, nil
+}
+
+// addPackage counts a package and its license.
+func (s *SBOMSummary) addPackage(license string) {
+	if license == "" || license == "NOASSERTION" || license == "NONE" {
+		license = "unknown"
+	}
+	s.Packages++
+	s.Licenses[license]++
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Reasons of decisions of scanner runs, see PlanOptions.Flagged.
+const (
+	ReasonFlagged    = "flagged by vulnerability scanner"
+	ReasonNotFlagged = "not flagged by vulnerability scanner"
+)
+
+// FlaggedImages are the images a vulnerability scanner flagged, with their
+// findings by severity, by repo@digest or, for reports of images that have
+// no repo digest, by bare digest, which matches the digest in every repo.
+type FlaggedImages struct {
+	refs map[string]map[string]int
+}
+
+// scanReport is the part of a Trivy (trivy image -f json) or Grype (grype -o
+// json) report that names the image and its findings.
+type scanReport struct {
+	// Trivy.
+	ArtifactName string `json:"ArtifactName"`
+	Metadata     struct {
+		RepoDigests []string `json:"RepoDigests"`
+	} `json:"Metadata"`
+	Results []struct {
+		Vulnerabilities []struct {
+			Severity string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+
+	// Grype.
+	Matches []struct {
+		Vulnerability struct {
+			Severity string `json:"severity"`
+		} `json:"vulnerability"`
+	} `json:"matches"`
+	Source struct {
+		Target struct {
+			UserInput      string   `json:"userInput"`
+			ManifestDigest string   `json:"manifestDigest"`
+			RepoDigests    []string `json:"repoDigests"`
+		} `json:"target"`
+	} `json:"source"`
+}
+
+// ParseScanReports parses Trivy or Grype JSON reports of images, each file
+// holding one report or an array of them, and returns the images with at
+// least one finding of minSeverity, like HIGH, or worse. With an empty
+// minSeverity, any finding flags an image.
+func ParseScanReports(files [][]byte, minSeverity string) (*FlaggedImages, error) {
+	min := 0
+	if minSeverity != "" {
+		var ok bool
+		if min, ok = severityRank[strings.ToUpper(minSeverity)]; !ok {
+			return nil, fmt.Errorf("unknown severity %q", minSeverity)
+		}
+	}
+
+	f := &FlaggedImages{refs: make(map[string]map[string]int)}
+	for i, b := range files {
+		var reports []*scanReport
+		if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+			if err := json.Unmarshal(b, &reports); err != nil {
+				return nil, fmt.Errorf("failed to parse scan report %d: %w", i+1, err)
+			}
+		} else {
+			var r scanReport
+			if err := json.Unmarshal(b, &r); err != nil {
+				return nil, fmt.Errorf("failed to parse scan report %d: %w", i+1, err)
+			}
+			reports = append(reports, &r)
+		}
+		for _, r := range reports {
+			if err := f.add(r, min); err != nil {
+				return nil, fmt.Errorf("scan report %d: %w", i+1, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+// add flags the image of the report if it has findings of the minimum
+// severity rank.
+func (f *FlaggedImages) add(r *scanReport, min int) error {
+	var severities []string
+	for _, res := range r.Results {
+		for _, v := range res.Vulnerabilities {
+			severities = append(severities, v.Severity)
+		}
+	}
+	for _, m := range r.Matches {
+		severities = append(severities, m.Vulnerability.Severity)
+	}
+
+	findings := make(map[string]int)
+	flagged := false
+	for _, s := range severities {
+		s = strings.ToUpper(s)
+		findings[s]++
+		flagged = flagged || severityRank[s] >= min
+	}
+	if !flagged {
+		return nil
+	}
+
+	name := r.ArtifactName + r.Source.Target.UserInput
+	refs := append(r.Metadata.RepoDigests, r.Source.Target.RepoDigests...)
+	if len(refs) == 0 {
+		if _, digest := splitImage(name); digest != "" {
+			refs = []string{digest}
+		} else if r.Source.Target.ManifestDigest != "" {
+			refs = []string{r.Source.Target.ManifestDigest}
+		}
+	}
+	if len(refs) == 0 {
+		return fmt.Errorf("no digest for %q, scan images by digest or from the registry", name)
+	}
+	for _, ref := range refs {
+		f.refs[ref] = findings
+	}
+	return nil
+}
+
+// Len returns how many images are flagged.
+func (f *FlaggedImages) Len() int {
+	return len(f.refs)
+}
+
+// Repos returns the repos of the flagged images, or nil if any of them is a
+// bare digest, which may be in any repo.
+func (f *FlaggedImages) Repos() []string {
+	seen := make(map[string]bool)
+	var repos []string
+	for ref := range f.refs {
+		i := strings.Index(ref, "@")
+		if i < 0 {
+			return nil
+		}
+		if repo := ref[:i]; !seen[repo] {
+			seen[repo] = true
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// lookup returns the findings of the decision's manifest, if it is flagged.
+func (f *FlaggedImages) lookup(d *Decision) (map[string]int, bool) {
+	if findings, ok := f.refs[d.Repo+"@"+d.Digest]; ok {
+		return findings, true
+	}
+	findings, ok := f.refs[d.Digest]
+	return findings, ok
+}
+
+// apply deletes exactly the flagged manifests of the plans and keeps every
+// other one, except forced deletions. Flagged manifests that are excepted, like those in use, or
+// forced to be kept are still kept, and logged.
+func (f *FlaggedImages) apply(plans []*RepoPlan) {
+	for _, plan := range plans {
+		for _, d := range plan.Decisions {
+			findings, flagged := f.lookup(d)
+			switch {
+			case !flagged:
+				if d.Delete && d.Reason != ReasonForceDelete {
+					d.Delete, d.Reason = false, ReasonNotFlagged
+				}
+			case d.Reason == ReasonException || d.Reason == ReasonForceKeep:
+				log.Printf("%s@%s: flagged by the scanner, but kept (%s)", d.Repo, d.Digest, d.Reason)
+			default:
+				d.Delete, d.Reason = true, ReasonFlagged
+				if d.Vulnerabilities == nil {
+					d.Vulnerabilities = findings
+				}
+			}
+		}
+	}
+}
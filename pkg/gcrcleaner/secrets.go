@@ -0,0 +1,154 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const secretManagerAPI = "https://secretmanager.googleapis.com/v1"
+
+// secretRefPrefix marks a value as a reference to a Secret Manager secret
+// version, like sm://projects/my-project/secrets/my-secret or the short
+// sm://my-project/my-secret/3. References without a version use the latest.
+const secretRefPrefix = "sm://"
+
+// SecretManager reads secrets from Google Secret Manager.
+type SecretManager struct {
+	client *http.Client
+}
+
+// NewSecretManager creates a Secret Manager client. The HTTP client must be
+// authorized for the cloud-platform scope.
+func NewSecretManager(client *http.Client) *SecretManager {
+	return &SecretManager{client: client}
+}
+
+// WithSecretManager resolves Secret Manager references in the configuration
+// of the clusters to scan.
+func WithSecretManager(s *SecretManager) Option {
+	return func(c *Cleaner) error {
+		c.secrets = s
+		return nil
+	}
+}
+
+// IsSecretRef returns true if the value is a Secret Manager reference.
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretRefPrefix)
+}
+
+// secretName returns the resource name of the secret version a reference
+// points to.
+func secretName(value string) (string, error) {
+	name := strings.TrimPrefix(value, secretRefPrefix)
+	if !strings.HasPrefix(name, "projects/") {
+		// The short form is PROJECT/SECRET[/VERSION].
+		parts := strings.Split(name, "/")
+		if (len(parts) != 2 && len(parts) != 3) || parts[0] == "" || parts[1] == "" {
+			return "", fmt.Errorf("invalid secret reference %q, expected sm://PROJECT/SECRET[/VERSION]", value)
+		}
+		name = "projects/" + parts[0] + "/secrets/" + parts[1]
+		if len(parts) == 3 {
+			name += "/versions/" + parts[2]
+		}
+	}
+	if !strings.Contains(name, "/secrets/") {
+		return "", fmt.Errorf("invalid secret reference %q, expected sm://projects/PROJECT/secrets/SECRET", value)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return name, nil
+}
+
+// Resolve returns the secret a Secret Manager reference points to, or the
+// value itself if it isn't a reference.
+func (s *SecretManager) Resolve(ctx context.Context, value string) ([]byte, error) {
+	if !IsSecretRef(value) {
+		return []byte(value), nil
+	}
+	name, err := secretName(value)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("secret reference %s needs Google credentials", value)
+	}
+
+	resp, err := s.client.Get(fmt.Sprintf("%s/%s:access", secretManagerAPI, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret %s: %w", value, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to access secret %s: %w", value,
+			&statusError{method: http.MethodGet, path: name, code: resp.StatusCode, body: bytes.TrimSpace(body)})
+	}
+
+	var version struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &version); err != nil {
+		return nil, fmt.Errorf("failed to parse secret %s: %w", value, err)
+	}
+	return base64.StdEncoding.DecodeString(version.Payload.Data)
+}
+
+// KeyTokenSource returns a token source for the service account JSON key
+// stored in a Secret Manager secret. The secret is read again every time an
+// access token is minted, so a rotated key is picked up at the next refresh
+// without restarting the cleaner. Callers should wrap it in
+// oauth2.ReuseTokenSource, as oauth2.NewClient does.
+func (s *SecretManager) KeyTokenSource(ref string, scopes ...string) oauth2.TokenSource {
+	return &keyTokenSource{secrets: s, ref: ref, scopes: scopes}
+}
+
+// keyTokenSource mints access tokens from the key in a secret.
+type keyTokenSource struct {
+	secrets *SecretManager
+	ref     string
+	scopes  []string
+}
+
+// Token implements oauth2.TokenSource.
+func (k *keyTokenSource) Token() (*oauth2.Token, error) {
+	ctx := context.Background()
+	key, err := k.secrets.Resolve(ctx, k.ref)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := google.CredentialsFromJSON(ctx, key, k.scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials in %s: %w", k.ref, err)
+	}
+	return creds.TokenSource.Token()
+}
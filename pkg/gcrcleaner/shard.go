@@ -0,0 +1,66 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// WithShard makes the cleaner only process the child repos that hash into
+// shard index of count, so count parallel runs together cover every child
+// repo exactly once.
+func WithShard(index, count int) Option {
+	return func(c *Cleaner) error {
+		if count < 1 || index < 0 || index >= count {
+			return fmt.Errorf("invalid shard %d/%d", index, count)
+		}
+		c.shardIndex = index
+		c.shardCount = count
+		return nil
+	}
+}
+
+// ParseShard parses a shard in the form "i/n".
+func ParseShard(s string) (int, int, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("shard %q must be in the form i/n", s)
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard index %q: %w", parts[0], err)
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard count %q: %w", parts[1], err)
+	}
+	if count < 1 || index < 0 || index >= count {
+		return 0, 0, fmt.Errorf("shard %q out of range", s)
+	}
+	return index, count, nil
+}
+
+// inShard returns true if the child repo belongs to this cleaner's shard.
+func (c *Cleaner) inShard(name string) bool {
+	if c.shardCount <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(c.shardCount)) == c.shardIndex
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseShard(t *testing.T) {
+	cases := []struct {
+		in           string
+		index, count int
+		wantErr      bool
+	}{
+		{in: "0/1", index: 0, count: 1},
+		{in: "0/2", index: 0, count: 2},
+		{in: "3/4", index: 3, count: 4},
+		{in: "3/2", wantErr: true},
+		{in: "2/2", wantErr: true},
+		{in: "-1/2", wantErr: true},
+		{in: "0/0", wantErr: true},
+		{in: "0/-1", wantErr: true},
+		{in: "1", wantErr: true},
+		{in: "1/2/3", wantErr: true},
+		{in: "a/2", wantErr: true},
+		{in: "1/b", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tc := range cases {
+		index, count, err := ParseShard(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseShard(%q) = %d, %d, want an error", tc.in, index, count)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseShard(%q): %s", tc.in, err)
+			continue
+		}
+		if index != tc.index || count != tc.count {
+			t.Errorf("ParseShard(%q) = %d, %d, want %d, %d", tc.in, index, count, tc.index, tc.count)
+		}
+	}
+}
+
+func TestWithShardRejectsInvalidShards(t *testing.T) {
+	for _, s := range [][2]int{{3, 2}, {-1, 2}, {0, 0}} {
+		if err := WithShard(s[0], s[1])(&Cleaner{}); err == nil {
+			t.Errorf("WithShard(%d, %d) succeeded, want an error", s[0], s[1])
+		}
+	}
+}
+
+func TestInShardCoversEveryRepoOnce(t *testing.T) {
+	var repos []string
+	for i := 0; i < 1000; i++ {
+		repos = append(repos, fmt.Sprintf("gcr.io/p/service-%d", i))
+	}
+
+	for _, count := range []int{1, 2, 3, 7} {
+		shards := make([]*Cleaner, count)
+		for i := range shards {
+			shards[i] = &Cleaner{}
+			if err := WithShard(i, count)(shards[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sizes := make([]int, count)
+		for _, repo := range repos {
+			var in []int
+			for i, c := range shards {
+				if c.inShard(repo) {
+					in = append(in, i)
+				}
+			}
+			if len(in) != 1 {
+				t.Fatalf("%s is in shards %v of %d, want exactly one", repo, in, count)
+			}
+			sizes[in[0]]++
+		}
+		for i, n := range sizes {
+			if n == 0 {
+				t.Errorf("shard %d/%d has no repos", i, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"strings"
+)
+
+var protectShared = getenv("CLEANER_PROTECT_SHARED_DIGESTS", "false") == "true"
+
+// ReasonKeptElsewhere is the reason a manifest is kept because a tagged
+// manifest with the same digest is kept in another child repo.
+const ReasonKeptElsewhere = "kept in another repo"
+
+// planOthers plans the child repos of the base repo that weren't planned,
+// because only some repos or one shard were asked for, so protections that
+// look across repos see the whole registry. Their plans are only used to
+// find what they keep. Repos that fail to list are returned as failures.
+func (c *Cleaner) planOthers(plans []*RepoPlan, failed []*RefError) ([]*RepoPlan, []*RefError) {
+	seen := make(map[string]bool)
+	for _, plan := range plans {
+		seen[plan.Repo] = true
+	}
+	for _, f := range failed {
+		seen[f.Repo] = true
+	}
+
+	children, err := c.backend.Children(c.base)
+	if err != nil {
+		return nil, []*RefError{{Repo: c.base, Ref: c.base, Err: classify(err)}}
+	}
+	var others []*RepoPlan
+	var failures []*RefError
+	for _, r := range children {
+		name := fmt.Sprintf("%s/%s", c.base, strings.TrimPrefix(r, c.base+"/"))
+		if seen[name] {
+			continue
+		}
+		tags, err := c.backend.List(name)
+		if err != nil {
+			failures = append(failures, &RefError{Repo: name, Ref: name, Err: classify(err)})
+			continue
+		}
+		others = append(others, c.planRepo(name, c.policyFor(name), tags))
+	}
+	return others, failures
+}
+
+// protectSharedDigests keeps every candidate of the plans whose digest another
+// child repo keeps tagged, as happens when promotion pipelines retag an image
+// into another repo. Others are the plans of the remaining child repos.
+func (c *Cleaner) protectSharedDigests(plans, others []*RepoPlan) {
+	keptIn := make(map[string]map[string]bool)
+	for _, plan := range append(plans[:len(plans):len(plans)], others...) {
+		for _, d := range plan.Decisions {
+			if d.Delete || len(d.Tags) == 0 {
+				continue
+			}
+			if keptIn[d.Digest] == nil {
+				keptIn[d.Digest] = make(map[string]bool)
+			}
+			keptIn[d.Digest][plan.Repo] = true
+		}
+	}
+
+	for _, plan := range plans {
+		for _, d := range plan.Decisions {
+			if !d.Delete {
+				continue
+			}
+			for repo := range keptIn[d.Digest] {
+				if repo != plan.Repo {
+					d.Delete, d.Reason = false, ReasonKeptElsewhere
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// SimulationStep is what a policy would have deleted from a single snapshot.
+type SimulationStep struct {
+	Taken   time.Time `json:"taken"`
+	Deleted int       `json:"deleted"`
+	Freed   int64     `json:"freed"`
+}
+
+// Simulation is what a policy would have deleted from a series of snapshots.
+type Simulation struct {
+	Steps   []SimulationStep `json:"steps"`
+	Deleted int              `json:"deleted"`
+	Freed   int64            `json:"freed"`
+}
+
+// Simulate replays the policy file at path, or the configured policies if
+// path is empty, against the snapshots of the cleaner's child repos, oldest
+// first, and returns what it would have deleted. Manifests deleted from one
+// snapshot are gone from the later ones, and untagged ones lose their tags.
+// Only the policies and the current exceptions apply, not the protections
+// that inspect the registry, like shared digests or base images.
+func (c *Cleaner) Simulate(snapshots []*Inventory, path string) (*Simulation, error) {
+	c.exceptLock.RLock()
+	defer c.exceptLock.RUnlock()
+
+	policies := c.policies
+	if path != "" {
+		var err error
+		if policies, err = loadPolicyFile(path); err != nil {
+			return nil, err
+		}
+		if err := policies.checkKeep(c.allowFullPrune); err != nil {
+			return nil, err
+		}
+	}
+
+	sim := &Simulation{}
+	gone := make(map[string]bool)
+	untagged := make(map[string]bool)
+	for _, inv := range snapshots {
+		step := SimulationStep{Taken: inv.Taken}
+
+		var names []string
+		for name := range inv.Repos {
+			if rel := strings.TrimPrefix(name, c.base+"/"); rel != name && c.inShard(rel) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			policy := policies.forRepo(strings.TrimPrefix(name, c.base+"/"))
+			live := &gcrgoogle.Tags{Name: name, Manifests: make(map[string]gcrgoogle.ManifestInfo)}
+			for digest, m := range inv.Repos[name].Manifests {
+				ref := name + "@" + digest
+				if gone[ref] {
+					continue
+				}
+				if untagged[ref] {
+					m.Tags = nil
+				}
+				live.Manifests[digest] = m
+				live.Tags = append(live.Tags, m.Tags...)
+			}
+
+			for _, d := range c.planRepo(name, policy, live).Candidates() {
+				ref := name + "@" + d.Digest
+				step.Deleted++
+				if policy.UntagOnly {
+					untagged[ref] = true
+					continue
+				}
+				gone[ref] = true
+				step.Freed += d.Size
+			}
+		}
+
+		sim.Steps = append(sim.Steps, step)
+		sim.Deleted += step.Deleted
+		sim.Freed += step.Freed
+	}
+	return sim, nil
+}
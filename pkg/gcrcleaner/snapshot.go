@@ -0,0 +1,243 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Annotations of snapshot files. The OCI ones are standard; the others are
+// our own.
+const (
+	annotationRefName  = "org.opencontainers.image.ref.name"
+	annotationCreated  = "org.opencontainers.image.created"
+	annotationRepo     = "com.github.farmersedgeinc.gcr-cleaner.repo"
+	annotationUploaded = "com.github.farmersedgeinc.gcr-cleaner.uploaded"
+	annotationTaken    = "com.github.farmersedgeinc.gcr-cleaner.taken"
+	annotationBase     = "com.github.farmersedgeinc.gcr-cleaner.base"
+)
+
+// errReadOnlySnapshot is returned when deleting from a snapshot.
+var errReadOnlySnapshot = errors.New("snapshots are read-only")
+
+// Snapshot lists the given child repos, or every child repo, and returns
+// their inventory. Repos that fail to list are left out and reported in a
+// *MultiError.
+func (c *Cleaner) Snapshot(repos []string) (*Inventory, error) {
+	if len(repos) == 0 {
+		var err error
+		if repos, err = c.Repos(); err != nil {
+			return nil, err
+		}
+	}
+
+	inv := &Inventory{Taken: time.Now(), Base: c.base, Repos: make(map[string]*gcrgoogle.Tags)}
+	var failures []*RefError
+	for _, r := range repos {
+		tags, err := c.listChild(r)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		name := fmt.Sprintf("%s/%s", c.base, r)
+		tags.Name = name
+		inv.Repos[name] = tags
+	}
+	if len(failures) > 0 {
+		return inv, &MultiError{Errors: failures}
+	}
+	return inv, nil
+}
+
+// Index returns the inventory as an OCI image index, like the index.json of
+// an OCI image layout. Every tag is a descriptor named repo:tag, and
+// untagged manifests are descriptors without a name. Sizes are the ones the
+// registry reports.
+func (inv *Inventory) Index() (*gcrv1.IndexManifest, error) {
+	idx := &gcrv1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []gcrv1.Descriptor{},
+		Annotations:   map[string]string{annotationTaken: inv.Taken.UTC().Format(time.RFC3339)},
+	}
+	if inv.Base != "" {
+		idx.Annotations[annotationBase] = inv.Base
+	}
+
+	var names []string
+	for name := range inv.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		manifests := inv.Repos[name].Manifests
+		var digests []string
+		for digest := range manifests {
+			digests = append(digests, digest)
+		}
+		sort.Strings(digests)
+
+		for _, digest := range digests {
+			m := manifests[digest]
+			hash, err := gcrv1.NewHash(digest)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			desc := gcrv1.Descriptor{
+				MediaType: types.MediaType(m.MediaType),
+				Size:      int64(m.Size),
+				Digest:    hash,
+				Annotations: map[string]string{
+					annotationRepo:     name,
+					annotationCreated:  m.Created.UTC().Format(time.RFC3339),
+					annotationUploaded: m.Uploaded.UTC().Format(time.RFC3339),
+				},
+			}
+			if len(m.Tags) == 0 {
+				idx.Manifests = append(idx.Manifests, desc)
+				continue
+			}
+			for _, tag := range m.Tags {
+				tagged := desc
+				tagged.Annotations = make(map[string]string, len(desc.Annotations)+1)
+				for k, v := range desc.Annotations {
+					tagged.Annotations[k] = v
+				}
+				tagged.Annotations[annotationRefName] = name + ":" + tag
+				idx.Manifests = append(idx.Manifests, tagged)
+			}
+		}
+	}
+	return idx, nil
+}
+
+// InventoryFromIndex returns the inventory of an index written by Index.
+func InventoryFromIndex(idx *gcrv1.IndexManifest) (*Inventory, error) {
+	taken, err := time.Parse(time.RFC3339, idx.Annotations[annotationTaken])
+	if err != nil {
+		return nil, fmt.Errorf("snapshot has no valid %s annotation", annotationTaken)
+	}
+	inv := &Inventory{Taken: taken, Base: idx.Annotations[annotationBase], Repos: make(map[string]*gcrgoogle.Tags)}
+
+	for _, desc := range idx.Manifests {
+		name := desc.Annotations[annotationRepo]
+		if name == "" {
+			return nil, fmt.Errorf("snapshot manifest %s has no %s annotation", desc.Digest, annotationRepo)
+		}
+		tags, ok := inv.Repos[name]
+		if !ok {
+			tags = &gcrgoogle.Tags{Name: name, Manifests: make(map[string]gcrgoogle.ManifestInfo)}
+			inv.Repos[name] = tags
+		}
+
+		digest := desc.Digest.String()
+		m := tags.Manifests[digest]
+		m.MediaType = string(desc.MediaType)
+		m.Size = uint64(desc.Size)
+		m.Created, _ = time.Parse(time.RFC3339, desc.Annotations[annotationCreated])
+		m.Uploaded, _ = time.Parse(time.RFC3339, desc.Annotations[annotationUploaded])
+		if ref, ok := desc.Annotations[annotationRefName]; ok {
+			tag := strings.TrimPrefix(ref, name+":")
+			m.Tags = append(m.Tags, tag)
+			tags.Tags = append(tags.Tags, tag)
+		}
+		tags.Manifests[digest] = m
+	}
+	return inv, nil
+}
+
+// WriteSnapshot writes the inventory to a file as an OCI image index.
+func WriteSnapshot(path string, inv *Inventory) error {
+	idx, err := inv.Index()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// ReadSnapshot reads a file written by WriteSnapshot.
+func ReadSnapshot(path string) (*Inventory, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var idx gcrv1.IndexManifest
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+	}
+	inv, err := InventoryFromIndex(&idx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return inv, nil
+}
+
+// snapshotBackend is a read-only Backend serving an inventory, so commands
+// can read a snapshot like a registry.
+type snapshotBackend struct {
+	inv *Inventory
+}
+
+// NewSnapshotBackend returns a read-only backend serving the repos of the
+// inventory. Deleting from it fails.
+func NewSnapshotBackend(inv *Inventory) Backend {
+	return &snapshotBackend{inv: inv}
+}
+
+func (s *snapshotBackend) Children(base string) ([]string, error) {
+	var children []string
+	for name := range s.inv.Repos {
+		if rel := strings.TrimPrefix(name, base+"/"); rel != name {
+			children = append(children, rel)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+func (s *snapshotBackend) List(repo string) (*gcrgoogle.Tags, error) {
+	tags, ok := s.inv.Repos[repo]
+	if !ok {
+		return nil, &statusError{method: http.MethodGet, path: repo, code: http.StatusNotFound, body: []byte("not in snapshot")}
+	}
+	return tags, nil
+}
+
+func (s *snapshotBackend) DeleteTag(repo, tag string) error {
+	return errReadOnlySnapshot
+}
+
+func (s *snapshotBackend) DeleteManifest(repo, digest string) error {
+	return errReadOnlySnapshot
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// State is information carried between runs, so that one-shot runs such as
+// CronJobs can act on history.
+type State struct {
+	// ZeroDeletionRuns is the number of consecutive real runs that deleted
+	// nothing despite having candidates.
+	ZeroDeletionRuns int `json:"zeroDeletionRuns"`
+
+	// Digest aggregates the runs since the last notification digest.
+	Digest *Digest `json:"digest,omitempty"`
+
+	// InUse are the images in use at the last scans, by base repo, oldest
+	// first, see WithInUseHistory.
+	InUse map[string][]InUseSnapshot `json:"inUse,omitempty"`
+
+	// Checkpoint is the progress of an unfinished run, in the checkpoint
+	// store, see Checkpoint.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+
+	// LastRun summarizes the last full run, to compare the next one with,
+	// see DiffRuns.
+	LastRun *RunSummary `json:"lastRun,omitempty"`
+}
+
+// StateStore loads and saves the State.
+type StateStore interface {
+	Load(ctx context.Context) (*State, error)
+	Save(ctx context.Context, s *State) error
+}
+
+// NewStateStore returns a store for the given location, either a local path
+// or a gs://bucket/object URI. The client must be authorized for the
+// devstorage scope when using GCS.
+func NewStateStore(location string, client *http.Client) (StateStore, error) {
+	if strings.HasPrefix(location, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid state location %q, expected gs://bucket/object", location)
+		}
+		return &gcsStateStore{
+			store:  &storageClient{client: client, bucket: parts[0]},
+			object: parts[1],
+		}, nil
+	}
+	return &fileStateStore{path: location}, nil
+}
+
+// fileStateStore keeps the state in a local file.
+type fileStateStore struct {
+	path string
+}
+
+// Load implements StateStore. A missing file is an empty state.
+func (f *fileStateStore) Load(ctx context.Context) (*State, error) {
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+	return decodeState(b)
+}
+
+// Save implements StateStore.
+func (f *fileStateStore) Save(ctx context.Context, s *State) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.path, b, 0600); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	return nil
+}
+
+// gcsStateStore keeps the state in a GCS object.
+type gcsStateStore struct {
+	store  *storageClient
+	object string
+}
+
+// Load implements StateStore. A missing object is an empty state.
+func (g *gcsStateStore) Load(ctx context.Context) (*State, error) {
+	b, err := g.store.get(ctx, g.object)
+	if errors.Is(err, errObjectNotExist) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(b)
+}
+
+// Save implements StateStore.
+func (g *gcsStateStore) Save(ctx context.Context, s *State) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = g.store.put(ctx, g.object, b, -1)
+	return err
+}
+
+// decodeState parses a serialized state.
+func decodeState(b []byte) (*State, error) {
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse state: %w", err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// SyntheticLoad is the shape of a generated inventory, for benchmarks.
+type SyntheticLoad struct {
+	// Repos is how many child repos there are.
+	Repos int
+
+	// Manifests is how many manifests every repo has.
+	Manifests int
+
+	// TaggedEvery tags one manifest in this many, the newest first. The
+	// others are untagged. 0 tags every manifest.
+	TaggedEvery int
+}
+
+// SyntheticInventory generates the inventory of a base repo with the load,
+// the same every time for the same now. Manifests are uploaded an hour apart,
+// the newest at now, and tagged manifests get a release tag like v1.42, with
+// every third also getting a branch tag like main-42, so policies that match
+// tags have something to match. Backed by NewSnapshotBackend, it's a fake
+// registry that needs no network.
+func SyntheticInventory(base string, load SyntheticLoad, now time.Time) *Inventory {
+	inv := &Inventory{Taken: now, Base: base, Repos: make(map[string]*gcrgoogle.Tags)}
+	for r := 0; r < load.Repos; r++ {
+		name := fmt.Sprintf("%s/app-%d", base, r)
+		tags := &gcrgoogle.Tags{Name: name, Manifests: make(map[string]gcrgoogle.ManifestInfo, load.Manifests)}
+		for i := 0; i < load.Manifests; i++ {
+			uploaded := now.Add(-time.Duration(i) * time.Hour)
+			info := gcrgoogle.ManifestInfo{
+				Size:      uint64(50<<20 + i%1024<<10),
+				MediaType: string(types.DockerManifestSchema2),
+				Created:   uploaded,
+				Uploaded:  uploaded,
+			}
+			if load.TaggedEvery <= 1 || i%load.TaggedEvery == 0 {
+				info.Tags = []string{fmt.Sprintf("v1.%d", load.Manifests-i)}
+				if i%3 == 0 {
+					info.Tags = append(info.Tags, fmt.Sprintf("main-%d", load.Manifests-i))
+				}
+				tags.Tags = append(tags.Tags, info.Tags...)
+			}
+			tags.Manifests[fmt.Sprintf("sha256:%064x", uint64(r)<<32|uint64(i))] = info
+		}
+		inv.Repos[name] = tags
+	}
+	return inv
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxDeletePercent and maxDeleteSize are the guardrails of real runs, see
+// CheckThresholds. Both are disabled when empty.
+var maxDeletePercent = getenv("CLEANER_MAX_DELETE_PERCENT", "")
+var maxDeleteSize = getenv("CLEANER_MAX_DELETE_SIZE", "")
+
+// thresholdMinManifests is how many manifests a repo needs before
+// CLEANER_MAX_DELETE_PERCENT applies to it, so cleaning small repos doesn't
+// trip it.
+const thresholdMinManifests = 10
+
+// CheckThresholds returns an error matching ErrThresholdExceeded if the plans
+// would delete more than CLEANER_MAX_DELETE_PERCENT percent of the manifests
+// of a repo, or more than CLEANER_MAX_DELETE_SIZE in total, which usually
+// means a policy is misconfigured. Repos that are dry run only don't count.
+func CheckThresholds(plans []*RepoPlan) error {
+	return (&Thresholds{}).Check(plans)
+}
+
+// Thresholds checks the plans of a clean that executes its repos in batches
+// against the deletion thresholds as a whole: CLEANER_MAX_DELETE_SIZE caps
+// what all of the batches free together, rather than every batch on its own.
+// CLEANER_MAX_DELETE_PERCENT is per repo, and repos are never split across
+// batches. The zero value has checked nothing yet.
+type Thresholds struct {
+	lock  sync.Mutex
+	freed int64
+}
+
+// Check is CheckThresholds counting what the plans of the earlier calls
+// would free, if they passed, towards CLEANER_MAX_DELETE_SIZE. If the plans
+// pass, they count towards the later calls.
+func (t *Thresholds) Check(plans []*RepoPlan) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var percent float64
+	if maxDeletePercent != "" {
+		var err error
+		if percent, err = strconv.ParseFloat(maxDeletePercent, 64); err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("invalid CLEANER_MAX_DELETE_PERCENT %q", maxDeletePercent)
+		}
+	}
+	var size int64
+	if maxDeleteSize != "" {
+		var err error
+		if size, err = ParseSize(maxDeleteSize); err != nil {
+			return fmt.Errorf("invalid CLEANER_MAX_DELETE_SIZE: %w", err)
+		}
+	}
+
+	var breaches []string
+	total := t.freed
+	for _, plan := range plans {
+		if plan.Policy.DryRun {
+			continue
+		}
+		candidates := plan.Candidates()
+		n := len(plan.Decisions)
+		if percent > 0 && n >= thresholdMinManifests && float64(len(candidates))*100 > percent*float64(n) {
+			breaches = append(breaches, fmt.Sprintf("%s would delete %d of %d manifests, more than %s%%",
+				plan.Repo, len(candidates), n, maxDeletePercent))
+		}
+		if !plan.Policy.UntagOnly {
+			for _, d := range candidates {
+				total += d.Size
+			}
+		}
+	}
+	if size > 0 && total > size {
+		breaches = append(breaches, fmt.Sprintf("would free %s in total, more than %s", FormatSize(total), FormatSize(size)))
+	}
+
+	if len(breaches) > 0 {
+		return fmt.Errorf("%w: %s", ErrThresholdExceeded, strings.Join(breaches, "; "))
+	}
+	t.freed = total
+	return nil
+}
+
+// ParseSize parses a size like 500MB or 1.5 TB in the decimal units of
+// FormatSize. A plain number is a number of bytes.
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "B")
+	mult := int64(1)
+	if value != "" {
+		if i := strings.IndexByte("KMGTPE", value[len(value)-1]); i >= 0 {
+			value = value[:len(value)-1]
+			for ; i >= 0; i-- {
+				mult *= 1000
+			}
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
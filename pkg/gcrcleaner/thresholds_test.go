@@ -0,0 +1,209 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "100", want: 100},
+		{in: "100B", want: 100},
+		{in: "1k", want: 1000},
+		{in: "500MB", want: 500 * 1000 * 1000},
+		{in: "1 GB", want: 1000 * 1000 * 1000},
+		{in: "1.5 TB", want: 1500 * 1000 * 1000 * 1000},
+		{in: " 2p ", want: 2 * 1000 * 1000 * 1000 * 1000 * 1000},
+		{in: "", wantErr: true},
+		{in: "B", wantErr: true},
+		{in: "-1MB", wantErr: true},
+		{in: "2KiB", wantErr: true},
+		{in: "ten", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := ParseSize(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseSize(%q) = %d, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSize(%q): %s", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+// thresholdPlan returns a plan of a repo with n manifests of the given size,
+// the first deleted of which are candidates.
+func thresholdPlan(repo string, n, deleted int, size int64) *RepoPlan {
+	plan := &RepoPlan{Repo: repo}
+	for i := 0; i < n; i++ {
+		plan.Decisions = append(plan.Decisions, &Decision{
+			Repo:   repo,
+			Digest: fmt.Sprintf("sha256:%d", i),
+			Size:   size,
+			Delete: i < deleted,
+		})
+	}
+	return plan
+}
+
+// setThresholds sets the thresholds, as if from the environment, and
+// returns a function that restores them.
+func setThresholds(percent, size string) func() {
+	oldPercent, oldSize := maxDeletePercent, maxDeleteSize
+	maxDeletePercent, maxDeleteSize = percent, size
+	return func() { maxDeletePercent, maxDeleteSize = oldPercent, oldSize }
+}
+
+func TestCheckThresholds(t *testing.T) {
+	untagOnly := thresholdPlan("untag", 10, 10, 1000)
+	untagOnly.Policy.UntagOnly = true
+	dryRun := thresholdPlan("dry", 10, 10, 1000)
+	dryRun.Policy.DryRun = true
+
+	cases := []struct {
+		name          string
+		percent, size string
+		plans         []*RepoPlan
+		exceeded      bool
+		invalid       bool
+	}{
+		{
+			name:  "unset",
+			plans: []*RepoPlan{thresholdPlan("a", 10, 10, 1000)},
+		},
+		{
+			name:  "size 0 is unset",
+			size:  "0",
+			plans: []*RepoPlan{thresholdPlan("a", 10, 10, 1000)},
+		},
+		{
+			name:    "percent 0 is invalid",
+			percent: "0",
+			plans:   []*RepoPlan{thresholdPlan("a", 10, 1, 1000)},
+			invalid: true,
+		},
+		{
+			name:    "invalid percent",
+			percent: "101",
+			invalid: true,
+		},
+		{
+			name:    "invalid size",
+			size:    "lots",
+			invalid: true,
+		},
+		{
+			name:    "exactly at the percent",
+			percent: "50",
+			plans:   []*RepoPlan{thresholdPlan("a", 10, 5, 1000)},
+		},
+		{
+			name:     "over the percent",
+			percent:  "50",
+			plans:    []*RepoPlan{thresholdPlan("a", 10, 6, 1000)},
+			exceeded: true,
+		},
+		{
+			name:    "percent is per repo",
+			percent: "50",
+			plans:   []*RepoPlan{thresholdPlan("a", 10, 5, 1000), thresholdPlan("b", 100, 0, 1000)},
+		},
+		{
+			name:    "repos under the minimum manifests don't count towards the percent",
+			percent: "50",
+			plans:   []*RepoPlan{thresholdPlan("a", thresholdMinManifests-1, thresholdMinManifests-1, 1000)},
+		},
+		{
+			name:  "exactly at the size",
+			size:  "10kB",
+			plans: []*RepoPlan{thresholdPlan("a", 10, 6, 1000), thresholdPlan("b", 10, 4, 1000)},
+		},
+		{
+			name:     "over the size across repos",
+			size:     "10kB",
+			plans:    []*RepoPlan{thresholdPlan("a", 10, 6, 1000), thresholdPlan("b", 10, 5, 1000)},
+			exceeded: true,
+		},
+		{
+			name:    "dry run repos don't count",
+			percent: "50",
+			size:    "1kB",
+			plans:   []*RepoPlan{dryRun},
+		},
+		{
+			name:  "untag only repos free nothing",
+			size:  "1kB",
+			plans: []*RepoPlan{untagOnly},
+		},
+		{
+			name:     "untag only repos count towards the percent",
+			percent:  "50",
+			plans:    []*RepoPlan{untagOnly},
+			exceeded: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setThresholds(tc.percent, tc.size)()
+			err := CheckThresholds(tc.plans)
+			switch {
+			case tc.invalid:
+				if err == nil || errors.Is(err, ErrThresholdExceeded) {
+					t.Errorf("CheckThresholds() = %v, want an invalid threshold", err)
+				}
+			case tc.exceeded:
+				if !errors.Is(err, ErrThresholdExceeded) {
+					t.Errorf("CheckThresholds() = %v, want %v", err, ErrThresholdExceeded)
+				}
+			case err != nil:
+				t.Errorf("CheckThresholds() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestThresholdsAcrossBatches(t *testing.T) {
+	defer setThresholds("", "10kB")()
+
+	var thresholds Thresholds
+	if err := thresholds.Check([]*RepoPlan{thresholdPlan("a", 10, 6, 1000)}); err != nil {
+		t.Fatalf("first batch: %s", err)
+	}
+	// A batch over the limit with the first doesn't count towards the next.
+	if err := thresholds.Check([]*RepoPlan{thresholdPlan("b", 10, 5, 1000)}); !errors.Is(err, ErrThresholdExceeded) {
+		t.Fatalf("second batch = %v, want %v", err, ErrThresholdExceeded)
+	}
+	if err := thresholds.Check([]*RepoPlan{thresholdPlan("c", 10, 4, 1000)}); err != nil {
+		t.Fatalf("third batch, exactly at the limit with the first: %s", err)
+	}
+	if err := thresholds.Check([]*RepoPlan{thresholdPlan("d", 10, 1, 1)}); !errors.Is(err, ErrThresholdExceeded) {
+		t.Fatalf("fourth batch = %v, want %v", err, ErrThresholdExceeded)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TransportConfig configures the HTTP transport used for registry requests.
+type TransportConfig struct {
+	// CABundle is the path to PEM certificates trusted in addition to the
+	// system roots, e.g. those of a TLS-intercepting proxy.
+	CABundle string
+
+	// ClientCert and ClientKey are the paths to a PEM client certificate and
+	// key presented to registries that ask for one.
+	ClientCert string
+	ClientKey  string
+
+	// HostCerts are client certificates presented only to the registry host
+	// they are keyed by, e.g. registry.example.com:5000, instead of
+	// ClientCert.
+	HostCerts map[string]HostCert
+
+	// IdleConnTimeout and MaxIdleConnsPerHost tune keep-alive connections.
+	// Zero keeps the defaults.
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+}
+
+// HostCert is the client certificate of a registry host, either PEM files or
+// a Kubernetes TLS secret in the cleaner's cluster, as "namespace/name".
+type HostCert struct {
+	Cert   string `json:"cert,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// LoadHostCerts reads the JSON file of HostCerts keyed by registry host.
+func LoadHostCerts(path string) (map[string]HostCert, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificates file: %w", err)
+	}
+	var certs map[string]HostCert
+	if err := json.Unmarshal(b, &certs); err != nil {
+		return nil, fmt.Errorf("failed to parse client certificates file: %w", err)
+	}
+	for host, c := range certs {
+		if (c.Secret == "") == (c.Cert == "" || c.Key == "") {
+			return nil, fmt.Errorf("client certificate of %s needs either cert and key or secret", host)
+		}
+	}
+	return certs, nil
+}
+
+// load reads the certificate from its files or its secret.
+func (h HostCert) load(ctx context.Context) (tls.Certificate, error) {
+	if h.Secret == "" {
+		return tls.LoadX509KeyPair(h.Cert, h.Key)
+	}
+
+	parts := strings.SplitN(h.Secret, "/", 2)
+	if len(parts) != 2 {
+		return tls.Certificate{}, fmt.Errorf("invalid secret %q, expected namespace/name", h.Secret)
+	}
+	client, err := inClusterKubeClient()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var secret struct {
+		Data map[string][]byte `json:"data"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(parts[0]), url.PathEscape(parts[1]))
+	if err := client.do(ctx, http.MethodGet, path, nil, &secret); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read secret %s: %w", h.Secret, err)
+	}
+	return tls.X509KeyPair(secret.Data["tls.crt"], secret.Data["tls.key"])
+}
+
+// hostTransport routes requests to the transport of their host, falling back
+// to the default one.
+type hostTransport struct {
+	hosts    map[string]http.RoundTripper
+	fallback http.RoundTripper
+}
+
+func (h *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t, ok := h.hosts[req.URL.Host]; ok {
+		return t.RoundTrip(req)
+	}
+	return h.fallback.RoundTrip(req)
+}
+
+// NewTransport creates an HTTP transport from the config. Like the default
+// transport, it honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func NewTransport(cfg TransportConfig) (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse CA bundle %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if len(cfg.HostCerts) == 0 {
+		return t, nil
+	}
+
+	hosts := make(map[string]http.RoundTripper, len(cfg.HostCerts))
+	for host, hc := range cfg.HostCerts {
+		cert, err := hc.load(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate of %s: %w", host, err)
+		}
+		ht := t.Clone()
+		ht.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		hosts[host] = ht
+	}
+	return &hostTransport{hosts: hosts, fallback: t}, nil
+}
+
+// transportSetter is implemented by backends that can send their requests
+// through a custom transport.
+type transportSetter interface {
+	setTransport(t http.RoundTripper)
+}
+
+func (g *gcrBackend) setTransport(t http.RoundTripper) { g.transport = t }
+
+func (g *GHCRBackend) setTransport(t http.RoundTripper) {
+	g.client = &http.Client{Transport: t}
+	if g.app != nil {
+		g.app.client = g.client
+	}
+}
+
+func (g *GitLabBackend) setTransport(t http.RoundTripper) { g.client = &http.Client{Transport: t} }
+
+func (q *QuayBackend) setTransport(t http.RoundTripper) { q.client = &http.Client{Transport: t} }
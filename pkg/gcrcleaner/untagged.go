@@ -0,0 +1,89 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// Reasons untagged manifests are kept in untagged-only repos, see
+// UntaggedOnly.
+const (
+	ReasonUntaggedNewest = "newest untagged in untagged-only repo"
+	ReasonUntaggedRecent = "untagged, within maxAge of untagged-only repo"
+)
+
+// UntaggedOnly configures the cleaning of repos none of whose manifests are
+// tagged, like repos pushed to by digest. There are no tags for the keep
+// window to keep in such a repo, so instead the newest Keep manifests are
+// kept, and of the rest only those built more than MaxAge ago, which accepts
+// days such as 30d, are deleted. Repos without the policy keep the policy's
+// Keep newest manifests.
+type UntaggedOnly struct {
+	Keep   int    `json:"keep"`
+	MaxAge string `json:"maxAge,omitempty"`
+
+	maxAge time.Duration
+}
+
+// compile parses the policy's max age.
+func (u *UntaggedOnly) compile() error {
+	if u.Keep < 0 {
+		return fmt.Errorf("invalid untaggedOnly.keep %d: must not be negative", u.Keep)
+	}
+	u.maxAge = 0
+	if u.MaxAge != "" {
+		d, err := ParseDuration(u.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid untaggedOnly.maxAge: %w", err)
+		}
+		u.maxAge = d
+	}
+	return nil
+}
+
+// isUntaggedOnly returns true if the listed repo has manifests, but no tags
+// other than those attaching artifacts to them.
+func isUntaggedOnly(tags *gcrgoogle.Tags) bool {
+	return len(tags.Manifests) > 0 && len(withoutAttachments(tags.Tags)) == 0
+}
+
+// keepUntagged keeps the newest untagged manifests of an untagged-only repo,
+// and those within the max age, under the policy's UntaggedOnly. Excepted
+// manifests are kept on top of the newest ones rather than counting towards
+// them. Decisions must be sorted by build time, newest first.
+func (p Policy) keepUntagged(decisions []*Decision, now time.Time) {
+	keep, maxAge := p.Keep, time.Duration(0)
+	if p.UntaggedOnly != nil {
+		keep, maxAge = p.UntaggedOnly.Keep, p.UntaggedOnly.maxAge
+	}
+	for _, d := range decisions {
+		if len(d.Tags) > 0 || d.Reason == ReasonException {
+			continue
+		}
+		switch {
+		case keep > 0:
+			keep--
+			if d.Delete {
+				d.Delete, d.Reason = false, ReasonUntaggedNewest
+			}
+		case d.Delete && now.Sub(d.Built) < maxAge:
+			d.Delete, d.Reason = false, ReasonUntaggedRecent
+		}
+	}
+}
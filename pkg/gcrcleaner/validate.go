@@ -0,0 +1,210 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// Problem is an issue with the configuration found by Validate. Warnings
+// don't stop the cleaner from running.
+type Problem struct {
+	Warning bool
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		return "warning: " + p.Message
+	}
+	return "error: " + p.Message
+}
+
+// Validate checks the policy file and the exceptions in the store without
+// contacting the registry: that they parse, that names are valid repos and
+// tags under the base repo, that regular expressions compile and that
+// policies don't conflict with each other or with the exceptions.
+func Validate(ctx context.Context, base string, store *ExceptionStore, allowFullPrune bool) []Problem {
+	var problems []Problem
+	errorf := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{Message: fmt.Sprintf(format, args...)})
+	}
+	warnf := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{Warning: true, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if _, err := gcrname.NewRepository(base); err != nil {
+		errorf("invalid base repo %q: %s", base, err)
+		return problems
+	}
+
+	if orphanedTagsMode != "report" && orphanedTagsMode != "delete" {
+		errorf("invalid CLEANER_ORPHANED_TAGS %q, expected report or delete", orphanedTagsMode)
+	}
+
+	policies, err := loadPolicies()
+	if err != nil {
+		errorf("%s", err)
+	} else if err := policies.checkKeep(allowFullPrune); err != nil {
+		errorf("%s", err)
+	}
+
+	ex, err := store.Load(ctx)
+	if err != nil {
+		errorf("%s", err)
+		return problems
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	repoExcepted := make(map[string]bool)
+	check := func(kind string, list []Exception, validate func(string) error) {
+		for _, e := range list {
+			key := kind + " " + e.Name
+			if seen[key] {
+				warnf("duplicate %s exception %s", kind, e.Name)
+			}
+			seen[key] = true
+			if err := validate(e.Name); err != nil {
+				errorf("invalid %s exception %q: %s", kind, e.Name, err)
+			}
+			if e.Expired(now) {
+				warnf("%s exception %s expired on %s", kind, e.Name, e.Expires.Format("2006-01-02"))
+			}
+		}
+	}
+	check("repo", ex.Repo, func(name string) error {
+		repoExcepted[name] = true
+		_, err := gcrname.NewRepository(base + "/" + name)
+		return err
+	})
+	check("tag", ex.Tag, func(name string) error {
+		if !strings.Contains(name, ":") {
+			return fmt.Errorf("expected repo:tag")
+		}
+		_, err := gcrname.NewTag(base + "/" + name)
+		return err
+	})
+	check("globalTag", ex.GlobalTag, func(name string) error {
+		_, err := gcrname.NewTag(base + "/repo:" + name)
+		return err
+	})
+
+	if policies != nil {
+		for r, p := range policies.Repos {
+			if _, err := gcrname.NewRepository(base + "/" + r); err != nil {
+				errorf("invalid repo %q in policy file: %s", r, err)
+			}
+			if repoExcepted[r] && !p.Cache {
+				warnf("policy for %s has no effect, as the repo is an exception repo that keeps every tag", r)
+			}
+			if p.Cache && (p.GroupBy != "" || p.GFS != nil || p.OrderBy != "") {
+				warnf("policy for %s is a cache policy, which ignores groupBy, gfs and orderBy", r)
+			}
+		}
+	}
+	return problems
+}
+
+// VerifyRegistry checks that every excepted repo and tag and every repo with
+// a policy of its own exists in the registry, so typos don't leave images
+// unprotected.
+func (c *Cleaner) VerifyRegistry() []Problem {
+	c.exceptLock.RLock()
+	defer c.exceptLock.RUnlock()
+
+	var problems []Problem
+	listed := make(map[string]map[string]bool)
+	exists := func(repo string) (map[string]bool, bool) {
+		if tags, ok := listed[repo]; ok {
+			return tags, tags != nil
+		}
+		tags, err := c.backend.List(repo)
+		if err != nil {
+			if !IsNotFound(err) {
+				problems = append(problems, Problem{Message: fmt.Sprintf("failed to list %s: %s", repo, err)})
+			}
+			listed[repo] = nil
+			return nil, false
+		}
+		set := make(map[string]bool)
+		for _, t := range tags.Tags {
+			set[t] = true
+		}
+		listed[repo] = set
+		return set, true
+	}
+	missing := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, r := range sortedKeys(c.repoExcept) {
+		if _, ok := exists(r); !ok {
+			missing("excepted repo %s does not exist", r)
+		}
+	}
+	tagExcept := make(map[string]bool, len(c.tagExcept))
+	for t := range c.tagExcept {
+		tagExcept[t] = true
+	}
+	for _, t := range sortedKeys(tagExcept) {
+		// In-use images are tag exceptions too, but may be in any registry.
+		if !strings.HasPrefix(t, c.base+"/") {
+			continue
+		}
+		i := strings.LastIndex(t, ":")
+		if i < 0 {
+			continue
+		}
+		tags, ok := exists(t[:i])
+		if !ok {
+			missing("excepted tag %s is in a repo that does not exist", t)
+		} else if !tags[t[i+1:]] {
+			missing("excepted tag %s does not exist", t)
+		}
+	}
+	for _, r := range sortedPolicyRepos(c.policies) {
+		if _, ok := exists(c.base + "/" + r); !ok {
+			missing("repo %s with a policy does not exist", c.base+"/"+r)
+		}
+	}
+	return problems
+}
+
+// sortedKeys returns the keys of the set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedPolicyRepos returns the repos with policies of their own in order.
+func sortedPolicyRepos(cfg *policyConfig) []string {
+	keys := make([]string, 0, len(cfg.Repos))
+	for k := range cfg.Repos {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gammazero/workerpool"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// verifyKeptTags HEADs the tags of the manifests in the keep window while
+// planning, see verifyKeepWindow.
+var verifyKeptTags = getenv("CLEANER_VERIFY_KEPT_TAGS", "false") == "true"
+
+// Reasons of verifying the keep window.
+const (
+	ReasonKeptMissing = "kept, but tags no longer resolve"
+	ReasonFallback    = "fallback for a missing kept image"
+)
+
+// ManifestHeader is implemented by backends that can resolve a tag without
+// fetching its manifest.
+type ManifestHeader interface {
+	// HeadManifest returns the digest a tag or digest of a repo resolves to.
+	HeadManifest(repo, ref string) (string, error)
+}
+
+// HeadManifest implements ManifestHeader.
+func (g *gcrBackend) HeadManifest(repo, ref string) (string, error) {
+	sep := ":"
+	if strings.Contains(ref, ":") {
+		sep = "@"
+	}
+	name, err := gcrname.ParseReference(repo + sep + ref)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse reference %s%s%s: %w", repo, sep, ref, err)
+	}
+
+	auth := g.auther
+	if g.keychain != nil {
+		if auth, err = g.keychain.Resolve(name.Context().Registry); err != nil {
+			return "", err
+		}
+	}
+	inner := g.transport
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	t, err := transport.New(name.Context().Registry, auth, inner, []string{name.Scope(transport.PullScope)})
+	if err != nil {
+		return "", err
+	}
+
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", name.Context().Registry.Scheme(),
+		name.Context().RegistryStr(), name.Context().RepositoryStr(), name.Identifier())
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		string(types.DockerManifestSchema2), string(types.DockerManifestList),
+		string(types.OCIManifestSchema1), string(types.OCIImageIndex),
+	}, ","))
+	resp, err := (&http.Client{Transport: t}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to head %s: %w", name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to head %s: %w", name,
+			&statusError{method: http.MethodHead, path: u, code: resp.StatusCode})
+	}
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// verifyKeepWindow HEADs the tags of the manifests the plan keeps in its
+// keep window, catching tags whose manifests were deleted since listing,
+// e.g. by hand, which would leave the repo with fewer pullable images than
+// the window. Such manifests are kept as missing, and the newest manifest
+// beyond the window is kept in place of each as a fallback. Tags that fail
+// to resolve for any other reason are returned as failures. This needs a
+// backend that implements ManifestHeader.
+func (c *Cleaner) verifyKeepWindow(plan *RepoPlan) []*RefError {
+	header, ok := c.backend.(ManifestHeader)
+	if !ok {
+		return nil
+	}
+
+	var lock sync.Mutex
+	missing := make(map[*Decision]int)
+	var failures []*RefError
+
+	pool := workerpool.New(c.concurrency)
+	for _, d := range plan.Decisions {
+		if d.Delete || d.Reason != ReasonKeepWindow {
+			continue
+		}
+		for _, t := range d.Tags {
+			d, t := d, t
+			pool.Submit(func() {
+				_, err := header.HeadManifest(d.Repo, t)
+
+				lock.Lock()
+				defer lock.Unlock()
+				switch {
+				case IsNotFound(err):
+					missing[d]++
+				case err != nil:
+					failures = append(failures, &RefError{Repo: d.Repo, Ref: d.Repo + ":" + t, Err: classify(err)})
+				}
+			})
+		}
+	}
+	pool.StopWait()
+
+	// A manifest is only missing if none of its tags resolve.
+	fallbacks := 0
+	for d, n := range missing {
+		if n == len(d.Tags) {
+			d.Reason = ReasonKeptMissing
+			log.Printf("%s@%s: kept tags %v no longer resolve", d.Repo, d.Digest, d.Tags)
+			fallbacks++
+		}
+	}
+
+	// Decisions are sorted newest first.
+	for _, d := range plan.Decisions {
+		if fallbacks == 0 {
+			break
+		}
+		if d.Delete && d.Reason == ReasonBeyond {
+			d.Delete, d.Reason = false, ReasonFallback
+			log.Printf("%s@%s: keeping %v as a fallback for a missing kept image", d.Repo, d.Digest, d.Tags)
+			fallbacks--
+		}
+	}
+	return failures
+}
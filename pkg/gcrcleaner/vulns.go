@@ -0,0 +1,171 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const containerAnalysisAPI = "https://containeranalysis.googleapis.com/v1"
+
+// SeverityCritical is the most severe vulnerability severity.
+const SeverityCritical = "CRITICAL"
+
+// severityRank orders vulnerability severities, most severe first.
+var severityRank = map[string]int{
+	SeverityCritical: 5,
+	"HIGH":           4,
+	"MEDIUM":         3,
+	"LOW":            2,
+	"MINIMAL":        1,
+}
+
+// annotateVulnerabilities adds the vulnerability findings of Container
+// Analysis to the candidates of the plans. Failures are only logged, as the
+// findings are informational.
+func (c *Cleaner) annotateVulnerabilities(plans []*RepoPlan) {
+	byProject := make(map[string][]*Decision)
+	for _, plan := range plans {
+		project := repoProject(plan.Repo)
+		if project == "" {
+			continue
+		}
+		byProject[project] = append(byProject[project], plan.Candidates()...)
+	}
+
+	for project, candidates := range byProject {
+		findings, err := c.vulnerabilities(project)
+		if err != nil {
+			log.Printf("Failed to get vulnerabilities of %s: %s", project, err)
+			continue
+		}
+		for _, d := range candidates {
+			d.Vulnerabilities = findings["https://"+d.Repo+"@"+d.Digest]
+		}
+	}
+}
+
+// vulnerabilities returns the counts of vulnerability occurrences in the
+// project by severity, keyed by resource URI.
+func (c *Cleaner) vulnerabilities(project string) (map[string]map[string]int, error) {
+	findings := make(map[string]map[string]int)
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("filter", `kind="VULNERABILITY"`)
+		q.Set("pageSize", "1000")
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		u := fmt.Sprintf("%s/projects/%s/occurrences?%s", containerAnalysisAPI, url.PathEscape(project), q.Encode())
+		resp, err := c.vulnClient.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &statusError{method: http.MethodGet, path: u, code: resp.StatusCode, body: bytes.TrimSpace(body)}
+		}
+
+		var page struct {
+			Occurrences []struct {
+				ResourceURI   string `json:"resourceUri"`
+				Vulnerability struct {
+					Severity          string `json:"severity"`
+					EffectiveSeverity string `json:"effectiveSeverity"`
+				} `json:"vulnerability"`
+			} `json:"occurrences"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse occurrences: %w", err)
+		}
+		for _, o := range page.Occurrences {
+			severity := o.Vulnerability.EffectiveSeverity
+			if severity == "" || severity == "SEVERITY_UNSPECIFIED" {
+				severity = o.Vulnerability.Severity
+			}
+			if findings[o.ResourceURI] == nil {
+				findings[o.ResourceURI] = make(map[string]int)
+			}
+			findings[o.ResourceURI][severity]++
+		}
+		if token = page.NextPageToken; token == "" {
+			return findings, nil
+		}
+	}
+}
+
+// repoProject returns the Google Cloud project of a Container Registry or
+// Artifact Registry repo, or "" for other registries.
+func repoProject(repo string) string {
+	parts := strings.SplitN(repo, "/", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	host := parts[0]
+	if host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev") {
+		return parts[1]
+	}
+	return ""
+}
+
+// worstSeverity returns the rank of the most severe finding of the decision,
+// or 0 if it has none.
+func worstSeverity(d *Decision) int {
+	worst := 0
+	for severity, count := range d.Vulnerabilities {
+		if count > 0 && severityRank[severity] > worst {
+			worst = severityRank[severity]
+		}
+	}
+	return worst
+}
+
+// sortVulnerableFirst sorts the candidates by their most severe finding,
+// most severe first, and then by build time, oldest first.
+func sortVulnerableFirst(candidates []*Decision) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		wi, wj := worstSeverity(candidates[i]), worstSeverity(candidates[j])
+		if wi != wj {
+			return wi > wj
+		}
+		return candidates[i].Built.Before(candidates[j].Built)
+	})
+}
+
+// WithSeverity returns the number of candidates with findings of the
+// severity, e.g. SeverityCritical.
+func (p *RepoPlan) WithSeverity(severity string) int {
+	n := 0
+	for _, d := range p.Candidates() {
+		if d.Vulnerabilities[severity] > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// Report is the structured report of a run uploaded to CLEANER_REPORT_BUCKET.
+type Report struct {
+	RunID      string                  `json:"runId"`
+	Base       string                  `json:"base"`
+	Dry        bool                    `json:"dry"`
+	Started    time.Time               `json:"started"`
+	Finished   time.Time               `json:"finished"`
+	Candidates int                     `json:"candidates"`
+	Deleted    int                     `json:"deleted"`
+	Freed      int64                   `json:"freed"`
+	Status     []string                `json:"status,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+	Errors     []gcrcleaner.ErrorGroup `json:"errors,omitempty"`
+
+	// FailedRepos are the repos that failed to be planned or cleaned, which
+	// have no status.
+	FailedRepos []*gcrcleaner.RepoFailure `json:"failedRepos,omitempty"`
+
+	// Anomalies are how the run differs from the previous one, with
+	// CLEANER_DIFF.
+	Anomalies []gcrcleaner.Anomaly `json:"anomalies,omitempty"`
+
+	// Plans are the decisions the run made for every manifest.
+	Plans []*gcrcleaner.RepoPlan `json:"plans"`
+}
+
+// reports uploads a report after every run.
+type reports struct {
+	store *gcrcleaner.ReportStore
+	base  string
+}
+
+// newReports configures report uploads from the environment. It returns nil
+// if CLEANER_REPORT_BUCKET isn't set.
+func newReports(jsonKey []byte, baseRepo string) (*reports, error) {
+	bucket := os.Getenv("CLEANER_REPORT_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	client, err := storageClient(jsonKey)
+	if err != nil {
+		return nil, err
+	}
+	return &reports{store: gcrcleaner.NewReportStore(bucket, client), base: baseRepo}, nil
+}
+
+// afterRun uploads the report of the run. Failures are only logged, as the
+// run itself is over.
+func (r *reports) afterRun(runID string, started time.Time, res *runResult, dry bool, runErr error) {
+	if r == nil || res.Skipped {
+		return
+	}
+
+	report := &Report{
+		RunID:      runID,
+		Base:       r.base,
+		Dry:        dry,
+		Started:    started,
+		Finished:   time.Now(),
+		Candidates: res.Candidates,
+		Deleted:    res.Deleted,
+		Status:     res.Status,
+		Errors:     res.Errors,
+		Plans:      res.Plans,
+
+		FailedRepos: res.Failed,
+		Anomalies:   res.Anomalies,
+	}
+	for _, size := range res.Freed {
+		report.Freed += size
+	}
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+
+	uri, err := r.store.Upload(context.Background(), started, runID, report)
+	if err != nil {
+		log.Printf("failed to upload run report: %s", err)
+		return
+	}
+	log.Printf("uploaded run report to %s", uri)
+}
@@ -0,0 +1,408 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// authCheckInterval is how long a successful or failed auth check is reused
+// before probing the registry again.
+const authCheckInterval = time.Minute
+
+// server runs the cleaner on a fixed interval and reports its health.
+type server struct {
+	cleaner   *gcrcleaner.Cleaner
+	runLock   *gcrcleaner.RunLock
+	elector   *gcrcleaner.LeaderElector
+	alerts    *alerting
+	notes     *notifications
+	reports   *reports
+	inventory *gcrcleaner.InventoryStore
+	keepSets  *gcrcleaner.KeepSetStore
+	kept      *gcrcleaner.KeptIndex
+	diffs     *differ
+	pushers   []gcrcleaner.MetricsPusher
+	dry       bool
+	interval  time.Duration
+	stagger   time.Duration
+	maxAge    time.Duration
+	started   time.Time
+
+	runMu   sync.Mutex
+	history history
+
+	lock        sync.RWMutex
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastErr     error
+	standbyAt   time.Time
+	authErr     error
+	authChecked time.Time
+	metrics     *gcrcleaner.RunMetrics
+}
+
+// healthStatus is the JSON body returned by the health endpoints.
+type healthStatus struct {
+	Ready               bool      `json:"ready"`
+	Leader              bool      `json:"leader"`
+	Auth                string    `json:"auth"`
+	ExceptionsFetchedAt time.Time `json:"exceptionsFetchedAt"`
+	ExceptionsFresh     bool      `json:"exceptionsFresh"`
+	ExpiredExceptions   []string  `json:"expiredExceptions,omitempty"`
+	LastRun             time.Time `json:"lastRun,omitempty"`
+	LastSuccess         time.Time `json:"lastSuccess,omitempty"`
+	LastError           string    `json:"lastError,omitempty"`
+}
+
+// runServer starts the clean loop and serves /healthz and /readyz on $PORT.
+func runServer(cleaner *gcrcleaner.Cleaner, lock *gcrcleaner.RunLock, jsonKey []byte, dry bool) error {
+	interval, err := time.ParseDuration(getenv("CLEANER_INTERVAL", "24h"))
+	if err != nil {
+		return fmt.Errorf("failed to parse CLEANER_INTERVAL: %w", err)
+	}
+	maxAge, err := time.ParseDuration(getenv("CLEANER_MAX_AGE", (2 * interval).String()))
+	if err != nil {
+		return fmt.Errorf("failed to parse CLEANER_MAX_AGE: %w", err)
+	}
+	stagger, err := time.ParseDuration(getenv("CLEANER_STAGGER_WINDOW", "0s"))
+	if err != nil {
+		return fmt.Errorf("failed to parse CLEANER_STAGGER_WINDOW: %w", err)
+	}
+	if stagger > interval {
+		return fmt.Errorf("CLEANER_STAGGER_WINDOW %s is longer than CLEANER_INTERVAL %s", stagger, interval)
+	}
+
+	s := &server{
+		cleaner:  cleaner,
+		runLock:  lock,
+		dry:      dry,
+		interval: interval,
+		stagger:  stagger,
+		maxAge:   maxAge,
+		started:  time.Now(),
+	}
+
+	if s.alerts, err = newAlerting(jsonKey, cleaner.BaseRepo()); err != nil {
+		return fmt.Errorf("failed to configure alerting: %w", err)
+	}
+	if s.notes, err = newNotifications(jsonKey, cleaner.BaseRepo()); err != nil {
+		return fmt.Errorf("failed to configure notifications: %w", err)
+	}
+	if s.reports, err = newReports(jsonKey, cleaner.BaseRepo()); err != nil {
+		return fmt.Errorf("failed to configure run reports: %w", err)
+	}
+	if s.inventory, err = newInventoryStore(jsonKey); err != nil {
+		return fmt.Errorf("failed to configure inventory snapshots: %w", err)
+	}
+	if s.keepSets, err = newKeepSetStore(jsonKey); err != nil {
+		return fmt.Errorf("failed to configure keep set export: %w", err)
+	}
+	s.kept = gcrcleaner.NewKeptIndex()
+	collectKeepSet = true
+	if s.keepSets != nil {
+		// Serve the index of the previous run until this one is done.
+		ks, err := s.keepSets.Load(context.Background())
+		if err != nil && !gcrcleaner.IsNotFound(err) && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to load the keep set of the previous run: %s", err)
+		} else if ks != nil {
+			s.kept.Update(ks)
+		}
+	}
+	if s.diffs, err = newDiffer(jsonKey); err != nil {
+		return fmt.Errorf("failed to configure run diffs: %w", err)
+	}
+	if s.pushers, err = newMetricsPushers(jsonKey); err != nil {
+		return fmt.Errorf("failed to configure metrics: %w", err)
+	}
+
+	if getenv("CLEANER_LEADER_ELECTION", "false") == "true" {
+		duration, err := time.ParseDuration(getenv("CLEANER_LEASE_DURATION", "30s"))
+		if err != nil {
+			return fmt.Errorf("failed to parse CLEANER_LEASE_DURATION: %w", err)
+		}
+		host, _ := os.Hostname()
+		identity := getenv("POD_NAME", host)
+
+		s.elector, err = gcrcleaner.NewLeaderElector(getenv("CLEANER_LEASE_NAME", "gcr-cleaner"), identity, duration)
+		if err != nil {
+			return fmt.Errorf("failed to create leader elector: %w", err)
+		}
+		go s.elector.Run(context.Background())
+
+		// A replica that loses the lease mid-run stops deleting, as the
+		// replica taking over may already be cleaning.
+		cleaner.HaltWhen(func() error {
+			if !s.elector.IsLeader() {
+				return errors.New("lost leadership")
+			}
+			return nil
+		})
+	}
+
+	go s.loop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.registerAPI(mux)
+	if getenv("CLEANER_DASHBOARD", "false") == "true" {
+		if err := s.registerDashboard(mux); err != nil {
+			return fmt.Errorf("failed to register dashboard: %w", err)
+		}
+	}
+
+	addr := ":" + getenv("PORT", "8080")
+	log.Printf("server is listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// loop runs a clean immediately and then once per interval. With leader
+// election enabled, cleans instead run at the multiples of the interval, e.g.
+// at midnight UTC with the default 24h, and only on the replica that is the
+// leader then, so a replica that takes over keeps the schedule rather than
+// cleaning right away. Staggered cleans start once per interval, however long
+// they take.
+func (s *server) loop() {
+	if s.elector != nil {
+		for {
+			time.Sleep(time.Until(time.Now().Truncate(s.interval).Add(s.interval)))
+			if s.isLeader() {
+				s.run()
+				continue
+			}
+			s.lock.Lock()
+			s.standbyAt = time.Now()
+			s.lock.Unlock()
+		}
+	}
+	for {
+		started := time.Now()
+		s.run()
+		if s.stagger > 0 {
+			time.Sleep(time.Until(started.Add(s.interval)))
+			continue
+		}
+		time.Sleep(s.interval)
+	}
+}
+
+// isLeader returns true if this replica should run cleans.
+func (s *server) isLeader() bool {
+	return s.elector == nil || s.elector.IsLeader()
+}
+
+// run performs a scheduled clean of every child repo, staggered if
+// CLEANER_STAGGER_WINDOW is set.
+func (s *server) run() {
+	started := time.Now()
+	var res *runResult
+	var err error
+	runID := ""
+	if s.stagger > 0 {
+		res, err = s.runStaggered()
+	} else {
+		run := s.history.start(nil, s.dry, nil)
+		runID = run.ID
+		res, err = s.execute(run, 0)
+	}
+	reportRun(res, err)
+	s.alerts.afterRun(res, s.dry, err)
+	s.notes.afterRun(res, s.dry, err)
+	metrics := runMetrics(s.cleaner.BaseRepo(), runID, res, s.dry, started, err)
+	pushMetrics(s.pushers, metrics)
+
+	s.lock.Lock()
+	if metrics != nil {
+		s.metrics = metrics
+	}
+	s.lastRun = time.Now()
+	s.lastErr = err
+	if err == nil {
+		s.lastSuccess = s.lastRun
+	}
+	s.lock.Unlock()
+}
+
+// execute refreshes the exceptions, unless they were fetched within
+// maxExceptionAge, and performs the clean described by the run, recording its
+// progress and result. Runs never overlap.
+func (s *server) execute(run *Run, maxExceptionAge time.Duration) (*runResult, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	// Runs never overlap, so the run's log lines are the ones logged until
+	// it is done.
+	log.SetPrefix("run=" + run.ID + " ")
+	defer log.SetPrefix("")
+
+	res := &runResult{}
+	var err error
+	if time.Since(s.cleaner.ExceptionsFetchedAt()) >= maxExceptionAge {
+		err = s.cleaner.RefreshExceptions()
+	}
+	if err == nil {
+		res, err = clean(s.cleaner, s.runLock, run.Repos, gcrcleaner.CleanOptions{
+			// Requested runs can only lower the keep of a dry run.
+			PlanOptions:    gcrcleaner.PlanOptions{Keep: run.Keep, RaiseKeepOnly: !run.Dry, RunID: run.ID},
+			ExecuteOptions: gcrcleaner.ExecuteOptions{Dry: run.Dry, Progress: s.history.progress(run)},
+		})
+		logStatus(res, run.Dry)
+	}
+	if err != nil {
+		log.Printf("failed to clean: %s", err)
+	}
+
+	if len(run.Repos) == 0 && run.Keep == nil {
+		s.diffs.afterRun(run.ID, run.Dry, res)
+	}
+	s.history.finish(run, res, err)
+	s.reports.afterRun(run.ID, run.Started, res, run.Dry, err)
+	if len(run.Repos) == 0 {
+		recordInventory(s.inventory, run.Started, res)
+		if ks := completeKeepSet(run.ID, s.cleaner.BaseRepo(), run.Dry, res); ks != nil {
+			exportKeepSet(s.keepSets, ks)
+			s.kept.Update(ks)
+		}
+	}
+	return res, err
+}
+
+// checkAuth returns the result of the most recent auth check, probing the
+// registry again if the cached result is older than authCheckInterval.
+func (s *server) checkAuth() error {
+	s.lock.RLock()
+	if time.Since(s.authChecked) < authCheckInterval {
+		err := s.authErr
+		s.lock.RUnlock()
+		return err
+	}
+	s.lock.RUnlock()
+
+	err := s.cleaner.CheckAuth()
+
+	s.lock.Lock()
+	s.authErr = err
+	s.authChecked = time.Now()
+	s.lock.Unlock()
+	return err
+}
+
+// status builds the current health status. With probe, the registry auth is
+// checked again if its cached result is stale, see checkAuth; otherwise the
+// status only reports the cached result, without any I/O.
+func (s *server) status(probe bool) *healthStatus {
+	var authErr error
+	if probe {
+		authErr = s.checkAuth()
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !probe {
+		authErr = s.authErr
+	}
+
+	fetchedAt := s.cleaner.ExceptionsFetchedAt()
+	st := &healthStatus{
+		Leader:              s.isLeader(),
+		Auth:                "ok",
+		ExceptionsFetchedAt: fetchedAt,
+		ExpiredExceptions:   s.cleaner.ExpiredExceptions(),
+		ExceptionsFresh:     time.Since(fetchedAt) <= s.maxAge,
+		LastRun:             s.lastRun,
+		LastSuccess:         s.lastSuccess,
+	}
+	if authErr != nil {
+		st.Auth = authErr.Error()
+	}
+	if s.lastErr != nil {
+		st.LastError = s.lastErr.Error()
+	}
+
+	// A run that has not succeeded within maxAge only counts against readiness
+	// once the server has been up long enough to have completed one. Standby
+	// replicas don't clean, so neither runs nor exceptions count against them,
+	// nor does a leader that was standing by at one of the last scheduled
+	// cleans.
+	successFresh := !st.Leader || time.Since(s.lastSuccess) <= s.maxAge ||
+		(s.lastSuccess.IsZero() && time.Since(s.started) <= s.maxAge) ||
+		time.Since(s.standbyAt) <= s.maxAge
+	st.Ready = authErr == nil && (!st.Leader || st.ExceptionsFresh) && successFresh
+	return st
+}
+
+// handleHealthz reports liveness. The process is alive as long as it can
+// serve, so this always returns 200 along with the current status, and never
+// waits on the registry; the auth is the result of the last check.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status(false))
+}
+
+// handleReadyz reports readiness: valid auth, fresh exceptions and a recent
+// successful run.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	st := s.status(true)
+	code := http.StatusOK
+	if !st.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, st)
+}
+
+// handleMetrics serves the metrics of the last run in the Prometheus text
+// format, which is empty until the first run finishes.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	m := s.metrics
+	s.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if m == nil {
+		return
+	}
+	if err := m.WritePrometheus(w); err != nil {
+		log.Printf("failed to write metrics: %s", err)
+	}
+}
+
+// writeJSON writes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %s", err)
+	}
+}
+
+// getenv returns the environment variable or the fallback if it is unset.
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
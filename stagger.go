@@ -0,0 +1,84 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// staggerRefresh is how old the exceptions may get during a staggered clean
+// before they are refreshed for the next repo, so the clusters aren't
+// scanned once per repo.
+const staggerRefresh = 15 * time.Minute
+
+// staggerOffset returns when within the window a child repo is cleaned. It
+// is a hash of the repo's name, so every repo keeps its slot from one
+// interval to the next.
+func staggerOffset(repo string, window time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(repo))
+	return time.Duration(h.Sum64() % uint64(window))
+}
+
+// runStaggered cleans the child repos one at a time, each at its offset
+// within the stagger window, to spread the load on the registry's API
+// instead of cleaning every repo at once. Every repo is recorded as a run of
+// its own, and the combined result is returned.
+func (s *server) runStaggered() (*runResult, error) {
+	started := time.Now()
+	total := &runResult{Skipped: true, Freed: make(map[string]int64)}
+	if err := s.cleaner.RefreshExceptions(); err != nil {
+		total.Skipped = false
+		return total, err
+	}
+	repos, err := s.cleaner.Repos()
+	if err != nil {
+		total.Skipped = false
+		return total, err
+	}
+	offsets := make(map[string]time.Duration, len(repos))
+	for _, r := range repos {
+		offsets[r] = staggerOffset(r, s.stagger)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return offsets[repos[i]] < offsets[repos[j]]
+	})
+	log.Printf("cleaning %d child repos of %s over %s", len(repos), s.cleaner.BaseRepo(), s.stagger)
+
+	var errStrings []string
+	for _, r := range repos {
+		time.Sleep(time.Until(started.Add(offsets[r])))
+		if !s.isLeader() {
+			errStrings = append(errStrings, "lost leadership before cleaning "+r)
+			break
+		}
+		res, err := s.execute(s.history.start([]string{r}, s.dry, nil), staggerRefresh)
+		if err != nil {
+			errStrings = append(errStrings, fmt.Sprintf("%s: %s", r, err))
+		}
+		total.add(res)
+	}
+	if len(errStrings) > 0 {
+		total.Skipped = false
+		return total, errors.New(strings.Join(errStrings, ", "))
+	}
+	return total, nil
+}
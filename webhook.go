@@ -0,0 +1,123 @@
+// Copyright 2019 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/farmersedgeinc/gcr-cleaner/pkg/gcrcleaner"
+)
+
+// webhook is a Kubernetes validating admission webhook that rejects, or
+// warns about, workloads whose images the cleaner deleted or is about to
+// delete, according to the exported keep set.
+type webhook struct {
+	store    *gcrcleaner.KeepSetStore
+	warnOnly bool
+
+	lock    sync.RWMutex
+	deleted *gcrcleaner.DeletedImages
+}
+
+// runWebhook serves the admission webhook on $PORT, over TLS if
+// CLEANER_WEBHOOK_TLS_CERT and CLEANER_WEBHOOK_TLS_KEY are set, reloading
+// the keep set at CLEANER_KEEP_SET every CLEANER_WEBHOOK_REFRESH.
+//
+//	gcrcleaner webhook
+func runWebhook() error {
+	if keepSetLocation == "" {
+		return fmt.Errorf("the webhook needs CLEANER_KEEP_SET")
+	}
+	mode := getenv("CLEANER_WEBHOOK_MODE", "warn")
+	if mode != "warn" && mode != "deny" {
+		return fmt.Errorf("invalid CLEANER_WEBHOOK_MODE %q, expected warn or deny", mode)
+	}
+	refresh, err := time.ParseDuration(getenv("CLEANER_WEBHOOK_REFRESH", "5m"))
+	if err != nil {
+		return fmt.Errorf("failed to parse CLEANER_WEBHOOK_REFRESH: %w", err)
+	}
+	jsonKey, err := readJSONKey()
+	if err != nil {
+		return fmt.Errorf("failed to read credentials: %w", err)
+	}
+	store, err := newKeepSetStore(jsonKey)
+	if err != nil {
+		return err
+	}
+
+	w := &webhook{store: store, warnOnly: mode == "warn"}
+	if err := w.reload(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(refresh) {
+			if err := w.reload(); err != nil {
+				log.Printf("failed to reload keep set, keeping the previous one: %s", err)
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", w.handleValidate)
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	addr := ":" + getenv("PORT", "8443")
+	log.Printf("serving admission webhook in %s mode on %s", mode, addr)
+	cert, key := os.Getenv("CLEANER_WEBHOOK_TLS_CERT"), os.Getenv("CLEANER_WEBHOOK_TLS_KEY")
+	if cert != "" || key != "" {
+		return http.ListenAndServeTLS(addr, cert, key, mux)
+	}
+	return http.ListenAndServe(addr, mux)
+}
+
+// reload reads the keep set again.
+func (w *webhook) reload() error {
+	ks, err := w.store.Load(context.Background())
+	if err != nil {
+		return err
+	}
+	deleted := gcrcleaner.NewDeletedImages(ks)
+
+	w.lock.Lock()
+	w.deleted = deleted
+	w.lock.Unlock()
+	log.Printf("loaded keep set of run %s with %d deleted manifests", ks.RunID, len(ks.Deleted))
+	return nil
+}
+
+// handleValidate answers an AdmissionReview.
+func (w *webhook) handleValidate(rw http.ResponseWriter, r *http.Request) {
+	var review gcrcleaner.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(rw, "expected an AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	w.lock.RLock()
+	deleted := w.deleted
+	w.lock.RUnlock()
+
+	review.Response = deleted.Review(review.Request, w.warnOnly)
+	review.Request = nil
+	writeJSON(rw, http.StatusOK, &review)
+}